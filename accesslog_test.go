@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestAccessLog tests that requests are logged with their status and size.
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("metric_a 1\n"))
+	})
+	mux.HandleFunc("/denied", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+	handler := accessLog(mux)
+
+	testCases := []struct {
+		path           string
+		user           string
+		expectedStatus float64
+		expectedBytes  float64
+	}{
+		{path: "/metrics", user: "prometheus", expectedStatus: 200, expectedBytes: 11},
+		{path: "/denied", expectedStatus: 401, expectedBytes: 13},
+		{path: "/missing", expectedStatus: 404, expectedBytes: 19},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			buf.Reset()
+			req := httptest.NewRequest("GET", tc.path, nil)
+			if tc.user != "" {
+				req.SetBasicAuth(tc.user, "secret")
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			var entry map[string]any
+			if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+				t.Fatalf("access log is not a single JSON entry: %v\n%s", err, buf.String())
+			}
+			if entry["method"] != "GET" || entry["path"] != tc.path {
+				t.Errorf("unexpected method or path in %v", entry)
+			}
+			if entry["status"] != tc.expectedStatus {
+				t.Errorf("expected status %v, got %v", tc.expectedStatus, entry["status"])
+			}
+			if entry["bytes"] != tc.expectedBytes {
+				t.Errorf("expected bytes %v, got %v", tc.expectedBytes, entry["bytes"])
+			}
+			if user, _ := entry["user"].(string); user != tc.user {
+				t.Errorf("expected user '%s', got '%s'", tc.user, user)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/manics/prometheus-metrics-combiner/combiner"
+)
+
+// landingPageTemplate is the page served at the root path.
+var landingPageTemplate = template.Must(template.New("landing").Funcs(template.FuncMap{
+	"ago": func(t time.Time) string {
+		return time.Since(t).Round(time.Second).String() + " ago"
+	},
+	"ms": func(d time.Duration) string {
+		return fmt.Sprintf("%.1fms", float64(d)/float64(time.Millisecond))
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Prometheus Metrics Combiner</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+.up { color: #080; }
+.down { color: #c00; }
+.unknown { color: #888; }
+</style>
+</head>
+<body>
+<h1>Prometheus Metrics Combiner</h1>
+<p><a href="{{.TelemetryPath}}">Combined metrics</a></p>
+<h2>Targets</h2>
+{{- if .Targets}}
+<table>
+<tr><th>URL</th><th>Health</th><th>Last scrape</th><th>Duration</th><th>Bytes</th><th>Last error</th></tr>
+{{- range .Targets}}
+<tr>
+<td>{{.URL}}</td>
+<td class="{{.Health}}">{{.Health}}</td>
+<td>{{if .LastScrape.IsZero}}never{{else}}<span title="{{.LastScrape.UTC.Format "2006-01-02T15:04:05Z07:00"}}">{{ago .LastScrape}}</span>{{end}}</td>
+<td>{{if not .LastScrape.IsZero}}{{ms .LastScrapeDuration}}{{end}}</td>
+<td>{{if not .LastScrape.IsZero}}{{.LastScrapeBytes}}{{end}}</td>
+<td>{{with .LastError}}{{.}}{{end}}</td>
+</tr>
+{{- end}}
+</table>
+{{- else}}
+<p>No targets configured.</p>
+{{- end}}
+</body>
+</html>
+`))
+
+// landingPageHandler serves a page linking to the combined metrics and
+// showing the status of each target, from the results of previous scrapes.
+// targets returns the current state of each target, normally
+// Combiner.Targets.
+func landingPageHandler(telemetryPath string, targets func() []combiner.TargetStatus) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		data := struct {
+			TelemetryPath string
+			Targets       []combiner.TargetStatus
+		}{telemetryPath, targets()}
+		if err := landingPageTemplate.Execute(w, data); err != nil {
+			slog.Error("Failed to render landing page", "err", err)
+		}
+	})
+}
+
+// healthzHandler reports that the process is alive.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "OK")
+}
+
+// readyHandler reports whether the combiner is ready to serve. If minUpstreams
+// is greater than zero at least that many targets must have been fetched
+// successfully within maxAge. This uses the results of previous scrapes so
+// probes never trigger a fetch from the upstreams. targets returns the current
+// state of each target, normally Combiner.Targets.
+func readyHandler(targets func() []combiner.TargetStatus, minUpstreams int, maxAge time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+		if minUpstreams <= 0 {
+			fmt.Fprintln(w, "OK")
+			return
+		}
+
+		reachable := 0
+		for _, t := range targets() {
+			if !t.LastSuccess.IsZero() && time.Since(t.LastSuccess) <= maxAge {
+				reachable++
+			}
+		}
+
+		if reachable < minUpstreams {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "Not ready: %d of %d required upstreams reachable in the last %v\n", reachable, minUpstreams, maxAge)
+			return
+		}
+		fmt.Fprintln(w, "OK")
+	})
+}
+
+// reloadHandler calls reload when it receives a POST request, reporting any
+// error to the client.
+func reloadHandler(reload func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Only POST requests are allowed.", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reload(); err != nil {
+			slog.Error("Failed to reload configuration", "err", err)
+			http.Error(w, fmt.Sprintf("Failed to reload configuration: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "OK")
+	})
+}
+
+// registerPprof adds the net/http/pprof profiling handlers to mux, requiring
+// authentication if it is configured.
+func registerPprof(mux *http.ServeMux, auth webAuth) {
+	mux.Handle("/debug/pprof/", auth.wrap(http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/cmdline", auth.wrap(http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle("/debug/pprof/profile", auth.wrap(http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", auth.wrap(http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", auth.wrap(http.HandlerFunc(pprof.Trace)))
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/manics/prometheus-metrics-combiner/combiner"
+)
+
+// TestLandingPageHandler tests the root page links to the metrics, shows the
+// status of each target, and other paths return 404.
+func TestLandingPageHandler(t *testing.T) {
+	targets := func() []combiner.TargetStatus {
+		return []combiner.TargetStatus{
+			{URL: "http://a/metrics", LastScrape: time.Now().Add(-time.Minute), LastScrapeDuration: 1500 * time.Microsecond, LastScrapeBytes: 1234},
+			{URL: "http://b/metrics", LastScrape: time.Now(), LastError: errors.New("connection <refused>")},
+			{URL: "http://c/metrics"},
+		}
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/{$}", landingPageHandler("/combined", targets))
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	for _, expected := range []string{
+		`<a href="/combined">`,
+		`<td>http://a/metrics</td>
+<td class="up">up</td>`,
+		">1m0s ago</span>",
+		"<td>1.5ms</td>\n<td>1234</td>",
+		`<td class="down">down</td>`,
+		"connection &lt;refused&gt;",
+		`<td class="unknown">unknown</td>
+<td>never</td>`,
+	} {
+		if !strings.Contains(rr.Body.String(), expected) {
+			t.Errorf("landing page does not contain %q: %s", expected, rr.Body.String())
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/other", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("unknown path returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+// TestHealthzHandler tests the liveness endpoint.
+func TestHealthzHandler(t *testing.T) {
+	rr := httptest.NewRecorder()
+	healthzHandler(rr, httptest.NewRequest("GET", "/healthz", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+// TestReadyHandler tests the readiness endpoint with different upstream states.
+func TestReadyHandler(t *testing.T) {
+	targets := func() []combiner.TargetStatus {
+		return []combiner.TargetStatus{
+			{URL: "http://a", LastSuccess: time.Now()},
+			{URL: "http://b", LastSuccess: time.Now().Add(-time.Hour)},
+			{URL: "http://c"},
+		}
+	}
+
+	testCases := []struct {
+		name           string
+		minUpstreams   int
+		expectedStatus int
+	}{
+		{"No requirement", 0, http.StatusOK},
+		{"Requirement met", 1, http.StatusOK},
+		{"Stale upstream not counted", 2, http.StatusServiceUnavailable},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			readyHandler(targets, tc.minUpstreams, 5*time.Minute).ServeHTTP(rr, httptest.NewRequest("GET", "/ready", nil))
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tc.expectedStatus)
+			}
+		})
+	}
+}
+
+// TestReloadHandler tests the reload endpoint only reloads on POST and reports errors.
+func TestReloadHandler(t *testing.T) {
+	testCases := []struct {
+		name            string
+		method          string
+		reloadErr       error
+		expectedStatus  int
+		expectedReloads int
+	}{
+		{"GET not allowed", "GET", nil, http.StatusMethodNotAllowed, 0},
+		{"Successful reload", "POST", nil, http.StatusOK, 1},
+		{"Failed reload", "POST", errors.New("bad config"), http.StatusInternalServerError, 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reloads := 0
+			handler := reloadHandler(func() error {
+				reloads++
+				return tc.reloadErr
+			})
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(tc.method, "/-/reload", nil))
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tc.expectedStatus)
+			}
+			if reloads != tc.expectedReloads {
+				t.Errorf("reload called %d times, want %d", reloads, tc.expectedReloads)
+			}
+		})
+	}
+}
+
+// TestRegisterPprof tests the profiling endpoints are only served on the given mux.
+func TestRegisterPprof(t *testing.T) {
+	mux := http.NewServeMux()
+	registerPprof(mux, webAuth{})
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/heap", "/debug/pprof/cmdline"} {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s returned wrong status code: got %v want %v", path, rr.Code, http.StatusOK)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	authMux := http.NewServeMux()
+	registerPprof(authMux, webAuth{tokens: []string{"secret"}})
+	authMux.ServeHTTP(rr, httptest.NewRequest("GET", "/debug/pprof/", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected profiling endpoints to require authentication, got %v", rr.Code)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"sync/atomic"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// clientAllowlist rejects requests from clients outside a set of networks. A
+// nil clientAllowlist allows all clients.
+type clientAllowlist struct {
+	networks []netip.Prefix
+	rejected atomic.Uint64
+}
+
+// newClientAllowlist creates an allowlist of the networks in cidrs, or returns
+// nil if there are none.
+func newClientAllowlist(cidrs []string) (*clientAllowlist, error) {
+	if len(cidrs) == 0 {
+		return nil, nil
+	}
+	a := &clientAllowlist{}
+	for _, s := range cidrs {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed client network: %w", err)
+		}
+		a.networks = append(a.networks, prefix.Masked())
+	}
+	return a, nil
+}
+
+// allowed reports whether the client of r is in one of the networks. Clients
+// connecting over a Unix domain socket don't have an IP address and are
+// always allowed, since access to the socket is controlled by its permissions.
+func (a *clientAllowlist) allowed(r *http.Request) bool {
+	addr, err := netip.ParseAddr(clientAddress(r))
+	if err != nil {
+		return true
+	}
+	addr = addr.Unmap()
+	for _, n := range a.networks {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// wrap returns a handler that rejects requests from clients outside the
+// networks with 403 Forbidden.
+func (a *clientAllowlist) wrap(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.allowed(r) {
+			a.rejected.Add(1)
+			slog.Debug("Rejected request from a client outside the allowed networks", "client", r.RemoteAddr, "path", r.URL.Path)
+			http.Error(w, "Forbidden.", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Transform implements combiner.Transformer, adding the number of rejected
+// requests to the combined metrics.
+func (a *clientAllowlist) Transform(ctx context.Context, families []*dto.MetricFamily) ([]*dto.MetricFamily, error) {
+	return append(families, &dto.MetricFamily{
+		Name:   proto.String("combiner_rejected_requests_total"),
+		Help:   proto.String("Requests rejected because the client is outside the allowed networks."),
+		Type:   dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(float64(a.rejected.Load()))}}},
+	}), nil
+}
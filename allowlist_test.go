@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestClientAllowlist tests requests are only allowed from the configured networks.
+func TestClientAllowlist(t *testing.T) {
+	allowlist, err := newClientAllowlist([]string{"10.0.0.0/8", "2001:db8::/32"})
+	if err != nil {
+		t.Fatalf("newClientAllowlist failed: %v", err)
+	}
+	handler := allowlist.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	testCases := []struct {
+		remoteAddr     string
+		expectedStatus int
+	}{
+		{"10.1.2.3:1234", http.StatusOK},
+		{"192.168.0.1:1234", http.StatusForbidden},
+		{"[2001:db8::1]:1234", http.StatusOK},
+		{"[::ffff:10.0.0.1]:1234", http.StatusOK},
+		{"[2001:db9::1]:1234", http.StatusForbidden},
+		// Unix domain socket clients don't have an address
+		{"@", http.StatusOK},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.RemoteAddr = tc.remoteAddr
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tc.expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", tc.remoteAddr, tc.expectedStatus, rr.Code)
+		}
+	}
+
+	families, err := allowlist.Transform(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("Transform failed: %v", err)
+	}
+	if len(families) != 1 || families[0].GetName() != "combiner_rejected_requests_total" || families[0].Metric[0].GetCounter().GetValue() != 2 {
+		t.Errorf("expected 2 rejected requests to be counted, got %v", families)
+	}
+}
+
+// TestNewClientAllowlist tests an empty allowlist allows everything and invalid networks are rejected.
+func TestNewClientAllowlist(t *testing.T) {
+	allowlist, err := newClientAllowlist(nil)
+	if err != nil || allowlist != nil {
+		t.Errorf("expected no allowlist, got %v, %v", allowlist, err)
+	}
+	if _, err := newClientAllowlist([]string{"10.0.0.1"}); err == nil {
+		t.Error("expected a network without a prefix length to be rejected")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/manics/prometheus-metrics-combiner/combiner"
+)
+
+// apiTarget is a target in the response of the targets API, with the same
+// fields as the Prometheus targets API where they apply.
+type apiTarget struct {
+	// ScrapePool is the group the target belongs to, empty for the targets
+	// served on the metrics path.
+	ScrapePool         string            `json:"scrapePool"`
+	ScrapeURL          string            `json:"scrapeUrl"`
+	Labels             map[string]string `json:"labels"`
+	Health             string            `json:"health"`
+	LastError          string            `json:"lastError"`
+	LastScrape         time.Time         `json:"lastScrape"`
+	LastScrapeDuration float64           `json:"lastScrapeDuration"`
+	LastScrapeBytes    int               `json:"lastScrapeBytes"`
+	ScrapeErrorsTotal  int               `json:"scrapeErrorsTotal"`
+}
+
+// targetsAPIResponse is the response of the targets API.
+type targetsAPIResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		ActiveTargets []apiTarget `json:"activeTargets"`
+	} `json:"data"`
+}
+
+// newAPITarget converts the status of a target in pool for the targets API.
+func newAPITarget(pool string, s combiner.TargetStatus) apiTarget {
+	t := apiTarget{
+		ScrapePool:         pool,
+		ScrapeURL:          s.URL,
+		Labels:             s.Labels,
+		Health:             s.Health(),
+		LastScrape:         s.LastScrape,
+		LastScrapeDuration: s.LastScrapeDuration.Seconds(),
+		LastScrapeBytes:    s.LastScrapeBytes,
+		ScrapeErrorsTotal:  s.ScrapeErrors,
+	}
+	if t.Labels == nil {
+		t.Labels = map[string]string{}
+	}
+	if s.LastError != nil {
+		t.LastError = s.LastError.Error()
+	}
+	return t
+}
+
+// targetsAPIHandler serves the state of every target as JSON, similar to the
+// Prometheus /api/v1/targets endpoint. targets returns the status of the
+// targets in each pool, where the pool is a group name or empty for the
+// targets served on the metrics path. Pools are listed in name order.
+func targetsAPIHandler(targets func() map[string][]combiner.TargetStatus) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pools := targets()
+		var resp targetsAPIResponse
+		resp.Status = "success"
+		resp.Data.ActiveTargets = []apiTarget{}
+		for _, pool := range slices.Sorted(maps.Keys(pools)) {
+			for _, s := range pools[pool] {
+				resp.Data.ActiveTargets = append(resp.Data.ActiveTargets, newAPITarget(pool, s))
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			slog.Error("Failed to write targets", "err", err)
+		}
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/manics/prometheus-metrics-combiner/combiner"
+)
+
+// TestTargetsAPIHandler tests the JSON state of the targets in each pool.
+func TestTargetsAPIHandler(t *testing.T) {
+	lastScrape := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	testCases := []struct {
+		name     string
+		pools    map[string][]combiner.TargetStatus
+		expected string
+	}{
+		{
+			name:     "No targets",
+			pools:    map[string][]combiner.TargetStatus{"": nil},
+			expected: `{"status":"success","data":{"activeTargets":[]}}` + "\n",
+		},
+		{
+			name: "Targets and groups",
+			pools: map[string][]combiner.TargetStatus{
+				"web": {{URL: "http://web/metrics", LastScrape: lastScrape, LastError: errors.New("timeout"), ScrapeErrors: 3}},
+				"": {
+					{URL: "http://a/metrics", Labels: map[string]string{"env": "prod"}, LastScrape: lastScrape, LastScrapeDuration: 250 * time.Millisecond, LastScrapeBytes: 100},
+					{URL: "http://b/metrics"},
+				},
+			},
+			expected: `{"status":"success","data":{"activeTargets":[` +
+				`{"scrapePool":"","scrapeUrl":"http://a/metrics","labels":{"env":"prod"},"health":"up","lastError":"","lastScrape":"2026-01-02T03:04:05Z","lastScrapeDuration":0.25,"lastScrapeBytes":100,"scrapeErrorsTotal":0},` +
+				`{"scrapePool":"","scrapeUrl":"http://b/metrics","labels":{},"health":"unknown","lastError":"","lastScrape":"0001-01-01T00:00:00Z","lastScrapeDuration":0,"lastScrapeBytes":0,"scrapeErrorsTotal":0},` +
+				`{"scrapePool":"web","scrapeUrl":"http://web/metrics","labels":{},"health":"down","lastError":"timeout","lastScrape":"2026-01-02T03:04:05Z","lastScrapeDuration":0,"lastScrapeBytes":0,"scrapeErrorsTotal":3}` +
+				"]}}\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := targetsAPIHandler(func() map[string][]combiner.TargetStatus { return tc.pools })
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/targets", nil))
+			if rr.Code != http.StatusOK {
+				t.Errorf("expected status %d, got %d", http.StatusOK, rr.Code)
+			}
+			if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("expected a JSON content type, got %s", ct)
+			}
+			if rr.Body.String() != tc.expected {
+				t.Errorf("got %s, want %s", rr.Body.String(), tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package combiner
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+)
+
+// Operators for aggregating a metric across targets.
+const (
+	AggregateSum   = "sum"
+	AggregateAvg   = "avg"
+	AggregateMin   = "min"
+	AggregateMax   = "max"
+	AggregateCount = "count"
+)
+
+// AggregateOps lists all aggregation operators.
+var AggregateOps = []string{AggregateSum, AggregateAvg, AggregateMin, AggregateMax, AggregateCount}
+
+// Aggregation combines the series of a metric across all targets, like a
+// recording rule, for example to total the requests served by every replica.
+type Aggregation struct {
+	// Metric is the name of the metric to aggregate.
+	Metric string `yaml:"metric"`
+	// Op is one of AggregateOps, empty is the same as AggregateSum. sum
+	// works on counters, gauges, untyped metrics and classic histograms and
+	// keeps the type. avg, min and max work on counters, gauges and untyped
+	// metrics, and count counts the series of any type. They produce gauges.
+	Op string `yaml:"op"`
+	// By keeps only these labels on the aggregated series, and Without
+	// removes these labels, for example those added to distinguish targets.
+	// If neither is set every series is aggregated into one.
+	By      []string `yaml:"by"`
+	Without []string `yaml:"without"`
+	// Name is the name of the aggregated metric. If empty the aggregated
+	// series replace the original metric, otherwise both are kept. The
+	// aggregation is skipped if a metric with this name already exists.
+	Name string `yaml:"name"`
+}
+
+// Validate checks the operator, and the metric and label names are valid.
+func (a Aggregation) Validate() error {
+	if !model.UTF8Validation.IsValidMetricName(a.Metric) {
+		return fmt.Errorf("invalid aggregation metric name %q", a.Metric)
+	}
+	if a.Op != "" && !slices.Contains(AggregateOps, a.Op) {
+		return fmt.Errorf("invalid aggregation op %q for %s, must be one of %s", a.Op, a.Metric, strings.Join(AggregateOps, ", "))
+	}
+	if a.Name != "" && !model.UTF8Validation.IsValidMetricName(a.Name) {
+		return fmt.Errorf("invalid aggregation name %q", a.Name)
+	}
+	if a.Name == a.Metric {
+		return fmt.Errorf("aggregation name of %s must differ from the metric, leave it empty to replace the metric", a.Metric)
+	}
+	if len(a.By) > 0 && len(a.Without) > 0 {
+		return fmt.Errorf("aggregation of %s can't set both by and without", a.Metric)
+	}
+	for _, name := range slices.Concat(a.By, a.Without) {
+		if !model.UTF8Validation.IsValidLabelName(name) {
+			return fmt.Errorf("invalid label name %q in aggregation of %s", name, a.Metric)
+		}
+	}
+	return nil
+}
+
+// keepLabel returns whether the aggregated series keep the label name.
+func (a Aggregation) keepLabel(name string) bool {
+	if len(a.Without) > 0 {
+		return !slices.Contains(a.Without, name)
+	}
+	return slices.Contains(a.By, name)
+}
+
+// aggregate returns a new family where the series of mf with the same labels,
+// after removing those that aren't kept, are combined by the operator.
+func (a Aggregation) aggregate(mf *dto.MetricFamily) (*dto.MetricFamily, error) {
+	op := cmp.Or(a.Op, AggregateSum)
+	typ := mf.GetType()
+	switch {
+	case op == AggregateCount:
+	case typ == dto.MetricType_COUNTER, typ == dto.MetricType_GAUGE, typ == dto.MetricType_UNTYPED:
+	case typ == dto.MetricType_HISTOGRAM && op == AggregateSum:
+	default:
+		return nil, fmt.Errorf("can't %s %s of type %s", op, mf.GetName(), typ)
+	}
+
+	// Group the series by the labels they keep, in the order they're first seen
+	type group struct {
+		labels []*dto.LabelPair
+		series []*dto.Metric
+	}
+	var groups []*group
+	index := make(map[string]*group)
+	for _, m := range mf.Metric {
+		var labels []*dto.LabelPair
+		for _, l := range m.Label {
+			if a.keepLabel(l.GetName()) {
+				labels = append(labels, l)
+			}
+		}
+		key := seriesKey(&dto.Metric{Label: labels})
+		g, ok := index[key]
+		if !ok {
+			g = &group{labels: labels}
+			index[key] = g
+			groups = append(groups, g)
+		}
+		g.series = append(g.series, m)
+	}
+
+	aggregated := &dto.MetricFamily{Name: proto.String(cmp.Or(a.Name, mf.GetName())), Help: mf.Help, Type: dto.MetricType_GAUGE.Enum(), Unit: mf.Unit}
+	if op == AggregateSum {
+		aggregated.Type = mf.Type
+	}
+	for _, g := range groups {
+		// Timestamps aren't kept since the result doesn't come from a single
+		// scrape
+		m := &dto.Metric{Label: g.labels}
+		switch op {
+		case AggregateSum:
+			first := g.series[0]
+			m.Counter, m.Gauge, m.Untyped, m.Histogram = first.Counter, first.Gauge, first.Untyped, first.Histogram
+			m = proto.Clone(m).(*dto.Metric)
+			for _, s := range g.series[1:] {
+				summed, ok := sumMetrics(typ, m, s)
+				if !ok {
+					return nil, fmt.Errorf("can't sum %s", seriesString(mf.GetName(), s))
+				}
+				m = summed
+			}
+		case AggregateCount:
+			m = proto.Clone(m).(*dto.Metric)
+			m.Gauge = &dto.Gauge{Value: proto.Float64(float64(len(g.series)))}
+		default:
+			values := make([]float64, len(g.series))
+			for i, s := range g.series {
+				values[i] = metricValue(s)
+			}
+			var value float64
+			switch op {
+			case AggregateAvg:
+				for _, v := range values {
+					value += v
+				}
+				value /= float64(len(values))
+			case AggregateMin:
+				value = slices.Min(values)
+			case AggregateMax:
+				value = slices.Max(values)
+			}
+			m = proto.Clone(m).(*dto.Metric)
+			m.Gauge = &dto.Gauge{Value: proto.Float64(value)}
+		}
+		aggregated.Metric = append(aggregated.Metric, m)
+	}
+	return aggregated, nil
+}
+
+// metricValue returns the value of a counter, gauge or untyped metric.
+func metricValue(m *dto.Metric) float64 {
+	switch {
+	case m.Counter != nil:
+		return m.Counter.GetValue()
+	case m.Gauge != nil:
+		return m.Gauge.GetValue()
+	default:
+		return m.Untyped.GetValue()
+	}
+}
+
+// aggregations is a Transformer applying each aggregation to the combined
+// metrics.
+type aggregations []Aggregation
+
+// Transform implements Transformer.
+func (aggs aggregations) Transform(ctx context.Context, families []*dto.MetricFamily) ([]*dto.MetricFamily, error) {
+	result := slices.Clone(families)
+	for _, a := range aggs {
+		i := slices.IndexFunc(result, func(mf *dto.MetricFamily) bool { return mf.GetName() == a.Metric })
+		if i < 0 {
+			continue
+		}
+		aggregated, err := a.aggregate(result[i])
+		if err != nil {
+			slog.Warn("Failed to aggregate metric, keeping the original series", "metric", a.Metric, "err", err)
+			continue
+		}
+		if a.Name == "" {
+			result[i] = aggregated
+			continue
+		}
+		// Adding series to an existing family could clash with its type or
+		// series, so the aggregation is skipped instead
+		if slices.ContainsFunc(result, func(mf *dto.MetricFamily) bool { return mf.GetName() == a.Name }) {
+			slog.Warn("Failed to aggregate metric, a metric with its name already exists", "metric", a.Metric, "name", a.Name)
+			continue
+		}
+		result = append(result, aggregated)
+	}
+	return result, nil
+}
+
+// compileAggregations validates aggregations and returns them as a
+// Transformer, or nil if there are none.
+func compileAggregations(aggs []Aggregation) (Transformer, error) {
+	if len(aggs) == 0 {
+		return nil, nil
+	}
+	names := make(map[string]bool)
+	for _, a := range aggs {
+		if err := a.Validate(); err != nil {
+			return nil, err
+		}
+		if a.Name != "" {
+			if names[a.Name] {
+				return nil, fmt.Errorf("aggregation name %s is used more than once", a.Name)
+			}
+			names[a.Name] = true
+		}
+	}
+	return aggregations(slices.Clone(aggs)), nil
+}
@@ -0,0 +1,176 @@
+package combiner
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// TestCombinerAggregations tests aggregating metrics across targets.
+func TestCombinerAggregations(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# TYPE http_requests_total counter\n")
+		fmt.Fprintf(w, "http_requests_total{code=\"200\"} %s\nhttp_requests_total{code=\"500\"} 1\n", r.URL.Path[1:])
+		fmt.Fprint(w, "# TYPE latency summary\nlatency_sum 1\nlatency_count 1\n")
+		fmt.Fprint(w, "# TYPE rpc_seconds histogram\nrpc_seconds_bucket{le=\"1\"} 1\nrpc_seconds_bucket{le=\"+Inf\"} 2\nrpc_seconds_sum 3\nrpc_seconds_count 2\n")
+	}))
+	defer server.Close()
+	targets := []Target{
+		{URL: server.URL + "/10", Labels: map[string]string{"instance": "a"}},
+		{URL: server.URL + "/20", Labels: map[string]string{"instance": "b"}},
+	}
+
+	testCases := []struct {
+		name         string
+		aggregations []Aggregation
+		prefix       string
+		expected     string
+	}{
+		{
+			name:         "Sum into one series",
+			aggregations: []Aggregation{{Metric: "http_requests_total"}},
+			expected:     "# TYPE http_requests_total counter\nhttp_requests_total 32\n",
+		},
+		{
+			name:         "Without the target label",
+			aggregations: []Aggregation{{Metric: "http_requests_total", Without: []string{"instance"}}},
+			expected:     "# TYPE http_requests_total counter\nhttp_requests_total{code=\"200\"} 30\nhttp_requests_total{code=\"500\"} 2\n",
+		},
+		{
+			name:         "By a label",
+			aggregations: []Aggregation{{Metric: "http_requests_total", By: []string{"instance"}}},
+			expected:     "# TYPE http_requests_total counter\nhttp_requests_total{instance=\"a\"} 11\nhttp_requests_total{instance=\"b\"} 21\n",
+		},
+		{
+			name:         "New name keeps the original",
+			aggregations: []Aggregation{{Metric: "http_requests_total", Name: "fleet_http_requests_total"}},
+			expected: "# TYPE fleet_http_requests_total counter\nfleet_http_requests_total 32\n" +
+				"# TYPE http_requests_total counter\n" +
+				"http_requests_total{code=\"200\",instance=\"a\"} 10\nhttp_requests_total{code=\"500\",instance=\"a\"} 1\n" +
+				"http_requests_total{code=\"200\",instance=\"b\"} 20\nhttp_requests_total{code=\"500\",instance=\"b\"} 1\n",
+		},
+		{
+			name:         "Missing metric",
+			aggregations: []Aggregation{{Metric: "missing"}},
+			expected: "# TYPE http_requests_total counter\n" +
+				"http_requests_total{code=\"200\",instance=\"a\"} 10\nhttp_requests_total{code=\"500\",instance=\"a\"} 1\n" +
+				"http_requests_total{code=\"200\",instance=\"b\"} 20\nhttp_requests_total{code=\"500\",instance=\"b\"} 1\n",
+		},
+		{
+			name:         "Histograms",
+			aggregations: []Aggregation{{Metric: "rpc_seconds"}},
+			prefix:       "rpc_",
+			expected:     "# TYPE rpc_seconds histogram\nrpc_seconds_bucket{le=\"1\"} 2\nrpc_seconds_bucket{le=\"+Inf\"} 4\nrpc_seconds_sum 6\nrpc_seconds_count 4\n",
+		},
+		{
+			name:         "Average",
+			aggregations: []Aggregation{{Metric: "http_requests_total", Op: AggregateAvg, Without: []string{"instance"}}},
+			expected:     "# TYPE http_requests_total gauge\nhttp_requests_total{code=\"200\"} 15\nhttp_requests_total{code=\"500\"} 1\n",
+		},
+		{
+			name:         "Minimum",
+			aggregations: []Aggregation{{Metric: "http_requests_total", Op: AggregateMin}},
+			expected:     "# TYPE http_requests_total gauge\nhttp_requests_total 1\n",
+		},
+		{
+			name:         "Maximum by a label",
+			aggregations: []Aggregation{{Metric: "http_requests_total", Op: AggregateMax, By: []string{"code"}}},
+			expected:     "# TYPE http_requests_total gauge\nhttp_requests_total{code=\"200\"} 20\nhttp_requests_total{code=\"500\"} 1\n",
+		},
+		{
+			name:         "Count summaries",
+			aggregations: []Aggregation{{Metric: "latency", Op: AggregateCount, Name: "latency_series"}},
+			prefix:       "latency",
+			expected: "# TYPE latency summary\n" +
+				"latency_sum{instance=\"a\"} 1\nlatency_count{instance=\"a\"} 1\n" +
+				"latency_sum{instance=\"b\"} 1\nlatency_count{instance=\"b\"} 1\n" +
+				"# TYPE latency_series gauge\nlatency_series 2\n",
+		},
+		{
+			name:         "Average of histograms isn't possible",
+			aggregations: []Aggregation{{Metric: "rpc_seconds", Op: AggregateAvg}},
+			prefix:       "rpc_",
+			expected: "# TYPE rpc_seconds histogram\n" +
+				"rpc_seconds_bucket{instance=\"a\",le=\"1\"} 1\nrpc_seconds_bucket{instance=\"a\",le=\"+Inf\"} 2\nrpc_seconds_sum{instance=\"a\"} 3\nrpc_seconds_count{instance=\"a\"} 2\n" +
+				"rpc_seconds_bucket{instance=\"b\",le=\"1\"} 1\nrpc_seconds_bucket{instance=\"b\",le=\"+Inf\"} 2\nrpc_seconds_sum{instance=\"b\"} 3\nrpc_seconds_count{instance=\"b\"} 2\n",
+		},
+		{
+			name:         "Summaries are kept",
+			aggregations: []Aggregation{{Metric: "latency"}},
+			prefix:       "latency",
+			expected: "# TYPE latency summary\n" +
+				"latency_sum{instance=\"a\"} 1\nlatency_count{instance=\"a\"} 1\n" +
+				"latency_sum{instance=\"b\"} 1\nlatency_count{instance=\"b\"} 1\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			agg, err := New(targets, Options{Aggregations: tc.aggregations, Filter: Filter{Prefixes: []string{cmp.Or(tc.prefix, "http_")}}})
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			rr := httptest.NewRecorder()
+			agg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+			}
+			if rr.Body.String() != tc.expected {
+				t.Errorf("got %q, want %q", rr.Body.String(), tc.expected)
+			}
+		})
+	}
+}
+
+// TestAggregationValidate tests invalid aggregations are rejected.
+func TestAggregationValidate(t *testing.T) {
+	testCases := []struct {
+		name        string
+		aggregation Aggregation
+		expectedErr bool
+	}{
+		{"Valid", Aggregation{Metric: "up", Without: []string{"instance"}, Name: "up_total"}, false},
+		{"No metric", Aggregation{}, true},
+		{"Invalid name", Aggregation{Metric: "up", Name: "up\xff"}, true},
+		{"By and without", Aggregation{Metric: "up", By: []string{"job"}, Without: []string{"instance"}}, true},
+		{"Invalid label", Aggregation{Metric: "up", By: []string{"\xff"}}, true},
+		{"Valid op", Aggregation{Metric: "up", Op: AggregateMax}, false},
+		{"UTF-8 names", Aggregation{Metric: "http.server.requests", By: []string{"http.route"}}, false},
+		{"Invalid op", Aggregation{Metric: "up", Op: "median"}, true},
+		{"Name of the metric", Aggregation{Metric: "up", Name: "up"}, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.aggregation.Validate(); (err != nil) != tc.expectedErr {
+				t.Errorf("expected error %v, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+// TestAggregationNameCollision tests an aggregation isn't added under the name
+// of an existing metric, and names can't be used twice.
+func TestAggregationNameCollision(t *testing.T) {
+	families := []*dto.MetricFamily{
+		{Name: proto.String("requests_total"), Type: dto.MetricType_COUNTER.Enum(), Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(1)}}}},
+		{Name: proto.String("fleet_requests"), Type: dto.MetricType_GAUGE.Enum(), Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(2)}}}},
+	}
+	aggs := aggregations{{Metric: "requests_total", Name: "fleet_requests"}}
+	result, err := aggs.Transform(context.Background(), families)
+	if err != nil {
+		t.Fatalf("Transform failed: %v", err)
+	}
+	if len(result) != 2 || result[1].GetType() != dto.MetricType_GAUGE || result[1].Metric[0].GetGauge().GetValue() != 2 {
+		t.Errorf("expected the existing metric to be kept unchanged, got %v", result)
+	}
+
+	if _, err := compileAggregations([]Aggregation{{Metric: "a", Name: "total"}, {Metric: "b", Name: "total"}}); err == nil {
+		t.Error("expected an error for an aggregation name used twice")
+	}
+}
@@ -0,0 +1,119 @@
+package combiner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secretRefreshInterval is how often credential files are re-read to pick up rotated secrets.
+const secretRefreshInterval = time.Minute
+
+// secretFile is a file containing a credential. The contents are cached and
+// re-read once refresh has elapsed so rotated credentials are picked up.
+type secretFile struct {
+	path    string
+	refresh time.Duration
+
+	mu     sync.Mutex
+	value  string
+	readAt time.Time
+}
+
+// newSecretFile creates a secretFile that is re-read every secretRefreshInterval.
+func newSecretFile(path string) *secretFile {
+	return &secretFile{path: path, refresh: secretRefreshInterval}
+}
+
+// get returns the contents of the file with surrounding whitespace removed.
+func (s *secretFile) get() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.readAt.IsZero() && time.Since(s.readAt) < s.refresh {
+		return s.value, nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", s.path, err)
+	}
+	s.value = strings.TrimSpace(string(data))
+	s.readAt = time.Now()
+	return s.value, nil
+}
+
+// bearerAuthRoundTripper adds a bearer token read from a file to each request.
+type bearerAuthRoundTripper struct {
+	token *secretFile
+	next  http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (rt *bearerAuthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := rt.token.get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bearer token: %w", err)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return rt.next.RoundTrip(req)
+}
+
+// basicAuthRoundTripper adds HTTP basic auth credentials to each request.
+// The password is read from a file.
+type basicAuthRoundTripper struct {
+	username string
+	password *secretFile
+	next     http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (rt *basicAuthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	password := ""
+	if rt.password != nil {
+		var err error
+		if password, err = rt.password.get(); err != nil {
+			return nil, fmt.Errorf("failed to read basic auth password: %w", err)
+		}
+	}
+	req = req.Clone(req.Context())
+	req.SetBasicAuth(rt.username, password)
+	return rt.next.RoundTrip(req)
+}
+
+// tokenSource provides access tokens, such as those from an OAuth2 token
+// endpoint, sent to upstreams as bearer tokens.
+type tokenSource interface {
+	// get returns a token, fetching a new one if the cached token is about
+	// to expire.
+	get(ctx context.Context) (string, error)
+	// invalidate discards token if it is still cached.
+	invalidate(token string)
+}
+
+// tokenSourceRoundTripper adds a token from a tokenSource to each request.
+type tokenSourceRoundTripper struct {
+	source tokenSource
+	next   http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper. If the upstream rejects the token
+// with 401 Unauthorized it is discarded, in case it was revoked.
+func (rt *tokenSourceRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := rt.source.get(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := rt.next.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		rt.source.invalidate(token)
+	}
+	return resp, err
+}
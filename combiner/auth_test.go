@@ -0,0 +1,99 @@
+package combiner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// TestSecretFile tests caching and refreshing of credential files.
+func TestSecretFile(t *testing.T) {
+	path := writeFile(t, "token", "first\n")
+	s := newSecretFile(path)
+
+	if v, err := s.get(); err != nil || v != "first" {
+		t.Fatalf("get returned '%s', %v; want 'first'", v, err)
+	}
+
+	if err := os.WriteFile(path, []byte("second"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.get(); v != "first" {
+		t.Errorf("expected cached value 'first' before the refresh interval, got '%s'", v)
+	}
+
+	s.refresh = 0
+	if v, _ := s.get(); v != "second" {
+		t.Errorf("expected refreshed value 'second', got '%s'", v)
+	}
+
+	if _, err := newSecretFile(path + ".missing").get(); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+// TestBearerTokenAuth tests that the bearer token is sent to upstreams.
+func TestBearerTokenAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("Authorization"))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(Target{URL: server.URL, BearerTokenFile: writeFile(t, "token", "secret\n")}, nil)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	body, _, err := fetchString(context.Background(), client, server.URL)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	if body != "Bearer secret" {
+		t.Errorf("expected Authorization header 'Bearer secret', but got: '%s'", body)
+	}
+
+	if _, err := NewClient(Target{URL: server.URL, BearerTokenFile: "/nonexistent/token"}, nil); err == nil {
+		t.Error("expected an error for a missing token file")
+	}
+}
+
+// TestBasicAuth tests that basic auth credentials are sent to upstreams.
+func TestBasicAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "scraper" || password != "hunter2" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		name        string
+		basicAuth   *BasicAuth
+		expectError bool
+	}{
+		{"Without credentials", nil, true},
+		{"Wrong password", &BasicAuth{Username: "scraper", PasswordFile: writeFile(t, "wrong", "wrong")}, true},
+		{"Correct password", &BasicAuth{Username: "scraper", PasswordFile: writeFile(t, "password", "hunter2\n")}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client, err := NewClient(Target{URL: server.URL, BasicAuth: tc.basicAuth}, nil)
+			if err != nil {
+				t.Fatalf("NewClient failed: %v", err)
+			}
+			_, _, err = fetchString(context.Background(), client, server.URL)
+			if tc.expectError && err == nil {
+				t.Error("expected an error, but got none")
+			}
+			if !tc.expectError && err != nil {
+				t.Errorf("expected no error, but got: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package combiner
+
+import (
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// breakerState is the state of a circuit breaker.
+type breakerState int
+
+const (
+	// breakerClosed allows all fetches.
+	breakerClosed breakerState = iota
+	// breakerOpen skips all fetches until the cooldown has elapsed.
+	breakerOpen
+	// breakerHalfOpen allows a single trial fetch to decide whether to close or re-open.
+	breakerHalfOpen
+)
+
+// breaker is a circuit breaker for a single target. After threshold
+// consecutive failures it opens and fetches are skipped for the cooldown
+// period, after which one trial fetch is let through. A nil breaker always
+// allows fetches.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	// now returns the current time, it can be overridden in tests.
+	now func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+// newBreaker creates a closed circuit breaker.
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// allow reports whether a fetch should be attempted.
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		// A trial fetch is already in progress
+		return false
+	default:
+		return true
+	}
+}
+
+// record updates the breaker with the outcome of a fetch.
+func (b *breaker) record(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = b.now()
+	}
+}
+
+// abandon ends a half-open trial fetch that was abandoned without an outcome,
+// for example because the client went away. The breaker goes back to open with
+// its original opening time so the next fetch is let through as a new trial,
+// without the abandoned fetch counting as a failure.
+func (b *breaker) abandon() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.state = breakerOpen
+	}
+}
+
+// current returns the current state of the breaker.
+func (b *breaker) current() breakerState {
+	if b == nil {
+		return breakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// breakerMetricFamily returns a gauge with the state of each target's circuit breaker.
+func breakerMetricFamily(targets []*target) *dto.MetricFamily {
+	mf := &dto.MetricFamily{
+		Name: proto.String("combiner_circuit_breaker_state"),
+		Help: proto.String("State of the upstream circuit breaker (0=closed, 1=open, 2=half-open)."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	for _, t := range targets {
+		mf.Metric = append(mf.Metric, &dto.Metric{
+			Label: []*dto.LabelPair{{Name: proto.String("url"), Value: proto.String(t.name)}},
+			Gauge: &dto.Gauge{Value: proto.Float64(float64(t.breaker.current()))},
+		})
+	}
+	return mf
+}
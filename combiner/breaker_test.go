@@ -0,0 +1,148 @@
+package combiner
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestBreaker tests the circuit breaker state transitions.
+func TestBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newBreaker(2, time.Minute)
+	b.now = func() time.Time { return now }
+	failure := errors.New("failed")
+
+	steps := []struct {
+		name          string
+		advance       time.Duration
+		outcome       error
+		expectedAllow bool
+		expectedState breakerState
+	}{
+		{"First failure keeps breaker closed", 0, failure, true, breakerClosed},
+		{"Second failure opens breaker", 0, failure, true, breakerOpen},
+		{"Open breaker skips fetches", 30 * time.Second, nil, false, breakerOpen},
+		{"Failed trial re-opens breaker", 30 * time.Second, failure, true, breakerOpen},
+		{"Re-opened breaker skips fetches", 59 * time.Second, nil, false, breakerOpen},
+		{"Successful trial closes breaker", time.Second, nil, true, breakerClosed},
+		{"Failure count was reset", 0, failure, true, breakerClosed},
+	}
+
+	for _, step := range steps {
+		now = now.Add(step.advance)
+		allowed := b.allow()
+		if allowed != step.expectedAllow {
+			t.Fatalf("%s: allow returned %v, want %v", step.name, allowed, step.expectedAllow)
+		}
+		if allowed {
+			b.record(step.outcome)
+		}
+		if state := b.current(); state != step.expectedState {
+			t.Fatalf("%s: breaker state is %v, want %v", step.name, state, step.expectedState)
+		}
+	}
+}
+
+// TestBreakerHalfOpenAllowsSingleTrial checks only one fetch is let through while half-open.
+func TestBreakerHalfOpenAllowsSingleTrial(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newBreaker(1, time.Minute)
+	b.now = func() time.Time { return now }
+
+	b.record(errors.New("failed"))
+	now = now.Add(time.Minute)
+
+	if !b.allow() {
+		t.Fatal("expected a trial fetch to be allowed after the cooldown")
+	}
+	if b.allow() {
+		t.Error("expected only one trial fetch to be allowed while half-open")
+	}
+	if state := b.current(); state != breakerHalfOpen {
+		t.Errorf("breaker state is %v, want %v", state, breakerHalfOpen)
+	}
+}
+
+// TestBreakerAbandonTrial checks an abandoned trial fetch re-opens the breaker
+// without a failure and without restarting the cooldown.
+func TestBreakerAbandonTrial(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newBreaker(2, time.Minute)
+	b.now = func() time.Time { return now }
+
+	b.record(errors.New("failed"))
+	b.record(errors.New("failed"))
+	now = now.Add(time.Minute)
+	if !b.allow() {
+		t.Fatal("expected a trial fetch to be allowed after the cooldown")
+	}
+	b.abandon()
+	if state := b.current(); state != breakerOpen {
+		t.Errorf("breaker state is %v, want %v", state, breakerOpen)
+	}
+	if !b.allow() {
+		t.Error("expected another trial fetch to be allowed after the abandoned one")
+	}
+	b.record(nil)
+	if state := b.current(); state != breakerClosed {
+		t.Errorf("breaker state is %v, want %v", state, breakerClosed)
+	}
+
+	// Abandoning a fetch while closed leaves the breaker alone
+	b.record(errors.New("failed"))
+	b.abandon()
+	if state := b.current(); state != breakerClosed {
+		t.Errorf("breaker state is %v, want %v", state, breakerClosed)
+	}
+}
+
+// TestCombinerCircuitBreaker checks that a failing upstream is skipped once its breaker opens.
+func TestCombinerCircuitBreaker(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "metric_a 1")
+	}))
+	defer healthy.Close()
+
+	agg, err := newCombiner(staticTargets([]string{server.URL, healthy.URL}), options{
+		breakerThreshold: 2,
+		breakerCooldown:  time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("newCombiner failed: %v", err)
+	}
+
+	var body string
+	for range 4 {
+		rr := httptest.NewRecorder()
+		agg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+		body = rr.Body.String()
+	}
+
+	if n := hits.Load(); n != 2 {
+		t.Errorf("failing upstream was fetched %d times, want 2", n)
+	}
+
+	expected := []string{
+		"metric_a 1\n",
+		fmt.Sprintf("combiner_circuit_breaker_state{url=\"%s\"} 1\n", server.URL),
+		fmt.Sprintf("combiner_circuit_breaker_state{url=\"%s\"} 0\n", healthy.URL),
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line) {
+			t.Errorf("response body does not contain expected line '%s'. Body:\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package combiner
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// refreshCall is a gather to refresh the cache that other requests can wait
+// for instead of starting their own.
+type refreshCall struct {
+	done     chan struct{}
+	families []*dto.MetricFamily
+	failed   []string
+	err      error
+}
+
+// cachedGather returns the cached combined result if it is younger than the
+// cache TTL. Within the stale TTL after that the cached result is returned
+// and refreshed in the background, otherwise the request waits for a refresh.
+// Without a cache TTL concurrent requests still share a single gather.
+func (c *Combiner) cachedGather(ctx context.Context, timeout time.Duration) ([]*dto.MetricFamily, []string, error) {
+	if snap := c.latestSnapshot(); snap != nil {
+		age := time.Since(snap.time)
+		if age < c.cacheTTL {
+			return snap.families, snap.failed, nil
+		}
+		if age < c.cacheTTL+c.cacheStaleTTL {
+			slog.Debug("Serving stale cached metrics while refreshing", "age", age)
+			c.refresh(ctx, c.timeout)
+			return snap.families, snap.failed, nil
+		}
+	}
+
+	call := c.refresh(ctx, timeout)
+	select {
+	case <-call.done:
+		return call.families, call.failed, call.err
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+}
+
+// refresh starts a gather in the background to refresh the cache, unless one
+// is already in progress, and returns it. Only successful results are cached,
+// and only if caching is enabled. A refresh is shared by all waiting requests,
+// so it isn't cancelled if the request that started it goes away, only by
+// Close.
+func (c *Combiner) refresh(ctx context.Context, timeout time.Duration) *refreshCall {
+	c.snapshotMu.Lock()
+	if call := c.inflight; call != nil {
+		c.snapshotMu.Unlock()
+		return call
+	}
+	call := &refreshCall{done: make(chan struct{})}
+	c.inflight = call
+	c.snapshotMu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(c.ctx, cancel)
+	go func() {
+		defer cancel()
+		defer stop()
+		call.families, call.failed, call.err = c.gather(ctx, timeout)
+
+		c.snapshotMu.Lock()
+		if call.err == nil && c.cacheTTL > 0 {
+			c.latest = &snapshot{families: call.families, failed: call.failed, time: time.Now()}
+		}
+		c.inflight = nil
+		c.snapshotMu.Unlock()
+
+		close(call.done)
+	}()
+	return call
+}
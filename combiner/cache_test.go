@@ -0,0 +1,181 @@
+package combiner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestCombinerCache tests reusing, revalidating and expiring the cached result.
+func TestCombinerCache(t *testing.T) {
+	testCases := []struct {
+		name string
+		// age is how old the cached result is made before the second request.
+		age           time.Duration
+		staleTTL      time.Duration
+		expectedBody  string
+		expectedFetch int32
+	}{
+		{
+			name:          "Fresh",
+			age:           0,
+			expectedBody:  "# TYPE metric_a untyped\nmetric_a 1\n",
+			expectedFetch: 1,
+		},
+		{
+			name:          "Stale while revalidating",
+			age:           90 * time.Second,
+			staleTTL:      time.Minute,
+			expectedBody:  "# TYPE metric_a untyped\nmetric_a 1\n",
+			expectedFetch: 2,
+		},
+		{
+			name:          "Expired",
+			age:           3 * time.Minute,
+			staleTTL:      time.Minute,
+			expectedBody:  "# TYPE metric_a untyped\nmetric_a 2\n",
+			expectedFetch: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var fetches atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, "metric_a %d\n", fetches.Add(1))
+			}))
+			defer server.Close()
+
+			agg, err := newCombiner(staticTargets([]string{server.URL}), options{cacheTTL: time.Minute, cacheStaleTTL: tc.staleTTL})
+			if err != nil {
+				t.Fatalf("newCombiner failed: %v", err)
+			}
+
+			agg.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+			agg.latestSnapshot().time = time.Now().Add(-tc.age)
+
+			rr := httptest.NewRecorder()
+			agg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+			}
+			if rr.Body.String() != tc.expectedBody {
+				t.Errorf("got %q, want %q", rr.Body.String(), tc.expectedBody)
+			}
+
+			// Wait for any background refresh to finish
+			deadline := time.Now().Add(5 * time.Second)
+			for fetches.Load() < tc.expectedFetch && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if n := fetches.Load(); n != tc.expectedFetch {
+				t.Errorf("expected %d upstream fetches, got %d", tc.expectedFetch, n)
+			}
+		})
+	}
+}
+
+// TestCombinerCacheCoalesces tests that concurrent requests share a single
+// refresh, which is only reused by later requests when caching.
+func TestCombinerCacheCoalesces(t *testing.T) {
+	testCases := []struct {
+		name string
+		opts options
+		// expectedFetch is the number of upstream fetches after a later
+		// request.
+		expectedFetch int32
+	}{
+		{name: "Cache", opts: options{cacheTTL: time.Minute}, expectedFetch: 1},
+		{name: "Coalesce without caching", opts: options{coalesceRequests: true}, expectedFetch: 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var fetches atomic.Int32
+			release := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				<-release
+				fmt.Fprintln(w, "metric_a 1")
+			}))
+			defer server.Close()
+
+			agg, err := newCombiner(staticTargets([]string{server.URL}), tc.opts)
+			if err != nil {
+				t.Fatalf("newCombiner failed: %v", err)
+			}
+
+			done := make(chan int)
+			for range 5 {
+				go func() {
+					rr := httptest.NewRecorder()
+					agg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+					done <- rr.Code
+				}()
+			}
+
+			// Let the requests queue up behind the first fetch before releasing it
+			deadline := time.Now().Add(5 * time.Second)
+			for fetches.Load() == 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+
+			for range 5 {
+				if code := <-done; code != http.StatusOK {
+					t.Errorf("expected status %d, got %d", http.StatusOK, code)
+				}
+			}
+			if n := fetches.Load(); n != 1 {
+				t.Errorf("expected 1 upstream fetch, got %d", n)
+			}
+
+			agg.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+			if n := fetches.Load(); n != tc.expectedFetch {
+				t.Errorf("expected %d upstream fetches after a later request, got %d", tc.expectedFetch, n)
+			}
+		})
+	}
+}
+
+// TestCombinerCloseCancelsRefresh checks that closing the Combiner aborts a
+// refresh that outlives the request that started it.
+func TestCombinerCloseCancelsRefresh(t *testing.T) {
+	aborted := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(aborted)
+	}))
+	defer slow.Close()
+
+	agg, err := newCombiner(staticTargets([]string{slow.URL}), options{cacheTTL: time.Minute})
+	if err != nil {
+		t.Fatalf("newCombiner failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	call := agg.refresh(ctx, 0)
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-aborted:
+		t.Fatal("refresh was cancelled with the request that started it")
+	default:
+	}
+
+	agg.Close()
+	select {
+	case <-call.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("refresh did not finish after Close")
+	}
+	select {
+	case <-aborted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream request was not aborted")
+	}
+}
@@ -0,0 +1,238 @@
+package combiner
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// TransportOptions are the connection settings for fetching upstreams.
+type TransportOptions struct {
+	// HTTP2 allows HTTP/2 to be negotiated with HTTPS upstreams.
+	HTTP2 bool
+	// MaxIdleConns is the total number of idle connections kept open for
+	// reuse, 0 is no limit.
+	MaxIdleConns int
+	// MaxIdleConnsPerHost is the number of idle connections kept open to
+	// each upstream host for reuse.
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost limits the connections to each upstream host,
+	// including those in use, 0 is no limit.
+	MaxConnsPerHost int
+	// IdleConnTimeout is how long an idle connection is kept open, 0 is no limit.
+	IdleConnTimeout time.Duration
+}
+
+// NewTransport creates the transport shared by all targets. Like
+// http.DefaultTransport it uses the HTTP_PROXY/HTTPS_PROXY/NO_PROXY
+// environment variables.
+func NewTransport(opts TransportOptions) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Protocols = new(http.Protocols)
+	transport.Protocols.SetHTTP1(true)
+	transport.Protocols.SetHTTP2(opts.HTTP2)
+	transport.MaxIdleConns = opts.MaxIdleConns
+	transport.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+	transport.MaxConnsPerHost = opts.MaxConnsPerHost
+	transport.IdleConnTimeout = opts.IdleConnTimeout
+	return transport
+}
+
+// NewClient creates the HTTP client used to fetch a target. Targets
+// without any custom settings share base, so connections to the same host are
+// reused across targets, while targets with their own TLS or proxy settings,
+// or a unix:// URL, get a copy of it. A nil base uses http.DefaultTransport.
+func NewClient(cfg Target, base *http.Transport) (*http.Client, error) {
+	return newClient(cfg, base, nil, nil)
+}
+
+// newClient is NewClient for a target restricted by policy, if it isn't nil.
+// Redirects are checked against the policy, and if it restricts the networks
+// that can be connected to so are the hosts of requests sent through a proxy.
+// OAuth2 token endpoints, STS and cloud metadata endpoints are fetched with
+// credentials, which isn't restricted by the policy since metadata endpoints
+// are usually in denied networks. A nil credentials uses base.
+func newClient(cfg Target, base, credentials *http.Transport, policy *urlPolicy) (*http.Client, error) {
+	if base == nil {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+	if credentials == nil {
+		credentials = base
+	}
+	var rt http.RoundTripper = base
+	proxy := base.Proxy
+
+	if cfg.TLSConfig != (TLSConfig{}) || cfg.ProxyURL != "" {
+		transport := base.Clone()
+
+		if cfg.TLSConfig != (TLSConfig{}) {
+			tlsCfg, err := newClientTLSConfig(cfg.TLSConfig)
+			if err != nil {
+				return nil, fmt.Errorf("invalid TLS config for %s: %w", RedactURL(cfg.URL), err)
+			}
+			if tlsCfg.InsecureSkipVerify {
+				slog.Warn("TLS certificate verification is disabled", "target", RedactURL(cfg.URL))
+			}
+			transport.TLSClientConfig = tlsCfg
+		}
+
+		if cfg.ProxyURL != "" {
+			proxy, err := parseProxyURL(cfg.ProxyURL)
+			if err != nil {
+				return nil, fmt.Errorf("invalid proxy for %s: %w", RedactURL(cfg.URL), err)
+			}
+			transport.Proxy = http.ProxyURL(proxy)
+		}
+		proxy = transport.Proxy
+
+		rt = transport
+	}
+
+	if u, err := url.Parse(cfg.URL); err == nil && u.Scheme == "unix" {
+		socket, path, err := splitUnixURL(u)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.ProxyURL != "" {
+			return nil, fmt.Errorf("proxy_url can't be used with the Unix socket %s", socket)
+		}
+		rt = &unixSocketRoundTripper{path: path, next: unixSocketTransport(base, socket)}
+		proxy = nil
+	}
+
+	if cfg.BearerTokenFile != "" {
+		token := newSecretFile(cfg.BearerTokenFile)
+		if _, err := token.get(); err != nil {
+			return nil, fmt.Errorf("invalid bearer token for %s: %w", RedactURL(cfg.URL), err)
+		}
+		rt = &bearerAuthRoundTripper{token: token, next: rt}
+	}
+
+	if cfg.BasicAuth != nil {
+		basic := &basicAuthRoundTripper{username: cfg.BasicAuth.Username, next: rt}
+		if cfg.BasicAuth.PasswordFile != "" {
+			basic.password = newSecretFile(cfg.BasicAuth.PasswordFile)
+			if _, err := basic.password.get(); err != nil {
+				return nil, fmt.Errorf("invalid basic auth password for %s: %w", RedactURL(cfg.URL), err)
+			}
+		}
+		rt = basic
+	}
+
+	if cfg.OAuth2 != nil {
+		// The token endpoint is fetched with the shared credentials
+		// transport, not the target's TLS, proxy or Unix socket settings
+		source := sharedOAuth2TokenSource(*cfg.OAuth2, credentials)
+		if _, err := source.secret.get(); err != nil {
+			return nil, fmt.Errorf("invalid oauth2 client secret for %s: %w", RedactURL(cfg.URL), err)
+		}
+		rt = &tokenSourceRoundTripper{source: source, next: rt}
+	}
+
+	if cfg.SigV4 != nil {
+		// STS is called with the shared credentials transport, like an
+		// OAuth2 token endpoint
+		signer, err := sharedSigV4Signer(*cfg.SigV4, credentials)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sigv4 config for %s: %w", RedactURL(cfg.URL), err)
+		}
+		rt = &sigv4RoundTripper{signer: signer, next: rt}
+	}
+
+	if cfg.GoogleIDToken != nil {
+		source, err := newGoogleIDTokenSource(*cfg.GoogleIDToken, credentials)
+		if err != nil {
+			return nil, fmt.Errorf("invalid google_id_token config for %s: %w", RedactURL(cfg.URL), err)
+		}
+		rt = &tokenSourceRoundTripper{source: sharedCloudToken(*cfg.GoogleIDToken, source.fetch), next: rt}
+	}
+
+	if cfg.AzureManagedIdentity != nil {
+		source := newAzureTokenSource(*cfg.AzureManagedIdentity, credentials)
+		rt = &tokenSourceRoundTripper{source: sharedCloudToken(*cfg.AzureManagedIdentity, source.fetch), next: rt}
+	}
+
+	if len(cfg.Headers) > 0 {
+		rt = &headersRoundTripper{headers: cfg.Headers, next: rt}
+	}
+
+	if policy == nil {
+		return &http.Client{Transport: rt}, nil
+	}
+	if policy.checksAddresses() && proxy != nil {
+		// Checked first so no credentials are fetched for a refused request
+		rt = &proxyCheckRoundTripper{policy: policy, proxy: proxy, next: rt}
+	}
+	return &http.Client{Transport: rt, CheckRedirect: policy.checkRedirect}, nil
+}
+
+// newClientTLSConfig converts a TLSConfig into a crypto/tls configuration.
+func newClientTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	tlsCfg := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+
+	if cfg.CAFile != "" {
+		pool, err := loadCAFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if err := cfg.Validate(); err != nil {
+			return nil, err
+		}
+		// Check the certificate can be loaded now rather than on the first fetch
+		if _, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile); err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		// Reload the certificate for every new connection so rotated certificates are picked up
+		tlsCfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load client certificate: %w", err)
+			}
+			return &cert, nil
+		}
+	}
+
+	return tlsCfg, nil
+}
+
+// loadCAFile reads a PEM file of CA certificates into a new certificate pool.
+func loadCAFile(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file %s", path)
+	}
+	return pool, nil
+}
+
+// headersRoundTripper adds a fixed set of headers to each request.
+type headersRoundTripper struct {
+	headers map[string]string
+	next    http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (rt *headersRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, value := range rt.headers {
+		// The Host header is taken from req.Host rather than the header map
+		if http.CanonicalHeaderKey(name) == "Host" {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+	return rt.next.RoundTrip(req)
+}
@@ -0,0 +1,277 @@
+package combiner
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and key generated for tests.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert generates a certificate signed by parent, or a self-signed CA if parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// writePEM writes the certificate and key to PEM files and returns their paths.
+func (c *testCert) writePEM(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	certFile = writeFile(t, "cert.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})))
+	keyFile = writeFile(t, "key.pem", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+	return certFile, keyFile
+}
+
+// TestNewTargetClientCAFile tests verification of an HTTPS upstream's certificate.
+func TestNewTargetClientCAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	caFile := writeFile(t, "ca.pem", string(caPEM))
+
+	t.Run("System roots reject the upstream", func(t *testing.T) {
+		client, err := NewClient(Target{URL: server.URL}, nil)
+		if err != nil {
+			t.Fatalf("NewClient failed: %v", err)
+		}
+		if _, _, err := fetchString(context.Background(), client, server.URL); err == nil {
+			t.Error("expected certificate verification to fail")
+		}
+	})
+
+	t.Run("Custom CA accepts the upstream", func(t *testing.T) {
+		client, err := NewClient(Target{URL: server.URL, TLSConfig: TLSConfig{CAFile: caFile}}, nil)
+		if err != nil {
+			t.Fatalf("NewClient failed: %v", err)
+		}
+		body, _, err := fetchString(context.Background(), client, server.URL)
+		if err != nil {
+			t.Fatalf("expected no error, but got: %v", err)
+		}
+		if body != "ok" {
+			t.Errorf("expected body 'ok', but got: '%s'", body)
+		}
+	})
+
+	t.Run("Skipping verification accepts the upstream", func(t *testing.T) {
+		client, err := NewClient(Target{URL: server.URL, TLSConfig: TLSConfig{InsecureSkipVerify: true}}, nil)
+		if err != nil {
+			t.Fatalf("NewClient failed: %v", err)
+		}
+		if _, _, err := fetchString(context.Background(), client, server.URL); err != nil {
+			t.Errorf("expected no error, but got: %v", err)
+		}
+	})
+
+	t.Run("Invalid CA file", func(t *testing.T) {
+		_, err := NewClient(Target{URL: server.URL, TLSConfig: TLSConfig{CAFile: writeFile(t, "bad.pem", "not a certificate")}}, nil)
+		if err == nil {
+			t.Error("expected an error for a CA file without certificates")
+		}
+	})
+}
+
+// TestNewTargetClientMutualTLS tests presenting a client certificate to an upstream.
+func TestNewTargetClientMutualTLS(t *testing.T) {
+	ca := newTestCert(t, "test-ca", nil)
+	certFile, keyFile := newTestCert(t, "combiner", ca).writePEM(t)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := writeFile(t, "ca.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})))
+
+	t.Run("Without client certificate", func(t *testing.T) {
+		client, err := NewClient(Target{URL: server.URL, TLSConfig: TLSConfig{CAFile: caFile}}, nil)
+		if err != nil {
+			t.Fatalf("NewClient failed: %v", err)
+		}
+		if _, _, err := fetchString(context.Background(), client, server.URL); err == nil {
+			t.Error("expected the upstream to reject the connection")
+		}
+	})
+
+	t.Run("With client certificate", func(t *testing.T) {
+		client, err := NewClient(Target{URL: server.URL, TLSConfig: TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}}, nil)
+		if err != nil {
+			t.Fatalf("NewClient failed: %v", err)
+		}
+		body, _, err := fetchString(context.Background(), client, server.URL)
+		if err != nil {
+			t.Fatalf("expected no error, but got: %v", err)
+		}
+		if body != "hello combiner" {
+			t.Errorf("expected body 'hello combiner', but got: '%s'", body)
+		}
+	})
+
+	t.Run("Certificate without key", func(t *testing.T) {
+		_, err := NewClient(Target{URL: server.URL, TLSConfig: TLSConfig{CertFile: certFile}}, nil)
+		if err == nil {
+			t.Error("expected an error when key_file is missing")
+		}
+	})
+}
+
+// TestNewTargetClientHeaders tests that custom headers are sent to upstreams.
+func TestNewTargetClientHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s", r.Header.Get("X-Scope-OrgID"), r.Header.Get("X-Api-Key"), r.Host)
+	}))
+	defer server.Close()
+
+	client, err := NewClient(Target{URL: server.URL, Headers: map[string]string{
+		"X-Scope-OrgID": "tenant-1",
+		"x-api-key":     "abc123",
+		"Host":          "exporter.internal",
+	}}, nil)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	body, _, err := fetchString(context.Background(), client, server.URL)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	if expected := "tenant-1 abc123 exporter.internal"; body != expected {
+		t.Errorf("expected headers '%s', but got: '%s'", expected, body)
+	}
+}
+
+// TestNewTargetClientProxy tests that fetches go through a configured proxy.
+func TestNewTargetClientProxy(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A forward proxy receives the absolute upstream URL
+		fmt.Fprintf(w, "proxied %s", r.URL.String())
+	}))
+	defer proxy.Close()
+
+	client, err := NewClient(Target{URL: "http://exporter.invalid/metrics", ProxyURL: proxy.URL}, nil)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	body, _, err := fetchString(context.Background(), client, "http://exporter.invalid/metrics")
+	if err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	if expected := "proxied http://exporter.invalid/metrics"; body != expected {
+		t.Errorf("expected body '%s', but got: '%s'", expected, body)
+	}
+
+	if _, err := NewClient(Target{URL: "http://exporter", ProxyURL: "ftp://proxy"}, nil); err == nil {
+		t.Error("expected an error for an unsupported proxy scheme")
+	}
+}
+
+// TestNewUpstreamTransport tests enabling HTTP/2 and reusing connections.
+func TestNewUpstreamTransport(t *testing.T) {
+	for _, http2 := range []bool{true, false} {
+		t.Run(fmt.Sprintf("HTTP/2 %v", http2), func(t *testing.T) {
+			var conns atomic.Int32
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, r.Proto)
+			}))
+			server.EnableHTTP2 = true
+			server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					conns.Add(1)
+				}
+			}
+			server.StartTLS()
+			defer server.Close()
+
+			base := NewTransport(TransportOptions{HTTP2: http2, MaxIdleConnsPerHost: 2, IdleConnTimeout: time.Minute})
+			client, err := NewClient(Target{URL: server.URL, TLSConfig: TLSConfig{InsecureSkipVerify: true}}, base)
+			if err != nil {
+				t.Fatalf("NewClient failed: %v", err)
+			}
+
+			expected := "HTTP/1.1"
+			if http2 {
+				expected = "HTTP/2.0"
+			}
+			for range 3 {
+				body, _, err := fetchString(context.Background(), client, server.URL)
+				if err != nil {
+					t.Fatalf("fetchURL failed: %v", err)
+				}
+				if body != expected {
+					t.Errorf("expected protocol %s, got %s", expected, body)
+				}
+			}
+			if n := conns.Load(); n != 1 {
+				t.Errorf("expected 1 connection to be reused, got %d connections", n)
+			}
+		})
+	}
+}
+
+// TestNewUpstreamTransportLimits tests that the connection pool settings are applied.
+func TestNewUpstreamTransportLimits(t *testing.T) {
+	transport := NewTransport(TransportOptions{MaxIdleConns: 500, MaxIdleConnsPerHost: 20, MaxConnsPerHost: 4, IdleConnTimeout: time.Minute})
+	if transport.MaxIdleConns != 500 || transport.MaxIdleConnsPerHost != 20 || transport.MaxConnsPerHost != 4 || transport.IdleConnTimeout != time.Minute {
+		t.Error("connection pool settings were not applied")
+	}
+	if transport.Proxy == nil {
+		t.Error("expected the proxy environment variables to be used")
+	}
+}
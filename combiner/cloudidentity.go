@@ -0,0 +1,430 @@
+package combiner
+
+import (
+	"cmp"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GoogleIDToken configures sending a Google-signed ID token for a service
+// account, as required by Identity-Aware Proxy and Cloud Run.
+type GoogleIDToken struct {
+	// Audience is the audience of the token, the OAuth client ID for
+	// Identity-Aware Proxy or the service URL for Cloud Run.
+	Audience string `yaml:"audience"`
+	// CredentialsFile is a service account key file. It defaults to the
+	// GOOGLE_APPLICATION_CREDENTIALS environment variable, otherwise the
+	// token is requested from the metadata server.
+	CredentialsFile string `yaml:"credentials_file"`
+}
+
+// Validate checks the Google ID token configuration is complete.
+func (c GoogleIDToken) Validate() error {
+	if c.Audience == "" {
+		return errors.New("google_id_token requires an audience")
+	}
+	return nil
+}
+
+// AzureManagedIdentity configures sending an access token for an Azure
+// managed identity, as required by Microsoft Entra application proxy and App
+// Service authentication.
+type AzureManagedIdentity struct {
+	// Resource is the application ID URI or client ID of the application
+	// protecting the upstream.
+	Resource string `yaml:"resource"`
+	// ClientID selects a user-assigned identity, instead of the
+	// system-assigned identity.
+	ClientID string `yaml:"client_id"`
+}
+
+// Validate checks the Azure managed identity configuration is complete.
+func (c AzureManagedIdentity) Validate() error {
+	if c.Resource == "" {
+		return errors.New("azure_managed_identity requires a resource")
+	}
+	return nil
+}
+
+// cloudTokenExpiryDelta is how long before it expires a cloud identity token
+// is replaced.
+const cloudTokenExpiryDelta = 5 * time.Minute
+
+// cachedToken is a tokenSource caching the tokens returned by fetch until
+// they are about to expire.
+type cachedToken struct {
+	fetch func(context.Context) (token string, expiry time.Time, err error)
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// get implements tokenSource.
+func (c *cachedToken) get(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Until(c.expiry) > cloudTokenExpiryDelta {
+		return c.token, nil
+	}
+	token, expiry, err := c.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	c.token, c.expiry = token, expiry
+	return token, nil
+}
+
+// invalidate implements tokenSource.
+func (c *cachedToken) invalidate(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token == token {
+		c.token = ""
+	}
+}
+
+// cloudTokens holds the tokens for each GoogleIDToken and AzureManagedIdentity
+// configuration, so targets with the same settings share a token.
+var cloudTokens = struct {
+	sync.Mutex
+	tokens map[any]*cachedToken
+}{tokens: make(map[any]*cachedToken)}
+
+// sharedCloudToken returns the token for cfg, creating it with fetch if there
+// isn't one.
+func sharedCloudToken(cfg any, fetch func(context.Context) (string, time.Time, error)) *cachedToken {
+	cloudTokens.Lock()
+	defer cloudTokens.Unlock()
+	token, ok := cloudTokens.tokens[cfg]
+	if !ok {
+		token = &cachedToken{fetch: fetch}
+		cloudTokens.tokens[cfg] = token
+	}
+	return token
+}
+
+// googleServiceAccount is the part of a service account key file used to
+// request ID tokens.
+type googleServiceAccount struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// newTokenClients returns the client for token endpoints, using base, and the
+// client for metadata servers, which are link-local so never use a proxy.
+func newTokenClients(base *http.Transport) (client, metadataClient *http.Client) {
+	direct := base.Clone()
+	direct.Proxy = nil
+	return &http.Client{Transport: base, Timeout: time.Minute}, &http.Client{Transport: direct, Timeout: time.Minute}
+}
+
+// googleIDTokenSource requests ID tokens from Google.
+type googleIDTokenSource struct {
+	cfg                    GoogleIDToken
+	client, metadataClient *http.Client
+	// credentialsFile is the service account key file, if any.
+	credentialsFile string
+	// metadataURL is the base URL of the metadata server.
+	metadataURL string
+}
+
+// newGoogleIDTokenSource creates a source of ID tokens for cfg whose requests
+// use base.
+func newGoogleIDTokenSource(cfg GoogleIDToken, base *http.Transport) (*googleIDTokenSource, error) {
+	s := &googleIDTokenSource{
+		cfg:             cfg,
+		credentialsFile: cmp.Or(cfg.CredentialsFile, os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")),
+		metadataURL:     "http://" + cmp.Or(os.Getenv("GCE_METADATA_HOST"), "metadata.google.internal") + "/computeMetadata/v1",
+	}
+	s.client, s.metadataClient = newTokenClients(base)
+	if s.credentialsFile != "" {
+		if _, _, err := s.serviceAccount(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// serviceAccount reads the service account key file, which is read for every
+// token so a rotated key is picked up.
+func (s *googleIDTokenSource) serviceAccount() (googleServiceAccount, *rsa.PrivateKey, error) {
+	var account googleServiceAccount
+	data, err := os.ReadFile(s.credentialsFile)
+	if err != nil {
+		return account, nil, fmt.Errorf("failed to read Google credentials: %w", err)
+	}
+	if err := json.Unmarshal(data, &account); err != nil {
+		return account, nil, fmt.Errorf("invalid Google credentials %s: %w", s.credentialsFile, err)
+	}
+	if account.Type != "service_account" {
+		return account, nil, fmt.Errorf("invalid Google credentials %s: type %q isn't supported, only service_account", s.credentialsFile, account.Type)
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return account, nil, fmt.Errorf("invalid Google credentials %s: no private key", s.credentialsFile)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return account, nil, fmt.Errorf("invalid Google credentials %s: %w", s.credentialsFile, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return account, nil, fmt.Errorf("invalid Google credentials %s: private key isn't RSA", s.credentialsFile)
+	}
+	account.TokenURI = cmp.Or(account.TokenURI, "https://oauth2.googleapis.com/token")
+	return account, key, nil
+}
+
+// fetch requests an ID token, with the service account key if there is one,
+// otherwise from the metadata server.
+func (s *googleIDTokenSource) fetch(ctx context.Context) (string, time.Time, error) {
+	var token string
+	var err error
+	if s.credentialsFile != "" {
+		token, err = s.fetchWithKey(ctx)
+	} else {
+		token, err = s.fetchFromMetadata(ctx)
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiry, err := jwtExpiry(token)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid Google ID token: %w", err)
+	}
+	return token, expiry, nil
+}
+
+// fetchFromMetadata requests an ID token for the instance's service account
+// from the metadata server.
+func (s *googleIDTokenSource) fetchFromMetadata(ctx context.Context) (string, error) {
+	u := s.metadataURL + "/instance/service-accounts/default/identity?" + url.Values{"audience": {s.cfg.Audience}, "format": {"full"}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create metadata server request: %w", err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	body, err := doTokenRequest(s.metadataClient, req, "Google ID token from the metadata server")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// fetchWithKey exchanges a JWT signed with the service account key for an ID
+// token.
+func (s *googleIDTokenSource) fetchWithKey(ctx context.Context) (string, error) {
+	account, key, err := s.serviceAccount()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	assertion, err := signJWT(key, map[string]any{"alg": "RS256", "typ": "JWT", "kid": account.PrivateKeyID}, map[string]any{
+		"iss":             account.ClientEmail,
+		"sub":             account.ClientEmail,
+		"aud":             account.TokenURI,
+		"iat":             now.Unix(),
+		"exp":             now.Add(time.Hour).Unix(),
+		"target_audience": s.cfg.Audience,
+	})
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, account.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("failed to create Google token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	body, err := doTokenRequest(s.client, req, "Google ID token")
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || resp.IDToken == "" {
+		return "", fmt.Errorf("invalid Google ID token response from %s", account.TokenURI)
+	}
+	return resp.IDToken, nil
+}
+
+// signJWT returns a JWT with header and claims signed with key using RS256.
+func signJWT(key *rsa.PrivateKey, header, claims map[string]any) (string, error) {
+	var parts []string
+	for _, part := range []map[string]any{header, claims} {
+		data, err := json.Marshal(part)
+		if err != nil {
+			return "", fmt.Errorf("failed to encode JWT: %w", err)
+		}
+		parts = append(parts, base64.RawURLEncoding.EncodeToString(data))
+	}
+	digest := sha256.Sum256([]byte(strings.Join(parts, ".")))
+	signature, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign JWT: %w", err)
+	}
+	return strings.Join(parts, ".") + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// jwtExpiry returns the expiry time in the exp claim of a JWT, without
+// verifying it.
+func jwtExpiry(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, errors.New("not a JWT")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid JWT claims: %w", err)
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return time.Time{}, fmt.Errorf("invalid JWT claims: %w", err)
+	}
+	if claims.Exp == 0 {
+		return time.Time{}, errors.New("JWT has no expiry")
+	}
+	return time.Unix(claims.Exp, 0), nil
+}
+
+// azureTokenSource requests access tokens for an Azure managed identity.
+type azureTokenSource struct {
+	cfg                    AzureManagedIdentity
+	client, metadataClient *http.Client
+	// imdsURL is the token endpoint of the Azure Instance Metadata Service.
+	imdsURL string
+}
+
+// newAzureTokenSource creates a source of access tokens for cfg whose
+// requests use base.
+func newAzureTokenSource(cfg AzureManagedIdentity, base *http.Transport) *azureTokenSource {
+	s := &azureTokenSource{cfg: cfg, imdsURL: "http://169.254.169.254/metadata/identity/oauth2/token"}
+	s.client, s.metadataClient = newTokenClients(base)
+	return s
+}
+
+// fetch requests an access token using workload identity federation on AKS,
+// the App Service identity endpoint, or the Instance Metadata Service,
+// depending on the environment variables that are set.
+func (s *azureTokenSource) fetch(ctx context.Context) (string, time.Time, error) {
+	var req *http.Request
+	var err error
+	client := s.client
+	switch {
+	case os.Getenv("AZURE_FEDERATED_TOKEN_FILE") != "" && os.Getenv("AZURE_TENANT_ID") != "":
+		req, err = s.workloadIdentityRequest(ctx)
+	case os.Getenv("IDENTITY_ENDPOINT") != "" && os.Getenv("IDENTITY_HEADER") != "":
+		params := url.Values{"api-version": {"2019-08-01"}, "resource": {s.cfg.Resource}}
+		if s.cfg.ClientID != "" {
+			params.Set("client_id", s.cfg.ClientID)
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, os.Getenv("IDENTITY_ENDPOINT")+"?"+params.Encode(), nil)
+		if err == nil {
+			req.Header.Set("X-IDENTITY-HEADER", os.Getenv("IDENTITY_HEADER"))
+		}
+		client = s.metadataClient
+	default:
+		params := url.Values{"api-version": {"2018-02-01"}, "resource": {s.cfg.Resource}}
+		if s.cfg.ClientID != "" {
+			params.Set("client_id", s.cfg.ClientID)
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, s.imdsURL+"?"+params.Encode(), nil)
+		if err == nil {
+			req.Header.Set("Metadata", "true")
+		}
+		client = s.metadataClient
+	}
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to create Azure token request: %w", err)
+	}
+
+	body, err := doTokenRequest(client, req, "Azure managed identity token")
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	var resp struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"`
+		ExpiresOn   json.Number `json:"expires_on"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid Azure managed identity token: %w", err)
+	}
+	if resp.AccessToken == "" {
+		return "", time.Time{}, errors.New("invalid Azure managed identity token: missing access_token")
+	}
+	// expires_on is a Unix time, but only expires_in is returned for
+	// workload identity
+	var expiry time.Time
+	if on, err := resp.ExpiresOn.Int64(); err == nil {
+		expiry = time.Unix(on, 0)
+	} else if in, err := resp.ExpiresIn.Int64(); err == nil {
+		expiry = time.Now().Add(time.Duration(in) * time.Second)
+	} else {
+		return "", time.Time{}, errors.New("invalid Azure managed identity token: missing expiry")
+	}
+	return resp.AccessToken, expiry, nil
+}
+
+// workloadIdentityRequest creates a request exchanging the federated token
+// from AKS workload identity for an access token.
+func (s *azureTokenSource) workloadIdentityRequest(ctx context.Context) (*http.Request, error) {
+	assertion, err := os.ReadFile(os.Getenv("AZURE_FEDERATED_TOKEN_FILE"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read federated token: %w", err)
+	}
+	authority := cmp.Or(os.Getenv("AZURE_AUTHORITY_HOST"), "https://login.microsoftonline.com/")
+	form := url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_id":             {cmp.Or(s.cfg.ClientID, os.Getenv("AZURE_CLIENT_ID"))},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {strings.TrimSpace(string(assertion))},
+		"scope":                 {strings.TrimSuffix(s.cfg.Resource, "/") + "/.default"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(authority, "/")+"/"+os.Getenv("AZURE_TENANT_ID")+"/oauth2/v2.0/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+// doTokenRequest sends a request for a token, returning the response body if
+// the status is 200 OK. what describes the token in errors.
+func doTokenRequest(client *http.Client, req *http.Request, what string) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %w", what, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", what, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status getting %s: %s: %s", what, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
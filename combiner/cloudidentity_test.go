@@ -0,0 +1,305 @@
+package combiner
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testJWT returns an unsigned JWT with the claims.
+func testJWT(claims map[string]any) string {
+	data, _ := json.Marshal(claims)
+	return "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(data) + ".signature"
+}
+
+// TestGoogleIDTokenMetadata tests ID tokens are requested from the metadata
+// server for the audience, and cached until they are about to expire.
+func TestGoogleIDTokenMetadata(t *testing.T) {
+	var requests atomic.Int32
+	expiry := time.Now().Add(time.Hour).Unix()
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" || r.URL.Path != "/computeMetadata/v1/instance/service-accounts/default/identity" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		requests.Add(1)
+		fmt.Fprint(w, testJWT(map[string]any{"aud": r.URL.Query().Get("audience"), "exp": expiry}))
+	}))
+	defer metadata.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("Authorization"))
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(metadata.URL, "http://"))
+	client, err := NewClient(Target{URL: upstream.URL, GoogleIDToken: &GoogleIDToken{Audience: "metadata-test.apps.googleusercontent.com"}}, nil)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	for range 2 {
+		body, _, err := fetchString(context.Background(), client, upstream.URL)
+		if err != nil {
+			t.Fatalf("fetch failed: %v", err)
+		}
+		expected := "Bearer " + testJWT(map[string]any{"aud": "metadata-test.apps.googleusercontent.com", "exp": expiry})
+		if body != expected {
+			t.Errorf("got %q, want %q", body, expected)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("expected 1 metadata server request, got %d", n)
+	}
+}
+
+// TestGoogleIDTokenServiceAccount tests a JWT signed with the service account
+// key is exchanged for an ID token.
+func TestGoogleIDTokenServiceAccount(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	idToken := testJWT(map[string]any{"exp": time.Now().Add(time.Hour).Unix()})
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			http.Error(w, "unsupported grant type", http.StatusBadRequest)
+			return
+		}
+		parts := strings.Split(r.PostFormValue("assertion"), ".")
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+			http.Error(w, "invalid signature", http.StatusBadRequest)
+			return
+		}
+		data, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var claims map[string]any
+		json.Unmarshal(data, &claims)
+		if claims["iss"] != "combiner@project.iam.gserviceaccount.com" || claims["target_audience"] != "https://exporter-abc123.a.run.app" {
+			http.Error(w, fmt.Sprintf("invalid claims %v", claims), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"id_token": %q}`, idToken)
+	}))
+	defer tokens.Close()
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey failed: %v", err)
+	}
+	credentials, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "combiner@project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    tokens.URL,
+	})
+
+	cfg := GoogleIDToken{Audience: "https://exporter-abc123.a.run.app", CredentialsFile: writeFile(t, "credentials.json", string(credentials))}
+	source, err := newGoogleIDTokenSource(cfg, http.DefaultTransport.(*http.Transport))
+	if err != nil {
+		t.Fatalf("newGoogleIDTokenSource failed: %v", err)
+	}
+	token, expiry, err := source.fetch(context.Background())
+	if err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	if token != idToken || time.Until(expiry) < 59*time.Minute {
+		t.Errorf("got token %q expiring at %s, want %q", token, expiry, idToken)
+	}
+
+	cfg.CredentialsFile = writeFile(t, "user.json", `{"type": "authorized_user"}`)
+	if _, err := newGoogleIDTokenSource(cfg, http.DefaultTransport.(*http.Transport)); err == nil || !strings.Contains(err.Error(), "only service_account") {
+		t.Errorf("expected an error for user credentials, got: %v", err)
+	}
+}
+
+// TestAzureManagedIdentity tests access tokens are requested from the endpoint
+// for the environment.
+func TestAzureManagedIdentity(t *testing.T) {
+	expiresOn := time.Now().Add(time.Hour).Unix()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		switch {
+		case r.URL.Path == "/imds" && r.Header.Get("Metadata") == "true":
+			fmt.Fprintf(w, `{"access_token": "imds-%s-%s", "expires_on": "%d"}`, query.Get("resource"), query.Get("client_id"), expiresOn)
+		case r.URL.Path == "/msi/token" && r.Header.Get("X-IDENTITY-HEADER") == "secret":
+			fmt.Fprintf(w, `{"access_token": "appservice-%s", "expires_on": "%d"}`, query.Get("resource"), expiresOn)
+		case r.URL.Path == "/tenant/oauth2/v2.0/token" && r.PostFormValue("client_assertion") == "federated":
+			fmt.Fprintf(w, `{"access_token": "workload-%s-%s", "expires_in": 3600}`, r.PostFormValue("client_id"), r.PostFormValue("scope"))
+		default:
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		name          string
+		env           map[string]string
+		cfg           AzureManagedIdentity
+		expectedToken string
+		expectedError string
+	}{
+		{
+			name:          "Instance metadata service",
+			cfg:           AzureManagedIdentity{Resource: "api://exporter", ClientID: "user-assigned"},
+			expectedToken: "imds-api://exporter-user-assigned",
+		},
+		{
+			name:          "App Service",
+			env:           map[string]string{"IDENTITY_ENDPOINT": server.URL + "/msi/token", "IDENTITY_HEADER": "secret"},
+			cfg:           AzureManagedIdentity{Resource: "api://exporter"},
+			expectedToken: "appservice-api://exporter",
+		},
+		{
+			name: "Workload identity",
+			env: map[string]string{
+				"AZURE_FEDERATED_TOKEN_FILE": writeFile(t, "token", "federated\n"),
+				"AZURE_TENANT_ID":            "tenant",
+				"AZURE_CLIENT_ID":            "workload",
+				"AZURE_AUTHORITY_HOST":       server.URL + "/",
+			},
+			cfg:           AzureManagedIdentity{Resource: "api://exporter/"},
+			expectedToken: "workload-workload-api://exporter/.default",
+		},
+		{
+			name:          "Rejected",
+			env:           map[string]string{"IDENTITY_ENDPOINT": server.URL + "/msi/token", "IDENTITY_HEADER": "wrong"},
+			cfg:           AzureManagedIdentity{Resource: "api://exporter"},
+			expectedError: "401 Unauthorized",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, name := range []string{"IDENTITY_ENDPOINT", "IDENTITY_HEADER", "AZURE_FEDERATED_TOKEN_FILE", "AZURE_TENANT_ID", "AZURE_CLIENT_ID", "AZURE_AUTHORITY_HOST"} {
+				t.Setenv(name, tc.env[name])
+			}
+			source := newAzureTokenSource(tc.cfg, http.DefaultTransport.(*http.Transport))
+			source.imdsURL = server.URL + "/imds"
+
+			token, expiry, err := source.fetch(context.Background())
+			if tc.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+					t.Fatalf("expected error containing %q, got: %v", tc.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("fetch failed: %v", err)
+			}
+			if token != tc.expectedToken {
+				t.Errorf("got token %q, want %q", token, tc.expectedToken)
+			}
+			if d := time.Until(expiry); d < 59*time.Minute || d > time.Hour {
+				t.Errorf("expected the token to expire in an hour, got %s", d)
+			}
+		})
+	}
+}
+
+// TestCachedToken tests tokens are fetched again when they are about to
+// expire or have been invalidated.
+func TestCachedToken(t *testing.T) {
+	var fetches int
+	expiresIn := time.Hour
+	c := &cachedToken{fetch: func(context.Context) (string, time.Time, error) {
+		fetches++
+		return fmt.Sprintf("token-%d", fetches), time.Now().Add(expiresIn), nil
+	}}
+	get := func() string {
+		t.Helper()
+		token, err := c.get(context.Background())
+		if err != nil {
+			t.Fatalf("get failed: %v", err)
+		}
+		return token
+	}
+
+	get()
+	if token := get(); token != "token-1" {
+		t.Errorf("expected the cached token, got %q", token)
+	}
+	c.invalidate("token-1")
+	if token := get(); token != "token-2" {
+		t.Errorf("expected a new token after invalidating, got %q", token)
+	}
+	expiresIn = time.Minute
+	c.invalidate("token-2")
+	get()
+	if token := get(); token != "token-4" {
+		t.Errorf("expected a new token when it is about to expire, got %q", token)
+	}
+}
+
+// TestJWTExpiry tests the expiry is read from the claims of a JWT.
+func TestJWTExpiry(t *testing.T) {
+	testCases := []struct {
+		name          string
+		token         string
+		expected      int64
+		expectedError string
+	}{
+		{name: "Valid", token: testJWT(map[string]any{"exp": 1700000000}), expected: 1700000000},
+		{name: "No expiry", token: testJWT(map[string]any{"aud": "x"}), expectedError: "no expiry"},
+		{name: "Not a JWT", token: "opaque", expectedError: "not a JWT"},
+		{name: "Invalid claims", token: "a.!!.c", expectedError: "invalid JWT claims"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			expiry, err := jwtExpiry(tc.token)
+			if tc.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+					t.Errorf("expected error containing %q, got: %v", tc.expectedError, err)
+				}
+				return
+			}
+			if err != nil || expiry.Unix() != tc.expected {
+				t.Errorf("got %v, %v; want %d", expiry, err, tc.expected)
+			}
+		})
+	}
+}
+
+// TestCloudIdentityValidate tests incomplete cloud identity settings are
+// rejected.
+func TestCloudIdentityValidate(t *testing.T) {
+	testCases := []struct {
+		name          string
+		target        Target
+		expectedError string
+	}{
+		{name: "Google", target: Target{GoogleIDToken: &GoogleIDToken{Audience: "client.apps.googleusercontent.com"}}},
+		{name: "Azure", target: Target{AzureManagedIdentity: &AzureManagedIdentity{Resource: "api://exporter"}}},
+		{name: "Google without audience", target: Target{GoogleIDToken: &GoogleIDToken{}}, expectedError: "requires an audience"},
+		{name: "Azure without resource", target: Target{AzureManagedIdentity: &AzureManagedIdentity{}}, expectedError: "requires a resource"},
+		{name: "With oauth2", target: Target{GoogleIDToken: &GoogleIDToken{Audience: "a"}, OAuth2: &OAuth2{ClientID: "c", ClientSecretFile: "/s", TokenURL: "https://auth.example.com/token"}}, expectedError: "oauth2 and google_id_token cannot be used together"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.target.Validate()
+			if tc.expectedError == "" {
+				if err != nil {
+					t.Errorf("expected no error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+				t.Errorf("expected error containing %q, got: %v", tc.expectedError, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,1279 @@
+package combiner
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// result holds the outcome of fetching and parsing a single target.
+type result struct {
+	// index is the position of the target, used to combine results in target order.
+	index    int
+	families []*dto.MetricFamily
+	err      error
+	// duration is how long the fetch took and bytes the size of the body.
+	duration time.Duration
+	bytes    int
+	// stale is set when the fetch failed and families are the target's last
+	// successfully fetched metrics instead.
+	stale bool
+}
+
+// fetchURL requests a given URL using client, returning the uncompressed body
+// for the caller to read and close, and its exposition format. The request is
+// aborted when ctx is cancelled.
+func fetchURL(ctx context.Context, client *http.Client, url string) (io.ReadCloser, expfmt.Format, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create request for %s: %w", RedactURL(url), err)
+	}
+	req.Header.Set("Accept", acceptHeader)
+	// Propagate the trace context so upstreams can continue the trace
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	// Setting Accept-Encoding stops the transport from transparently
+	// decompressing, so this also covers clients with compression disabled.
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get %s: %w", RedactURL(url), dnsError(err))
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, "", fmt.Errorf("bad status for %s: %s", RedactURL(url), resp.Status)
+	}
+
+	body := resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return nil, "", fmt.Errorf("failed to decompress body from %s: %w", RedactURL(url), err)
+		}
+		body = &gzipBody{Reader: gz, body: resp.Body}
+	}
+
+	return body, expfmt.ResponseFormat(resp.Header), nil
+}
+
+// RedactURL returns rawURL with any password replaced by "xxxxx", for showing
+// to users. The password is also hidden in URLs that can't be parsed, such as
+// templates like http://user:password@{host}:9100/metrics.
+func RedactURL(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil {
+		return u.Redacted()
+	}
+	scheme, rest, ok := strings.Cut(rawURL, "://")
+	if !ok {
+		return rawURL
+	}
+	authority := rest
+	if i := strings.IndexAny(rest, "/?#"); i >= 0 {
+		authority = rest[:i]
+	}
+	at := strings.LastIndex(authority, "@")
+	if at < 0 {
+		return rawURL
+	}
+	username, _, hasPassword := strings.Cut(authority[:at], ":")
+	if !hasPassword {
+		return rawURL
+	}
+	return scheme + "://" + username + ":xxxxx" + rest[at:]
+}
+
+// gzipBody decompresses a response body, closing both when it is closed.
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+// Close closes the decompressor and the underlying body.
+func (b *gzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
+
+// errBodyTooLarge is returned when reading more than the limit of a countingReader.
+var errBodyTooLarge = errors.New("body too large")
+
+// countingReader counts the bytes read through it. If limit is greater than
+// zero reading more than limit bytes fails with errBodyTooLarge.
+type countingReader struct {
+	r     io.Reader
+	n     int
+	limit int
+}
+
+// Read reads from the underlying reader, adding to the count.
+func (c *countingReader) Read(p []byte) (int, error) {
+	if c.limit > 0 {
+		// Read at most one byte past the limit to detect that it was exceeded
+		if remaining := c.limit - c.n + 1; len(p) > remaining {
+			p = p[:remaining]
+		}
+	}
+	n, err := c.r.Read(p)
+	c.n += n
+	if c.limit > 0 && c.n > c.limit {
+		return n, errBodyTooLarge
+	}
+	return n, err
+}
+
+// target is a single upstream metrics endpoint.
+type target struct {
+	url string
+	// name identifies the target wherever users can see it, the URL with
+	// any password redacted.
+	name    string
+	client  *http.Client
+	breaker *breaker
+	// labels are added to every series fetched from the target, resolving
+	// labels already present on a series using labelConflict.
+	labels        map[string]string
+	labelConflict string
+	// metricPrefix is prepended to the name of every metric fetched from the target.
+	metricPrefix string
+
+	mu sync.Mutex
+	// last is the most recent fetch.
+	last lastFetch
+	// lastSuccess is the time of the most recent successful fetch.
+	lastSuccess time.Time
+	// scrapeErrors is the number of failed fetches, and dnsErrors the number
+	// of those that failed to resolve the target's host.
+	scrapeErrors int
+	dnsErrors    int
+	// lastGood is a copy of the metrics from the most recent successful
+	// fetch, only kept when serving stale metrics is enabled.
+	lastGood []*dto.MetricFamily
+}
+
+// lastFetch describes a fetch of a target.
+type lastFetch struct {
+	start    time.Time
+	duration time.Duration
+	bytes    int
+	err      error
+}
+
+// recordFetch records the outcome of a fetch.
+func (t *target) recordFetch(f lastFetch) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.last = f
+	if f.err == nil {
+		t.lastSuccess = f.start.Add(f.duration)
+	} else {
+		t.scrapeErrors++
+		if errors.Is(f.err, ErrDNS) {
+			t.dnsErrors++
+		}
+	}
+}
+
+// status returns the health of the target.
+func (t *target) status() TargetStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return TargetStatus{
+		URL:                t.name,
+		Labels:             maps.Clone(t.labels),
+		LastScrape:         t.last.start,
+		LastScrapeDuration: t.last.duration,
+		LastScrapeBytes:    t.last.bytes,
+		LastError:          t.last.err,
+		LastSuccess:        t.lastSuccess,
+		ScrapeErrors:       t.scrapeErrors,
+	}
+}
+
+// setLastGood stores a copy of families as the target's last successfully
+// fetched metrics.
+func (t *target) setLastGood(families []*dto.MetricFamily) {
+	copied := cloneFamilies(families)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastGood = copied
+}
+
+// staleFamilies returns a copy of the target's last successfully fetched
+// metrics if they were fetched within maxAge.
+func (t *target) staleFamilies(maxAge time.Duration) ([]*dto.MetricFamily, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.lastGood == nil || time.Since(t.lastSuccess) > maxAge {
+		return nil, false
+	}
+	return cloneFamilies(t.lastGood), true
+}
+
+// lastGoodFamilies returns the target's last successfully fetched metrics,
+// which must not be modified.
+func (t *target) lastGoodFamilies() []*dto.MetricFamily {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lastGood
+}
+
+// scrapeErrorCount returns the number of failed fetches.
+func (t *target) scrapeErrorCount() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.scrapeErrors
+}
+
+// dnsErrorCount returns the number of fetches that failed to resolve the
+// target's host.
+func (t *target) dnsErrorCount() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.dnsErrors
+}
+
+// lastSuccessTime returns the time of the most recent successful fetch.
+func (t *target) lastSuccessTime() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lastSuccess
+}
+
+// offset returns the delay of the target's fetches within jitter. It's derived
+// from the URL so each target is fetched at the same point of every scrape,
+// and targets are spread evenly over the jitter.
+func (t *target) offset(jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(t.url))
+	return time.Duration(h.Sum64() % uint64(jitter))
+}
+
+// Options are the settings that apply to all targets of a Combiner. The zero
+// value fetches every target for each request with no timeout, and includes
+// all metrics in the output.
+type Options struct {
+	// Filter selects the metrics and series included in the output.
+	Filter Filter
+	// Timeout is the maximum total time spent fetching the targets for a
+	// single request, 0 for no limit. When it expires outstanding fetches are
+	// cancelled and whatever was collected so far is combined.
+	Timeout time.Duration
+	// TimeoutOffset is subtracted from the X-Prometheus-Scrape-Timeout-Seconds
+	// header sent by Prometheus, leaving time to combine and send the partial
+	// results before Prometheus gives up on the scrape.
+	TimeoutOffset time.Duration
+	// BreakerThreshold is the number of consecutive failures after which a
+	// target's circuit breaker opens and it is skipped for BreakerCooldown,
+	// 0 disables circuit breakers.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	// DuplicatePolicy is how series exposed by more than one target are
+	// resolved, one of DuplicatePolicies. Empty is the same as DuplicateFirst.
+	DuplicatePolicy string
+	// SortSeries sorts the series in each family by their labels. Families
+	// are always sorted by name, and otherwise series are in target order.
+	SortSeries bool
+	// InjectTimestamps sets the timestamp of every sample without one to
+	// the time its target was fetched, so a result served from the cache or
+	// a background scrape keeps the time the samples were collected.
+	InjectTimestamps bool
+	// StripTimestamps removes the timestamps of the samples from targets,
+	// before InjectTimestamps is applied.
+	StripTimestamps bool
+	// OutputValidation checks the combined metrics are valid, and is one of
+	// ValidationModes to choose what happens to invalid series. Empty
+	// disables validation.
+	OutputValidation string
+	// SelfMetrics adds metrics about each target's fetch to the output,
+	// including combiner_scrape_partial which is 1 when some targets failed.
+	SelfMetrics bool
+	// FailedTargetsHeader lists the targets that failed in the
+	// X-Combiner-Failed-Targets header of partial responses.
+	FailedTargetsHeader bool
+	// BuildInfo is added to the output with the self metrics if it isn't
+	// nil, for example a combiner_build_info gauge.
+	BuildInfo *dto.MetricFamily
+	// ScrapeInterval enables background mode, where Run fetches the targets
+	// on this interval and requests are served the latest result. 0 fetches
+	// the targets for every request.
+	ScrapeInterval time.Duration
+	// ScrapeJitter spreads the fetches of a background scrape, each target is
+	// fetched after a fixed offset up to ScrapeJitter from the start of every
+	// scrape. It must be less than ScrapeInterval.
+	ScrapeJitter time.Duration
+	// CoalesceRequests makes concurrent requests share a single fetch of the
+	// targets, as they do when CacheTTL is set, without caching the result.
+	CoalesceRequests bool
+	// CacheTTL is how long a combined result is reused for later requests, 0
+	// disables caching. Once it expires the result is still served for up to
+	// CacheStaleTTL while it is refreshed in the background. Caching can't be
+	// used with ScrapeInterval.
+	CacheTTL      time.Duration
+	CacheStaleTTL time.Duration
+	// Transport is shared by all targets, nil uses http.DefaultTransport.
+	Transport *http.Transport
+	// DNSRefreshInterval caches the resolved addresses of the targets' host
+	// names for new connections, resolving them again once they're older
+	// than the interval. 0 resolves them for every new connection. A host's
+	// cached addresses are tried one at a time, so IPv4 and IPv6 addresses
+	// aren't raced.
+	DNSRefreshInterval time.Duration
+	// IPFamily is the IP family of the addresses connected to, one of
+	// IPFamilies. Empty is the same as IPFamilyDual.
+	IPFamily string
+	// DefaultScheme and DefaultMetricsPath complete target URLs given as a
+	// bare host:port, see NormalizeURL. They default to http and /metrics.
+	DefaultScheme      string
+	DefaultMetricsPath string
+	// MaxConcurrentFetches limits how many targets are fetched at the same
+	// time for a single request, 0 is unlimited.
+	MaxConcurrentFetches int
+	// MaxBodySize is the maximum size of an uncompressed target body in
+	// bytes, larger bodies fail the fetch. 0 is unlimited.
+	MaxBodySize int
+	// MinSuccess is how many targets must be fetched successfully, otherwise
+	// the request fails with ErrTooFewSucceeded instead of serving partial
+	// results. Targets served their last metrics with StalenessCache count
+	// as successful.
+	MinSuccess SuccessThreshold
+	// ServeStaleMaxAge is how long a target's last successfully fetched
+	// metrics are served in place of a failed fetch, 0 disables this.
+	ServeStaleMaxAge time.Duration
+	// StalenessPolicy is one of StalenessPolicies, and decides how the last
+	// successfully fetched metrics of a failed target are served. Empty is
+	// StalenessCache if ServeStaleMaxAge is set, otherwise StalenessOmit.
+	StalenessPolicy string
+	// ForwardParams are the names of request query parameters that are added
+	// to the URL of every target.
+	ForwardParams []string
+	// Scales multiply or divide the values of metrics, and then
+	// Aggregations combine metrics across the targets. They are applied to
+	// the combined metrics before the Transformers.
+	Scales       []Scale
+	Aggregations []Aggregation
+	// Transformers are applied in order to the combined metrics before they
+	// are served or pushed.
+	Transformers []Transformer
+	// URLPolicy restricts the targets and redirects that can be fetched.
+	URLPolicy URLPolicy
+}
+
+// compile checks the options and converts them to the form used internally.
+func (o Options) compile() (options, error) {
+	opts := options{
+		dropLabels:           o.Filter.DropLabels,
+		timeout:              o.Timeout,
+		timeoutOffset:        o.TimeoutOffset,
+		breakerThreshold:     o.BreakerThreshold,
+		breakerCooldown:      o.BreakerCooldown,
+		duplicatePolicy:      o.DuplicatePolicy,
+		sortSeries:           o.SortSeries,
+		injectTimestamps:     o.InjectTimestamps,
+		stripTimestamps:      o.StripTimestamps,
+		outputValidation:     o.OutputValidation,
+		coalesceRequests:     o.CoalesceRequests,
+		selfMetrics:          o.SelfMetrics,
+		failedTargetsHeader:  o.FailedTargetsHeader,
+		buildInfo:            o.BuildInfo,
+		scrapeInterval:       o.ScrapeInterval,
+		scrapeJitter:         o.ScrapeJitter,
+		cacheTTL:             o.CacheTTL,
+		cacheStaleTTL:        o.CacheStaleTTL,
+		transport:            o.Transport,
+		defaultScheme:        o.DefaultScheme,
+		defaultMetricsPath:   o.DefaultMetricsPath,
+		maxConcurrentFetches: o.MaxConcurrentFetches,
+		maxBodySize:          o.MaxBodySize,
+		serveStaleMaxAge:     o.ServeStaleMaxAge,
+		minSuccess:           o.MinSuccess,
+		forwardParams:        o.ForwardParams,
+		transformers:         o.Transformers,
+	}
+	if o.DuplicatePolicy != "" && !slices.Contains(DuplicatePolicies, o.DuplicatePolicy) {
+		return opts, fmt.Errorf("invalid duplicate policy %q, must be one of %s", o.DuplicatePolicy, strings.Join(DuplicatePolicies, ", "))
+	}
+	if o.IPFamily != "" && !slices.Contains(IPFamilies, o.IPFamily) {
+		return opts, fmt.Errorf("invalid IP family %q, must be one of %s", o.IPFamily, strings.Join(IPFamilies, ", "))
+	}
+	if o.DefaultScheme != "" && o.DefaultScheme != "http" && o.DefaultScheme != "https" {
+		return opts, fmt.Errorf("invalid default scheme %q, must be http or https", o.DefaultScheme)
+	}
+	if o.DefaultMetricsPath != "" && !strings.HasPrefix(o.DefaultMetricsPath, "/") {
+		return opts, fmt.Errorf("invalid default metrics path %q, must start with /", o.DefaultMetricsPath)
+	}
+	if o.OutputValidation != "" && !slices.Contains(ValidationModes, o.OutputValidation) {
+		return opts, fmt.Errorf("invalid output validation mode %q, must be one of %s", o.OutputValidation, strings.Join(ValidationModes, ", "))
+	}
+	if o.Timeout < 0 || o.TimeoutOffset < 0 || o.BreakerThreshold < 0 || o.BreakerCooldown < 0 || o.ScrapeInterval < 0 || o.CacheTTL < 0 || o.CacheStaleTTL < 0 ||
+		o.MaxConcurrentFetches < 0 || o.MaxBodySize < 0 || o.ServeStaleMaxAge < 0 || o.DNSRefreshInterval < 0 {
+		return opts, errors.New("durations and limits must not be negative")
+	}
+	if o.ScrapeJitter < 0 || (o.ScrapeJitter > 0 && o.ScrapeJitter >= o.ScrapeInterval) {
+		return opts, errors.New("the scrape jitter must be less than the scrape interval")
+	}
+	if o.CacheTTL > 0 && o.ScrapeInterval > 0 {
+		return opts, errors.New("caching can't be used with a scrape interval")
+	}
+	if o.CacheStaleTTL > 0 && o.CacheTTL == 0 {
+		return opts, errors.New("a cache stale TTL requires a cache TTL")
+	}
+	for _, name := range o.ForwardParams {
+		if name == "target" || name == "format" {
+			return opts, fmt.Errorf("the %s query parameter can't be forwarded", name)
+		}
+	}
+	if err := o.MinSuccess.validate(); err != nil {
+		return opts, err
+	}
+	var err error
+	if opts.stalenessPolicy, err = stalenessPolicy(o.StalenessPolicy, o.ServeStaleMaxAge); err != nil {
+		return opts, err
+	}
+	if slices.Contains(o.Transformers, nil) {
+		return opts, errors.New("transformers must not be nil")
+	}
+	// Scales are applied first so aggregations see the converted metrics
+	var builtin []Transformer
+	scales, err := compileScales(o.Scales)
+	if err != nil {
+		return opts, err
+	}
+	if scales != nil {
+		builtin = append(builtin, scales)
+	}
+	aggs, err := compileAggregations(o.Aggregations)
+	if err != nil {
+		return opts, err
+	}
+	if aggs != nil {
+		builtin = append(builtin, aggs)
+	}
+	if len(builtin) > 0 {
+		opts.transformers = append(builtin, o.Transformers...)
+	}
+	if opts.urlPolicy, err = o.URLPolicy.compile(); err != nil {
+		return opts, err
+	}
+	opts.credentialTransport = opts.transport
+	if opts.credentialTransport == nil {
+		opts.credentialTransport = http.DefaultTransport.(*http.Transport)
+	}
+	if opts.urlPolicy.checksAddresses() {
+		opts.transport = opts.urlPolicy.transport(opts.transport)
+	}
+	if o.DNSRefreshInterval > 0 || (o.IPFamily != "" && o.IPFamily != IPFamilyDual) {
+		// Wrapping the policy's transport means the resolved addresses are
+		// still checked when they're connected to
+		dialer := newHostDialer(o.DNSRefreshInterval, o.IPFamily)
+		opts.transport = dialer.transport(opts.transport)
+		opts.credentialTransport = dialer.transport(opts.credentialTransport)
+	}
+	opts.filter, opts.seriesFilter, err = o.Filter.compile()
+	return opts, err
+}
+
+// options holds the settings that apply to all targets of a Combiner, with
+// the filters compiled.
+type options struct {
+	filter familyFilter
+	// seriesFilter keeps or drops individual series after filter is applied.
+	seriesFilter seriesFilter
+	// dropLabels are removed from every series after filtering.
+	dropLabels []string
+	timeout    time.Duration
+	// timeoutOffset is subtracted from the Prometheus scrape timeout.
+	timeoutOffset time.Duration
+	// breakerThreshold is the number of consecutive failures after which a
+	// target's circuit breaker opens, 0 disables circuit breakers.
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	// duplicatePolicy is how series exposed by more than one target are
+	// resolved, one of DuplicatePolicies. Empty is the same as first.
+	duplicatePolicy string
+	// sortSeries sorts the series in each family by their labels.
+	sortSeries bool
+	// injectTimestamps sets the timestamp of samples without one to the time
+	// their target was fetched.
+	injectTimestamps bool
+	// stripTimestamps removes the timestamps of samples from targets.
+	stripTimestamps bool
+	// outputValidation is how invalid series in the combined metrics are
+	// handled, empty if they aren't checked.
+	outputValidation string
+	// selfMetrics adds metrics about each target's fetch to the output.
+	selfMetrics bool
+	// failedTargetsHeader lists the failed targets in a response header.
+	failedTargetsHeader bool
+	// buildInfo is added to the output with the self metrics if it isn't nil.
+	buildInfo *dto.MetricFamily
+	// scrapeInterval enables background mode, where targets are fetched on
+	// this interval and requests are served the latest scrape. 0 fetches
+	// the targets for every request.
+	scrapeInterval time.Duration
+	// scrapeJitter is the range of the offsets of the targets' fetches in a
+	// background scrape.
+	scrapeJitter time.Duration
+	// coalesceRequests makes concurrent requests share a single gather.
+	coalesceRequests bool
+	// cacheTTL is how long a combined result is reused for later requests, 0
+	// disables caching. Once it expires the result is still served for up to
+	// cacheStaleTTL while it is refreshed in the background.
+	cacheTTL      time.Duration
+	cacheStaleTTL time.Duration
+	// transport is shared by all targets, nil uses http.DefaultTransport.
+	transport *http.Transport
+	// credentialTransport fetches the tokens and signing credentials of the
+	// targets. It isn't restricted by urlPolicy, so cloud metadata endpoints
+	// can still be reached when link-local networks are denied.
+	credentialTransport *http.Transport
+	// defaultScheme and defaultMetricsPath complete bare host:port target
+	// URLs.
+	defaultScheme      string
+	defaultMetricsPath string
+	// maxConcurrentFetches limits how many targets are fetched at the same
+	// time for a single request, 0 is unlimited.
+	maxConcurrentFetches int
+	// maxBodySize is the maximum size of an uncompressed upstream body in
+	// bytes, larger bodies fail the fetch. 0 is unlimited.
+	maxBodySize int
+	// serveStaleMaxAge is how long a target's last successfully fetched
+	// metrics are served in place of a failed fetch.
+	serveStaleMaxAge time.Duration
+	// stalenessPolicy is how a failed target's last metrics are served,
+	// StalenessOmit if they aren't.
+	stalenessPolicy string
+	// minSuccess is how many targets must succeed to serve partial results.
+	minSuccess SuccessThreshold
+	// forwardParams are the names of request query parameters that are added
+	// to the URL of every target.
+	forwardParams []string
+	// transformers are applied in order to the combined metrics.
+	transformers []Transformer
+	// urlPolicy restricts the targets and redirects that can be fetched.
+	urlPolicy *urlPolicy
+}
+
+// Combiner fetches and combines metrics from a set of upstream targets. It is
+// an http.Handler serving the combined metrics, and is safe for concurrent
+// use.
+type Combiner struct {
+	options
+
+	mu      sync.RWMutex
+	targets []*target
+
+	snapshotMu sync.RWMutex
+	// latest is the most recent background scrape or cached response, nil
+	// until one completes.
+	latest *snapshot
+	// inflight is the gather in progress to refresh the cache, if any.
+	inflight *refreshCall
+
+	// ctx is cancelled by Close to abort refreshes, which aren't tied to a
+	// single request.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// New creates a Combiner for targets. The targets can be changed later with
+// SetTargets. In background mode Run must also be called to fetch them.
+func New(targets []Target, opts Options) (*Combiner, error) {
+	compiled, err := opts.compile()
+	if err != nil {
+		return nil, err
+	}
+	return newCombiner(targets, compiled)
+}
+
+// newCombiner creates a Combiner for targets with compiled options.
+func newCombiner(targets []Target, opts options) (*Combiner, error) {
+	c := &Combiner{options: opts}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	if err := c.SetTargets(targets); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close cancels any upstream fetches still running to refresh the combined
+// metrics, for use on shutdown. Requests waiting for them fail, as do later
+// requests that need a refresh.
+func (c *Combiner) Close() {
+	c.cancel()
+}
+
+// Target health values returned by TargetStatus.Health.
+const (
+	HealthUp      = "up"
+	HealthDown    = "down"
+	HealthUnknown = "unknown"
+)
+
+// TargetStatus is the health of a target.
+type TargetStatus struct {
+	// URL is the target's URL with any password redacted.
+	URL string
+	// Labels are added to every series fetched from the target.
+	Labels map[string]string
+	// LastScrape is the time the most recent fetch started, zero if the
+	// target hasn't been fetched. LastScrapeDuration, LastScrapeBytes and
+	// LastError are the duration, uncompressed body size and error of that
+	// fetch.
+	LastScrape         time.Time
+	LastScrapeDuration time.Duration
+	LastScrapeBytes    int
+	LastError          error
+	// LastSuccess is the time of the most recent successful fetch, zero if
+	// there hasn't been one.
+	LastSuccess time.Time
+	// ScrapeErrors is the total number of failed fetches.
+	ScrapeErrors int
+}
+
+// Targets returns the status of each target, in the order they were set.
+func (c *Combiner) Targets() []TargetStatus {
+	targets := c.currentTargets()
+	statuses := make([]TargetStatus, len(targets))
+	for i, t := range targets {
+		statuses[i] = t.status()
+	}
+	return statuses
+}
+
+// Health returns HealthUp if the most recent fetch succeeded, HealthDown if
+// it failed, or HealthUnknown if the target hasn't been fetched.
+func (s TargetStatus) Health() string {
+	switch {
+	case s.LastScrape.IsZero():
+		return HealthUnknown
+	case s.LastError != nil:
+		return HealthDown
+	default:
+		return HealthUp
+	}
+}
+
+// CheckURL checks a target URL is allowed by the URLPolicy option. Host names
+// are only checked against the allowed and denied networks when they are
+// resolved for a fetch.
+func (c *Combiner) CheckURL(rawURL string) error {
+	if c.urlPolicy == nil {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	return c.urlPolicy.checkURL(u)
+}
+
+// currentTargets returns the targets currently being combined.
+func (c *Combiner) currentTargets() []*target {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.targets
+}
+
+// SetTargets replaces the targets being combined. The circuit breaker and
+// health state of targets whose URL hasn't changed are kept. If any target is
+// invalid the existing targets are left unchanged.
+func (c *Combiner) SetTargets(configs []Target) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	existing := make(map[string]*target, len(c.targets))
+	for _, t := range c.targets {
+		existing[t.url] = t
+	}
+
+	targets := make([]*target, 0, len(configs))
+	for _, tc := range configs {
+		if err := tc.Validate(); err != nil {
+			return fmt.Errorf("target %s: %w", RedactURL(tc.URL), err)
+		}
+		normalized, err := NormalizeURL(tc.URL, c.defaultScheme, c.defaultMetricsPath)
+		if err != nil {
+			return fmt.Errorf("target %s: %w", RedactURL(tc.URL), err)
+		}
+		tc.URL = normalized
+		if err := c.CheckURL(tc.URL); err != nil {
+			return fmt.Errorf("target %s: %w", RedactURL(tc.URL), err)
+		}
+		client, err := newClient(tc, c.transport, c.credentialTransport, c.urlPolicy)
+		if err != nil {
+			return err
+		}
+		t := &target{url: tc.URL, name: RedactURL(tc.URL), client: client, labels: tc.Labels, labelConflict: tc.LabelConflict, metricPrefix: tc.MetricPrefix}
+		if old, ok := existing[tc.URL]; ok {
+			t.breaker = old.breaker
+			old.mu.Lock()
+			t.last, t.lastSuccess, t.scrapeErrors, t.dnsErrors = old.last, old.lastSuccess, old.scrapeErrors, old.dnsErrors
+			old.mu.Unlock()
+			// The last metrics only still apply if they're relabelled the same way
+			if maps.Equal(t.labels, old.labels) && t.labelConflict == old.labelConflict && t.metricPrefix == old.metricPrefix {
+				t.lastGood = old.lastGoodFamilies()
+			}
+		} else if c.breakerThreshold > 0 {
+			t.breaker = newBreaker(c.breakerThreshold, c.breakerCooldown)
+		}
+		targets = append(targets, t)
+	}
+
+	c.targets = targets
+	return nil
+}
+
+// fetch fetches a single target and sends the result to a channel, skipping
+// the fetch if the target's circuit breaker is open. If sem isn't nil a slot
+// in it is held while fetching, limiting the number of concurrent fetches.
+// params are query parameters added to the target URL, the result of a fetch
+// with params isn't kept to be served stale since it may differ. The fetch
+// starts after delay.
+func (c *Combiner) fetch(ctx context.Context, index int, t *target, params url.Values, delay time.Duration, sem chan struct{}, ch chan<- result, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	serveStale := (c.stalenessPolicy == StalenessCache || c.stalenessPolicy == StalenessMark) && len(params) == 0
+
+	ctx, span := tracer().Start(ctx, "fetch", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.String("url.full", t.name)))
+	defer span.End()
+
+	// skip sends a result for a target that wasn't fetched
+	skip := func(err error) {
+		span.SetStatus(codes.Error, err.Error())
+		res := result{index: index, err: err}
+		if serveStale {
+			res.families, res.stale = t.staleFamilies(c.serveStaleMaxAge)
+		}
+		ch <- res
+	}
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			skip(fmt.Errorf("gave up waiting to fetch %s: %w", t.name, ctx.Err()))
+			return
+		}
+	}
+
+	if sem != nil {
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+		case <-ctx.Done():
+			skip(fmt.Errorf("gave up waiting to fetch %s: %w", t.name, ctx.Err()))
+			return
+		}
+	}
+
+	if !t.breaker.allow() {
+		skip(fmt.Errorf("circuit breaker open for %s, skipping", t.name))
+		return
+	}
+
+	// The body is parsed as it's read so it is never held in memory
+	var families []*dto.MetricFamily
+	counter := &countingReader{limit: c.maxBodySize}
+	start := time.Now()
+	body, format, err := fetchURL(ctx, t.client, withParams(t.url, params))
+	if err == nil {
+		counter.r = body
+		families, err = parseMetrics(counter, format)
+		body.Close()
+		if counter.limit > 0 && counter.n > counter.limit {
+			err = fmt.Errorf("body from %s exceeds the maximum size of %d bytes", t.name, counter.limit)
+		} else if err != nil {
+			err = fmt.Errorf("failed to parse metrics from %s: %w", t.name, err)
+		} else {
+			prefixNames(families, t.metricPrefix)
+			addLabels(families, t.labels, t.labelConflict)
+			if c.stripTimestamps {
+				families = withoutTimestamps(families)
+			}
+			if c.injectTimestamps {
+				setTimestamps(families, start)
+			}
+		}
+	}
+
+	duration := time.Since(start)
+
+	span.SetAttributes(attribute.Int("http.response.body.size", counter.n))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	if err != nil && callerCancelled(ctx) {
+		// The fetch was abandoned because the request was cancelled, which
+		// isn't the target's fault
+		t.breaker.abandon()
+		ch <- result{index: index, err: err, duration: duration}
+		return
+	}
+	t.breaker.record(err)
+	t.recordFetch(lastFetch{start: start, duration: duration, bytes: counter.n, err: err})
+	if err == nil && serveStale {
+		t.setLastGood(families)
+	}
+
+	res := result{index: index, families: families, err: err, duration: duration, bytes: counter.n}
+	if err != nil && serveStale {
+		res.families, res.stale = t.staleFamilies(c.serveStaleMaxAge)
+	}
+	ch <- res
+}
+
+// withParams returns rawURL with params replacing any query parameters of the
+// same name.
+func withParams(rawURL string, params url.Values) string {
+	if len(params) == 0 {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	query := u.Query()
+	maps.Copy(query, params)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// forwardedParams returns the query parameters of a request whose names are
+// in allowed.
+func forwardedParams(query url.Values, allowed []string) url.Values {
+	var params url.Values
+	for _, name := range allowed {
+		if values, ok := query[name]; ok {
+			if params == nil {
+				params = make(url.Values)
+			}
+			params[name] = values
+		}
+	}
+	return params
+}
+
+// scrapeTimeout returns the deadline to apply to a scrape. If the client sent
+// the X-Prometheus-Scrape-Timeout-Seconds header and it is shorter than the
+// configured timeout it is used instead, since Prometheus gives up after that.
+// The header is reduced by offset, unless that would leave no time at all.
+func scrapeTimeout(r *http.Request, timeout, offset time.Duration) time.Duration {
+	v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if v == "" {
+		return timeout
+	}
+	seconds, err := strconv.ParseFloat(v, 64)
+	if err != nil || seconds <= 0 {
+		return timeout
+	}
+	d := time.Duration(seconds * float64(time.Second))
+	if d > offset {
+		d -= offset
+	}
+	if timeout <= 0 || d < timeout {
+		return d
+	}
+	return timeout
+}
+
+var (
+	// ErrNoTargets is returned by Gather when there are no targets.
+	ErrNoTargets = errors.New("no upstream URLs configured")
+	// ErrAllFailed is returned by Gather when no target was fetched successfully.
+	ErrAllFailed = errors.New("all upstreams failed")
+)
+
+// callerCancelled returns whether ctx was cancelled by the caller of a
+// gather, for example because the client went away, rather than a deadline
+// expiring.
+func callerCancelled(ctx context.Context) bool {
+	return errors.Is(ctx.Err(), context.Canceled)
+}
+
+// FailedTargetsHeader is the response header listing the URLs of the targets
+// missing from a partial response, when the FailedTargetsHeader option is set.
+const FailedTargetsHeader = "X-Combiner-Failed-Targets"
+
+// Gather fetches metrics from all targets and combines them, limited to the
+// Timeout option. Unlike requests to the handler it always fetches the
+// targets, bypassing the cache and background scrape.
+func (c *Combiner) Gather(ctx context.Context) ([]*dto.MetricFamily, error) {
+	families, _, err := c.gather(ctx, c.timeout)
+	return families, err
+}
+
+// gather fetches metrics from all targets and combines them, also returning
+// the URLs of the targets that failed.
+func (c *Combiner) gather(ctx context.Context, timeout time.Duration) ([]*dto.MetricFamily, []string, error) {
+	return c.gatherTargets(ctx, timeout, c.currentTargets(), nil, 0)
+}
+
+// gatherTargets fetches metrics from targets, adding params to their URLs,
+// and combines them. Outstanding fetches are cancelled once the timeout
+// expires, and whatever was collected so far is combined. The URLs of the
+// targets that failed or didn't respond in time are returned with the
+// partial results. Each fetch is delayed by its target's offset within
+// jitter, if set. Fetches are recorded under the span in ctx.
+func (c *Combiner) gatherTargets(ctx context.Context, timeout time.Duration, targets []*target, params url.Values, jitter time.Duration) ([]*dto.MetricFamily, []string, error) {
+	if len(targets) == 0 {
+		return nil, nil, ErrNoTargets
+	}
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.Int("combiner.targets", len(targets)))
+
+	// The caller's context is cancelled when the client goes away
+	caller := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var wg sync.WaitGroup
+	ch := make(chan result, len(targets))
+
+	// Fetches beyond the concurrency limit wait for a slot
+	var sem chan struct{}
+	if c.maxConcurrentFetches > 0 {
+		sem = make(chan struct{}, c.maxConcurrentFetches)
+	}
+
+	wg.Add(len(targets))
+	for i, t := range targets {
+		go c.fetch(ctx, i, t, params, t.offset(jitter), sem, ch, &wg)
+	}
+
+	// Wait for all fetch operations to complete, then close the channel.
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+
+	// Results are stored by target index so they're combined in target order
+	// regardless of which upstream responds first.
+	perTarget := make([][]*dto.MetricFamily, len(targets))
+	results := make([]*result, len(targets))
+	succeeded := 0
+
+	// Read results from the channel until all fetches are done or the deadline expires.
+collect:
+	for {
+		var res result
+		var ok bool
+		select {
+		case res, ok = <-ch:
+			if !ok {
+				break collect
+			}
+		case <-ctx.Done():
+			if callerCancelled(caller) {
+				err := caller.Err()
+				// Nobody is waiting for the result, so outstanding fetches
+				// are abandoned and cancelled on return
+				slog.Debug("Request cancelled, abandoning outstanding fetches", "err", err)
+				span.SetStatus(codes.Error, err.Error())
+				return nil, nil, err
+			}
+			slog.Warn("Scrape deadline exceeded, returning partial results", "err", ctx.Err())
+			break collect
+		}
+
+		results[res.index] = &res
+		switch {
+		case res.stale && c.stalenessPolicy == StalenessMark:
+			// The target is still down, its series are only included to end them
+			slog.Warn("Failed to fetch target, marking the last successfully fetched metrics stale", "target", targets[res.index].name, "last_success", targets[res.index].lastSuccessTime(), "err", res.err)
+			res.families = markStale(res.families)
+		case res.stale:
+			slog.Warn("Failed to fetch target, serving the last successfully fetched metrics", "target", targets[res.index].name, "last_success", targets[res.index].lastSuccessTime(), "err", res.err)
+			succeeded++
+		case res.err != nil:
+			slog.Warn("Failed to fetch target", "target", targets[res.index].name, "duration", res.duration, "err", res.err)
+			continue
+		default:
+			slog.Debug("Fetched target", "target", targets[res.index].name, "duration", res.duration, "bytes", res.bytes)
+			succeeded++
+		}
+
+		families := filterSeries(filterFamilies(res.families, c.filter), c.seriesFilter)
+		removeLabels(families, c.dropLabels)
+		perTarget[res.index] = families
+	}
+
+	span.SetAttributes(attribute.Int("combiner.targets_succeeded", succeeded))
+
+	// Return an error if all fetches failed, otherwise return partial results
+	if succeeded == 0 {
+		span.SetStatus(codes.Error, ErrAllFailed.Error())
+		return nil, nil, ErrAllFailed
+	}
+	if required := c.minSuccess.required(len(targets)); succeeded < required {
+		slog.Warn("Too few targets fetched successfully", "succeeded", succeeded, "required", required, "targets", len(targets))
+		span.SetStatus(codes.Error, ErrTooFewSucceeded.Error())
+		return nil, nil, ErrTooFewSucceeded
+	}
+	failed := failedTargets(targets, results)
+
+	families := slices.Concat(perTarget...)
+	if c.breakerThreshold > 0 {
+		families = append(families, breakerMetricFamily(targets))
+	}
+	if c.selfMetrics {
+		families = append(families, selfMetricFamilies(c.buildInfo, targets, results)...)
+	}
+
+	merged, err := mergeFamilies(families, c.duplicatePolicy)
+	if err == nil {
+		merged, err = transform(ctx, c.transformers, merged, c.duplicatePolicy)
+	}
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, nil, err
+	}
+	if c.sortSeries {
+		sortSeries(merged)
+	}
+	if c.outputValidation != "" {
+		var invalid int
+		if merged, invalid, err = validateFamilies(merged, c.outputValidation); err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			return nil, nil, err
+		}
+		if c.selfMetrics {
+			merged = insertFamily(merged, invalidSeriesMetricFamily(invalid))
+		}
+	}
+	return merged, failed, nil
+}
+
+// failedTargets returns the redacted URLs of the targets whose fetch failed or
+// didn't complete, including those served their last successfully fetched
+// metrics.
+func failedTargets(targets []*target, results []*result) []string {
+	var failed []string
+	for i, t := range targets {
+		if res := results[i]; res == nil || res.err != nil {
+			failed = append(failed, t.name)
+		}
+	}
+	return failed
+}
+
+// selectTargets returns the targets whose URL, host or hostname is one of
+// names, in the configured order. It fails if a name doesn't match any target.
+func selectTargets(targets []*target, names []string) ([]*target, error) {
+	selected := make([]bool, len(targets))
+	for _, name := range names {
+		found := false
+		for i, t := range targets {
+			if t.url == name || t.name == name {
+				selected[i], found = true, true
+				continue
+			}
+			if u, err := url.Parse(t.url); err == nil && (u.Host == name || u.Hostname() == name) {
+				selected[i], found = true, true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown target %q", name)
+		}
+	}
+
+	var subset []*target
+	for i, t := range targets {
+		if selected[i] {
+			subset = append(subset, t)
+		}
+	}
+	return subset, nil
+}
+
+// ServeHTTP combines metrics from all targets and writes the result back. In
+// background mode the latest scrape is served, otherwise the targets are
+// fetched for every request. If the request selects targets with the target
+// query parameter, or has parameters to forward to the targets, the targets
+// are always fetched, bypassing the cache and background scrape. Any match[]
+// selectors filter the combined series.
+func (c *Combiner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Received request", "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+
+	// A nil subset means all targets
+	var subset []*target
+	query := r.URL.Query()
+	if names := query["target"]; len(names) > 0 {
+		var err error
+		if subset, err = selectTargets(c.currentTargets(), names); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid target parameter: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	// match[] selects series like the Prometheus federation endpoint
+	var match seriesFilter
+	for _, s := range query["match[]"] {
+		sel, err := parseSelector(s)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid match[] parameter: %v", err), http.StatusBadRequest)
+			return
+		}
+		match.keep = append(match.keep, sel)
+	}
+	params := forwardedParams(query, c.forwardParams)
+	if params != nil && subset == nil {
+		subset = c.currentTargets()
+	}
+
+	if c.scrapeInterval > 0 && subset == nil {
+		snap := c.latestSnapshot()
+		if snap == nil {
+			http.Error(w, "No scrape of the upstream services has completed yet.", http.StatusServiceUnavailable)
+			return
+		}
+		if snap.err != nil {
+			writeGatherError(w, snap.err)
+			return
+		}
+		c.setFailedTargetsHeader(w, snap.failed)
+		writeMetrics(w, r, filterSeries(snap.families, match))
+		return
+	}
+
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer().Start(ctx, "combine", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
+	var families []*dto.MetricFamily
+	var failed []string
+	var err error
+	switch {
+	case subset != nil:
+		families, failed, err = c.gatherTargets(ctx, scrapeTimeout(r, c.timeout, c.timeoutOffset), subset, params, 0)
+	case c.cacheTTL > 0 || c.coalesceRequests:
+		families, failed, err = c.cachedGather(ctx, scrapeTimeout(r, c.timeout, c.timeoutOffset))
+	default:
+		families, failed, err = c.gather(ctx, scrapeTimeout(r, c.timeout, c.timeoutOffset))
+	}
+	if err != nil {
+		writeGatherError(w, err)
+		return
+	}
+	c.setFailedTargetsHeader(w, failed)
+	writeMetrics(w, r, filterSeries(families, match))
+}
+
+// setFailedTargetsHeader lists the targets missing from a partial response
+// in the failed targets header, if it is enabled.
+func (c *Combiner) setFailedTargetsHeader(w http.ResponseWriter, failed []string) {
+	if c.failedTargetsHeader && len(failed) > 0 {
+		w.Header().Set(FailedTargetsHeader, strings.Join(failed, ", "))
+	}
+}
+
+// writeGatherError writes the response for an error returned by gather.
+func writeGatherError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, context.Canceled):
+		// The client has gone away so there's no one to respond to
+		slog.Debug("Request cancelled before the metrics were combined", "err", err)
+	case errors.Is(err, ErrNoTargets):
+		http.Error(w, "No upstream URLs configured.", http.StatusInternalServerError)
+	case errors.Is(err, ErrAllFailed):
+		http.Error(w, "Failed to fetch one or more upstream services.", http.StatusInternalServerError)
+	case errors.Is(err, ErrTooFewSucceeded):
+		http.Error(w, "Too few upstream services were fetched successfully.", http.StatusInternalServerError)
+	default:
+		slog.Error("Failed to combine metrics", "err", err)
+		http.Error(w, fmt.Sprintf("Failed to combine metrics: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// writeMetrics streams families to w in the format requested by the format
+// query parameter or negotiated with the client's Accept header, or responds with 304 Not
+// Modified if the client already has them. Once the response has started an
+// encoding error can only be logged.
+func writeMetrics(w http.ResponseWriter, r *http.Request, families []*dto.MetricFamily) {
+	format := expfmt.NegotiateIncludingOpenMetrics(r.Header)
+	contentType := string(format)
+	// For formats other than the exposition formats, format is only used to
+	// distinguish the ETag
+	write := func(w io.Writer) error {
+		return writeFamilies(w, families, format)
+	}
+	f := r.URL.Query().Get("format")
+	if f == "" && acceptsJSON(r.Header.Get("Accept")) {
+		f = "json"
+	}
+	switch f {
+	case "":
+	case "json":
+		format = expfmt.Format(f)
+		contentType = jsonContentType
+		write = func(w io.Writer) error {
+			return writeJSON(w, families)
+		}
+	case "influx":
+		format = expfmt.Format(f)
+		contentType = influxContentType
+		write = func(w io.Writer) error {
+			return writeInflux(w, families)
+		}
+	default:
+		http.Error(w, fmt.Sprintf("Invalid format parameter: %q", f), http.StatusBadRequest)
+		return
+	}
+
+	etag, err := familiesETag(families, format)
+	if err != nil {
+		slog.Error("Failed to encode metrics", "err", err)
+		http.Error(w, "Failed to encode metrics.", http.StatusInternalServerError)
+		return
+	}
+	// The format, and so the ETag, depends on the Accept header
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("ETag", etag)
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+
+	bw := bufio.NewWriter(w)
+	if err := write(bw); err != nil {
+		slog.Error("Failed to encode metrics", "err", err)
+		return
+	}
+	if err := bw.Flush(); err != nil {
+		slog.Debug("Failed to write response", "err", err)
+	}
+}
@@ -0,0 +1,1243 @@
+package combiner
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+)
+
+// writeFile writes content to a file in a temporary directory and returns its path.
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+	return path
+}
+
+// staticTargets creates targets for a list of URLs.
+func staticTargets(urls []string) []Target {
+	targets := make([]Target, len(urls))
+	for i, u := range urls {
+		targets[i] = Target{URL: u}
+	}
+	return targets
+}
+
+// TestNew tests the options are checked when creating a Combiner.
+func TestNew(t *testing.T) {
+	testCases := []struct {
+		name        string
+		opts        Options
+		expectedErr bool
+	}{
+		{"Zero options", Options{}, false},
+		{"Filters", Options{Filter: Filter{Prefixes: []string{"a_"}, KeepSeries: []string{`{env="prod"}`}}}, false},
+		{"Invalid regex", Options{Filter: Filter{MatchRegexes: []string{"("}}}, true},
+		{"Invalid metric type", Options{Filter: Filter{IncludeTypes: []string{"timer"}}}, true},
+		{"Valid metric types", Options{Filter: Filter{IncludeTypes: []string{"counter"}, ExcludeTypes: []string{"gaugehistogram"}}}, false},
+		{"Invalid series selector", Options{Filter: Filter{DropSeries: []string{"{"}}}, true},
+		{"Invalid duplicate policy", Options{DuplicatePolicy: "max"}, true},
+		{"Negative timeout", Options{Timeout: -time.Second}, true},
+		{"Cache with scrape interval", Options{CacheTTL: time.Second, ScrapeInterval: time.Second}, true},
+		{"Scrape jitter", Options{ScrapeInterval: time.Minute, ScrapeJitter: time.Second}, false},
+		{"Scrape jitter not less than the interval", Options{ScrapeInterval: time.Second, ScrapeJitter: time.Second}, true},
+		{"Scrape jitter without an interval", Options{ScrapeJitter: time.Second}, true},
+		{"Invalid default scheme", Options{DefaultScheme: "ftp"}, true},
+		{"Invalid default metrics path", Options{DefaultMetricsPath: "metrics"}, true},
+		{"Stale TTL without TTL", Options{CacheStaleTTL: time.Second}, true},
+		{"Forward target", Options{ForwardParams: []string{"target"}}, true},
+		{"Invalid success threshold", Options{MinSuccess: SuccessThreshold{Percent: 120}}, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := New(staticTargets([]string{"http://a"}), tc.opts)
+			if (err != nil) != tc.expectedErr {
+				t.Errorf("expected error %v, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+
+	if _, err := New([]Target{{URL: "http://a", LabelConflict: "replace"}}, Options{}); err == nil {
+		t.Error("expected an invalid target to be rejected")
+	}
+	if _, err := New(staticTargets([]string{"ftp://a/metrics"}), Options{}); err == nil {
+		t.Error("expected a target with an unsupported scheme to be rejected")
+	}
+	agg, err := New(staticTargets([]string{"a:9100"}), Options{DefaultScheme: "https"})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if url := agg.Targets()[0].URL; url != "https://a:9100/metrics" {
+		t.Errorf("expected the bare target to be completed, got %s", url)
+	}
+}
+
+// TestCombinerHandler tests the combiner handler logic.
+func TestCombinerHandler(t *testing.T) {
+	// Mock upstream server 1
+	server1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "metric_a 1")
+		fmt.Fprintln(w, "metric_b 2")
+	}))
+	defer server1.Close()
+
+	// Mock upstream server 2
+	server2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "metric_c 3")
+		fmt.Fprintln(w, "another_metric 4")
+	}))
+	defer server2.Close()
+
+	// Mock a server that returns something other than metrics
+	server4 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "<html><body>Hello</body></html>")
+	}))
+	defer server4.Close()
+
+	// Mock a server that will fail
+	server3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}))
+	defer server3.Close()
+
+	testCases := []struct {
+		name           string
+		urls           []string
+		prefixes       []string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "Two healthy upstreams, no filter",
+			urls:           []string{server1.URL, server2.URL},
+			prefixes:       []string{},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "metric_a 1\nmetric_b 2\nmetric_c 3\nanother_metric 4\n",
+		},
+		{
+			name:           "Two healthy upstreams, with prefix filter",
+			urls:           []string{server1.URL, server2.URL},
+			prefixes:       []string{"metric_"},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "metric_a 1\nmetric_b 2\nmetric_c 3\n",
+		},
+		{
+			name:           "Two healthy upstreams, with multiple prefix filters",
+			urls:           []string{server1.URL, server2.URL},
+			prefixes:       []string{"metric_a", "another_"},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "metric_a 1\nanother_metric 4\n",
+		},
+		{
+			name:           "One healthy, one failing upstream",
+			urls:           []string{server1.URL, server3.URL},
+			prefixes:       []string{},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "metric_a 1\nmetric_b 2\n",
+		},
+		{
+			name:           "One healthy, one unparseable upstream",
+			urls:           []string{server1.URL, server4.URL},
+			prefixes:       []string{},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "metric_a 1\nmetric_b 2\n",
+		},
+		{
+			name:           "All upstreams failing",
+			urls:           []string{server3.URL, "http://localhost:12345"}, // one 500, one unreachable
+			prefixes:       []string{},
+			expectedStatus: http.StatusInternalServerError,
+			expectedBody:   "Failed to fetch one or more upstream services.\n",
+		},
+		{
+			name:           "No upstreams configured",
+			urls:           []string{},
+			prefixes:       []string{},
+			expectedStatus: http.StatusInternalServerError,
+			expectedBody:   "No upstream URLs configured.\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			rr := httptest.NewRecorder()
+
+			agg, err := newCombiner(staticTargets(tc.urls), options{filter: familyFilter{prefixes: tc.prefixes}})
+			if err != nil {
+				t.Fatalf("newCombiner failed: %v", err)
+			}
+			agg.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, tc.expectedStatus)
+			}
+
+			// For successful cases, we can't guarantee order, so we check for presence of lines.
+			if tc.expectedStatus == http.StatusOK {
+				body := rr.Body.String()
+				expectedLines := strings.Split(strings.TrimSpace(tc.expectedBody), "\n")
+				for _, line := range expectedLines {
+					if !strings.Contains(body, line) {
+						t.Errorf("handler response body does not contain expected line '%s'. Body:\n%s", line, body)
+					}
+				}
+			} else {
+				// For error cases, we can check the exact body.
+				if body := rr.Body.String(); body != tc.expectedBody {
+					t.Errorf("handler returned unexpected body: got '%v' want '%v'", body, tc.expectedBody)
+				}
+			}
+		})
+	}
+}
+
+// TestCombinerHandlerDeadline checks that slow upstreams are abandoned once the deadline expires.
+func TestCombinerHandlerDeadline(t *testing.T) {
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "metric_fast 1")
+	}))
+	defer fast.Close()
+
+	unblock := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-unblock:
+		}
+	}))
+	defer slow.Close()
+	defer close(unblock)
+
+	agg, err := newCombiner(staticTargets([]string{fast.URL, slow.URL}), options{timeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("newCombiner failed: %v", err)
+	}
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	rr := httptest.NewRecorder()
+
+	start := time.Now()
+	agg.ServeHTTP(rr, req)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("handler did not respect the deadline, took %v", elapsed)
+	}
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if body := rr.Body.String(); body != "# TYPE metric_fast untyped\nmetric_fast 1\n" {
+		t.Errorf("handler returned unexpected body: got '%v'", body)
+	}
+
+	// The slow upstream is reported as down
+	agg.selfMetrics = true
+	rr = httptest.NewRecorder()
+	agg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		fmt.Sprintf("combiner_target_up{target=\"%s\"} 1", fast.URL),
+		fmt.Sprintf("combiner_target_up{target=\"%s\"} 0", slow.URL),
+		"combiner_scrape_partial 1",
+	} {
+		if !strings.Contains(rr.Body.String(), line) {
+			t.Errorf("response body does not contain expected line '%s'. Body:\n%s", line, rr.Body.String())
+		}
+	}
+}
+
+// TestCombinerHandlerClientCancel checks that upstream fetches are aborted
+// when the client goes away, without counting as failures of the targets.
+func TestCombinerHandlerClientCancel(t *testing.T) {
+	aborted := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(aborted)
+	}))
+	defer slow.Close()
+
+	agg, err := newCombiner(staticTargets([]string{slow.URL}), options{breakerThreshold: 1, breakerCooldown: time.Hour})
+	if err != nil {
+		t.Fatalf("newCombiner failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	agg.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil).WithContext(ctx))
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("handler did not return when the request was cancelled, took %v", elapsed)
+	}
+	select {
+	case <-aborted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream request was not aborted")
+	}
+	// Give the abandoned fetch time to finish
+	time.Sleep(100 * time.Millisecond)
+
+	status := agg.Targets()[0]
+	if status.ScrapeErrors != 0 || status.LastError != nil {
+		t.Errorf("expected the cancelled fetch not to be recorded, got %+v", status)
+	}
+	if !agg.currentTargets()[0].breaker.allow() {
+		t.Error("expected the circuit breaker to stay closed")
+	}
+}
+
+// TestCombinerHandlerClientCancelHalfOpen checks that a half-open circuit
+// breaker's trial fetch abandoned by the client doesn't leave the breaker
+// stuck, so the target is tried again on the next request.
+func TestCombinerHandlerClientCancelHalfOpen(t *testing.T) {
+	aborted := make(chan struct{}, 1)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		aborted <- struct{}{}
+	}))
+	defer slow.Close()
+
+	agg, err := newCombiner(staticTargets([]string{slow.URL}), options{breakerThreshold: 1, breakerCooldown: time.Minute})
+	if err != nil {
+		t.Fatalf("newCombiner failed: %v", err)
+	}
+	now := time.Unix(0, 0)
+	b := agg.currentTargets()[0].breaker
+	b.now = func() time.Time { return now }
+	b.record(errors.New("failed"))
+	now = now.Add(time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	agg.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil).WithContext(ctx))
+	select {
+	case <-aborted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream request was not aborted")
+	}
+	// Give the abandoned fetch time to finish
+	time.Sleep(100 * time.Millisecond)
+
+	if state := b.current(); state != breakerOpen {
+		t.Errorf("breaker state is %v, want %v", state, breakerOpen)
+	}
+	if !b.allow() {
+		t.Error("expected a new trial fetch to be allowed after the abandoned one")
+	}
+}
+
+// TestCombinerHandlerMergesFamilies checks that HELP and TYPE are written once for metrics exposed by several upstreams.
+func TestCombinerHandlerMergesFamilies(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "# HELP go_goroutines Number of goroutines.")
+		fmt.Fprintln(w, "# TYPE go_goroutines gauge")
+		fmt.Fprintf(w, "go_goroutines{instance=%q} 5\n", r.Host)
+	})
+	server1 := httptest.NewServer(handler)
+	defer server1.Close()
+	server2 := httptest.NewServer(handler)
+	defer server2.Close()
+
+	agg, err := newCombiner(staticTargets([]string{server1.URL, server2.URL}), options{})
+	if err != nil {
+		t.Fatalf("newCombiner failed: %v", err)
+	}
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	rr := httptest.NewRecorder()
+	agg.ServeHTTP(rr, req)
+
+	body := rr.Body.String()
+	if n := strings.Count(body, "# HELP go_goroutines"); n != 1 {
+		t.Errorf("expected one HELP line, got %d. Body:\n%s", n, body)
+	}
+	if n := strings.Count(body, "# TYPE go_goroutines"); n != 1 {
+		t.Errorf("expected one TYPE line, got %d. Body:\n%s", n, body)
+	}
+	if n := strings.Count(body, "go_goroutines{"); n != 2 {
+		t.Errorf("expected two samples, got %d. Body:\n%s", n, body)
+	}
+}
+
+// TestCombinerHandlerDuplicates checks that duplicate series are resolved in target order, not response order.
+func TestCombinerHandlerDuplicates(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprintln(w, "metric_a 1")
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "metric_a 2")
+	}))
+	defer fast.Close()
+
+	testCases := []struct {
+		policy         string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{policy: DuplicateFirst, expectedStatus: http.StatusOK, expectedBody: "# TYPE metric_a untyped\nmetric_a 1\n"},
+		{policy: DuplicateLast, expectedStatus: http.StatusOK, expectedBody: "# TYPE metric_a untyped\nmetric_a 2\n"},
+		{policy: DuplicateSum, expectedStatus: http.StatusOK, expectedBody: "# TYPE metric_a untyped\nmetric_a 3\n"},
+		{policy: DuplicateError, expectedStatus: http.StatusInternalServerError, expectedBody: "Failed to combine metrics: duplicate series metric_a{}\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.policy, func(t *testing.T) {
+			agg, err := newCombiner(staticTargets([]string{slow.URL, fast.URL}), options{duplicatePolicy: tc.policy})
+			if err != nil {
+				t.Fatalf("newCombiner failed: %v", err)
+			}
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			rr := httptest.NewRecorder()
+			agg.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tc.expectedStatus)
+			}
+			if body := rr.Body.String(); body != tc.expectedBody {
+				t.Errorf("handler returned unexpected body: got %q want %q", body, tc.expectedBody)
+			}
+		})
+	}
+}
+
+// TestCombinerHandlerDropLabels checks that series which become identical after dropping labels are merged.
+func TestCombinerHandlerDropLabels(t *testing.T) {
+	server1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `requests{container_id="a",job="web"} 1`)
+	}))
+	defer server1.Close()
+	server2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `requests{container_id="b",job="web"} 2`)
+	}))
+	defer server2.Close()
+
+	agg, err := newCombiner(staticTargets([]string{server1.URL, server2.URL}), options{
+		dropLabels:      []string{"container_id"},
+		duplicatePolicy: DuplicateSum,
+	})
+	if err != nil {
+		t.Fatalf("newCombiner failed: %v", err)
+	}
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	rr := httptest.NewRecorder()
+	agg.ServeHTTP(rr, req)
+
+	expected := "# TYPE requests untyped\nrequests{job=\"web\"} 3\n"
+	if body := rr.Body.String(); body != expected {
+		t.Errorf("handler returned unexpected body: got %q want %q", body, expected)
+	}
+}
+
+// TestCombinerInjectTimestamps checks that samples without a timestamp get the
+// time their target was fetched, and existing timestamps are kept.
+func TestCombinerInjectTimestamps(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "metric_a 1\nmetric_b 2 1700000000000\n")
+	}))
+	defer server.Close()
+
+	agg, err := New(staticTargets([]string{server.URL}), Options{InjectTimestamps: true, CacheTTL: time.Hour})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	before := time.Now().UnixMilli()
+	agg.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+	after := time.Now().UnixMilli()
+	time.Sleep(2 * time.Millisecond)
+
+	// The cached result keeps the time it was fetched
+	rr := httptest.NewRecorder()
+	agg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	families, err := parseMetrics(rr.Body, expfmt.FmtText)
+	if err != nil {
+		t.Fatalf("parseMetrics failed: %v", err)
+	}
+	if len(families) != 2 {
+		t.Fatalf("expected 2 families, got %d", len(families))
+	}
+	if ts := families[0].Metric[0].GetTimestampMs(); ts < before || ts > after {
+		t.Errorf("expected metric_a to have a timestamp between %d and %d, got %d", before, after, ts)
+	}
+	if ts := families[1].Metric[0].GetTimestampMs(); ts != 1700000000000 {
+		t.Errorf("expected metric_b to keep its timestamp, got %d", ts)
+	}
+}
+
+// TestCombinerStripTimestamps checks that timestamps from targets are removed,
+// and replaced by the fetch time if they're also injected.
+func TestCombinerStripTimestamps(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "metric_a 1\nmetric_b 2 1700000000000\n")
+	}))
+	defer server.Close()
+
+	agg, err := New(staticTargets([]string{server.URL}), Options{StripTimestamps: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	agg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	expected := "# TYPE metric_a untyped\nmetric_a 1\n# TYPE metric_b untyped\nmetric_b 2\n"
+	if body := rr.Body.String(); body != expected {
+		t.Errorf("handler returned unexpected body: got %q want %q", body, expected)
+	}
+
+	agg, err = New(staticTargets([]string{server.URL}), Options{StripTimestamps: true, InjectTimestamps: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	before := time.Now().UnixMilli()
+	rr = httptest.NewRecorder()
+	agg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	families, err := parseMetrics(rr.Body, expfmt.FmtText)
+	if err != nil {
+		t.Fatalf("parseMetrics failed: %v", err)
+	}
+	for _, mf := range families {
+		if ts := mf.Metric[0].GetTimestampMs(); ts < before {
+			t.Errorf("expected %s to have the fetch time as its timestamp, got %d", mf.GetName(), ts)
+		}
+	}
+}
+
+// TestCombinerHandlerFilterMetadata checks that the HELP and TYPE of metrics
+// selected by a prefix are kept, even though the comments don't start with it.
+func TestCombinerHandlerFilterMetadata(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# HELP http_requests_total Total requests.\n# TYPE http_requests_total counter\nhttp_requests_total 5\n")
+		fmt.Fprint(w, "# HELP go_goroutines Number of goroutines.\n# TYPE go_goroutines gauge\ngo_goroutines 10\n")
+	}))
+	defer server.Close()
+
+	agg, err := newCombiner(staticTargets([]string{server.URL}), options{filter: familyFilter{prefixes: []string{"http_"}}})
+	if err != nil {
+		t.Fatalf("newCombiner failed: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	agg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+
+	expected := "# HELP http_requests_total Total requests.\n# TYPE http_requests_total counter\nhttp_requests_total 5\n"
+	if body := rr.Body.String(); body != expected {
+		t.Errorf("handler returned unexpected body: got %q want %q", body, expected)
+	}
+}
+
+// TestCombinerHandlerFilterFamilyName checks that filters match the metric
+// family name, so all the samples of a histogram are selected together.
+func TestCombinerHandlerFilterFamilyName(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# TYPE rpc_seconds histogram\nrpc_seconds_bucket{le=\"1\"} 1\nrpc_seconds_bucket{le=\"+Inf\"} 2\nrpc_seconds_sum 3\nrpc_seconds_count 2\n")
+		fmt.Fprint(w, "# TYPE rpc_total counter\nrpc_total{code=\"200\"} 5\nrpc_total{code=\"500\"} 1\n")
+	}))
+	defer server.Close()
+	histogram := "# TYPE rpc_seconds histogram\nrpc_seconds_bucket{le=\"1\"} 1\nrpc_seconds_bucket{le=\"+Inf\"} 2\nrpc_seconds_sum 3\nrpc_seconds_count 2\n"
+
+	testCases := []struct {
+		name     string
+		filter   Filter
+		expected string
+	}{
+		{"Prefix of the family", Filter{Prefixes: []string{"rpc_seconds"}}, histogram},
+		{"Regex of the family", Filter{MatchRegexes: []string{"rpc_sec.*"}}, histogram},
+		{"Sample suffix isn't part of the family name", Filter{Prefixes: []string{"rpc_seconds_bucket"}}, ""},
+		{"Exclude family", Filter{Prefixes: []string{"rpc_"}, ExcludeRegexes: []string{".*_total"}}, histogram},
+		{"All series of a family", Filter{Prefixes: []string{"rpc_total"}}, "# TYPE rpc_total counter\nrpc_total{code=\"200\"} 5\nrpc_total{code=\"500\"} 1\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			agg, err := New(staticTargets([]string{server.URL}), Options{Filter: tc.filter})
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			rr := httptest.NewRecorder()
+			agg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+			if body := rr.Body.String(); body != tc.expected {
+				t.Errorf("handler returned unexpected body: got %q want %q", body, tc.expected)
+			}
+		})
+	}
+}
+
+// TestCombinerHandlerUTF8Names checks that UTF-8 metric and label names from
+// upstreams are only escaped for clients that don't accept them.
+func TestCombinerHandlerUTF8Names(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# TYPE \"http.server.requests\" counter\n{\"http.server.requests\",\"http.route\"=\"/\"} 5\n")
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		name     string
+		accept   string
+		filter   Filter
+		expected string
+	}{
+		{
+			name:     "Escaped by default",
+			expected: "# TYPE http_server_requests counter\nhttp_server_requests{http_route=\"/\"} 5\n",
+		},
+		{
+			name:     "UTF-8 allowed",
+			accept:   "text/plain;version=1.0.0;escaping=allow-utf-8",
+			expected: "# TYPE \"http.server.requests\" counter\n{\"http.server.requests\",\"http.route\"=\"/\"} 5\n",
+		},
+		{
+			name:     "Filtered by UTF-8 names",
+			filter:   Filter{Prefixes: []string{"http.server"}, KeepSeries: []string{`{"http.route"="/"}`}},
+			expected: "# TYPE http_server_requests counter\nhttp_server_requests{http_route=\"/\"} 5\n",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			agg, err := New(staticTargets([]string{server.URL}), Options{Filter: tc.filter})
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			req.Header.Set("Accept", tc.accept)
+			rr := httptest.NewRecorder()
+			agg.ServeHTTP(rr, req)
+			if body := rr.Body.String(); body != tc.expected {
+				t.Errorf("handler returned unexpected body: got %q want %q", body, tc.expected)
+			}
+		})
+	}
+}
+
+// TestCombinerHandlerOpenMetrics checks that OpenMetrics is served when requested.
+func TestCombinerHandlerOpenMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "metric_a 1")
+	}))
+	defer server.Close()
+
+	agg, err := newCombiner(staticTargets([]string{server.URL}), options{})
+	if err != nil {
+		t.Fatalf("newCombiner failed: %v", err)
+	}
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text;version=1.0.0")
+	rr := httptest.NewRecorder()
+	agg.ServeHTTP(rr, req)
+
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text; version=1.0.0") {
+		t.Errorf("handler returned wrong content type: got %q", ct)
+	}
+	if body := rr.Body.String(); !strings.HasSuffix(body, "# EOF\n") {
+		t.Errorf("handler response does not end with # EOF. Body:\n%s", body)
+	}
+}
+
+// TestCombinerHandlerProtobuf checks that protobuf is accepted from upstreams and served when requested.
+func TestCombinerHandlerProtobuf(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := expfmt.Negotiate(r.Header)
+		w.Header().Set("Content-Type", string(format))
+		enc := expfmt.NewEncoder(w, format)
+		enc.Encode(&dto.MetricFamily{
+			Name:   proto.String("metric_proto"),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+		})
+	}))
+	defer server.Close()
+
+	agg, err := newCombiner(staticTargets([]string{server.URL}), options{})
+	if err != nil {
+		t.Fatalf("newCombiner failed: %v", err)
+	}
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited")
+	rr := httptest.NewRecorder()
+	agg.ServeHTTP(rr, req)
+
+	format := expfmt.ResponseFormat(rr.Header())
+	if format.FormatType() != expfmt.TypeProtoDelim {
+		t.Fatalf("handler returned wrong content type: got %q", rr.Header().Get("Content-Type"))
+	}
+	families, err := parseMetrics(rr.Body, format)
+	if err != nil {
+		t.Fatalf("parseMetrics failed: %v", err)
+	}
+	if len(families) != 1 || families[0].GetName() != "metric_proto" || families[0].Metric[0].GetGauge().GetValue() != 1 {
+		t.Errorf("handler returned unexpected metrics: %v", families)
+	}
+}
+
+// TestCombinerSetTargets checks that replacing targets keeps the state of unchanged ones.
+func TestCombinerSetTargets(t *testing.T) {
+	agg, err := newCombiner(staticTargets([]string{"http://a", "http://b"}), options{breakerThreshold: 1})
+	if err != nil {
+		t.Fatalf("newCombiner failed: %v", err)
+	}
+	old := agg.currentTargets()
+	old[0].recordFetch(lastFetch{start: time.Unix(100, 0)})
+
+	if err := agg.SetTargets(staticTargets([]string{"http://a", "http://c"})); err != nil {
+		t.Fatalf("SetTargets failed: %v", err)
+	}
+	targets := agg.currentTargets()
+	if len(targets) != 2 || targets[0].url != "http://a" || targets[1].url != "http://c" {
+		t.Fatalf("SetTargets did not replace the targets: %v", targets)
+	}
+	if targets[0].breaker != old[0].breaker || !targets[0].lastSuccessTime().Equal(time.Unix(100, 0)) {
+		t.Error("state of an unchanged target was not kept")
+	}
+	if targets[1].breaker == nil {
+		t.Error("new target has no circuit breaker")
+	}
+
+	invalid := []Target{{URL: "http://d", TLSConfig: TLSConfig{CAFile: "/nonexistent/ca.pem"}}}
+	if err := agg.SetTargets(invalid); err == nil {
+		t.Error("expected an error for an invalid target")
+	}
+	if len(agg.currentTargets()) != 2 {
+		t.Error("targets were changed by a failed SetTargets")
+	}
+}
+
+// TestCombinerServeStale tests serving a target's last successfully fetched
+// metrics when fetching it fails.
+func TestCombinerServeStale(t *testing.T) {
+	testCases := []struct {
+		name           string
+		policy         string
+		maxAge         time.Duration
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "Disabled", policy: StalenessOmit, maxAge: 0, expectedStatus: http.StatusInternalServerError, expectedBody: "Failed to fetch one or more upstream services.\n"},
+		{name: "Within max age", policy: StalenessCache, maxAge: time.Hour, expectedStatus: http.StatusOK, expectedBody: "# TYPE metric_a untyped\nmetric_a{env=\"prod\"} 1\n"},
+		{name: "Too old", policy: StalenessCache, maxAge: time.Nanosecond, expectedStatus: http.StatusInternalServerError, expectedBody: "Failed to fetch one or more upstream services.\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var failing atomic.Bool
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if failing.Load() {
+					http.Error(w, "internal server error", http.StatusInternalServerError)
+					return
+				}
+				fmt.Fprintln(w, "metric_a 1")
+			}))
+			defer server.Close()
+
+			targets := []Target{{URL: server.URL, Labels: map[string]string{"env": "prod"}}}
+			agg, err := newCombiner(targets, options{serveStaleMaxAge: tc.maxAge, stalenessPolicy: tc.policy, dropLabels: []string{"env"}})
+			if err != nil {
+				t.Fatalf("newCombiner failed: %v", err)
+			}
+
+			agg.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+			time.Sleep(time.Millisecond)
+			failing.Store(true)
+
+			// The last metrics must not have been modified by -drop-label
+			agg.dropLabels = nil
+			rr := httptest.NewRecorder()
+			agg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d", tc.expectedStatus, rr.Code)
+			}
+			if rr.Body.String() != tc.expectedBody {
+				t.Errorf("got %q, want %q", rr.Body.String(), tc.expectedBody)
+			}
+		})
+	}
+}
+
+// TestCombinerMinSuccess tests partial results are only served if enough
+// targets succeed.
+func TestCombinerMinSuccess(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "metric_a 1")
+	}))
+	defer healthy.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	// 4 of 5 targets succeed
+	urls := []string{healthy.URL + "/1", healthy.URL + "/2", failing.URL, healthy.URL + "/3", healthy.URL + "/4"}
+
+	testCases := []struct {
+		name           string
+		minSuccess     SuccessThreshold
+		expectedStatus int
+	}{
+		{"Default", SuccessThreshold{}, http.StatusOK},
+		{"Count met", SuccessThreshold{Count: 4}, http.StatusOK},
+		{"Count not met", SuccessThreshold{Count: 5}, http.StatusInternalServerError},
+		{"Percent met", SuccessThreshold{Percent: 80}, http.StatusOK},
+		{"Percent not met", SuccessThreshold{Percent: 81}, http.StatusInternalServerError},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			agg, err := newCombiner(staticTargets(urls), options{minSuccess: tc.minSuccess})
+			if err != nil {
+				t.Fatalf("newCombiner failed: %v", err)
+			}
+			rr := httptest.NewRecorder()
+			agg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d: %s", tc.expectedStatus, rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
+// TestCombinerFailedTargetsHeader tests the targets that failed are listed in
+// a header of partial responses in each mode.
+func TestCombinerFailedTargetsHeader(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "metric_a 1")
+	}))
+	defer healthy.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	testCases := []struct {
+		name     string
+		urls     []string
+		opts     options
+		expected string
+	}{
+		{name: "Disabled", urls: []string{healthy.URL, failing.URL}, opts: options{}, expected: ""},
+		{name: "All succeeded", urls: []string{healthy.URL, healthy.URL + "/b"}, opts: options{failedTargetsHeader: true}, expected: ""},
+		{name: "Partial", urls: []string{failing.URL, healthy.URL, failing.URL + "/b"}, opts: options{failedTargetsHeader: true}, expected: failing.URL + ", " + failing.URL + "/b"},
+		{name: "Cached", urls: []string{healthy.URL, failing.URL}, opts: options{failedTargetsHeader: true, cacheTTL: time.Hour}, expected: failing.URL},
+		{name: "Background scrape", urls: []string{healthy.URL, failing.URL}, opts: options{failedTargetsHeader: true, scrapeInterval: time.Hour}, expected: failing.URL},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			agg, err := newCombiner(staticTargets(tc.urls), tc.opts)
+			if err != nil {
+				t.Fatalf("newCombiner failed: %v", err)
+			}
+			if tc.opts.scrapeInterval > 0 {
+				agg.scrape(context.Background())
+			}
+			// The second request is served from the cache
+			for range 2 {
+				rr := httptest.NewRecorder()
+				agg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+				if rr.Code != http.StatusOK {
+					t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+				}
+				if got := rr.Header().Get(FailedTargetsHeader); got != tc.expected {
+					t.Errorf("got %s header %q, want %q", FailedTargetsHeader, got, tc.expected)
+				}
+			}
+		})
+	}
+}
+
+// TestCombinerSelectTargets tests combining only the targets given in the
+// target query parameter.
+func TestCombinerSelectTargets(t *testing.T) {
+	var urls []string
+	for _, name := range []string{"a", "b", "c"} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "metric_%s 1\n", name)
+		}))
+		defer server.Close()
+		urls = append(urls, server.URL)
+	}
+	host := strings.TrimPrefix(urls[2], "http://")
+
+	testCases := []struct {
+		name           string
+		query          url.Values
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "All targets",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "# TYPE metric_a untyped\nmetric_a 1\n# TYPE metric_b untyped\nmetric_b 1\n# TYPE metric_c untyped\nmetric_c 1\n",
+		},
+		{
+			name:           "URL and host",
+			query:          url.Values{"target": {host, urls[0]}},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "# TYPE metric_a untyped\nmetric_a 1\n# TYPE metric_c untyped\nmetric_c 1\n",
+		},
+		{
+			name:           "Unknown target",
+			query:          url.Values{"target": {urls[0], "http://other"}},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "Invalid target parameter: unknown target \"http://other\"\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Selecting targets bypasses the cache
+			agg, err := newCombiner(staticTargets(urls), options{cacheTTL: time.Hour})
+			if err != nil {
+				t.Fatalf("newCombiner failed: %v", err)
+			}
+			agg.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+
+			rr := httptest.NewRecorder()
+			agg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics?"+tc.query.Encode(), nil))
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d", tc.expectedStatus, rr.Code)
+			}
+			if rr.Body.String() != tc.expectedBody {
+				t.Errorf("got %q, want %q", rr.Body.String(), tc.expectedBody)
+			}
+		})
+	}
+}
+
+// TestCombinerForwardParams tests forwarding allowlisted query parameters
+// to the upstreams.
+func TestCombinerForwardParams(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "upstream_query{query=%q} 1\n", r.URL.RawQuery)
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		name         string
+		query        string
+		expectedBody string
+	}{
+		{
+			name:         "No parameters",
+			expectedBody: "# TYPE upstream_query untyped\nupstream_query{query=\"a=1&collect%5B%5D=x\"} 1\n",
+		},
+		{
+			name:         "Forwarded parameter replaces the target's",
+			query:        "collect[]=y&collect[]=z&other=1",
+			expectedBody: "# TYPE upstream_query untyped\nupstream_query{query=\"a=1&collect%5B%5D=y&collect%5B%5D=z\"} 1\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			agg, err := newCombiner(staticTargets([]string{server.URL + "?a=1&collect%5B%5D=x"}), options{forwardParams: []string{"collect[]"}})
+			if err != nil {
+				t.Fatalf("newCombiner failed: %v", err)
+			}
+			rr := httptest.NewRecorder()
+			agg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics?"+tc.query, nil))
+			if rr.Body.String() != tc.expectedBody {
+				t.Errorf("got %q, want %q", rr.Body.String(), tc.expectedBody)
+			}
+		})
+	}
+}
+
+// TestCombinerMatchParam tests filtering the combined series with match[]
+// selectors.
+func TestCombinerMatchParam(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `node_load1{job="db"} 1`)
+		fmt.Fprintln(w, `node_load1{job="web"} 2`)
+		fmt.Fprintln(w, `process_open_fds{job="db"} 3`)
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		name           string
+		match          []string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "Name and label",
+			match:          []string{`{__name__=~"node_.*",job="db"}`},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "# TYPE node_load1 untyped\nnode_load1{job=\"db\"} 1\n",
+		},
+		{
+			name:           "Any of several selectors",
+			match:          []string{`node_load1{job="web"}`, `process_open_fds`},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "# TYPE node_load1 untyped\nnode_load1{job=\"web\"} 2\n# TYPE process_open_fds untyped\nprocess_open_fds{job=\"db\"} 3\n",
+		},
+		{
+			name:           "Invalid selector",
+			match:          []string{`{job=}`},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	// The cached result must not be modified by the filtering
+	agg, err := newCombiner(staticTargets([]string{server.URL}), options{cacheTTL: time.Hour})
+	if err != nil {
+		t.Fatalf("newCombiner failed: %v", err)
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			agg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics?"+url.Values{"match[]": tc.match}.Encode(), nil))
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d", tc.expectedStatus, rr.Code)
+			}
+			if tc.expectedStatus == http.StatusOK && rr.Body.String() != tc.expectedBody {
+				t.Errorf("got %q, want %q", rr.Body.String(), tc.expectedBody)
+			}
+		})
+	}
+}
+
+// TestScrapeTimeout tests how the Prometheus scrape timeout header limits the configured timeout.
+func TestScrapeTimeout(t *testing.T) {
+	testCases := []struct {
+		name     string
+		header   string
+		timeout  time.Duration
+		offset   time.Duration
+		expected time.Duration
+	}{
+		{"No header", "", 10 * time.Second, 0, 10 * time.Second},
+		{"Shorter header", "2.5", 10 * time.Second, 0, 2500 * time.Millisecond},
+		{"Longer header", "30", 10 * time.Second, 0, 10 * time.Second},
+		{"Header with timeout disabled", "5", 0, 0, 5 * time.Second},
+		{"Invalid header", "abc", 10 * time.Second, 0, 10 * time.Second},
+		{"Header with offset", "2.5", 10 * time.Second, 500 * time.Millisecond, 2 * time.Second},
+		{"Offset without header", "", 10 * time.Second, 500 * time.Millisecond, 10 * time.Second},
+		{"Offset longer than header", "0.2", 10 * time.Second, 500 * time.Millisecond, 200 * time.Millisecond},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			if tc.header != "" {
+				req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", tc.header)
+			}
+			if got := scrapeTimeout(req, tc.timeout, tc.offset); got != tc.expected {
+				t.Errorf("scrapeTimeout returned wrong value: got %v want %v", got, tc.expected)
+			}
+		})
+	}
+}
+
+// TestCombinerMaxConcurrentFetches tests that no more than the maximum
+// number of upstreams are fetched at the same time.
+func TestCombinerMaxConcurrentFetches(t *testing.T) {
+	var current, peak atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := current.Add(1)
+		defer current.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprintf(w, "metric%s 1\n", strings.ReplaceAll(r.URL.Path, "/", "_"))
+	}))
+	defer server.Close()
+
+	var urls []string
+	for i := range 10 {
+		urls = append(urls, fmt.Sprintf("%s/%d", server.URL, i))
+	}
+	agg, err := newCombiner(staticTargets(urls), options{maxConcurrentFetches: 3})
+	if err != nil {
+		t.Fatalf("newCombiner failed: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	agg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+
+	if n := strings.Count(rr.Body.String(), " 1\n"); n != 10 {
+		t.Errorf("expected metrics from 10 upstreams, got %d. Body:\n%s", n, rr.Body.String())
+	}
+	if p := peak.Load(); p > 3 {
+		t.Errorf("expected at most 3 concurrent fetches, got %d", p)
+	}
+}
+
+// TestCountingReader tests counting and limiting the bytes read.
+func TestCountingReader(t *testing.T) {
+	testCases := []struct {
+		name          string
+		input         string
+		limit         int
+		expectedCount int
+		expectedError error
+	}{
+		{name: "No limit", input: "0123456789", limit: 0, expectedCount: 10},
+		{name: "Under limit", input: "0123456789", limit: 20, expectedCount: 10},
+		{name: "At limit", input: "0123456789", limit: 10, expectedCount: 10},
+		{name: "Over limit", input: "0123456789", limit: 5, expectedCount: 6, expectedError: errBodyTooLarge},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &countingReader{r: strings.NewReader(tc.input), limit: tc.limit}
+			_, err := io.ReadAll(c)
+			if err != tc.expectedError {
+				t.Errorf("expected error %v, got %v", tc.expectedError, err)
+			}
+			if c.n != tc.expectedCount {
+				t.Errorf("expected %d bytes read, got %d", tc.expectedCount, c.n)
+			}
+		})
+	}
+}
+
+// TestCombinerMaxBodySize tests that upstreams with bodies over the maximum
+// size are treated as failed, including when the body is compressed.
+func TestCombinerMaxBodySize(t *testing.T) {
+	large := strings.Repeat("metric_large 1\n", 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			fmt.Fprint(w, "metric_small 1\n")
+		case "/large":
+			fmt.Fprint(w, large)
+		case "/gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			fmt.Fprint(gz, large)
+			gz.Close()
+		}
+	}))
+	defer server.Close()
+
+	urls := []string{server.URL + "/small", server.URL + "/large", server.URL + "/gzip"}
+	agg, err := newCombiner(staticTargets(urls), options{maxBodySize: 100})
+	if err != nil {
+		t.Fatalf("newCombiner failed: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	agg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+
+	if expected := "# TYPE metric_small untyped\nmetric_small 1\n"; rr.Body.String() != expected {
+		t.Errorf("got %q, want %q", rr.Body.String(), expected)
+	}
+	if n := agg.currentTargets()[1].scrapeErrorCount(); n != 1 {
+		t.Errorf("expected the large body to be recorded as an error, got %d errors", n)
+	}
+}
+
+// fetchString fetches url with fetchURL and reads the whole body.
+func fetchString(ctx context.Context, client *http.Client, url string) (string, expfmt.Format, error) {
+	body, format, err := fetchURL(ctx, client, url)
+	if err != nil {
+		return "", "", err
+	}
+	defer body.Close()
+	b, err := io.ReadAll(body)
+	return string(b), format, err
+}
+
+// TestFetchURL tests the URL fetching logic in isolation.
+func TestFetchURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/success":
+			fmt.Fprint(w, "ok")
+		case "/gzip":
+			if r.Header.Get("Accept-Encoding") != "gzip" {
+				http.Error(w, "gzip not accepted", http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			fmt.Fprint(gz, "compressed")
+			gz.Close()
+		case "/bad-gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+			fmt.Fprint(w, "not compressed")
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	t.Run("Successful fetch", func(t *testing.T) {
+		body, _, err := fetchString(context.Background(), http.DefaultClient, server.URL+"/success")
+		if err != nil {
+			t.Errorf("expected no error, but got: %v", err)
+		}
+		if body != "ok" {
+			t.Errorf("expected body 'ok', but got: '%s'", body)
+		}
+	})
+
+	t.Run("Gzip compressed fetch", func(t *testing.T) {
+		body, _, err := fetchString(context.Background(), http.DefaultClient, server.URL+"/gzip")
+		if err != nil {
+			t.Errorf("expected no error, but got: %v", err)
+		}
+		if body != "compressed" {
+			t.Errorf("expected body 'compressed', but got: '%s'", body)
+		}
+	})
+
+	t.Run("Invalid gzip body", func(t *testing.T) {
+		_, _, err := fetchString(context.Background(), http.DefaultClient, server.URL+"/bad-gzip")
+		if err == nil {
+			t.Fatal("expected an error, but got none")
+		}
+	})
+
+	t.Run("Failed fetch with bad status", func(t *testing.T) {
+		_, _, err := fetchString(context.Background(), http.DefaultClient, server.URL+"/fail")
+		if err == nil {
+			t.Fatal("expected an error, but got none")
+		}
+		if !strings.Contains(err.Error(), "bad status") {
+			t.Errorf("error message should contain 'bad status', but got: %v", err)
+		}
+	})
+}
+
+// TestCombinerTargets tests the status of each target after a fetch.
+func TestCombinerTargets(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "metric_a 1\n")
+	}))
+	defer healthy.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	c, err := New(staticTargets([]string{healthy.URL, failing.URL, "http://unfetched"}), Options{})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	// Only fetch the first two targets
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics?target="+healthy.URL+"&target="+failing.URL, nil))
+
+	statuses := c.Targets()
+	if len(statuses) != 3 {
+		t.Fatalf("expected 3 targets, got %d", len(statuses))
+	}
+	if s := statuses[0]; s.Health() != HealthUp || s.LastScrape.IsZero() || s.LastSuccess.IsZero() || s.LastScrapeBytes != 11 || s.LastError != nil {
+		t.Errorf("unexpected status for the healthy target: %+v", s)
+	}
+	if s := statuses[1]; s.Health() != HealthDown || s.LastError == nil || !s.LastSuccess.IsZero() || s.ScrapeErrors != 1 {
+		t.Errorf("unexpected status for the failing target: %+v", s)
+	}
+	if s := statuses[2]; s.Health() != HealthUnknown || !s.LastScrape.IsZero() {
+		t.Errorf("unexpected status for the unfetched target: %+v", s)
+	}
+}
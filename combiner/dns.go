@@ -0,0 +1,206 @@
+package combiner
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrDNS is wrapped by the errors of fetches that failed because the
+// upstream's host name couldn't be resolved, to tell them apart from
+// connection and HTTP failures.
+var ErrDNS = errors.New("failed to resolve upstream host")
+
+// dnsError returns err wrapped with ErrDNS if it is a resolution failure.
+func dnsError(err error) error {
+	var dnsErr *net.DNSError
+	if err == nil || errors.Is(err, ErrDNS) || !errors.As(err, &dnsErr) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrDNS, err)
+}
+
+// IP families for connecting to upstreams.
+const (
+	// IPFamilyDual connects to IPv4 and IPv6 addresses, racing them if a
+	// host has both. With Options.DNSRefreshInterval set they are tried one
+	// at a time instead.
+	IPFamilyDual = "dual"
+	// IPFamilyIPv4 only connects to IPv4 addresses.
+	IPFamilyIPv4 = "ipv4"
+	// IPFamilyIPv6 only connects to IPv6 addresses.
+	IPFamilyIPv6 = "ipv6"
+	// IPFamilyPreferIPv4 tries the IPv4 addresses of a host before its IPv6
+	// addresses.
+	IPFamilyPreferIPv4 = "prefer-ipv4"
+	// IPFamilyPreferIPv6 tries the IPv6 addresses of a host before its IPv4
+	// addresses.
+	IPFamilyPreferIPv6 = "prefer-ipv6"
+)
+
+// IPFamilies lists all IP families.
+var IPFamilies = []string{IPFamilyDual, IPFamilyIPv4, IPFamilyIPv6, IPFamilyPreferIPv4, IPFamilyPreferIPv6}
+
+// orderAddrs returns the addresses that can be connected to with family, in
+// the order they should be tried.
+func orderAddrs(addrs []netip.Addr, family string) []netip.Addr {
+	is4 := func(addr netip.Addr) bool { return addr.Unmap().Is4() }
+	switch family {
+	case IPFamilyIPv4:
+		return slices.DeleteFunc(slices.Clone(addrs), func(addr netip.Addr) bool { return !is4(addr) })
+	case IPFamilyIPv6:
+		return slices.DeleteFunc(slices.Clone(addrs), is4)
+	case IPFamilyPreferIPv4, IPFamilyPreferIPv6:
+		ordered := slices.Clone(addrs)
+		slices.SortStableFunc(ordered, func(a, b netip.Addr) int {
+			if is4(a) == is4(b) {
+				return 0
+			}
+			if is4(a) == (family == IPFamilyPreferIPv4) {
+				return -1
+			}
+			return 1
+		})
+		return ordered
+	}
+	return addrs
+}
+
+// hostResolver looks up the addresses of a host, it is implemented by
+// net.Resolver.
+type hostResolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// dnsEntry is the cached addresses of a host.
+type dnsEntry struct {
+	addrs    []netip.Addr
+	resolved time.Time
+}
+
+// hostDialer resolves the host names of upstreams itself rather than leaving
+// it to the dialer, so the addresses can be cached and ordered by IP family.
+// With a refresh interval the addresses are reused for new connections until
+// it has passed, instead of resolving them for every connection.
+type hostDialer struct {
+	refresh  time.Duration
+	family   string
+	resolver hostResolver
+	now      func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+// newHostDialer creates a dialer that connects to the addresses of family,
+// caching them until they're older than refresh if it isn't 0.
+func newHostDialer(refresh time.Duration, family string) *hostDialer {
+	return &hostDialer{refresh: refresh, family: family, resolver: net.DefaultResolver, now: time.Now, entries: make(map[string]dnsEntry)}
+}
+
+// lookup returns the addresses of host, resolving it if caching is disabled,
+// it isn't cached or the cached addresses are older than the refresh
+// interval. If resolving it again fails the previous addresses are used, so a
+// DNS outage doesn't take down upstreams that are still reachable.
+func (d *hostDialer) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	d.mu.Lock()
+	entry, ok := d.entries[host]
+	d.mu.Unlock()
+	if ok && d.now().Sub(entry.resolved) < d.refresh {
+		return entry.addrs, nil
+	}
+
+	addrs, err := d.resolver.LookupNetIP(ctx, "ip", host)
+	if err == nil && len(addrs) == 0 {
+		err = errors.New("no addresses found")
+	}
+	if err != nil {
+		if ok {
+			slog.Warn("Failed to resolve upstream host again, using the previous addresses", "host", host, "err", err)
+			return entry.addrs, nil
+		}
+		return nil, fmt.Errorf("%w %s: %w", ErrDNS, host, err)
+	}
+
+	if d.refresh > 0 {
+		d.mu.Lock()
+		d.entries[host] = dnsEntry{addrs: addrs, resolved: d.now()}
+		d.mu.Unlock()
+	}
+	return addrs, nil
+}
+
+// forget removes host from the cache, so it is resolved again for the next
+// connection.
+func (d *hostDialer) forget(host string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.entries, host)
+}
+
+// dialContext returns a dial function that resolves host names with lookup
+// and connects to each address of the IP family in turn with dial. If none
+// of the addresses can be connected to the host is forgotten, since its
+// addresses may have changed.
+func (d *hostDialer) dialContext(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return dial(ctx, network, address)
+		}
+		if addr, err := netip.ParseAddr(host); err == nil {
+			if len(orderAddrs([]netip.Addr{addr}, d.family)) == 0 {
+				return nil, fmt.Errorf("can't connect to %s with IP family %s", addr, d.family)
+			}
+			return dial(ctx, network, address)
+		}
+
+		addrs, err := d.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var errs []error
+		for _, addr := range orderAddrs(addrs, d.family) {
+			if (network == "tcp4" && !addr.Unmap().Is4()) || (network == "tcp6" && addr.Unmap().Is4()) {
+				continue
+			}
+			conn, err := dial(ctx, network, net.JoinHostPort(addr.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				return nil, errors.Join(errs...)
+			}
+		}
+		d.forget(host)
+		if len(errs) == 0 {
+			return nil, fmt.Errorf("%w %s: no addresses for IP family %s and network %s", ErrDNS, host, cmp.Or(d.family, IPFamilyDual), network)
+		}
+		return nil, errors.Join(errs...)
+	}
+}
+
+// transport returns a copy of base, or http.DefaultTransport if it is nil,
+// that connects to upstreams with the dialer.
+func (d *hostDialer) transport(base *http.Transport) *http.Transport {
+	if base == nil {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+	transport := base.Clone()
+	dial := base.DialContext
+	if dial == nil {
+		// The same settings as http.DefaultTransport
+		dial = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	}
+	transport.DialContext = d.dialContext(dial)
+	return transport
+}
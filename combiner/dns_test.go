@@ -0,0 +1,235 @@
+package combiner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// fakeResolver returns fixed addresses for each host and counts the lookups.
+type fakeResolver struct {
+	hosts   map[string][]netip.Addr
+	err     error
+	lookups int
+}
+
+// LookupNetIP implements hostResolver.
+func (r *fakeResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	r.lookups++
+	if r.err != nil {
+		return nil, r.err
+	}
+	addrs, ok := r.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+// TestHostDialerLookup tests host names are only resolved again after the
+// refresh interval, and the previous addresses are used if that fails.
+func TestHostDialerLookup(t *testing.T) {
+	resolver := &fakeResolver{hosts: map[string][]netip.Addr{"exporter": {netip.MustParseAddr("10.0.0.1")}}}
+	now := time.Unix(0, 0)
+	dialer := newHostDialer(time.Minute, "")
+	dialer.resolver = resolver
+	dialer.now = func() time.Time { return now }
+
+	lookup := func() netip.Addr {
+		t.Helper()
+		addrs, err := dialer.lookup(context.Background(), "exporter")
+		if err != nil {
+			t.Fatalf("lookup failed: %v", err)
+		}
+		return addrs[0]
+	}
+
+	lookup()
+	now = now.Add(30 * time.Second)
+	lookup()
+	if resolver.lookups != 1 {
+		t.Errorf("expected 1 lookup within the refresh interval, got %d", resolver.lookups)
+	}
+
+	resolver.hosts["exporter"] = []netip.Addr{netip.MustParseAddr("10.0.0.2")}
+	now = now.Add(time.Minute)
+	if addr := lookup(); addr.String() != "10.0.0.2" {
+		t.Errorf("expected the new address after the refresh interval, got %s", addr)
+	}
+
+	resolver.err = errors.New("server misbehaving")
+	now = now.Add(time.Minute)
+	if addr := lookup(); addr.String() != "10.0.0.2" {
+		t.Errorf("expected the previous address when resolving fails, got %s", addr)
+	}
+
+	_, err := dialer.lookup(context.Background(), "unknown")
+	if !errors.Is(err, ErrDNS) {
+		t.Errorf("expected an ErrDNS error, got %v", err)
+	}
+}
+
+// TestHostDialerDial tests connections use the cached addresses, and a host is
+// resolved again once none of its addresses can be connected to.
+func TestHostDialerDial(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("url.Parse failed: %v", err)
+	}
+	addr := netip.MustParseAddr(u.Hostname())
+
+	resolver := &fakeResolver{hosts: map[string][]netip.Addr{"exporter": {addr}}}
+	dialer := newHostDialer(time.Hour, "")
+	dialer.resolver = resolver
+	var dialed []string
+	dial := dialer.dialContext(func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = append(dialed, address)
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	})
+
+	for range 2 {
+		conn, err := dial(context.Background(), "tcp", net.JoinHostPort("exporter", u.Port()))
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		conn.Close()
+	}
+	if resolver.lookups != 1 {
+		t.Errorf("expected 1 lookup, got %d", resolver.lookups)
+	}
+	if expected := u.Host; dialed[0] != expected || dialed[1] != expected {
+		t.Errorf("expected connections to %s, got %v", expected, dialed)
+	}
+
+	server.Close()
+	if _, err := dial(context.Background(), "tcp", net.JoinHostPort("exporter", u.Port())); err == nil {
+		t.Fatal("expected dialing a closed server to fail")
+	}
+	if _, err := dial(context.Background(), "tcp", net.JoinHostPort("exporter", u.Port())); err == nil {
+		t.Fatal("expected dialing a closed server to fail")
+	}
+	if resolver.lookups != 2 {
+		t.Errorf("expected the host to be resolved again after failing to connect, got %d lookups", resolver.lookups)
+	}
+}
+
+// TestCombinerDNSErrors tests fetches that fail to resolve the upstream are
+// counted separately.
+func TestCombinerDNSErrors(t *testing.T) {
+	testCases := []struct {
+		name     string
+		interval time.Duration
+	}{
+		{name: "Without a cache"},
+		{name: "With a cache", interval: time.Minute},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			target := "http://combiner-test.invalid/metrics"
+			agg, err := New(staticTargets([]string{target}), Options{SelfMetrics: true, DNSRefreshInterval: tc.interval})
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			rr := httptest.NewRecorder()
+			agg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+
+			if err := agg.Targets()[0].LastError; !errors.Is(err, ErrDNS) {
+				t.Errorf("expected an ErrDNS error, got %v", err)
+			}
+			if count := agg.currentTargets()[0].dnsErrorCount(); count != 1 {
+				t.Errorf("expected 1 DNS error, got %d", count)
+			}
+		})
+	}
+}
+
+// TestDNSError tests only resolution failures are classified as DNS errors.
+func TestDNSError(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "DNS error", err: &url.Error{Op: "Get", URL: "http://a", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "a"}}}, expected: true},
+		{name: "Already classified", err: fmt.Errorf("%w a: timeout", ErrDNS), expected: true},
+		{name: "Connection refused", err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}},
+		{name: "No error"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := errors.Is(dnsError(tc.err), ErrDNS); got != tc.expected {
+				t.Errorf("got %v, want %v", got, tc.expected)
+			}
+		})
+	}
+}
+
+// TestOrderAddrs tests the addresses are filtered and ordered by IP family.
+func TestOrderAddrs(t *testing.T) {
+	addrs := []netip.Addr{
+		netip.MustParseAddr("2001:db8::1"),
+		netip.MustParseAddr("10.0.0.1"),
+		netip.MustParseAddr("2001:db8::2"),
+		netip.MustParseAddr("::ffff:10.0.0.2"),
+	}
+	testCases := []struct {
+		family   string
+		expected string
+	}{
+		{family: "", expected: "[2001:db8::1 10.0.0.1 2001:db8::2 ::ffff:10.0.0.2]"},
+		{family: IPFamilyDual, expected: "[2001:db8::1 10.0.0.1 2001:db8::2 ::ffff:10.0.0.2]"},
+		{family: IPFamilyIPv4, expected: "[10.0.0.1 ::ffff:10.0.0.2]"},
+		{family: IPFamilyIPv6, expected: "[2001:db8::1 2001:db8::2]"},
+		{family: IPFamilyPreferIPv4, expected: "[10.0.0.1 ::ffff:10.0.0.2 2001:db8::1 2001:db8::2]"},
+		{family: IPFamilyPreferIPv6, expected: "[2001:db8::1 2001:db8::2 10.0.0.1 ::ffff:10.0.0.2]"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.family, func(t *testing.T) {
+			if got := fmt.Sprint(orderAddrs(addrs, tc.family)); got != tc.expected {
+				t.Errorf("got %s, want %s", got, tc.expected)
+			}
+		})
+	}
+}
+
+// TestHostDialerIPFamily tests only addresses of the IP family are connected
+// to.
+func TestHostDialerIPFamily(t *testing.T) {
+	resolver := &fakeResolver{hosts: map[string][]netip.Addr{"exporter": {netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("10.0.0.1")}}}
+	testCases := []struct {
+		family   string
+		address  string
+		expected []string
+	}{
+		{family: IPFamilyIPv4, address: "exporter:9100", expected: []string{"10.0.0.1:9100"}},
+		{family: IPFamilyPreferIPv6, address: "exporter:9100", expected: []string{"[2001:db8::1]:9100", "10.0.0.1:9100"}},
+		{family: IPFamilyIPv6, address: "10.0.0.1:9100"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.family, func(t *testing.T) {
+			dialer := newHostDialer(0, tc.family)
+			dialer.resolver = resolver
+			var dialed []string
+			dial := dialer.dialContext(func(ctx context.Context, network, address string) (net.Conn, error) {
+				dialed = append(dialed, address)
+				return nil, errors.New("connection refused")
+			})
+			if _, err := dial(context.Background(), "tcp", tc.address); err == nil {
+				t.Fatal("expected dialing to fail")
+			}
+			if fmt.Sprint(dialed) != fmt.Sprint(tc.expected) {
+				t.Errorf("dialed %v, want %v", dialed, tc.expected)
+			}
+		})
+	}
+}
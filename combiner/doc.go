@@ -0,0 +1,43 @@
+// Package combiner fetches Prometheus metrics from several upstream
+// endpoints and combines them into a single exposition, so a Go service can
+// serve the metrics of its sidecars or child processes without running the
+// prometheus-metrics-combiner binary.
+//
+// Each upstream is described by a Target, which holds its URL and how to
+// reach it: TLS, authentication, extra headers and a proxy. A Target can also
+// add labels or a metric name prefix to everything fetched from it.
+//
+// A Combiner fetches its targets, merges the metric families they return and
+// serves the result as an http.Handler. It is created with New, and its
+// targets can be replaced at any time with SetTargets, for example from
+// service discovery. Options control how the targets are fetched and
+// combined: the Filter selecting metrics and series, timeouts, circuit
+// breakers, caching, how duplicate series are resolved and whether self
+// metrics are added. With Options.ScrapeInterval set the Combiner runs in
+// background mode, where Run fetches the targets on an interval and requests
+// are served the latest result. Gather returns the combined metrics for use
+// outside of HTTP, and RunPusher sends them to a Pusher such as a
+// RemoteWriter. Close cancels fetches still running in the background when
+// the Combiner is no longer needed.
+//
+// A Transformer modifies the combined metrics before they are served or
+// pushed, after the filters, scales and aggregations in Options. Add one to
+// Options.Transformers to rename metrics or add synthetic ones, using
+// TransformerFunc to implement it with a function.
+//
+// For a fixed set of targets NewHandler builds a Combiner from a Config and
+// starts any background scrapes and pushes, which is the simplest way to
+// embed the combined metrics in an existing mux:
+//
+//	handler, err := combiner.NewHandler(ctx, combiner.Config{
+//		Targets: []combiner.Target{
+//			{URL: "http://localhost:9100/metrics"},
+//			{URL: "http://localhost:9187/metrics", Labels: map[string]string{"job": "postgres"}},
+//		},
+//		Options: combiner.Options{Timeout: 10 * time.Second},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	mux.Handle("/metrics", handler)
+package combiner
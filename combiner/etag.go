@@ -0,0 +1,42 @@
+package combiner
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+)
+
+// familiesETag returns a strong ETag for families encoded in format. It
+// hashes the families rather than the encoded output so the response can
+// still be streamed.
+func familiesETag(families []*dto.MetricFamily, format expfmt.Format) (string, error) {
+	h := fnv.New64a()
+	fmt.Fprintln(h, format)
+	opts := proto.MarshalOptions{Deterministic: true}
+	var buf []byte
+	for _, mf := range families {
+		var err error
+		if buf, err = opts.MarshalAppend(buf[:0], mf); err != nil {
+			return "", fmt.Errorf("failed to hash %s: %w", mf.GetName(), err)
+		}
+		fmt.Fprintf(h, "%d:", len(buf))
+		h.Write(buf)
+	}
+	return fmt.Sprintf(`"%016x"`, h.Sum64()), nil
+}
+
+// etagMatches reports whether an If-None-Match header matches etag, using
+// the weak comparison required for If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
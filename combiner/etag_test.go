@@ -0,0 +1,97 @@
+package combiner
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// TestFamiliesETag tests that the ETag changes with the metrics and format.
+func TestFamiliesETag(t *testing.T) {
+	etag := func(input string, format expfmt.Format) string {
+		families, err := parseMetrics(strings.NewReader(input), expfmt.FmtText)
+		if err != nil {
+			t.Fatalf("parseMetrics failed: %v", err)
+		}
+		etag, err := familiesETag(families, format)
+		if err != nil {
+			t.Fatalf("familiesETag failed: %v", err)
+		}
+		return etag
+	}
+
+	base := etag("metric_a 1\nmetric_b 2\n", expfmt.FmtText)
+	if again := etag("metric_b 2\nmetric_a 1\n", expfmt.FmtText); again != base {
+		t.Errorf("expected the same metrics to have the same ETag, got %s and %s", base, again)
+	}
+	if changed := etag("metric_a 1\nmetric_b 3\n", expfmt.FmtText); changed == base {
+		t.Error("expected a different value to change the ETag")
+	}
+	if openMetrics := etag("metric_a 1\nmetric_b 2\n", expfmt.FmtOpenMetrics_1_0_0); openMetrics == base {
+		t.Error("expected a different format to change the ETag")
+	}
+}
+
+// TestEtagMatches tests matching If-None-Match headers.
+func TestEtagMatches(t *testing.T) {
+	testCases := []struct {
+		ifNoneMatch string
+		expected    bool
+	}{
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"xyz", "abc"`, true},
+		{`*`, true},
+		{`"xyz"`, false},
+		{`abc`, false},
+	}
+
+	for _, tc := range testCases {
+		if got := etagMatches(tc.ifNoneMatch, `"abc"`); got != tc.expected {
+			t.Errorf("etagMatches(%s): expected %v, got %v", tc.ifNoneMatch, tc.expected, got)
+		}
+	}
+}
+
+// TestCombinerHandlerETag tests returning 304 Not Modified for a matching ETag.
+func TestCombinerHandlerETag(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "metric_a 1")
+	}))
+	defer server.Close()
+
+	agg, err := newCombiner(staticTargets([]string{server.URL}), options{})
+	if err != nil {
+		t.Fatalf("newCombiner failed: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	agg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	etag := rr.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag in the response")
+	}
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	agg.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("expected status %d, got %d", http.StatusNotModified, rr.Code)
+	}
+	if rr.Body.Len() != 0 {
+		t.Errorf("expected an empty body, got %q", rr.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("If-None-Match", `"other"`)
+	rr = httptest.NewRecorder()
+	agg.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status %d for a different ETag, got %d", http.StatusOK, rr.Code)
+	}
+}
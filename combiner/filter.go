@@ -0,0 +1,109 @@
+package combiner
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// MetricTypes maps the metric type names used by Filter to their types.
+var MetricTypes = map[string]dto.MetricType{
+	"counter":        dto.MetricType_COUNTER,
+	"gauge":          dto.MetricType_GAUGE,
+	"summary":        dto.MetricType_SUMMARY,
+	"untyped":        dto.MetricType_UNTYPED,
+	"histogram":      dto.MetricType_HISTOGRAM,
+	"gaugehistogram": dto.MetricType_GAUGE_HISTOGRAM,
+}
+
+// Filter selects the metrics and series included in the output. The zero
+// value includes everything.
+type Filter struct {
+	// Prefixes and MatchRegexes select the metrics to include by name, if
+	// neither is set all metrics are included. Regular expressions must match
+	// the whole name.
+	Prefixes     []string `yaml:"prefixes"`
+	MatchRegexes []string `yaml:"match_regexes"`
+	// ExcludePrefixes and ExcludeRegexes remove metrics from those selected.
+	ExcludePrefixes []string `yaml:"exclude_prefixes"`
+	ExcludeRegexes  []string `yaml:"exclude_regexes"`
+	// IncludeTypes selects the metrics to include by type, for example
+	// counter and gauge, and ExcludeTypes removes metrics of these types. The
+	// names are the keys of MetricTypes.
+	IncludeTypes []string `yaml:"include_types"`
+	ExcludeTypes []string `yaml:"exclude_types"`
+	// KeepSeries and DropSeries are series selectors such as
+	// {env="prod"}. If KeepSeries is set only series matching one of them are
+	// included, and series matching one of DropSeries are removed.
+	KeepSeries []string `yaml:"keep_series"`
+	DropSeries []string `yaml:"drop_series"`
+	// DropLabels are removed from every series after filtering.
+	DropLabels []string `yaml:"drop_labels"`
+}
+
+// Validate checks the regular expressions, metric types and series selectors
+// are valid.
+func (c Filter) Validate() error {
+	_, _, err := c.compile()
+	return err
+}
+
+// compile parses the regular expressions, metric types and series selectors.
+func (c Filter) compile() (familyFilter, seriesFilter, error) {
+	filter := familyFilter{prefixes: c.Prefixes, excludePrefixes: c.ExcludePrefixes}
+	for _, expr := range c.MatchRegexes {
+		re, err := compileAnchoredRegex(expr)
+		if err != nil {
+			return filter, seriesFilter{}, fmt.Errorf("invalid match regex %q: %w", expr, err)
+		}
+		filter.regexes = append(filter.regexes, re)
+	}
+	for _, expr := range c.ExcludeRegexes {
+		re, err := compileAnchoredRegex(expr)
+		if err != nil {
+			return filter, seriesFilter{}, fmt.Errorf("invalid exclude regex %q: %w", expr, err)
+		}
+		filter.excludeRegexes = append(filter.excludeRegexes, re)
+	}
+	var err error
+	if filter.types, err = parseMetricTypes(c.IncludeTypes); err != nil {
+		return filter, seriesFilter{}, err
+	}
+	if filter.excludeTypes, err = parseMetricTypes(c.ExcludeTypes); err != nil {
+		return filter, seriesFilter{}, err
+	}
+
+	var series seriesFilter
+	for _, s := range c.KeepSeries {
+		sel, err := parseSelector(s)
+		if err != nil {
+			return filter, series, err
+		}
+		series.keep = append(series.keep, sel)
+	}
+	for _, s := range c.DropSeries {
+		sel, err := parseSelector(s)
+		if err != nil {
+			return filter, series, err
+		}
+		series.drop = append(series.drop, sel)
+	}
+	return filter, series, nil
+}
+
+// parseMetricTypes converts metric type names to their types.
+func parseMetricTypes(names []string) ([]dto.MetricType, error) {
+	var types []dto.MetricType
+	for _, name := range names {
+		typ, ok := MetricTypes[name]
+		if !ok {
+			valid := slices.Sorted(maps.Keys(MetricTypes))
+			return nil, fmt.Errorf("invalid metric type %q, must be one of %s", name, strings.Join(valid, ", "))
+		}
+		types = append(types, typ)
+	}
+	return types, nil
+}
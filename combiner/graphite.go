@@ -0,0 +1,103 @@
+package combiner
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// graphitePathReplacer replaces characters that would change the hierarchy of
+// a Graphite metric path, or can't be used in one.
+var graphitePathReplacer = strings.NewReplacer(".", "_", " ", "_", "/", "_", ";", "_", "\t", "_", "\n", "_")
+
+// graphiteTagReplacer replaces characters that can't be used in Graphite tag
+// values.
+var graphiteTagReplacer = strings.NewReplacer(";", "_", "~", "_", " ", "_", "\t", "_", "\n", "_")
+
+// GraphitePusher sends metrics to a Carbon server using the Graphite
+// plaintext protocol.
+type GraphitePusher struct {
+	address string
+	// prefix is prepended to every metric path.
+	prefix string
+	// tags sends labels as Graphite tags instead of path components.
+	tags bool
+	// now returns the current time, it can be overridden in tests.
+	now func() time.Time
+}
+
+// NewGraphitePusher creates a Pusher for the Carbon plaintext listener at
+// address.
+func NewGraphitePusher(address, prefix string, tags bool) *GraphitePusher {
+	return &GraphitePusher{address: address, prefix: prefix, tags: tags, now: time.Now}
+}
+
+// Push implements Pusher, opening a new connection for every push. Samples
+// without a timestamp are sent with the current time.
+func (g *GraphitePusher) Push(ctx context.Context, families []*dto.MetricFamily) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", g.address)
+	if err != nil {
+		return fmt.Errorf("failed to connect to Carbon at %s: %w", g.address, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetWriteDeadline(deadline); err != nil {
+			return err
+		}
+	}
+
+	w := bufio.NewWriter(conn)
+	if err := g.write(w, families); err != nil {
+		return fmt.Errorf("failed to send metrics to Carbon at %s: %w", g.address, err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to send metrics to Carbon at %s: %w", g.address, err)
+	}
+	return nil
+}
+
+// write writes families as Graphite plaintext lines. Graphite can't store
+// NaN or infinite values so those samples are skipped.
+func (g *GraphitePusher) write(w *bufio.Writer, families []*dto.MetricFamily) error {
+	now := g.now().Unix()
+	for _, s := range flattenFamilies(families) {
+		if math.IsNaN(s.value) || math.IsInf(s.value, 0) {
+			continue
+		}
+		timestamp := now
+		if s.timestampMs != 0 {
+			timestamp = s.timestampMs / 1000
+		}
+		if _, err := fmt.Fprintf(w, "%s %s %d\n", g.path(s), strconv.FormatFloat(s.value, 'f', -1, 64), timestamp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// path returns the Graphite metric path of a sample. Labels are either
+// appended as name.value path components or as name=value tags.
+func (g *GraphitePusher) path(s flatSample) string {
+	var b strings.Builder
+	b.WriteString(g.prefix)
+	b.WriteString(s.name)
+	for _, l := range s.labels {
+		if l.GetValue() == "" {
+			continue
+		}
+		if g.tags {
+			b.WriteString(";" + l.GetName() + "=" + graphiteTagReplacer.Replace(l.GetValue()))
+		} else {
+			b.WriteString("." + l.GetName() + "." + graphitePathReplacer.Replace(l.GetValue()))
+		}
+	}
+	return b.String()
+}
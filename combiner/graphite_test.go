@@ -0,0 +1,93 @@
+package combiner
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// TestGraphitePusher tests sending metrics in the Graphite plaintext format.
+func TestGraphitePusher(t *testing.T) {
+	input := `# TYPE http_requests_total counter
+http_requests_total{path="/api/v1",code="200"} 5
+http_requests_total{path="/",code=""} 2 1700000000123
+# TYPE temperature gauge
+temperature{room="living room"} NaN
+`
+
+	testCases := []struct {
+		name     string
+		prefix   string
+		tags     bool
+		expected string
+	}{
+		{
+			name:   "Path components",
+			prefix: "prometheus.",
+			expected: "prometheus.http_requests_total.code.200.path._api_v1 5 1800000000\n" +
+				"prometheus.http_requests_total.path._ 2 1700000000\n",
+		},
+		{
+			name: "Tags",
+			tags: true,
+			expected: "http_requests_total;code=200;path=/api/v1 5 1800000000\n" +
+				"http_requests_total;path=/ 2 1700000000\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("failed to listen: %v", err)
+			}
+			defer listener.Close()
+			received := make(chan string, 1)
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					received <- err.Error()
+					return
+				}
+				defer conn.Close()
+				b, _ := io.ReadAll(conn)
+				received <- string(b)
+			}()
+
+			families, err := parseMetrics(strings.NewReader(input), expfmt.FmtText)
+			if err != nil {
+				t.Fatalf("parseMetrics failed: %v", err)
+			}
+			g := NewGraphitePusher(listener.Addr().String(), tc.prefix, tc.tags)
+			g.now = func() time.Time { return time.Unix(1800000000, 0) }
+			if err := g.Push(context.Background(), families); err != nil {
+				t.Fatalf("push failed: %v", err)
+			}
+
+			if got := <-received; got != tc.expected {
+				t.Errorf("got %q, want %q", got, tc.expected)
+			}
+		})
+	}
+}
+
+// TestGraphitePusherConnectionRefused tests that failing to connect is an
+// error.
+func TestGraphitePusherConnectionRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	err = NewGraphitePusher(address, "", false).Push(context.Background(), nil)
+	if err == nil || !strings.Contains(err.Error(), "failed to connect") {
+		t.Errorf("expected error containing 'failed to connect', got: %v", err)
+	}
+}
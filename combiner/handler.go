@@ -0,0 +1,59 @@
+package combiner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Config is the complete configuration of a combined metrics handler.
+type Config struct {
+	// Targets are the upstreams to fetch and combine.
+	Targets []Target
+	Options
+	// Pushes send the combined metrics to other systems in the background.
+	Pushes []PushConfig
+}
+
+// PushConfig sends the combined metrics with Pusher every Interval.
+type PushConfig struct {
+	// Name identifies the output in logs and traces.
+	Name     string
+	Interval time.Duration
+	Pusher   Pusher
+}
+
+// NewHandler creates a handler serving the combined metrics of cfg.Targets,
+// for mounting on an existing mux alongside other handlers. If
+// cfg.ScrapeInterval or cfg.Pushes are set the background scrapes and pushes
+// are started, and run until ctx is cancelled. Cancelling ctx also cancels
+// upstream fetches shared between requests. Use New instead to change the
+// targets while running.
+func NewHandler(ctx context.Context, cfg Config) (http.Handler, error) {
+	for _, p := range cfg.Pushes {
+		if p.Pusher == nil {
+			return nil, fmt.Errorf("push %q has no pusher", p.Name)
+		}
+		if p.Interval <= 0 {
+			return nil, fmt.Errorf("push %q interval must be positive", p.Name)
+		}
+	}
+	if len(cfg.Targets) == 0 {
+		return nil, errors.New("at least one target is required")
+	}
+
+	c, err := New(cfg.Targets, cfg.Options)
+	if err != nil {
+		return nil, err
+	}
+	context.AfterFunc(ctx, c.Close)
+	if cfg.ScrapeInterval > 0 {
+		go c.Run(ctx)
+	}
+	for _, p := range cfg.Pushes {
+		go c.RunPusher(ctx, p.Name, p.Interval, p.Pusher)
+	}
+	return c, nil
+}
@@ -0,0 +1,100 @@
+package combiner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// TestNewHandler tests mounting the combined metrics on an existing mux.
+func TestNewHandler(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "upstream_metric 1")
+		fmt.Fprintln(w, "other_metric 2")
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pushed := make(chan []*dto.MetricFamily, 1)
+	handler, err := NewHandler(ctx, Config{
+		Targets: []Target{{URL: server.URL, Labels: map[string]string{"source": "test"}}},
+		Options: Options{
+			Filter:         Filter{Prefixes: []string{"upstream_"}},
+			ScrapeInterval: time.Hour,
+		},
+		Pushes: []PushConfig{{Name: "test", Interval: time.Hour, Pusher: pushFunc(func(ctx context.Context, families []*dto.MetricFamily) error {
+			pushed <- families
+			return nil
+		})}},
+	})
+	if err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+
+	select {
+	case families := <-pushed:
+		if len(families) != 1 || families[0].GetName() != "upstream_metric" {
+			t.Errorf("unexpected families pushed: %v", families)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a push")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/combined", handler)
+	mux.HandleFunc("/other", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "other")
+	})
+
+	// The first background scrape runs as soon as the handler is created
+	expected := "# TYPE upstream_metric untyped\nupstream_metric{source=\"test\"} 1\n"
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", "/combined", nil))
+		if rr.Code == http.StatusOK && rr.Body.String() == expected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d %q, want %q", rr.Code, rr.Body.String(), expected)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/other", nil))
+	if rr.Body.String() != "other" {
+		t.Errorf("other handler returned %q", rr.Body.String())
+	}
+}
+
+// TestNewHandlerInvalidConfig tests invalid configurations are rejected.
+func TestNewHandlerInvalidConfig(t *testing.T) {
+	targets := []Target{{URL: "http://a"}}
+	push := pushFunc(func(ctx context.Context, families []*dto.MetricFamily) error { return nil })
+
+	testCases := []struct {
+		name string
+		cfg  Config
+	}{
+		{"No targets", Config{}},
+		{"Invalid target", Config{Targets: []Target{{URL: "http://a", LabelConflict: "replace"}}}},
+		{"Invalid options", Config{Targets: targets, Options: Options{DuplicatePolicy: "max"}}},
+		{"Push without pusher", Config{Targets: targets, Pushes: []PushConfig{{Name: "test", Interval: time.Minute}}}},
+		{"Push without interval", Config{Targets: targets, Pushes: []PushConfig{{Name: "test", Pusher: push}}}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewHandler(context.Background(), tc.cfg); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package combiner
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// influxContentType is the Content-Type of InfluxDB line protocol responses.
+const influxContentType = "text/plain; charset=utf-8"
+
+// influxMeasurementReplacer escapes InfluxDB line protocol measurement names.
+var influxMeasurementReplacer = strings.NewReplacer(",", `\,`, " ", `\ `)
+
+// influxTagReplacer escapes InfluxDB line protocol tag keys and values.
+var influxTagReplacer = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+
+// writeInflux writes families as InfluxDB line protocol, in the same layout
+// as InfluxDB's own Prometheus integration: the metric name is the
+// measurement, labels are tags and the sample is the value field. Histograms
+// and summaries are split into their _bucket, _sum and _count series. Samples
+// without a timestamp are written without one so the receiver uses its own,
+// and NaN and infinite values are skipped since they can't be stored.
+func writeInflux(w io.Writer, families []*dto.MetricFamily) error {
+	bw := bufio.NewWriter(w)
+	for _, s := range flattenFamilies(families) {
+		if math.IsNaN(s.value) || math.IsInf(s.value, 0) {
+			continue
+		}
+		bw.WriteString(influxMeasurementReplacer.Replace(s.name))
+		for _, l := range s.labels {
+			// Empty tag values aren't allowed, and mean the label isn't set
+			if l.GetValue() == "" {
+				continue
+			}
+			bw.WriteString("," + influxTagReplacer.Replace(l.GetName()) + "=" + influxTagReplacer.Replace(l.GetValue()))
+		}
+		bw.WriteString(" value=" + strconv.FormatFloat(s.value, 'g', -1, 64))
+		if s.timestampMs != 0 {
+			bw.WriteString(" " + strconv.FormatInt(s.timestampMs*1e6, 10))
+		}
+		if err := bw.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
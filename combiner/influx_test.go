@@ -0,0 +1,128 @@
+package combiner
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// TestWriteInflux tests converting metrics to InfluxDB line protocol.
+func TestWriteInflux(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "Labels as tags",
+			input:    "# TYPE http_requests_total counter\nhttp_requests_total{path=\"/a b\",code=\"200\",empty=\"\"} 5\n",
+			expected: "http_requests_total,code=200,path=/a\\ b value=5\n",
+		},
+		{
+			name:     "Escaped tag values",
+			input:    "metric{v=\"a,b=c\"} 1.5 1700000000123\n",
+			expected: "metric,v=a\\,b\\=c value=1.5 1700000000123000000\n",
+		},
+		{
+			name:     "Histogram",
+			input:    "# TYPE size histogram\nsize_bucket{le=\"1\"} 2\nsize_bucket{le=\"+Inf\"} 5\nsize_sum 12\nsize_count 5\n",
+			expected: "size_bucket,le=1 value=2\nsize_bucket,le=+Inf value=5\nsize_sum value=12\nsize_count value=5\n",
+		},
+		{
+			name:     "Non-finite values",
+			input:    "a NaN\nb +Inf\nc 1e+30\n",
+			expected: "c value=1e+30\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			families, err := parseMetrics(strings.NewReader(tc.input), expfmt.FmtText)
+			if err != nil {
+				t.Fatalf("parseMetrics failed: %v", err)
+			}
+			var buf strings.Builder
+			if err := writeInflux(&buf, families); err != nil {
+				t.Fatalf("writeInflux failed: %v", err)
+			}
+			if buf.String() != tc.expected {
+				t.Errorf("got %q, want %q", buf.String(), tc.expected)
+			}
+		})
+	}
+}
+
+// TestCombinerFormatParam tests selecting the output format with the
+// format query parameter.
+func TestCombinerFormatParam(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "upstream_metric{env=\"prod\"} 1")
+	}))
+	defer server.Close()
+
+	agg, err := newCombiner(staticTargets([]string{server.URL}), options{})
+	if err != nil {
+		t.Fatalf("newCombiner failed: %v", err)
+	}
+
+	testCases := []struct {
+		name                string
+		query               string
+		accept              string
+		expectedStatus      int
+		expectedContentType string
+		expectedBody        string
+	}{
+		{
+			name:                "Influx",
+			query:               "format=influx",
+			expectedStatus:      http.StatusOK,
+			expectedContentType: influxContentType,
+			expectedBody:        "upstream_metric,env=prod value=1\n",
+		},
+		{
+			name:                "JSON",
+			query:               "format=json",
+			expectedStatus:      http.StatusOK,
+			expectedContentType: jsonContentType,
+			expectedBody:        `[{"name":"upstream_metric","type":"UNTYPED","metrics":[{"labels":{"env":"prod"},"value":"1"}]}]` + "\n",
+		},
+		{
+			name:                "JSON from the Accept header",
+			accept:              "application/json",
+			expectedStatus:      http.StatusOK,
+			expectedContentType: jsonContentType,
+			expectedBody:        `[{"name":"upstream_metric","type":"UNTYPED","metrics":[{"labels":{"env":"prod"},"value":"1"}]}]` + "\n",
+		},
+		{
+			name:           "Unknown format",
+			query:          "format=xml",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "Invalid format parameter: \"xml\"\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/metrics?"+tc.query, nil)
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			rr := httptest.NewRecorder()
+			agg.ServeHTTP(rr, req)
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d", tc.expectedStatus, rr.Code)
+			}
+			if tc.expectedContentType != "" && rr.Header().Get("Content-Type") != tc.expectedContentType {
+				t.Errorf("expected Content-Type '%s', got '%s'", tc.expectedContentType, rr.Header().Get("Content-Type"))
+			}
+			if rr.Body.String() != tc.expectedBody {
+				t.Errorf("got %q, want %q", rr.Body.String(), tc.expectedBody)
+			}
+		})
+	}
+}
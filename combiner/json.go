@@ -0,0 +1,110 @@
+package combiner
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// jsonContentType is the Content-Type of JSON responses.
+const jsonContentType = "application/json"
+
+// jsonFamily is a metric family in the JSON output, in the same layout as
+// prom2json.
+type jsonFamily struct {
+	Name    string       `json:"name"`
+	Help    string       `json:"help,omitempty"`
+	Type    string       `json:"type"`
+	Metrics []jsonMetric `json:"metrics"`
+}
+
+// jsonMetric is a single series in the JSON output. Numbers are strings so
+// NaN and infinite values can be represented. Counters, gauges and untyped
+// metrics have a value, summaries have quantiles and histograms have buckets.
+type jsonMetric struct {
+	Labels      map[string]string `json:"labels,omitempty"`
+	TimestampMs string            `json:"timestamp_ms,omitempty"`
+	Value       string            `json:"value,omitempty"`
+	Quantiles   map[string]string `json:"quantiles,omitempty"`
+	Buckets     map[string]string `json:"buckets,omitempty"`
+	Count       string            `json:"count,omitempty"`
+	Sum         string            `json:"sum,omitempty"`
+}
+
+// acceptsJSON reports whether an Accept header lists application/json.
+func acceptsJSON(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil || mediaType != jsonContentType {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// writeJSON writes families as a JSON array.
+func writeJSON(w io.Writer, families []*dto.MetricFamily) error {
+	result := make([]jsonFamily, 0, len(families))
+	for _, mf := range families {
+		family := jsonFamily{Name: mf.GetName(), Help: mf.GetHelp(), Type: mf.GetType().String(), Metrics: make([]jsonMetric, 0, len(mf.Metric))}
+		for _, m := range mf.Metric {
+			family.Metrics = append(family.Metrics, newJSONMetric(m))
+		}
+		result = append(result, family)
+	}
+	return json.NewEncoder(w).Encode(result)
+}
+
+// newJSONMetric converts a metric to its JSON representation.
+func newJSONMetric(m *dto.Metric) jsonMetric {
+	var metric jsonMetric
+	if len(m.Label) > 0 {
+		metric.Labels = make(map[string]string, len(m.Label))
+		for _, l := range m.Label {
+			metric.Labels[l.GetName()] = l.GetValue()
+		}
+	}
+	if m.TimestampMs != nil {
+		metric.TimestampMs = strconv.FormatInt(m.GetTimestampMs(), 10)
+	}
+
+	switch {
+	case m.Counter != nil:
+		metric.Value = formatFloat(m.Counter.GetValue())
+	case m.Gauge != nil:
+		metric.Value = formatFloat(m.Gauge.GetValue())
+	case m.Untyped != nil:
+		metric.Value = formatFloat(m.Untyped.GetValue())
+	case m.Summary != nil:
+		metric.Quantiles = make(map[string]string, len(m.Summary.Quantile))
+		for _, q := range m.Summary.Quantile {
+			metric.Quantiles[formatFloat(q.GetQuantile())] = formatFloat(q.GetValue())
+		}
+		metric.Count = strconv.FormatUint(m.Summary.GetSampleCount(), 10)
+		metric.Sum = formatFloat(m.Summary.GetSampleSum())
+	case m.Histogram != nil:
+		h := m.Histogram
+		metric.Buckets = make(map[string]string, len(h.Bucket))
+		for _, b := range h.Bucket {
+			value := strconv.FormatUint(b.GetCumulativeCount(), 10)
+			if b.CumulativeCountFloat != nil {
+				value = formatFloat(b.GetCumulativeCountFloat())
+			}
+			metric.Buckets[formatFloat(b.GetUpperBound())] = value
+		}
+		metric.Count = strconv.FormatUint(h.GetSampleCount(), 10)
+		if h.SampleCountFloat != nil {
+			metric.Count = formatFloat(h.GetSampleCountFloat())
+		}
+		metric.Sum = formatFloat(h.GetSampleSum())
+	}
+	return metric
+}
@@ -0,0 +1,73 @@
+package combiner
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// TestWriteJSON tests converting metrics to JSON.
+func TestWriteJSON(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "Counter",
+			input:    "# HELP requests_total Requests.\n# TYPE requests_total counter\nrequests_total{code=\"200\"} 5 1700000000000\nrequests_total{code=\"500\"} NaN\n",
+			expected: `[{"name":"requests_total","help":"Requests.","type":"COUNTER","metrics":[{"labels":{"code":"200"},"timestamp_ms":"1700000000000","value":"5"},{"labels":{"code":"500"},"value":"NaN"}]}]`,
+		},
+		{
+			name:     "Summary",
+			input:    "# TYPE latency summary\nlatency{quantile=\"0.5\"} 0.2\nlatency_sum 10\nlatency_count 40\n",
+			expected: `[{"name":"latency","type":"SUMMARY","metrics":[{"quantiles":{"0.5":"0.2"},"count":"40","sum":"10"}]}]`,
+		},
+		{
+			name:     "Histogram",
+			input:    "# TYPE size histogram\nsize_bucket{le=\"1\"} 2\nsize_bucket{le=\"+Inf\"} 5\nsize_sum 12\nsize_count 5\n",
+			expected: `[{"name":"size","type":"HISTOGRAM","metrics":[{"buckets":{"+Inf":"5","1":"2"},"count":"5","sum":"12"}]}]`,
+		},
+		{
+			name:     "No metrics",
+			expected: `[]`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			families, err := parseMetrics(strings.NewReader(tc.input), expfmt.FmtText)
+			if err != nil {
+				t.Fatalf("parseMetrics failed: %v", err)
+			}
+			var buf strings.Builder
+			if err := writeJSON(&buf, families); err != nil {
+				t.Fatalf("writeJSON failed: %v", err)
+			}
+			if got := strings.TrimSpace(buf.String()); got != tc.expected {
+				t.Errorf("got %s, want %s", got, tc.expected)
+			}
+		})
+	}
+}
+
+// TestAcceptsJSON tests detecting requests for JSON in the Accept header.
+func TestAcceptsJSON(t *testing.T) {
+	testCases := []struct {
+		accept   string
+		expected bool
+	}{
+		{accept: "", expected: false},
+		{accept: "application/json", expected: true},
+		{accept: "text/html, application/json;q=0.9", expected: true},
+		{accept: "application/json;q=0", expected: false},
+		{accept: "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5,*/*;q=0.1", expected: false},
+	}
+
+	for _, tc := range testCases {
+		if got := acceptsJSON(tc.accept); got != tc.expected {
+			t.Errorf("acceptsJSON(%q) = %v, want %v", tc.accept, got, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,483 @@
+package combiner
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+)
+
+// acceptHeader is the Accept header sent to upstreams, preferring the
+// protobuf format since it's the only one that can carry native histograms.
+// UTF-8 metric and label names are allowed so upstreams don't escape them.
+const acceptHeader = `application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;escaping=allow-utf-8;q=0.7,text/plain;version=0.0.4;escaping=allow-utf-8;q=0.3,*/*;q=0.2`
+
+// parseMetrics decodes metric families in the given exposition format, unknown
+// formats are parsed as the Prometheus text format. UTF-8 metric and label
+// names are accepted, whether or not the format says so, and are escaped when
+// writing if the client doesn't support them. The families are sorted by name
+// so the output for an upstream is stable.
+func parseMetrics(r io.Reader, format expfmt.Format) ([]*dto.MetricFamily, error) {
+	var families []*dto.MetricFamily
+	dec := expfmt.NewDecoder(r, format.WithEscapingScheme(model.NoEscaping))
+	for {
+		mf := &dto.MetricFamily{}
+		if err := dec.Decode(mf); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		families = append(families, mf)
+	}
+	slices.SortFunc(families, func(a, b *dto.MetricFamily) int {
+		return strings.Compare(a.GetName(), b.GetName())
+	})
+	return families, nil
+}
+
+// familyFilter selects metric families by name and type.
+type familyFilter struct {
+	// prefixes and regexes select families, if both are empty all families
+	// are selected.
+	prefixes []string
+	regexes  []*regexp.Regexp
+	// excludePrefixes and excludeRegexes remove families that were selected.
+	excludePrefixes []string
+	excludeRegexes  []*regexp.Regexp
+	// types selects families with one of these types, if empty all types are
+	// selected, and families with one of excludeTypes are removed.
+	types        []dto.MetricType
+	excludeTypes []dto.MetricType
+}
+
+// includes reports whether the family is selected.
+func (f familyFilter) includes(mf *dto.MetricFamily) bool {
+	name := mf.GetName()
+	if (len(f.prefixes) > 0 || len(f.regexes) > 0) && !matchesName(name, f.prefixes, f.regexes) {
+		return false
+	}
+	if len(f.types) > 0 && !slices.Contains(f.types, mf.GetType()) {
+		return false
+	}
+	return !matchesName(name, f.excludePrefixes, f.excludeRegexes) && !slices.Contains(f.excludeTypes, mf.GetType())
+}
+
+// filterFamilies returns the families selected by filter.
+func filterFamilies(families []*dto.MetricFamily, filter familyFilter) []*dto.MetricFamily {
+	var filtered []*dto.MetricFamily
+	for _, mf := range families {
+		if filter.includes(mf) {
+			filtered = append(filtered, mf)
+		}
+	}
+	return filtered
+}
+
+// matchesName reports whether name starts with one of the prefixes or matches
+// one of the regexes.
+func matchesName(name string, prefixes []string, regexes []*regexp.Regexp) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	for _, re := range regexes {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileAnchoredRegex compiles a regular expression that must match the
+// whole string, like regexes in Prometheus.
+func compileAnchoredRegex(expr string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+// Policies for target labels that are already present on a series.
+const (
+	// LabelConflictOverwrite replaces the series' label with the target label.
+	LabelConflictOverwrite = "overwrite"
+	// LabelConflictKeep keeps the series' label, like honor_labels in Prometheus.
+	LabelConflictKeep = "keep"
+	// LabelConflictRename renames the series' label to exported_<name>, like
+	// Prometheus does by default.
+	LabelConflictRename = "rename"
+)
+
+// LabelConflictPolicies lists all label conflict policies.
+var LabelConflictPolicies = []string{LabelConflictOverwrite, LabelConflictKeep, LabelConflictRename}
+
+// addLabels adds labels to every metric in families, resolving labels that are
+// already present using policy. An empty policy is the same as overwrite. The
+// labels of each metric are sorted by name.
+func addLabels(families []*dto.MetricFamily, labels map[string]string, policy string) {
+	if len(labels) == 0 {
+		return
+	}
+
+	names := slices.Sorted(maps.Keys(labels))
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			for _, name := range names {
+				i := slices.IndexFunc(m.Label, func(l *dto.LabelPair) bool { return l.GetName() == name })
+				if i < 0 {
+					m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(labels[name])})
+					continue
+				}
+
+				switch policy {
+				case LabelConflictKeep:
+				case LabelConflictRename:
+					m.Label[i] = &dto.LabelPair{Name: proto.String(exportedLabelName(m.Label, name)), Value: m.Label[i].Value}
+					m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(labels[name])})
+				default:
+					m.Label[i] = &dto.LabelPair{Name: proto.String(name), Value: proto.String(labels[name])}
+				}
+			}
+			slices.SortFunc(m.Label, func(a, b *dto.LabelPair) int {
+				return strings.Compare(a.GetName(), b.GetName())
+			})
+		}
+	}
+}
+
+// exportedLabelName returns the name a conflicting label is renamed to,
+// prepending exported_ until it doesn't clash with another label.
+func exportedLabelName(labels []*dto.LabelPair, name string) string {
+	for {
+		name = model.ExportedLabelPrefix + name
+		if !slices.ContainsFunc(labels, func(l *dto.LabelPair) bool { return l.GetName() == name }) {
+			return name
+		}
+	}
+}
+
+// removeLabels removes the named labels from every metric in families.
+func removeLabels(families []*dto.MetricFamily, names []string) {
+	if len(names) == 0 {
+		return
+	}
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			m.Label = slices.DeleteFunc(m.Label, func(l *dto.LabelPair) bool {
+				return slices.Contains(names, l.GetName())
+			})
+		}
+	}
+}
+
+// cloneFamilies returns a deep copy of families.
+func cloneFamilies(families []*dto.MetricFamily) []*dto.MetricFamily {
+	cloned := make([]*dto.MetricFamily, len(families))
+	for i, mf := range families {
+		cloned[i] = proto.Clone(mf).(*dto.MetricFamily)
+	}
+	return cloned
+}
+
+// setTimestamps sets the timestamp of every metric in families that doesn't
+// have one to t.
+func setTimestamps(families []*dto.MetricFamily, t time.Time) {
+	ms := t.UnixMilli()
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			if m.TimestampMs == nil {
+				m.TimestampMs = proto.Int64(ms)
+			}
+		}
+	}
+}
+
+// withoutTimestamps returns families with the timestamps of all metrics
+// removed. Families without timestamps are returned as is, the others are
+// copied.
+func withoutTimestamps(families []*dto.MetricFamily) []*dto.MetricFamily {
+	result := make([]*dto.MetricFamily, len(families))
+	for i, mf := range families {
+		result[i] = mf
+		for _, m := range mf.Metric {
+			if m.TimestampMs != nil {
+				mf = proto.Clone(mf).(*dto.MetricFamily)
+				for _, m := range mf.Metric {
+					m.TimestampMs = nil
+				}
+				result[i] = mf
+				break
+			}
+		}
+	}
+	return result
+}
+
+// prefixNames prepends prefix to the name of every family.
+func prefixNames(families []*dto.MetricFamily, prefix string) {
+	if prefix == "" {
+		return
+	}
+	for _, mf := range families {
+		mf.Name = proto.String(prefix + mf.GetName())
+	}
+}
+
+// encodeMetrics encodes metric families in the given exposition format.
+func encodeMetrics(families []*dto.MetricFamily, format expfmt.Format) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeFamilies(&buf, families, format); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeFamilies encodes metric families to w one at a time in the given
+// exposition format.
+func writeFamilies(w io.Writer, families []*dto.MetricFamily, format expfmt.Format) error {
+	enc := expfmt.NewEncoder(w, format)
+	for _, mf := range families {
+		if err := enc.Encode(mf); err != nil {
+			return fmt.Errorf("failed to encode %s: %w", mf.GetName(), err)
+		}
+	}
+	// Close writes the # EOF marker required by OpenMetrics
+	if closer, ok := enc.(expfmt.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Policies for resolving a series that is exposed by more than one upstream.
+const (
+	DuplicateFirst = "first"
+	DuplicateLast  = "last"
+	DuplicateSum   = "sum"
+	DuplicateError = "error"
+)
+
+// DuplicatePolicies lists all duplicate series policies.
+var DuplicatePolicies = []string{DuplicateFirst, DuplicateLast, DuplicateSum, DuplicateError}
+
+// mergeFamilies combines families with the same name into a single family so
+// that HELP and TYPE are only written once. The HELP and TYPE of the first
+// family seen are kept, families with a conflicting type are dropped since
+// their samples can't be represented under the first type. Series with the
+// same labels are resolved using policy, where first and last refer to the
+// order of families. The result is sorted by name.
+func mergeFamilies(families []*dto.MetricFamily, policy string) ([]*dto.MetricFamily, error) {
+	byName := make(map[string]*dto.MetricFamily)
+	var merged []*dto.MetricFamily
+	for _, mf := range families {
+		existing, ok := byName[mf.GetName()]
+		if !ok {
+			// Copy the family so the metrics of the original aren't modified
+			existing = &dto.MetricFamily{
+				Name:   mf.Name,
+				Help:   mf.Help,
+				Type:   mf.Type,
+				Unit:   mf.Unit,
+				Metric: slices.Clone(mf.Metric),
+			}
+			byName[mf.GetName()] = existing
+			merged = append(merged, existing)
+			continue
+		}
+
+		if existing.GetType() != mf.GetType() {
+			slog.Warn("Dropping metric family with a type that conflicts with another upstream", "metric", mf.GetName(), "type", mf.GetType(), "existing_type", existing.GetType())
+			continue
+		}
+		if existing.Help == nil {
+			existing.Help = mf.Help
+		}
+		existing.Metric = append(existing.Metric, mf.Metric...)
+	}
+
+	for _, mf := range merged {
+		if err := dedupeSeries(mf, policy); err != nil {
+			return nil, err
+		}
+	}
+
+	slices.SortFunc(merged, func(a, b *dto.MetricFamily) int {
+		return strings.Compare(a.GetName(), b.GetName())
+	})
+	return merged, nil
+}
+
+// dedupeSeries resolves metrics in a family with identical labels using
+// policy. An empty policy is the same as first. The family's metrics are
+// modified in place so it must not be shared.
+func dedupeSeries(mf *dto.MetricFamily, policy string) error {
+	index := make(map[string]int, len(mf.Metric))
+	metrics := mf.Metric[:0]
+	for _, m := range mf.Metric {
+		key := seriesKey(m)
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(metrics)
+			metrics = append(metrics, m)
+			continue
+		}
+
+		switch policy {
+		case DuplicateLast:
+			metrics[i] = m
+		case DuplicateSum:
+			summed, ok := sumMetrics(mf.GetType(), metrics[i], m)
+			if !ok {
+				slog.Warn("Cannot sum series, keeping the first", "series", seriesString(mf.GetName(), m), "type", mf.GetType())
+				continue
+			}
+			metrics[i] = summed
+		case DuplicateError:
+			return fmt.Errorf("duplicate series %s", seriesString(mf.GetName(), m))
+		}
+	}
+	mf.Metric = metrics
+	return nil
+}
+
+// seriesKey returns a key identifying a metric by its labels, independent of
+// the order of the labels.
+func seriesKey(m *dto.Metric) string {
+	pairs := make([]string, 0, len(m.Label))
+	for _, l := range m.Label {
+		pairs = append(pairs, l.GetName()+"\xff"+l.GetValue())
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, "\xfe")
+}
+
+// sortSeries sorts the metrics of each family by their labels, so the output
+// doesn't depend on the order upstreams expose series in. Labels are compared
+// in name order, then series with the same labels by timestamp. The families
+// are modified in place so they must not be shared.
+func sortSeries(families []*dto.MetricFamily) {
+	type keyed struct {
+		labels []*dto.LabelPair
+		metric *dto.Metric
+	}
+	for _, mf := range families {
+		series := make([]keyed, len(mf.Metric))
+		for i, m := range mf.Metric {
+			labels := slices.Clone(m.Label)
+			slices.SortFunc(labels, func(a, b *dto.LabelPair) int {
+				return strings.Compare(a.GetName(), b.GetName())
+			})
+			series[i] = keyed{labels, m}
+		}
+		slices.SortStableFunc(series, func(a, b keyed) int {
+			c := slices.CompareFunc(a.labels, b.labels, func(a, b *dto.LabelPair) int {
+				return cmp.Or(strings.Compare(a.GetName(), b.GetName()), strings.Compare(a.GetValue(), b.GetValue()))
+			})
+			return cmp.Or(c, cmp.Compare(a.metric.GetTimestampMs(), b.metric.GetTimestampMs()))
+		})
+		for i, s := range series {
+			mf.Metric[i] = s.metric
+		}
+	}
+}
+
+// seriesString formats a series for log and error messages.
+func seriesString(name string, m *dto.Metric) string {
+	labels := make([]string, 0, len(m.Label))
+	for _, l := range m.Label {
+		labels = append(labels, fmt.Sprintf("%s=%q", l.GetName(), l.GetValue()))
+	}
+	return name + "{" + strings.Join(labels, ",") + "}"
+}
+
+// sumMetrics returns a new metric with the labels of a and the sum of the
+// values of a and b. Only counters, gauges, untyped metrics and classic
+// histograms can be summed.
+func sumMetrics(typ dto.MetricType, a, b *dto.Metric) (*dto.Metric, bool) {
+	summed := proto.Clone(a).(*dto.Metric)
+	switch typ {
+	case dto.MetricType_COUNTER:
+		summed.Counter.Value = proto.Float64(a.GetCounter().GetValue() + b.GetCounter().GetValue())
+	case dto.MetricType_GAUGE:
+		summed.Gauge.Value = proto.Float64(a.GetGauge().GetValue() + b.GetGauge().GetValue())
+	case dto.MetricType_UNTYPED:
+		summed.Untyped.Value = proto.Float64(a.GetUntyped().GetValue() + b.GetUntyped().GetValue())
+	case dto.MetricType_HISTOGRAM:
+		return summed, sumHistograms(summed.Histogram, b.GetHistogram())
+	default:
+		return nil, false
+	}
+	return summed, true
+}
+
+// sumHistograms adds the counts and sum of the classic histogram b to a.
+// Buckets are cumulative, so only the bucket boundaries present in both can
+// be summed correctly and the others are removed from a. Native histograms
+// can't be summed, in which case it returns false.
+func sumHistograms(a, b *dto.Histogram) bool {
+	if a == nil || b == nil || isNativeHistogram(a) || isNativeHistogram(b) {
+		return false
+	}
+	counts := make(map[float64]*dto.Bucket, len(b.Bucket))
+	for _, bucket := range b.Bucket {
+		counts[bucket.GetUpperBound()] = bucket
+	}
+	buckets := a.Bucket[:0]
+	for _, bucket := range a.Bucket {
+		other, ok := counts[bucket.GetUpperBound()]
+		if !ok {
+			continue
+		}
+		if bucket.CumulativeCountFloat != nil || other.CumulativeCountFloat != nil {
+			bucket.CumulativeCountFloat = proto.Float64(bucketCount(bucket) + bucketCount(other))
+			bucket.CumulativeCount = nil
+		} else {
+			bucket.CumulativeCount = proto.Uint64(bucket.GetCumulativeCount() + other.GetCumulativeCount())
+		}
+		buckets = append(buckets, bucket)
+	}
+	a.Bucket = buckets
+
+	if a.SampleCountFloat != nil || b.SampleCountFloat != nil {
+		a.SampleCountFloat = proto.Float64(histogramCount(a) + histogramCount(b))
+		a.SampleCount = nil
+	} else {
+		a.SampleCount = proto.Uint64(a.GetSampleCount() + b.GetSampleCount())
+	}
+	a.SampleSum = proto.Float64(a.GetSampleSum() + b.GetSampleSum())
+	return true
+}
+
+// isNativeHistogram returns whether h has native histogram buckets.
+func isNativeHistogram(h *dto.Histogram) bool {
+	return h.Schema != nil || len(h.PositiveSpan) > 0 || len(h.NegativeSpan) > 0
+}
+
+// bucketCount returns the cumulative count of a bucket with an integer or
+// float count.
+func bucketCount(b *dto.Bucket) float64 {
+	if b.CumulativeCountFloat != nil {
+		return b.GetCumulativeCountFloat()
+	}
+	return float64(b.GetCumulativeCount())
+}
+
+// histogramCount returns the sample count of a histogram with an integer or
+// float count.
+func histogramCount(h *dto.Histogram) float64 {
+	if h.SampleCountFloat != nil {
+		return h.GetSampleCountFloat()
+	}
+	return float64(h.GetSampleCount())
+}
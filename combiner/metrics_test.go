@@ -0,0 +1,644 @@
+package combiner
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+)
+
+// TestParseMetrics tests parsing the text exposition format.
+func TestParseMetrics(t *testing.T) {
+	testCases := []struct {
+		name          string
+		input         string
+		expectedNames []string
+		expectError   bool
+	}{
+		{
+			name:          "Untyped samples",
+			input:         "metric_b 2\nmetric_a 1\n",
+			expectedNames: []string{"metric_a", "metric_b"},
+		},
+		{
+			name: "HELP and TYPE",
+			input: "# HELP requests_total Total requests.\n" +
+				"# TYPE requests_total counter\n" +
+				"requests_total{code=\"200\"} 10\n" +
+				"requests_total{code=\"500\"} 1\n",
+			expectedNames: []string{"requests_total"},
+		},
+		{
+			name:          "Empty input",
+			input:         "",
+			expectedNames: []string{},
+		},
+		{
+			name:        "Invalid sample",
+			input:       "metric_a not_a_number\n",
+			expectError: true,
+		},
+		{
+			name:        "HTML error page",
+			input:       "<html><body>Bad Gateway</body></html>\n",
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			families, err := parseMetrics(strings.NewReader(tc.input), expfmt.FmtText)
+			if tc.expectError {
+				if err == nil {
+					t.Fatalf("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			names := []string{}
+			for _, mf := range families {
+				names = append(names, mf.GetName())
+			}
+			if strings.Join(names, ",") != strings.Join(tc.expectedNames, ",") {
+				t.Errorf("got families %v, want %v", names, tc.expectedNames)
+			}
+		})
+	}
+}
+
+// compileRegexes compiles anchored regular expressions.
+func compileRegexes(t *testing.T, exprs []string) []*regexp.Regexp {
+	t.Helper()
+	var regexes []*regexp.Regexp
+	for _, expr := range exprs {
+		re, err := compileAnchoredRegex(expr)
+		if err != nil {
+			t.Fatalf("compileAnchoredRegex failed: %v", err)
+		}
+		regexes = append(regexes, re)
+	}
+	return regexes
+}
+
+// TestFilterFamilies tests filtering metric families by name and type.
+func TestFilterFamilies(t *testing.T) {
+	input := "# TYPE metric_a counter\nmetric_a 1\n# TYPE metric_b gauge\nmetric_b 2\nanother_metric 3\n" +
+		"# TYPE http_errors_total counter\nhttp_errors_total 4\n"
+	families, err := parseMetrics(strings.NewReader(input), expfmt.FmtText)
+	if err != nil {
+		t.Fatalf("parseMetrics failed: %v", err)
+	}
+
+	testCases := []struct {
+		name            string
+		prefixes        []string
+		regexes         []string
+		excludePrefixes []string
+		excludeRegexes  []string
+		types           []dto.MetricType
+		excludeTypes    []dto.MetricType
+		expectedNames   []string
+	}{
+		{
+			name:          "No prefixes",
+			prefixes:      nil,
+			expectedNames: []string{"another_metric", "http_errors_total", "metric_a", "metric_b"},
+		},
+		{
+			name:          "Single prefix",
+			prefixes:      []string{"metric_"},
+			expectedNames: []string{"metric_a", "metric_b"},
+		},
+		{
+			name:          "Multiple prefixes",
+			prefixes:      []string{"metric_a", "another_"},
+			expectedNames: []string{"another_metric", "metric_a"},
+		},
+		{
+			name:          "No matches",
+			prefixes:      []string{"missing_"},
+			expectedNames: []string{},
+		},
+		{
+			name:          "Regex",
+			regexes:       []string{".*_errors_total"},
+			expectedNames: []string{"http_errors_total"},
+		},
+		{
+			name:          "Regex is anchored",
+			regexes:       []string{"metric"},
+			expectedNames: []string{},
+		},
+		{
+			name:          "Prefix and regex",
+			prefixes:      []string{"another_"},
+			regexes:       []string{"metric_[ab]"},
+			expectedNames: []string{"another_metric", "metric_a", "metric_b"},
+		},
+		{
+			name:            "Exclude prefix",
+			excludePrefixes: []string{"metric_", "http_"},
+			expectedNames:   []string{"another_metric"},
+		},
+		{
+			name:           "Exclude regex",
+			excludeRegexes: []string{".*_total"},
+			expectedNames:  []string{"another_metric", "metric_a", "metric_b"},
+		},
+		{
+			name:            "Exclude after include",
+			prefixes:        []string{"metric_"},
+			regexes:         []string{"http_.*"},
+			excludePrefixes: []string{"metric_b"},
+			excludeRegexes:  []string{"http_errors_.*"},
+			expectedNames:   []string{"metric_a"},
+		},
+		{
+			name:          "Types",
+			types:         []dto.MetricType{dto.MetricType_GAUGE, dto.MetricType_UNTYPED},
+			expectedNames: []string{"another_metric", "metric_b"},
+		},
+		{
+			name:          "Exclude type",
+			excludeTypes:  []dto.MetricType{dto.MetricType_COUNTER},
+			expectedNames: []string{"another_metric", "metric_b"},
+		},
+		{
+			name:          "Prefix and type",
+			prefixes:      []string{"metric_"},
+			types:         []dto.MetricType{dto.MetricType_COUNTER},
+			expectedNames: []string{"metric_a"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			filter := familyFilter{
+				prefixes:        tc.prefixes,
+				regexes:         compileRegexes(t, tc.regexes),
+				excludePrefixes: tc.excludePrefixes,
+				excludeRegexes:  compileRegexes(t, tc.excludeRegexes),
+				types:           tc.types,
+				excludeTypes:    tc.excludeTypes,
+			}
+
+			names := []string{}
+			for _, mf := range filterFamilies(families, filter) {
+				names = append(names, mf.GetName())
+			}
+			if strings.Join(names, ",") != strings.Join(tc.expectedNames, ",") {
+				t.Errorf("got families %v, want %v", names, tc.expectedNames)
+			}
+		})
+	}
+}
+
+// TestEncodeMetrics checks that parsed metrics round-trip through the encoder.
+func TestEncodeMetrics(t *testing.T) {
+	input := "# HELP requests_total Total requests.\n" +
+		"# TYPE requests_total counter\n" +
+		"requests_total{code=\"200\"} 10\n" +
+		"requests_total{code=\"500\"} 1\n"
+
+	families, err := parseMetrics(strings.NewReader(input), expfmt.FmtText)
+	if err != nil {
+		t.Fatalf("parseMetrics failed: %v", err)
+	}
+	body, err := encodeMetrics(families, expfmt.FmtText)
+	if err != nil {
+		t.Fatalf("encodeMetrics failed: %v", err)
+	}
+	if string(body) != input {
+		t.Errorf("got %q, want %q", body, input)
+	}
+}
+
+// TestMergeFamilies tests combining families with the same name from multiple upstreams.
+func TestMergeFamilies(t *testing.T) {
+	testCases := []struct {
+		name     string
+		inputs   []string
+		expected string
+	}{
+		{
+			name: "Same family from two upstreams",
+			inputs: []string{
+				"# HELP go_goroutines Number of goroutines.\n# TYPE go_goroutines gauge\ngo_goroutines{job=\"a\"} 1\n",
+				"# HELP go_goroutines Number of goroutines that currently exist.\n# TYPE go_goroutines gauge\ngo_goroutines{job=\"b\"} 2\n",
+			},
+			expected: "# HELP go_goroutines Number of goroutines.\n# TYPE go_goroutines gauge\ngo_goroutines{job=\"a\"} 1\ngo_goroutines{job=\"b\"} 2\n",
+		},
+		{
+			name: "HELP taken from a later upstream if missing",
+			inputs: []string{
+				"# TYPE up gauge\nup{job=\"a\"} 1\n",
+				"# HELP up Whether the target is up.\n# TYPE up gauge\nup{job=\"b\"} 0\n",
+			},
+			expected: "# HELP up Whether the target is up.\n# TYPE up gauge\nup{job=\"a\"} 1\nup{job=\"b\"} 0\n",
+		},
+		{
+			name: "Conflicting type is dropped",
+			inputs: []string{
+				"# TYPE requests counter\nrequests{job=\"a\"} 1\n",
+				"# TYPE requests gauge\nrequests{job=\"b\"} 2\n",
+			},
+			expected: "# TYPE requests counter\nrequests{job=\"a\"} 1\n",
+		},
+		{
+			name: "Distinct families are sorted by name",
+			inputs: []string{
+				"metric_b 2\n",
+				"metric_a 1\n",
+			},
+			expected: "# TYPE metric_a untyped\nmetric_a 1\n# TYPE metric_b untyped\nmetric_b 2\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var families []*dto.MetricFamily
+			for _, input := range tc.inputs {
+				parsed, err := parseMetrics(strings.NewReader(input), expfmt.FmtText)
+				if err != nil {
+					t.Fatalf("parseMetrics failed: %v", err)
+				}
+				families = append(families, parsed...)
+			}
+
+			merged, err := mergeFamilies(families, DuplicateFirst)
+			if err != nil {
+				t.Fatalf("mergeFamilies failed: %v", err)
+			}
+			body, err := encodeMetrics(merged, expfmt.FmtText)
+			if err != nil {
+				t.Fatalf("encodeMetrics failed: %v", err)
+			}
+			if string(body) != tc.expected {
+				t.Errorf("got %q, want %q", body, tc.expected)
+			}
+		})
+	}
+}
+
+// TestSortSeries tests sorting the series in each family by their labels.
+func TestSortSeries(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "By label value",
+			input:    "up{job=\"b\"} 1\nup{job=\"a\"} 0\nup{job=\"c\"} 1\n",
+			expected: "# TYPE up untyped\nup{job=\"a\"} 0\nup{job=\"b\"} 1\nup{job=\"c\"} 1\n",
+		},
+		{
+			name:     "By label name",
+			input:    "up{job=\"a\",zone=\"1\"} 1\nup{instance=\"x\",job=\"a\"} 0\n",
+			expected: "# TYPE up untyped\nup{instance=\"x\",job=\"a\"} 0\nup{job=\"a\",zone=\"1\"} 1\n",
+		},
+		{
+			name:     "Fewer labels first",
+			input:    "up{job=\"a\",zone=\"1\"} 1\nup{job=\"a\"} 0\nup 2\n",
+			expected: "# TYPE up untyped\nup 2\nup{job=\"a\"} 0\nup{job=\"a\",zone=\"1\"} 1\n",
+		},
+		{
+			name:     "Same labels by timestamp",
+			input:    "up 1 2000\nup 0 1000\n",
+			expected: "# TYPE up untyped\nup 0 1000\nup 1 2000\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			families, err := parseMetrics(strings.NewReader(tc.input), expfmt.FmtText)
+			if err != nil {
+				t.Fatalf("parseMetrics failed: %v", err)
+			}
+			sortSeries(families)
+			body, err := encodeMetrics(families, expfmt.FmtText)
+			if err != nil {
+				t.Fatalf("encodeMetrics failed: %v", err)
+			}
+			if string(body) != tc.expected {
+				t.Errorf("got %q, want %q", body, tc.expected)
+			}
+		})
+	}
+}
+
+// TestMergeFamiliesDuplicates tests resolving series exposed by more than one upstream.
+func TestMergeFamiliesDuplicates(t *testing.T) {
+	inputs := []string{
+		"# TYPE requests_total counter\nrequests_total{code=\"200\",job=\"x\"} 1\nrequests_total{code=\"500\",job=\"x\"} 5\n",
+		"# TYPE requests_total counter\nrequests_total{job=\"x\",code=\"200\"} 2\n",
+		"# TYPE requests_total counter\nrequests_total{code=\"200\",job=\"x\"} 4\n",
+	}
+
+	testCases := []struct {
+		name        string
+		policy      string
+		expected    string
+		expectError bool
+	}{
+		{
+			name:     "First wins",
+			policy:   DuplicateFirst,
+			expected: "# TYPE requests_total counter\nrequests_total{code=\"200\",job=\"x\"} 1\nrequests_total{code=\"500\",job=\"x\"} 5\n",
+		},
+		{
+			name:     "Empty policy is first wins",
+			policy:   "",
+			expected: "# TYPE requests_total counter\nrequests_total{code=\"200\",job=\"x\"} 1\nrequests_total{code=\"500\",job=\"x\"} 5\n",
+		},
+		{
+			name:     "Last wins",
+			policy:   DuplicateLast,
+			expected: "# TYPE requests_total counter\nrequests_total{code=\"200\",job=\"x\"} 4\nrequests_total{code=\"500\",job=\"x\"} 5\n",
+		},
+		{
+			name:     "Sum",
+			policy:   DuplicateSum,
+			expected: "# TYPE requests_total counter\nrequests_total{code=\"200\",job=\"x\"} 7\nrequests_total{code=\"500\",job=\"x\"} 5\n",
+		},
+		{
+			name:        "Error",
+			policy:      DuplicateError,
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var families []*dto.MetricFamily
+			for _, input := range inputs {
+				parsed, err := parseMetrics(strings.NewReader(input), expfmt.FmtText)
+				if err != nil {
+					t.Fatalf("parseMetrics failed: %v", err)
+				}
+				families = append(families, parsed...)
+			}
+
+			merged, err := mergeFamilies(families, tc.policy)
+			if tc.expectError {
+				if err == nil {
+					t.Fatalf("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("mergeFamilies failed: %v", err)
+			}
+			body, err := encodeMetrics(merged, expfmt.FmtText)
+			if err != nil {
+				t.Fatalf("encodeMetrics failed: %v", err)
+			}
+			if string(body) != tc.expected {
+				t.Errorf("got %q, want %q", body, tc.expected)
+			}
+		})
+	}
+}
+
+// TestMergeFamiliesSumHistogram tests summing the buckets of classic
+// histograms, and that other series which can't be summed keep the first.
+func TestMergeFamiliesSumHistogram(t *testing.T) {
+	testCases := []struct {
+		name     string
+		inputs   []string
+		expected string
+	}{
+		{
+			name: "Same buckets",
+			inputs: []string{
+				"# TYPE latency histogram\nlatency_bucket{le=\"0.1\"} 1\nlatency_bucket{le=\"1\"} 2\nlatency_bucket{le=\"+Inf\"} 3\nlatency_sum 2.5\nlatency_count 3\n",
+				"# TYPE latency histogram\nlatency_bucket{le=\"0.1\"} 4\nlatency_bucket{le=\"1\"} 5\nlatency_bucket{le=\"+Inf\"} 6\nlatency_sum 1.5\nlatency_count 6\n",
+			},
+			expected: "# TYPE latency histogram\nlatency_bucket{le=\"0.1\"} 5\nlatency_bucket{le=\"1\"} 7\nlatency_bucket{le=\"+Inf\"} 9\nlatency_sum 4\nlatency_count 9\n",
+		},
+		{
+			name: "Buckets only in one histogram are removed",
+			inputs: []string{
+				"# TYPE latency histogram\nlatency_bucket{le=\"0.1\"} 1\nlatency_bucket{le=\"1\"} 2\nlatency_bucket{le=\"+Inf\"} 3\nlatency_sum 2.5\nlatency_count 3\n",
+				"# TYPE latency histogram\nlatency_bucket{le=\"0.5\"} 4\nlatency_bucket{le=\"1\"} 5\nlatency_bucket{le=\"+Inf\"} 6\nlatency_sum 1.5\nlatency_count 6\n",
+			},
+			expected: "# TYPE latency histogram\nlatency_bucket{le=\"1\"} 7\nlatency_bucket{le=\"+Inf\"} 9\nlatency_sum 4\nlatency_count 9\n",
+		},
+		{
+			name: "Summaries keep the first",
+			inputs: []string{
+				"# TYPE rpc summary\nrpc{quantile=\"0.5\"} 1\nrpc_sum 1\nrpc_count 1\n",
+				"# TYPE rpc summary\nrpc{quantile=\"0.5\"} 2\nrpc_sum 2\nrpc_count 1\n",
+			},
+			expected: "# TYPE rpc summary\nrpc{quantile=\"0.5\"} 1\nrpc_sum 1\nrpc_count 1\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var families []*dto.MetricFamily
+			for _, input := range tc.inputs {
+				parsed, err := parseMetrics(strings.NewReader(input), expfmt.FmtText)
+				if err != nil {
+					t.Fatalf("parseMetrics failed: %v", err)
+				}
+				families = append(families, parsed...)
+			}
+
+			merged, err := mergeFamilies(families, DuplicateSum)
+			if err != nil {
+				t.Fatalf("mergeFamilies failed: %v", err)
+			}
+			body, err := encodeMetrics(merged, expfmt.FmtText)
+			if err != nil {
+				t.Fatalf("encodeMetrics failed: %v", err)
+			}
+			if string(body) != tc.expected {
+				t.Errorf("got %q, want %q", body, tc.expected)
+			}
+		})
+	}
+}
+
+// TestSumHistogramsNative checks that native histograms can't be summed.
+func TestSumHistogramsNative(t *testing.T) {
+	classic := &dto.Histogram{SampleCount: proto.Uint64(1), SampleSum: proto.Float64(1)}
+	native := &dto.Histogram{SampleCount: proto.Uint64(1), SampleSum: proto.Float64(1), Schema: proto.Int32(3)}
+	if sumHistograms(proto.Clone(classic).(*dto.Histogram), native) {
+		t.Error("expected a native histogram not to be summed")
+	}
+	if !sumHistograms(proto.Clone(classic).(*dto.Histogram), classic) {
+		t.Error("expected classic histograms to be summed")
+	}
+}
+
+// TestParseMetricsProtobuf checks that metrics round-trip through the protobuf format.
+func TestParseMetricsProtobuf(t *testing.T) {
+	input := "# HELP latency Request latency.\n" +
+		"# TYPE latency histogram\n" +
+		"latency_bucket{le=\"0.1\"} 1\n" +
+		"latency_bucket{le=\"+Inf\"} 2\n" +
+		"latency_sum 0.6\n" +
+		"latency_count 2\n" +
+		"# TYPE up gauge\n" +
+		"up 1\n"
+
+	families, err := parseMetrics(strings.NewReader(input), expfmt.FmtText)
+	if err != nil {
+		t.Fatalf("parseMetrics failed: %v", err)
+	}
+	encoded, err := encodeMetrics(families, expfmt.NewFormat(expfmt.TypeProtoDelim))
+	if err != nil {
+		t.Fatalf("encodeMetrics failed: %v", err)
+	}
+
+	decoded, err := parseMetrics(bytes.NewReader(encoded), expfmt.NewFormat(expfmt.TypeProtoDelim))
+	if err != nil {
+		t.Fatalf("parseMetrics failed: %v", err)
+	}
+	body, err := encodeMetrics(decoded, expfmt.FmtText)
+	if err != nil {
+		t.Fatalf("encodeMetrics failed: %v", err)
+	}
+	if string(body) != input {
+		t.Errorf("got %q, want %q", body, input)
+	}
+}
+
+// TestEncodeMetricsOpenMetrics checks that OpenMetrics output ends with # EOF.
+func TestEncodeMetricsOpenMetrics(t *testing.T) {
+	families, err := parseMetrics(strings.NewReader("# TYPE requests_total counter\nrequests_total 10\n"), expfmt.FmtText)
+	if err != nil {
+		t.Fatalf("parseMetrics failed: %v", err)
+	}
+	body, err := encodeMetrics(families, expfmt.FmtOpenMetrics_1_0_0)
+	if err != nil {
+		t.Fatalf("encodeMetrics failed: %v", err)
+	}
+	expected := "# TYPE requests counter\nrequests_total 10.0\n# EOF\n"
+	if string(body) != expected {
+		t.Errorf("got %q, want %q", body, expected)
+	}
+}
+
+// TestAddLabels tests adding target labels to every series.
+func TestAddLabels(t *testing.T) {
+	input := "# TYPE requests_total counter\n" +
+		"requests_total{code=\"200\",source=\"upstream\"} 1\n" +
+		"requests_total{code=\"500\",exported_source=\"other\",source=\"upstream\"} 2\n" +
+		"requests_total{code=\"503\"} 3\n"
+
+	testCases := []struct {
+		name     string
+		policy   string
+		expected string
+	}{
+		{
+			name:   "Overwrite",
+			policy: LabelConflictOverwrite,
+			expected: "# TYPE requests_total counter\n" +
+				"requests_total{az=\"a\",code=\"200\",source=\"node1\"} 1\n" +
+				"requests_total{az=\"a\",code=\"500\",exported_source=\"other\",source=\"node1\"} 2\n" +
+				"requests_total{az=\"a\",code=\"503\",source=\"node1\"} 3\n",
+		},
+		{
+			name:   "Empty policy is overwrite",
+			policy: "",
+			expected: "# TYPE requests_total counter\n" +
+				"requests_total{az=\"a\",code=\"200\",source=\"node1\"} 1\n" +
+				"requests_total{az=\"a\",code=\"500\",exported_source=\"other\",source=\"node1\"} 2\n" +
+				"requests_total{az=\"a\",code=\"503\",source=\"node1\"} 3\n",
+		},
+		{
+			name:   "Keep",
+			policy: LabelConflictKeep,
+			expected: "# TYPE requests_total counter\n" +
+				"requests_total{az=\"a\",code=\"200\",source=\"upstream\"} 1\n" +
+				"requests_total{az=\"a\",code=\"500\",exported_source=\"other\",source=\"upstream\"} 2\n" +
+				"requests_total{az=\"a\",code=\"503\",source=\"node1\"} 3\n",
+		},
+		{
+			name:   "Rename",
+			policy: LabelConflictRename,
+			expected: "# TYPE requests_total counter\n" +
+				"requests_total{az=\"a\",code=\"200\",exported_source=\"upstream\",source=\"node1\"} 1\n" +
+				"requests_total{az=\"a\",code=\"500\",exported_exported_source=\"upstream\",exported_source=\"other\",source=\"node1\"} 2\n" +
+				"requests_total{az=\"a\",code=\"503\",source=\"node1\"} 3\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			families, err := parseMetrics(strings.NewReader(input), expfmt.FmtText)
+			if err != nil {
+				t.Fatalf("parseMetrics failed: %v", err)
+			}
+
+			addLabels(families, map[string]string{"source": "node1", "az": "a"}, tc.policy)
+
+			body, err := encodeMetrics(families, expfmt.FmtText)
+			if err != nil {
+				t.Fatalf("encodeMetrics failed: %v", err)
+			}
+			if string(body) != tc.expected {
+				t.Errorf("got %q, want %q", body, tc.expected)
+			}
+		})
+	}
+}
+
+// TestPrefixNames tests prepending a prefix to metric names.
+func TestPrefixNames(t *testing.T) {
+	input := "# HELP requests_total Total requests.\n" +
+		"# TYPE requests_total counter\n" +
+		"requests_total 1\n" +
+		"# TYPE up gauge\n" +
+		"up 1\n"
+	families, err := parseMetrics(strings.NewReader(input), expfmt.FmtText)
+	if err != nil {
+		t.Fatalf("parseMetrics failed: %v", err)
+	}
+
+	prefixNames(families, "svc1_")
+
+	body, err := encodeMetrics(families, expfmt.FmtText)
+	if err != nil {
+		t.Fatalf("encodeMetrics failed: %v", err)
+	}
+	expected := "# HELP svc1_requests_total Total requests.\n" +
+		"# TYPE svc1_requests_total counter\n" +
+		"svc1_requests_total 1\n" +
+		"# TYPE svc1_up gauge\n" +
+		"svc1_up 1\n"
+	if string(body) != expected {
+		t.Errorf("got %q, want %q", body, expected)
+	}
+}
+
+// TestRemoveLabels tests removing labels from every series.
+func TestRemoveLabels(t *testing.T) {
+	input := "# TYPE up gauge\n" +
+		"up{container_id=\"abc\",job=\"node\",pod_template_hash=\"123\"} 1\n"
+	families, err := parseMetrics(strings.NewReader(input), expfmt.FmtText)
+	if err != nil {
+		t.Fatalf("parseMetrics failed: %v", err)
+	}
+
+	removeLabels(families, []string{"pod_template_hash", "container_id", "missing"})
+
+	body, err := encodeMetrics(families, expfmt.FmtText)
+	if err != nil {
+		t.Fatalf("encodeMetrics failed: %v", err)
+	}
+	expected := "# TYPE up gauge\nup{job=\"node\"} 1\n"
+	if string(body) != expected {
+		t.Errorf("got %q, want %q", body, expected)
+	}
+}
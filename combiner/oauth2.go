@@ -0,0 +1,166 @@
+package combiner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OAuth2 configures fetching an access token from an OAuth2 token endpoint
+// with the client credentials grant, which is sent to the upstream as a
+// bearer token.
+type OAuth2 struct {
+	ClientID string `yaml:"client_id"`
+	// ClientSecretFile is a file containing the client secret, re-read
+	// periodically.
+	ClientSecretFile string `yaml:"client_secret_file"`
+	TokenURL         string `yaml:"token_url"`
+	// Scopes are requested for the token.
+	Scopes []string `yaml:"scopes"`
+	// EndpointParams are extra parameters sent to the token endpoint, such
+	// as audience.
+	EndpointParams map[string]string `yaml:"endpoint_params"`
+}
+
+// Validate checks the OAuth2 configuration is complete.
+func (c OAuth2) Validate() error {
+	if c.ClientID == "" {
+		return errors.New("oauth2 requires a client_id")
+	}
+	if c.ClientSecretFile == "" {
+		return errors.New("oauth2 requires a client_secret_file")
+	}
+	u, err := url.Parse(c.TokenURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid oauth2 token_url %q, must be an http or https URL", c.TokenURL)
+	}
+	return nil
+}
+
+// oauth2ExpiryDelta is how long before it expires a token is replaced, so it
+// doesn't expire during a fetch.
+const oauth2ExpiryDelta = 10 * time.Second
+
+// oauth2TokenSource fetches and caches the access token for an OAuth2
+// configuration.
+type oauth2TokenSource struct {
+	cfg    OAuth2
+	secret *secretFile
+	client *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// oauth2TokenSources holds a token source for each OAuth2 configuration, so
+// targets with the same settings, such as the targets of a group, share a
+// token rather than each requesting their own.
+var oauth2TokenSources = struct {
+	sync.Mutex
+	sources map[string]*oauth2TokenSource
+}{sources: make(map[string]*oauth2TokenSource)}
+
+// sharedOAuth2TokenSource returns the token source for cfg, creating it with
+// a client using transport if there isn't one.
+func sharedOAuth2TokenSource(cfg OAuth2, transport http.RoundTripper) *oauth2TokenSource {
+	params := url.Values{}
+	for name, value := range cfg.EndpointParams {
+		params.Set(name, value)
+	}
+	key := strings.Join([]string{cfg.ClientID, cfg.ClientSecretFile, cfg.TokenURL, strings.Join(cfg.Scopes, " "), params.Encode()}, "\x00")
+
+	oauth2TokenSources.Lock()
+	defer oauth2TokenSources.Unlock()
+	source, ok := oauth2TokenSources.sources[key]
+	if !ok {
+		source = &oauth2TokenSource{cfg: cfg, secret: newSecretFile(cfg.ClientSecretFile), client: &http.Client{Transport: transport, Timeout: time.Minute}}
+		oauth2TokenSources.sources[key] = source
+	}
+	return source
+}
+
+// get returns the cached token, fetching a new one if there isn't one or it
+// is about to expire.
+func (s *oauth2TokenSource) get(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && (s.expiry.IsZero() || time.Until(s.expiry) > oauth2ExpiryDelta) {
+		return s.token, nil
+	}
+
+	secret, err := s.secret.get()
+	if err != nil {
+		return "", fmt.Errorf("failed to read oauth2 client secret: %w", err)
+	}
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(s.cfg.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.cfg.Scopes, " "))
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.cfg.EndpointParams)) {
+		form.Set(name, s.cfg.EndpointParams[name])
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("failed to create oauth2 token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// The credentials are form encoded as RFC 6749 section 2.3.1 requires
+	req.SetBasicAuth(url.QueryEscape(s.cfg.ClientID), url.QueryEscape(secret))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get oauth2 token from %s: %w", s.cfg.TokenURL, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("failed to read oauth2 token from %s: %w", s.cfg.TokenURL, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("bad status getting oauth2 token from %s: %s: %s", s.cfg.TokenURL, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", fmt.Errorf("invalid oauth2 token from %s: %w", s.cfg.TokenURL, err)
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("invalid oauth2 token from %s: missing access_token", s.cfg.TokenURL)
+	}
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return "", fmt.Errorf("invalid oauth2 token from %s: unsupported token_type %q", s.cfg.TokenURL, token.TokenType)
+	}
+
+	s.token = token.AccessToken
+	// Tokens without an expiry are used until the upstream rejects them
+	s.expiry = time.Time{}
+	if token.ExpiresIn > 0 {
+		s.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	return s.token, nil
+}
+
+// invalidate discards token if it is still the cached token, so the next
+// request fetches a new one.
+func (s *oauth2TokenSource) invalidate(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token == token {
+		s.token = ""
+	}
+}
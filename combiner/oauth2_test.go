@@ -0,0 +1,216 @@
+package combiner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// tokenServer is an OAuth2 token endpoint that issues numbered tokens to the
+// client "combiner" with the secret "hunter2".
+type tokenServer struct {
+	*httptest.Server
+	expiresIn int
+	issued    atomic.Int32
+	// form is the form of the last token request.
+	form atomic.Value
+}
+
+// newTokenServer starts a token endpoint whose tokens expire after expiresIn
+// seconds.
+func newTokenServer(t *testing.T, expiresIn int) *tokenServer {
+	s := &tokenServer{expiresIn: expiresIn}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		if r.Method != http.MethodPost || !ok || id != "combiner" || secret != "hunter2" {
+			http.Error(w, `{"error": "invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		form := make(map[string]string)
+		for name := range r.PostForm {
+			form[name] = r.PostForm.Get(name)
+		}
+		s.form.Store(form)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token": "token-%d", "token_type": "Bearer", "expires_in": %d}`, s.issued.Add(1), s.expiresIn)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// TestOAuth2 tests access tokens are fetched, cached until they are about to
+// expire, and sent to the upstream.
+func TestOAuth2(t *testing.T) {
+	testCases := []struct {
+		name           string
+		expiresIn      int
+		expectedTokens []string
+	}{
+		{name: "Cached", expiresIn: 3600, expectedTokens: []string{"Bearer token-1", "Bearer token-1"}},
+		{name: "No expiry", expectedTokens: []string{"Bearer token-1", "Bearer token-1"}},
+		{name: "About to expire", expiresIn: 5, expectedTokens: []string{"Bearer token-1", "Bearer token-2"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tokens := newTokenServer(t, tc.expiresIn)
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, r.Header.Get("Authorization"))
+			}))
+			defer upstream.Close()
+
+			cfg := &OAuth2{
+				ClientID:         "combiner",
+				ClientSecretFile: writeFile(t, "secret", "hunter2\n"),
+				TokenURL:         tokens.URL,
+				Scopes:           []string{"metrics.read", "metrics.list"},
+				EndpointParams:   map[string]string{"audience": "exporters"},
+			}
+			client, err := NewClient(Target{URL: upstream.URL, OAuth2: cfg}, nil)
+			if err != nil {
+				t.Fatalf("NewClient failed: %v", err)
+			}
+			var got []string
+			for range tc.expectedTokens {
+				body, _, err := fetchString(context.Background(), client, upstream.URL)
+				if err != nil {
+					t.Fatalf("fetch failed: %v", err)
+				}
+				got = append(got, body)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.expectedTokens) {
+				t.Errorf("got %v, want %v", got, tc.expectedTokens)
+			}
+
+			expectedForm := map[string]string{"grant_type": "client_credentials", "scope": "metrics.read metrics.list", "audience": "exporters"}
+			if form := tokens.form.Load(); fmt.Sprint(form) != fmt.Sprint(expectedForm) {
+				t.Errorf("token request form %v, want %v", form, expectedForm)
+			}
+		})
+	}
+}
+
+// TestOAuth2Shared tests targets with the same settings share a token, and a
+// token rejected by the upstream is replaced.
+func TestOAuth2Shared(t *testing.T) {
+	tokens := newTokenServer(t, 3600)
+	revoked := "Bearer token-1"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == revoked {
+			http.Error(w, "token revoked", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, r.Header.Get("Authorization"))
+	}))
+	defer upstream.Close()
+
+	cfg := OAuth2{ClientID: "combiner", ClientSecretFile: writeFile(t, "secret", "hunter2"), TokenURL: tokens.URL}
+	var clients []*http.Client
+	for range 2 {
+		// Each target has its own copy of the settings
+		cfg := cfg
+		client, err := NewClient(Target{URL: upstream.URL, OAuth2: &cfg}, nil)
+		if err != nil {
+			t.Fatalf("NewClient failed: %v", err)
+		}
+		clients = append(clients, client)
+	}
+
+	if _, _, err := fetchString(context.Background(), clients[0], upstream.URL); err == nil {
+		t.Fatal("expected the revoked token to be rejected")
+	}
+	for _, client := range clients {
+		body, _, err := fetchString(context.Background(), client, upstream.URL)
+		if err != nil {
+			t.Fatalf("fetch failed: %v", err)
+		}
+		if body != "Bearer token-2" {
+			t.Errorf("expected the replacement token, got %q", body)
+		}
+	}
+	if issued := tokens.issued.Load(); issued != 2 {
+		t.Errorf("expected 2 tokens to be issued, got %d", issued)
+	}
+}
+
+// TestOAuth2Errors tests failures to get a token are returned as fetch
+// errors.
+func TestOAuth2Errors(t *testing.T) {
+	tokens := newTokenServer(t, 3600)
+	invalid := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"token_type": "Bearer"}`)
+	}))
+	defer invalid.Close()
+
+	testCases := []struct {
+		name          string
+		secret        string
+		tokenURL      string
+		expectedError string
+	}{
+		{name: "Wrong secret", secret: "wrong", tokenURL: tokens.URL, expectedError: "401 Unauthorized"},
+		{name: "Missing access token", secret: "hunter2", tokenURL: invalid.URL, expectedError: "missing access_token"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &OAuth2{ClientID: "combiner", ClientSecretFile: writeFile(t, "secret", tc.secret), TokenURL: tc.tokenURL}
+			client, err := NewClient(Target{URL: "http://exporter.invalid/metrics", OAuth2: cfg}, nil)
+			if err != nil {
+				t.Fatalf("NewClient failed: %v", err)
+			}
+			_, _, err = fetchString(context.Background(), client, "http://exporter.invalid/metrics")
+			if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+				t.Errorf("expected error containing %q, got: %v", tc.expectedError, err)
+			}
+		})
+	}
+
+	if _, err := NewClient(Target{URL: "http://exporter.invalid/metrics", OAuth2: &OAuth2{ClientID: "combiner", ClientSecretFile: "/nonexistent/secret", TokenURL: tokens.URL}}, nil); err == nil {
+		t.Error("expected an error for a missing client secret file")
+	}
+}
+
+// TestOAuth2Validate tests incomplete OAuth2 settings are rejected.
+func TestOAuth2Validate(t *testing.T) {
+	valid := OAuth2{ClientID: "combiner", ClientSecretFile: "/etc/secret", TokenURL: "https://auth.example.com/token"}
+	testCases := []struct {
+		name          string
+		target        Target
+		expectedError string
+	}{
+		{name: "Valid", target: Target{OAuth2: &valid}},
+		{name: "Missing client ID", target: Target{OAuth2: &OAuth2{ClientSecretFile: "/etc/secret", TokenURL: "https://auth.example.com/token"}}, expectedError: "client_id"},
+		{name: "Missing secret", target: Target{OAuth2: &OAuth2{ClientID: "combiner", TokenURL: "https://auth.example.com/token"}}, expectedError: "client_secret_file"},
+		{name: "Invalid token URL", target: Target{OAuth2: &OAuth2{ClientID: "combiner", ClientSecretFile: "/etc/secret", TokenURL: "auth.example.com/token"}}, expectedError: "invalid oauth2 token_url"},
+		{name: "With bearer token", target: Target{OAuth2: &valid, BearerTokenFile: "/etc/token"}, expectedError: "cannot be used together"},
+		{name: "With Authorization header", target: Target{OAuth2: &valid, Headers: map[string]string{"Authorization": "x"}}, expectedError: "Authorization header cannot be set"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.target.Validate()
+			if tc.expectedError == "" {
+				if err != nil {
+					t.Errorf("expected no error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+				t.Errorf("expected error containing %q, got: %v", tc.expectedError, err)
+			}
+		})
+	}
+
+	if got := (Target{OAuth2: &valid}).WithDefaults(Target{BearerTokenFile: "/etc/token"}); got.BearerTokenFile != "" {
+		t.Errorf("expected the default bearer token not to be applied to an oauth2 target, got %q", got.BearerTokenFile)
+	}
+}
@@ -0,0 +1,148 @@
+package combiner
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Pusher sends the combined metrics to another system.
+type Pusher interface {
+	// Push sends families, which must not be modified.
+	Push(ctx context.Context, families []*dto.MetricFamily) error
+}
+
+// RunPusher gathers the combined metrics immediately and then every interval
+// until ctx is cancelled, passing them to p. Failures are logged and the next
+// push is attempted at the next interval. Gathering and pushing are each
+// limited to the interval so pushes don't overlap. name identifies the output
+// in logs and traces.
+func (c *Combiner) RunPusher(ctx context.Context, name string, interval time.Duration, p Pusher) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	timeout := c.timeout
+	if timeout <= 0 || timeout > interval {
+		timeout = interval
+	}
+
+	for {
+		func() {
+			ctx, span := tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindInternal))
+			defer span.End()
+
+			start := time.Now()
+			families, _, err := c.gather(ctx, timeout)
+			if err != nil {
+				slog.Warn("Failed to gather metrics to push", "output", name, "err", err)
+				return
+			}
+			pushCtx, cancel := context.WithTimeout(ctx, interval)
+			defer cancel()
+			if err := p.Push(pushCtx, families); err != nil {
+				slog.Warn("Failed to push metrics", "output", name, "duration", time.Since(start), "err", err)
+				return
+			}
+			slog.Debug("Pushed metrics", "output", name, "duration", time.Since(start), "families", len(families))
+		}()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// flatSample is a single sample of a series, with histograms and summaries
+// split into their _bucket, _sum and _count series as in the text format.
+type flatSample struct {
+	name string
+	// labels are sorted by name and don't include the metric name.
+	labels []*dto.LabelPair
+	value  float64
+	// timestampMs is the sample's own timestamp, or 0 if it has none.
+	timestampMs int64
+}
+
+// flattenFamilies returns the samples of every series in families. Native
+// histograms only have their _sum and _count series, since their buckets
+// can't be represented as plain samples.
+func flattenFamilies(families []*dto.MetricFamily) []flatSample {
+	var samples []flatSample
+	for _, mf := range families {
+		name := mf.GetName()
+		for _, m := range mf.Metric {
+			labels := sortLabels(m.Label)
+			add := func(suffix string, value float64, extra ...*dto.LabelPair) {
+				l := labels
+				if len(extra) > 0 {
+					l = sortLabels(slices.Concat(labels, extra))
+				}
+				samples = append(samples, flatSample{name: name + suffix, labels: l, value: value, timestampMs: m.GetTimestampMs()})
+			}
+
+			switch {
+			case m.Counter != nil:
+				add("", m.Counter.GetValue())
+			case m.Gauge != nil:
+				add("", m.Gauge.GetValue())
+			case m.Untyped != nil:
+				add("", m.Untyped.GetValue())
+			case m.Summary != nil:
+				for _, q := range m.Summary.Quantile {
+					add("", q.GetValue(), labelPair(model.QuantileLabel, formatFloat(q.GetQuantile())))
+				}
+				add("_sum", m.Summary.GetSampleSum())
+				add("_count", float64(m.Summary.GetSampleCount()))
+			case m.Histogram != nil:
+				h := m.Histogram
+				count := float64(h.GetSampleCount())
+				if h.SampleCountFloat != nil {
+					count = h.GetSampleCountFloat()
+				}
+				hasInf := false
+				for _, b := range h.Bucket {
+					value := float64(b.GetCumulativeCount())
+					if b.CumulativeCountFloat != nil {
+						value = b.GetCumulativeCountFloat()
+					}
+					hasInf = hasInf || math.IsInf(b.GetUpperBound(), 1)
+					add("_bucket", value, labelPair(model.BucketLabel, formatFloat(b.GetUpperBound())))
+				}
+				// The +Inf bucket is implicit in the protobuf format
+				if len(h.Bucket) > 0 && !hasInf {
+					add("_bucket", count, labelPair(model.BucketLabel, "+Inf"))
+				}
+				add("_sum", h.GetSampleSum())
+				add("_count", count)
+			}
+		}
+	}
+	return samples
+}
+
+// sortLabels returns a copy of labels sorted by name.
+func sortLabels(labels []*dto.LabelPair) []*dto.LabelPair {
+	return slices.SortedFunc(slices.Values(labels), func(a, b *dto.LabelPair) int {
+		return cmp.Compare(a.GetName(), b.GetName())
+	})
+}
+
+// labelPair creates a label.
+func labelPair(name, value string) *dto.LabelPair {
+	return &dto.LabelPair{Name: &name, Value: &value}
+}
+
+// formatFloat formats a quantile or bucket bound the way Prometheus does.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
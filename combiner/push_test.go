@@ -0,0 +1,161 @@
+package combiner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+)
+
+// formatSample formats a flattened sample like a line of the text format.
+func formatSample(s flatSample) string {
+	var labels []string
+	for _, l := range s.labels {
+		labels = append(labels, fmt.Sprintf("%s=%q", l.GetName(), l.GetValue()))
+	}
+	line := fmt.Sprintf("%s{%s} %s", s.name, strings.Join(labels, ","), formatFloat(s.value))
+	if s.timestampMs != 0 {
+		line += fmt.Sprintf(" %d", s.timestampMs)
+	}
+	return line
+}
+
+// TestFlattenFamilies tests splitting families into individual samples.
+func TestFlattenFamilies(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected []string
+	}{
+		{
+			name:     "Gauge with sorted labels",
+			input:    "# TYPE temp gauge\ntemp{z=\"1\",a=\"2\"} 21.5 1700000000000\n",
+			expected: []string{`temp{a="2",z="1"} 21.5 1700000000000`},
+		},
+		{
+			name:     "Untyped",
+			input:    "requests 3\n",
+			expected: []string{`requests{} 3`},
+		},
+		{
+			name:  "Summary",
+			input: "# TYPE latency summary\nlatency{quantile=\"0.5\"} 0.2\nlatency{quantile=\"0.99\"} 0.9\nlatency_sum 10\nlatency_count 40\n",
+			expected: []string{
+				`latency{quantile="0.5"} 0.2`,
+				`latency{quantile="0.99"} 0.9`,
+				`latency_sum{} 10`,
+				`latency_count{} 40`,
+			},
+		},
+		{
+			name:  "Histogram",
+			input: "# TYPE size histogram\nsize_bucket{path=\"/\",le=\"1\"} 2\nsize_bucket{path=\"/\",le=\"+Inf\"} 5\nsize_sum{path=\"/\"} 12\nsize_count{path=\"/\"} 5\n",
+			expected: []string{
+				`size_bucket{le="1",path="/"} 2`,
+				`size_bucket{le="+Inf",path="/"} 5`,
+				`size_sum{path="/"} 12`,
+				`size_count{path="/"} 5`,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			families, err := parseMetrics(strings.NewReader(tc.input), expfmt.FmtText)
+			if err != nil {
+				t.Fatalf("parseMetrics failed: %v", err)
+			}
+			var got []string
+			for _, s := range flattenFamilies(families) {
+				got = append(got, formatSample(s))
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("got %q, want %q", got, tc.expected)
+			}
+		})
+	}
+}
+
+// TestFlattenFamiliesImplicitInf tests that the +Inf bucket is added when it
+// is implicit, as it is in protobuf exposition.
+func TestFlattenFamiliesImplicitInf(t *testing.T) {
+	families := []*dto.MetricFamily{{
+		Name: proto.String("size"),
+		Type: dto.MetricType_HISTOGRAM.Enum(),
+		Metric: []*dto.Metric{{Histogram: &dto.Histogram{
+			SampleCount: proto.Uint64(7),
+			SampleSum:   proto.Float64(0),
+			Bucket:      []*dto.Bucket{{UpperBound: proto.Float64(0.5), CumulativeCount: proto.Uint64(3)}},
+		}}},
+	}}
+
+	var got []string
+	for _, s := range flattenFamilies(families) {
+		got = append(got, formatSample(s))
+	}
+	expected := []string{`size_bucket{le="0.5"} 3`, `size_bucket{le="+Inf"} 7`, `size_sum{} 0`, `size_count{} 7`}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %q, want %q", got, expected)
+	}
+}
+
+// pushFunc implements Pusher with a function.
+type pushFunc func(ctx context.Context, families []*dto.MetricFamily) error
+
+func (f pushFunc) Push(ctx context.Context, families []*dto.MetricFamily) error {
+	return f(ctx, families)
+}
+
+// TestCombinerRunPusher tests that the combined metrics are pushed on every
+// interval until the context is cancelled.
+func TestCombinerRunPusher(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "upstream_metric 1")
+	}))
+	defer server.Close()
+
+	agg, err := newCombiner(staticTargets([]string{server.URL}), options{timeout: time.Second})
+	if err != nil {
+		t.Fatalf("newCombiner failed: %v", err)
+	}
+
+	pushed := make(chan []*dto.MetricFamily)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		agg.RunPusher(ctx, "test", 100*time.Millisecond, pushFunc(func(ctx context.Context, families []*dto.MetricFamily) error {
+			select {
+			case pushed <- families:
+			case <-ctx.Done():
+			}
+			return nil
+		}))
+		close(done)
+	}()
+
+	for range 2 {
+		select {
+		case families := <-pushed:
+			if len(families) != 1 || families[0].GetName() != "upstream_metric" {
+				t.Errorf("unexpected families pushed: %v", families)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a push")
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunPusher didn't return after the context was cancelled")
+	}
+}
@@ -0,0 +1,83 @@
+package combiner
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// PushgatewayPusher pushes metrics to a group on a Prometheus Pushgateway,
+// replacing everything previously pushed to the group.
+type PushgatewayPusher struct {
+	url    string
+	client *http.Client
+}
+
+// NewPushgatewayPusher creates a Pusher for the group identified by job and
+// instance on the Pushgateway at cfg.URL. instance may be empty.
+func NewPushgatewayPusher(cfg Target, job, instance string, transport *http.Transport) (*PushgatewayPusher, error) {
+	if job == "" {
+		return nil, fmt.Errorf("a job name is required to push to %s", cfg.URL)
+	}
+	client, err := NewClient(cfg, transport)
+	if err != nil {
+		return nil, err
+	}
+	return &PushgatewayPusher{url: pushgatewayGroupURL(cfg.URL, job, instance), client: client}, nil
+}
+
+// pushgatewayGroupURL returns the URL of a Pushgateway group. Values that
+// can't be used as a path segment are base64 encoded.
+func pushgatewayGroupURL(base, job, instance string) string {
+	u := strings.TrimSuffix(base, "/") + "/metrics" + pushgatewayGroupingPath("job", job)
+	if instance != "" {
+		u += pushgatewayGroupingPath("instance", instance)
+	}
+	return u
+}
+
+// pushgatewayGroupingPath returns the path segments for one grouping label.
+func pushgatewayGroupingPath(name, value string) string {
+	if value == "" {
+		return "/" + name + "@base64/="
+	}
+	if strings.Contains(value, "/") {
+		return "/" + name + "@base64/" + base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+	return "/" + name + "/" + url.PathEscape(value)
+}
+
+// Push implements Pusher. Timestamps are removed since the Pushgateway rejects
+// metrics that have them.
+func (p *PushgatewayPusher) Push(ctx context.Context, families []*dto.MetricFamily) error {
+	format := expfmt.NewFormat(expfmt.TypeProtoDelim)
+	body, err := encodeMetrics(withoutTimestamps(families), format)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", string(format))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to push to %s: %w", p.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("bad status from Pushgateway %s: %s: %s", p.url, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
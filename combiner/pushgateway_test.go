@@ -0,0 +1,102 @@
+package combiner
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// TestPushgatewayGroupURL tests building the URL of a Pushgateway group.
+func TestPushgatewayGroupURL(t *testing.T) {
+	testCases := []struct {
+		name     string
+		base     string
+		job      string
+		instance string
+		expected string
+	}{
+		{
+			name:     "Job only",
+			base:     "http://pushgateway:9091",
+			job:      "combiner",
+			expected: "http://pushgateway:9091/metrics/job/combiner",
+		},
+		{
+			name:     "Job and instance",
+			base:     "http://pushgateway:9091/",
+			job:      "combiner",
+			instance: "host 1",
+			expected: "http://pushgateway:9091/metrics/job/combiner/instance/host%201",
+		},
+		{
+			name:     "Value with a slash",
+			base:     "http://pushgateway:9091",
+			job:      "a/b",
+			expected: "http://pushgateway:9091/metrics/job@base64/YS9i",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := pushgatewayGroupURL(tc.base, tc.job, tc.instance); got != tc.expected {
+				t.Errorf("got %s, want %s", got, tc.expected)
+			}
+		})
+	}
+}
+
+// TestPushgatewayPusher tests pushing metrics to a Pushgateway group.
+func TestPushgatewayPusher(t *testing.T) {
+	var method, path string
+	var pushed string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		families, err := parseMetrics(r.Body, expfmt.ResponseFormat(r.Header))
+		if err != nil {
+			t.Errorf("failed to parse pushed metrics: %v", err)
+		}
+		var buf strings.Builder
+		if err := writeFamilies(&buf, families, expfmt.NewFormat(expfmt.TypeTextPlain)); err != nil {
+			t.Errorf("failed to write pushed metrics: %v", err)
+		}
+		pushed = buf.String()
+		if status != http.StatusOK {
+			http.Error(w, "inconsistent metrics", status)
+		}
+	}))
+	defer server.Close()
+
+	p, err := NewPushgatewayPusher(Target{URL: server.URL}, "combiner", "host1", nil)
+	if err != nil {
+		t.Fatalf("NewPushgatewayPusher failed: %v", err)
+	}
+
+	families, err := parseMetrics(strings.NewReader("metric_a{x=\"1\"} 1 1700000000000\nmetric_b 2\n"), expfmt.FmtText)
+	if err != nil {
+		t.Fatalf("parseMetrics failed: %v", err)
+	}
+	if err := p.Push(context.Background(), families); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+
+	if method != http.MethodPut || path != "/metrics/job/combiner/instance/host1" {
+		t.Errorf("expected PUT to the group, got %s %s", method, path)
+	}
+	expected := "# TYPE metric_a untyped\nmetric_a{x=\"1\"} 1\n# TYPE metric_b untyped\nmetric_b 2\n"
+	if pushed != expected {
+		t.Errorf("got %q, want %q", pushed, expected)
+	}
+	if families[0].Metric[0].GetTimestampMs() != 1700000000000 {
+		t.Error("expected the original timestamp not to be modified")
+	}
+
+	status = http.StatusBadRequest
+	if err := p.Push(context.Background(), families); err == nil || !strings.Contains(err.Error(), "inconsistent metrics") {
+		t.Errorf("expected error containing 'inconsistent metrics', got: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package combiner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/golang/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Remote write metadata types, from the MetricMetadata message of the
+// Prometheus remote write protocol.
+var remoteWriteMetricTypes = map[dto.MetricType]uint64{
+	dto.MetricType_COUNTER:         1,
+	dto.MetricType_GAUGE:           2,
+	dto.MetricType_HISTOGRAM:       3,
+	dto.MetricType_GAUGE_HISTOGRAM: 4,
+	dto.MetricType_SUMMARY:         5,
+}
+
+// RemoteWriter pushes metrics to a Prometheus remote write endpoint, using
+// version 1.0 of the protocol.
+type RemoteWriter struct {
+	url    string
+	client *http.Client
+	// now returns the current time, it can be overridden in tests.
+	now func() time.Time
+}
+
+// NewRemoteWriter creates a remote writer for the endpoint in cfg, which can
+// also set TLS and authentication settings in the same way as a target.
+func NewRemoteWriter(cfg Target, transport *http.Transport) (*RemoteWriter, error) {
+	client, err := NewClient(cfg, transport)
+	if err != nil {
+		return nil, err
+	}
+	return &RemoteWriter{url: cfg.URL, client: client, now: time.Now}, nil
+}
+
+// Push implements Pusher. Samples without a timestamp are sent with the
+// current time.
+func (w *RemoteWriter) Push(ctx context.Context, families []*dto.MetricFamily) error {
+	body := snappy.Encode(nil, encodeWriteRequest(families, w.now()))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send remote write request to %s: %w", w.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("bad status from remote write endpoint %s: %s: %s", w.url, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// encodeWriteRequest encodes families as a remote write WriteRequest
+// protobuf message, with a TimeSeries for every series and metadata for each
+// family.
+func encodeWriteRequest(families []*dto.MetricFamily, now time.Time) []byte {
+	var b []byte
+	for _, s := range flattenFamilies(families) {
+		labels := sortLabels(append(slices.Clone(s.labels), labelPair(model.MetricNameLabel, s.name)))
+		var series []byte
+		for _, l := range labels {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, l.GetName())
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, l.GetValue())
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, label)
+		}
+
+		ts := s.timestampMs
+		if ts == 0 {
+			ts = now.UnixMilli()
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(ts))
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, sample)
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, series)
+	}
+
+	for _, mf := range families {
+		var metadata []byte
+		metadata = protowire.AppendTag(metadata, 1, protowire.VarintType)
+		metadata = protowire.AppendVarint(metadata, remoteWriteMetricTypes[mf.GetType()])
+		metadata = protowire.AppendTag(metadata, 2, protowire.BytesType)
+		metadata = protowire.AppendString(metadata, mf.GetName())
+		if mf.GetHelp() != "" {
+			metadata = protowire.AppendTag(metadata, 4, protowire.BytesType)
+			metadata = protowire.AppendString(metadata, mf.GetHelp())
+		}
+		if mf.GetUnit() != "" {
+			metadata = protowire.AppendTag(metadata, 5, protowire.BytesType)
+			metadata = protowire.AppendString(metadata, mf.GetUnit())
+		}
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, metadata)
+	}
+	return b
+}
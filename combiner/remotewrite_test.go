@@ -0,0 +1,177 @@
+package combiner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodeFields decodes the fields of a protobuf message, returning the
+// contents of length delimited fields and the raw values of the others by
+// field number.
+func decodeFields(t *testing.T, b []byte) map[protowire.Number][][]byte {
+	t.Helper()
+	fields := map[protowire.Number][][]byte{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		var value []byte
+		if typ == protowire.BytesType {
+			value, n = protowire.ConsumeBytes(b)
+		} else {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			value = b[:max(n, 0)]
+		}
+		if n < 0 {
+			t.Fatalf("invalid field %d: %v", num, protowire.ParseError(n))
+		}
+		fields[num] = append(fields[num], value)
+		b = b[n:]
+	}
+	return fields
+}
+
+// decodeWriteRequest decodes the series in a WriteRequest as text format
+// lines, and its metadata as "name type help" lines.
+func decodeWriteRequest(t *testing.T, b []byte) (series, metadata []string) {
+	t.Helper()
+	request := decodeFields(t, b)
+	for _, ts := range request[1] {
+		fields := decodeFields(t, ts)
+		var labels []string
+		for _, l := range fields[1] {
+			label := decodeFields(t, l)
+			labels = append(labels, fmt.Sprintf("%s=%q", label[1][0], label[2][0]))
+		}
+		sample := decodeFields(t, fields[2][0])
+		value, _ := protowire.ConsumeFixed64(sample[1][0])
+		timestamp, _ := protowire.ConsumeVarint(sample[2][0])
+		series = append(series, fmt.Sprintf("{%s} %s %d", strings.Join(labels, ","), formatFloat(math.Float64frombits(value)), timestamp))
+	}
+	for _, md := range request[3] {
+		fields := decodeFields(t, md)
+		typ, _ := protowire.ConsumeVarint(fields[1][0])
+		line := fmt.Sprintf("%s %d", fields[2][0], typ)
+		if help, ok := fields[4]; ok {
+			line += " " + string(help[0])
+		}
+		metadata = append(metadata, line)
+	}
+	return series, metadata
+}
+
+// TestRemoteWriter tests sending metrics to a remote write endpoint.
+func TestRemoteWriter(t *testing.T) {
+	testCases := []struct {
+		name             string
+		input            string
+		status           int
+		expectedSeries   []string
+		expectedMetadata []string
+		expectedError    string
+	}{
+		{
+			name:   "Counter and untyped",
+			input:  "# HELP requests_total Requests.\n# TYPE requests_total counter\nrequests_total{code=\"200\",a=\"x\"} 5\nother 1.5 1700000000000\n",
+			status: http.StatusNoContent,
+			expectedSeries: []string{
+				`{__name__="other"} 1.5 1700000000000`,
+				`{__name__="requests_total",a="x",code="200"} 5 1800000000000`,
+			},
+			expectedMetadata: []string{"other 0", "requests_total 1 Requests."},
+		},
+		{
+			name:   "Summary",
+			input:  "# TYPE latency summary\nlatency{quantile=\"0.5\"} 0.2\nlatency_sum 10\nlatency_count 40\n",
+			status: http.StatusOK,
+			expectedSeries: []string{
+				`{__name__="latency",quantile="0.5"} 0.2 1800000000000`,
+				`{__name__="latency_sum"} 10 1800000000000`,
+				`{__name__="latency_count"} 40 1800000000000`,
+			},
+			expectedMetadata: []string{"latency 5"},
+		},
+		{
+			name:          "Error status",
+			input:         "other 1\n",
+			status:        http.StatusBadRequest,
+			expectedError: "out of order sample",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var body []byte
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost {
+					t.Errorf("expected a POST request, got %s", r.Method)
+				}
+				for header, expected := range map[string]string{
+					"Content-Encoding":                  "snappy",
+					"Content-Type":                      "application/x-protobuf",
+					"X-Prometheus-Remote-Write-Version": "0.1.0",
+					"Authorization":                     "Bearer secret",
+				} {
+					if got := r.Header.Get(header); got != expected {
+						t.Errorf("expected %s header '%s', got '%s'", header, expected, got)
+					}
+				}
+				compressed, err := io.ReadAll(r.Body)
+				if err != nil {
+					t.Errorf("failed to read body: %v", err)
+				}
+				if body, err = snappy.Decode(nil, compressed); err != nil {
+					t.Errorf("failed to decode body: %v", err)
+				}
+				w.WriteHeader(tc.status)
+				if tc.status == http.StatusBadRequest {
+					fmt.Fprintln(w, "out of order sample")
+				}
+			}))
+			defer server.Close()
+
+			writer, err := NewRemoteWriter(Target{URL: server.URL, BearerTokenFile: writeFile(t, "token", "secret\n")}, nil)
+			if err != nil {
+				t.Fatalf("NewRemoteWriter failed: %v", err)
+			}
+			writer.now = func() time.Time { return time.UnixMilli(1800000000000) }
+
+			families, err := parseMetrics(strings.NewReader(tc.input), expfmt.FmtText)
+			if err != nil {
+				t.Fatalf("parseMetrics failed: %v", err)
+			}
+			err = writer.Push(context.Background(), families)
+			if tc.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+					t.Fatalf("expected error containing '%s', got: %v", tc.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("push failed: %v", err)
+			}
+
+			series, metadata := decodeWriteRequest(t, body)
+			if !reflect.DeepEqual(series, tc.expectedSeries) {
+				t.Errorf("got series %q, want %q", series, tc.expectedSeries)
+			}
+			if !reflect.DeepEqual(metadata, tc.expectedMetadata) {
+				t.Errorf("got metadata %q, want %q", metadata, tc.expectedMetadata)
+			}
+		})
+	}
+}
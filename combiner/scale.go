@@ -0,0 +1,119 @@
+package combiner
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+)
+
+// Scale multiplies or divides the values of a metric, for example to convert
+// milliseconds to seconds so exporters using different units can be combined.
+type Scale struct {
+	// Metric is the name of the metric to scale.
+	Metric string `yaml:"metric"`
+	// Multiply or Divide is the positive factor the values are scaled by.
+	// Only one can be set. The values of counters, gauges and untyped
+	// metrics, the sum, bucket boundaries and quantile values of histograms
+	// and summaries are scaled, but not their counts.
+	Multiply float64 `yaml:"multiply"`
+	Divide   float64 `yaml:"divide"`
+	// Name renames the metric, for example to add a _seconds suffix. Empty
+	// keeps the name.
+	Name string `yaml:"name"`
+}
+
+// Validate checks the factor and the metric names are valid.
+func (s Scale) Validate() error {
+	if !model.UTF8Validation.IsValidMetricName(s.Metric) {
+		return fmt.Errorf("invalid scale metric name %q", s.Metric)
+	}
+	if s.Name != "" && !model.UTF8Validation.IsValidMetricName(s.Name) {
+		return fmt.Errorf("invalid scale name %q", s.Name)
+	}
+	if (s.Multiply == 0) == (s.Divide == 0) {
+		return fmt.Errorf("scale of %s must set one of multiply or divide", s.Metric)
+	}
+	if s.Multiply < 0 || s.Divide < 0 {
+		return fmt.Errorf("scale of %s must be positive", s.Metric)
+	}
+	return nil
+}
+
+// apply scales a value. Dividing directly avoids the rounding error of
+// multiplying by the reciprocal.
+func (s Scale) apply(v float64) float64 {
+	if s.Divide != 0 {
+		return v / s.Divide
+	}
+	return v * s.Multiply
+}
+
+// scale returns a copy of mf with its values scaled and the new name. Native
+// histograms are dropped since their bucket boundaries are fixed by their
+// schema and can't be scaled.
+func (s Scale) scale(mf *dto.MetricFamily) *dto.MetricFamily {
+	scaled := &dto.MetricFamily{Name: proto.String(cmp.Or(s.Name, mf.GetName())), Help: mf.Help, Type: mf.Type, Unit: mf.Unit}
+	for _, m := range mf.Metric {
+		m = proto.Clone(m).(*dto.Metric)
+		switch {
+		case m.Counter != nil:
+			m.Counter.Value = proto.Float64(s.apply(m.Counter.GetValue()))
+		case m.Gauge != nil:
+			m.Gauge.Value = proto.Float64(s.apply(m.Gauge.GetValue()))
+		case m.Untyped != nil:
+			m.Untyped.Value = proto.Float64(s.apply(m.Untyped.GetValue()))
+		case m.Histogram != nil && isNativeHistogram(m.Histogram):
+			slog.Warn("Dropping native histogram that can't be scaled", "series", seriesString(mf.GetName(), m))
+			continue
+		case m.Histogram != nil:
+			m.Histogram.SampleSum = proto.Float64(s.apply(m.Histogram.GetSampleSum()))
+			for _, b := range m.Histogram.Bucket {
+				b.UpperBound = proto.Float64(s.apply(b.GetUpperBound()))
+			}
+		case m.Summary != nil:
+			m.Summary.SampleSum = proto.Float64(s.apply(m.Summary.GetSampleSum()))
+			for _, q := range m.Summary.Quantile {
+				q.Value = proto.Float64(s.apply(q.GetValue()))
+			}
+		}
+		scaled.Metric = append(scaled.Metric, m)
+	}
+	return scaled
+}
+
+// scales is a Transformer applying each scale to the combined metrics.
+type scales []Scale
+
+// Transform implements Transformer.
+func (ss scales) Transform(ctx context.Context, families []*dto.MetricFamily) ([]*dto.MetricFamily, error) {
+	result := slices.Clone(families)
+	for i, mf := range result {
+		for _, s := range ss {
+			if mf.GetName() == s.Metric {
+				result[i] = s.scale(mf)
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+// compileScales validates scales and returns them as a Transformer, or nil if
+// there are none.
+func compileScales(ss []Scale) (Transformer, error) {
+	if len(ss) == 0 {
+		return nil, nil
+	}
+	for _, s := range ss {
+		if err := s.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return scales(slices.Clone(ss)), nil
+}
@@ -0,0 +1,111 @@
+package combiner
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestCombinerScales tests scaling and renaming metrics to harmonise the units
+// of different exporters.
+func TestCombinerScales(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ms":
+			fmt.Fprint(w, "# TYPE request_duration_milliseconds gauge\nrequest_duration_milliseconds 250\n")
+			fmt.Fprint(w, "# TYPE rpc_milliseconds histogram\nrpc_milliseconds_bucket{le=\"100\"} 1\nrpc_milliseconds_bucket{le=\"+Inf\"} 2\nrpc_milliseconds_sum 300\nrpc_milliseconds_count 2\n")
+			fmt.Fprint(w, "# TYPE gc_milliseconds summary\ngc_milliseconds{quantile=\"0.5\"} 20\ngc_milliseconds_sum 50\ngc_milliseconds_count 2\n")
+		case "/s":
+			fmt.Fprint(w, "# TYPE request_duration_seconds gauge\nrequest_duration_seconds 0.5\n")
+		}
+	}))
+	defer server.Close()
+	targets := []Target{
+		{URL: server.URL + "/ms", Labels: map[string]string{"instance": "a"}},
+		{URL: server.URL + "/s", Labels: map[string]string{"instance": "b"}},
+	}
+
+	testCases := []struct {
+		name         string
+		scales       []Scale
+		aggregations []Aggregation
+		prefixes     []string
+		expected     string
+	}{
+		{
+			name:   "Divide and rename",
+			scales: []Scale{{Metric: "request_duration_milliseconds", Divide: 1000, Name: "request_duration_seconds"}},
+			expected: "# TYPE request_duration_seconds gauge\n" +
+				"request_duration_seconds{instance=\"a\"} 0.25\nrequest_duration_seconds{instance=\"b\"} 0.5\n",
+		},
+		{
+			name:   "Multiply",
+			scales: []Scale{{Metric: "request_duration_seconds", Multiply: 1000}},
+			expected: "# TYPE request_duration_milliseconds gauge\nrequest_duration_milliseconds{instance=\"a\"} 250\n" +
+				"# TYPE request_duration_seconds gauge\nrequest_duration_seconds{instance=\"b\"} 500\n",
+		},
+		{
+			name:         "Aggregations see the scaled metrics",
+			scales:       []Scale{{Metric: "request_duration_milliseconds", Divide: 1000, Name: "request_duration_seconds"}},
+			aggregations: []Aggregation{{Metric: "request_duration_seconds", Op: AggregateMax}},
+			expected:     "# TYPE request_duration_seconds gauge\nrequest_duration_seconds 0.5\n",
+		},
+		{
+			name: "Histograms and summaries",
+			scales: []Scale{
+				{Metric: "rpc_milliseconds", Divide: 1000, Name: "rpc_seconds"},
+				{Metric: "gc_milliseconds", Divide: 1000, Name: "gc_seconds"},
+			},
+			prefixes: []string{"rpc_", "gc_"},
+			expected: "# TYPE gc_seconds summary\ngc_seconds{instance=\"a\",quantile=\"0.5\"} 0.02\ngc_seconds_sum{instance=\"a\"} 0.05\ngc_seconds_count{instance=\"a\"} 2\n" +
+				"# TYPE rpc_seconds histogram\nrpc_seconds_bucket{instance=\"a\",le=\"0.1\"} 1\nrpc_seconds_bucket{instance=\"a\",le=\"+Inf\"} 2\nrpc_seconds_sum{instance=\"a\"} 0.3\nrpc_seconds_count{instance=\"a\"} 2\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			filter := Filter{Prefixes: []string{"request_"}}
+			if tc.prefixes != nil {
+				filter.Prefixes = tc.prefixes
+			}
+			agg, err := New(targets, Options{Scales: tc.scales, Aggregations: tc.aggregations, Filter: filter})
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			rr := httptest.NewRecorder()
+			agg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+			}
+			if rr.Body.String() != tc.expected {
+				t.Errorf("got %q, want %q", rr.Body.String(), tc.expected)
+			}
+		})
+	}
+}
+
+// TestScaleValidate tests invalid scales are rejected.
+func TestScaleValidate(t *testing.T) {
+	testCases := []struct {
+		name        string
+		scale       Scale
+		expectedErr bool
+	}{
+		{"Multiply", Scale{Metric: "a", Multiply: 2}, false},
+		{"Divide and rename", Scale{Metric: "a_ms", Divide: 1000, Name: "a_seconds"}, false},
+		{"No factor", Scale{Metric: "a"}, true},
+		{"Both factors", Scale{Metric: "a", Multiply: 2, Divide: 2}, true},
+		{"Negative", Scale{Metric: "a", Multiply: -1}, true},
+		{"Invalid name", Scale{Metric: "a", Multiply: 2, Name: "a\xff"}, true},
+		{"UTF-8 names", Scale{Metric: "http.server.duration", Divide: 1000, Name: "http.server.duration.seconds"}, false},
+		{"No metric", Scale{Multiply: 2}, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.scale.Validate(); (err != nil) != tc.expectedErr {
+				t.Errorf("expected error %v, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
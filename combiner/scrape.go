@@ -0,0 +1,70 @@
+package combiner
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// snapshot is the outcome of a background scrape of all targets.
+type snapshot struct {
+	families []*dto.MetricFamily
+	// failed are the URLs of the targets missing from families.
+	failed []string
+	err    error
+	// time is when the scrape completed.
+	time time.Time
+}
+
+// latestSnapshot returns the most recent background scrape, or nil if none
+// has completed.
+func (c *Combiner) latestSnapshot() *snapshot {
+	c.snapshotMu.RLock()
+	defer c.snapshotMu.RUnlock()
+	return c.latest
+}
+
+// scrape fetches and combines all targets and stores the result as the latest
+// snapshot. The timeout is extended by the jitter, so a target fetched late
+// still has the full timeout, but a scrape never takes longer than the scrape
+// interval, so the timeout is capped to it.
+func (c *Combiner) scrape(ctx context.Context) {
+	timeout := c.timeout + c.scrapeJitter
+	if c.timeout <= 0 || timeout > c.scrapeInterval {
+		timeout = c.scrapeInterval
+	}
+
+	ctx, span := tracer().Start(ctx, "combine", trace.WithSpanKind(trace.SpanKindInternal))
+	defer span.End()
+
+	start := time.Now()
+	families, failed, err := c.gatherTargets(ctx, timeout, c.currentTargets(), nil, c.scrapeJitter)
+	if err != nil {
+		slog.Warn("Background scrape failed", "duration", time.Since(start), "err", err)
+	} else {
+		slog.Debug("Background scrape completed", "duration", time.Since(start), "families", len(families))
+	}
+
+	c.snapshotMu.Lock()
+	defer c.snapshotMu.Unlock()
+	c.latest = &snapshot{families: families, failed: failed, err: err, time: time.Now()}
+}
+
+// Run scrapes the targets immediately and then every ScrapeInterval until ctx
+// is cancelled. It must be called when the ScrapeInterval option is set.
+func (c *Combiner) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.scrapeInterval)
+	defer ticker.Stop()
+
+	for {
+		c.scrape(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package combiner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestCombinerBackgroundScrape tests that in background mode requests are
+// served the latest scrape without fetching the upstreams.
+func TestCombinerBackgroundScrape(t *testing.T) {
+	var requests atomic.Int32
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		if failing.Load() {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "metric_a %d\n", n)
+	}))
+	defer server.Close()
+
+	agg, err := newCombiner(staticTargets([]string{server.URL}), options{scrapeInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("newCombiner failed: %v", err)
+	}
+
+	get := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		agg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+		return rr
+	}
+
+	if rr := get(); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d before the first scrape, got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+
+	agg.scrape(context.Background())
+	for range 2 {
+		rr := get()
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+		if expected := "# TYPE metric_a untyped\nmetric_a 1\n"; rr.Body.String() != expected {
+			t.Errorf("got %q, want %q", rr.Body.String(), expected)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("expected 1 upstream request, got %d", n)
+	}
+
+	failing.Store(true)
+	agg.scrape(context.Background())
+	if rr := get(); rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected status %d after a failed scrape, got %d", http.StatusInternalServerError, rr.Code)
+	}
+}
+
+// TestCombinerRun tests that Run scrapes immediately and stops when the
+// context is cancelled.
+func TestCombinerRun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "metric_a 1")
+	}))
+	defer server.Close()
+
+	agg, err := newCombiner(staticTargets([]string{server.URL}), options{scrapeInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("newCombiner failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		agg.Run(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for agg.latestSnapshot() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("no scrape completed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not stop after the context was cancelled")
+	}
+}
+
+// TestTargetOffset tests the offsets of the targets are within the jitter,
+// stable and spread out.
+func TestTargetOffset(t *testing.T) {
+	jitter := 10 * time.Second
+	offsets := make(map[time.Duration]bool)
+	for i := range 20 {
+		tg := &target{url: fmt.Sprintf("http://upstream-%d:9100/metrics", i)}
+		offset := tg.offset(jitter)
+		if offset < 0 || offset >= jitter {
+			t.Errorf("offset %v of %s isn't within %v", offset, tg.url, jitter)
+		}
+		if again := tg.offset(jitter); again != offset {
+			t.Errorf("offset of %s changed from %v to %v", tg.url, offset, again)
+		}
+		if tg.offset(0) != 0 {
+			t.Errorf("expected no offset for %s without a jitter", tg.url)
+		}
+		offsets[offset] = true
+	}
+	if len(offsets) < 10 {
+		t.Errorf("expected the offsets to be spread out, got %d distinct values", len(offsets))
+	}
+}
+
+// TestCombinerScrapeJitter tests a background scrape waits for the offsets
+// of the targets.
+func TestCombinerScrapeJitter(t *testing.T) {
+	var fetched atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched.Store(time.Now().UnixNano())
+		fmt.Fprintln(w, "metric_a 1")
+	}))
+	defer server.Close()
+
+	jitter := 200 * time.Millisecond
+	agg, err := newCombiner(staticTargets([]string{server.URL}), options{scrapeInterval: time.Hour, scrapeJitter: jitter})
+	if err != nil {
+		t.Fatalf("newCombiner failed: %v", err)
+	}
+	offset := agg.currentTargets()[0].offset(jitter)
+
+	start := time.Now()
+	agg.scrape(context.Background())
+	if delay := time.Duration(fetched.Load() - start.UnixNano()); delay < offset {
+		t.Errorf("expected the fetch to be delayed by at least %v, got %v", offset, delay)
+	}
+	if s := agg.latestSnapshot(); s == nil || s.err != nil {
+		t.Errorf("expected a successful scrape, got %+v", s)
+	}
+}
@@ -0,0 +1,305 @@
+package combiner
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// matchType is the comparison made by a label matcher.
+type matchType string
+
+const (
+	matchEqual     matchType = "="
+	matchNotEqual  matchType = "!="
+	matchRegexp    matchType = "=~"
+	matchNotRegexp matchType = "!~"
+)
+
+// labelMatcher matches the value of a single label.
+type labelMatcher struct {
+	name  string
+	typ   matchType
+	value string
+	// re is the compiled anchored regex for matchRegexp and matchNotRegexp.
+	re *regexp.Regexp
+}
+
+// matches reports whether the label value matches. A missing label has an
+// empty value.
+func (m labelMatcher) matches(value string) bool {
+	switch m.typ {
+	case matchEqual:
+		return value == m.value
+	case matchNotEqual:
+		return value != m.value
+	case matchRegexp:
+		return m.re.MatchString(value)
+	case matchNotRegexp:
+		return !m.re.MatchString(value)
+	}
+	return false
+}
+
+// seriesSelector is a PromQL style series selector such as
+// `http_requests_total{code=~"5.."}`, a series must match every matcher. The
+// metric name is matched as the __name__ label.
+type seriesSelector []labelMatcher
+
+// matches reports whether a metric in the family with the given name matches
+// the selector.
+func (s seriesSelector) matches(name string, m *dto.Metric) bool {
+	for _, lm := range s {
+		value := ""
+		if lm.name == model.MetricNameLabel {
+			value = name
+		} else {
+			for _, l := range m.Label {
+				if l.GetName() == lm.name {
+					value = l.GetValue()
+					break
+				}
+			}
+		}
+		if !lm.matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSelector parses a series selector of the form name{label="value",...}
+// where either the name or the matchers may be omitted. Label values may be
+// quoted with double quotes, single quotes or backticks. UTF-8 metric and
+// label names are quoted inside the braces, as in {"my.metric","my.label"="a"}.
+func parseSelector(s string) (seriesSelector, error) {
+	p := &selectorParser{input: s}
+	sel, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("invalid series selector %q: %w", s, err)
+	}
+	return sel, nil
+}
+
+// selectorParser is the state of parsing a single series selector.
+type selectorParser struct {
+	input string
+	pos   int
+}
+
+func (p *selectorParser) parse() (seriesSelector, error) {
+	var sel seriesSelector
+
+	p.skipSpace()
+	if name := p.identifier(true); name != "" {
+		sel = append(sel, labelMatcher{name: model.MetricNameLabel, typ: matchEqual, value: name})
+	}
+
+	p.skipSpace()
+	if p.consume("{") {
+		for {
+			p.skipSpace()
+			if p.consume("}") {
+				break
+			}
+			m, err := p.matcher()
+			if err != nil {
+				return nil, err
+			}
+			sel = append(sel, m)
+
+			p.skipSpace()
+			if p.consume("}") {
+				break
+			}
+			if !p.consume(",") {
+				return nil, fmt.Errorf("expected , or } at position %d", p.pos)
+			}
+		}
+	}
+
+	p.skipSpace()
+	if p.pos != len(p.input) {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.input[p.pos:], p.pos)
+	}
+	if len(sel) == 0 {
+		return nil, fmt.Errorf("a metric name or at least one label matcher is required")
+	}
+	return sel, nil
+}
+
+// matcher parses a single label matcher. Label names may be quoted to use
+// UTF-8 characters, and a quoted name on its own, as in {"my.metric"}, is the
+// metric name.
+func (p *selectorParser) matcher() (labelMatcher, error) {
+	var m labelMatcher
+	if p.pos < len(p.input) && strings.IndexByte("\"'`", p.input[p.pos]) >= 0 {
+		name, err := p.quoted()
+		if err != nil {
+			return m, err
+		}
+		p.skipSpace()
+		if p.pos == len(p.input) || p.input[p.pos] == ',' || p.input[p.pos] == '}' {
+			return labelMatcher{name: model.MetricNameLabel, typ: matchEqual, value: name}, nil
+		}
+		m.name = name
+	} else if m.name = p.identifier(false); m.name == "" {
+		return m, fmt.Errorf("expected a label name at position %d", p.pos)
+	}
+
+	p.skipSpace()
+	// Check the two character operators first so = doesn't match =~
+	for _, typ := range []matchType{matchNotEqual, matchRegexp, matchNotRegexp, matchEqual} {
+		if p.consume(string(typ)) {
+			m.typ = typ
+			break
+		}
+	}
+	if m.typ == "" {
+		return m, fmt.Errorf("expected one of =, !=, =~ or !~ at position %d", p.pos)
+	}
+
+	p.skipSpace()
+	value, err := p.quoted()
+	if err != nil {
+		return m, err
+	}
+	m.value = value
+
+	if m.typ == matchRegexp || m.typ == matchNotRegexp {
+		if m.re, err = compileAnchoredRegex(value); err != nil {
+			return m, fmt.Errorf("invalid regex for label %s: %w", m.name, err)
+		}
+	}
+	return m, nil
+}
+
+// identifier consumes a label name, or a metric name which may also contain
+// colons.
+func (p *selectorParser) identifier(metricName bool) string {
+	start := p.pos
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(p.pos > start && c >= '0' && c <= '9') || (metricName && c == ':') {
+			p.pos++
+			continue
+		}
+		break
+	}
+	return p.input[start:p.pos]
+}
+
+// quoted consumes a quoted string and returns its unescaped value.
+func (p *selectorParser) quoted() (string, error) {
+	if p.pos >= len(p.input) {
+		return "", fmt.Errorf("expected a quoted label value at position %d", p.pos)
+	}
+	quote := p.input[p.pos]
+	if quote != '"' && quote != '\'' && quote != '`' {
+		return "", fmt.Errorf("expected a quoted label value at position %d", p.pos)
+	}
+	start := p.pos
+	p.pos++
+
+	var sb strings.Builder
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		p.pos++
+		switch {
+		case c == quote:
+			return sb.String(), nil
+		case c == '\\' && quote != '`':
+			if p.pos >= len(p.input) {
+				break
+			}
+			escaped := p.input[p.pos]
+			p.pos++
+			switch escaped {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case '\\', '"', '\'':
+				sb.WriteByte(escaped)
+			default:
+				return "", fmt.Errorf("unknown escape sequence \\%c at position %d", escaped, p.pos-2)
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated quoted string starting at position %d", start)
+}
+
+// skipSpace consumes any whitespace.
+func (p *selectorParser) skipSpace() {
+	for p.pos < len(p.input) && strings.IndexByte(" \t\n\r", p.input[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+// consume consumes s if the remaining input starts with it.
+func (p *selectorParser) consume(s string) bool {
+	if strings.HasPrefix(p.input[p.pos:], s) {
+		p.pos += len(s)
+		return true
+	}
+	return false
+}
+
+// seriesFilter keeps or drops individual series using selectors.
+type seriesFilter struct {
+	// keep selects the series to keep, if empty all series are kept.
+	keep []seriesSelector
+	// drop removes series that were kept.
+	drop []seriesSelector
+}
+
+// includes reports whether a metric in the family with the given name is kept.
+func (f seriesFilter) includes(name string, m *dto.Metric) bool {
+	if len(f.keep) > 0 && !matchesAny(f.keep, name, m) {
+		return false
+	}
+	return !matchesAny(f.drop, name, m)
+}
+
+// matchesAny reports whether the metric matches any of the selectors.
+func matchesAny(selectors []seriesSelector, name string, m *dto.Metric) bool {
+	for _, sel := range selectors {
+		if sel.matches(name, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterSeries returns the families with only the series selected by filter.
+// Families are copied rather than modified, and families without any
+// remaining series are removed.
+func filterSeries(families []*dto.MetricFamily, filter seriesFilter) []*dto.MetricFamily {
+	if len(filter.keep) == 0 && len(filter.drop) == 0 {
+		return families
+	}
+
+	var filtered []*dto.MetricFamily
+	for _, mf := range families {
+		var metrics []*dto.Metric
+		for _, m := range mf.Metric {
+			if filter.includes(mf.GetName(), m) {
+				metrics = append(metrics, m)
+			}
+		}
+		if len(metrics) == 0 {
+			continue
+		}
+		if len(metrics) < len(mf.Metric) {
+			mf = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type, Unit: mf.Unit, Metric: metrics}
+		}
+		filtered = append(filtered, mf)
+	}
+	return filtered
+}
@@ -0,0 +1,144 @@
+package combiner
+
+import (
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+)
+
+// TestParseSelector tests parsing series selectors and matching them against series.
+func TestParseSelector(t *testing.T) {
+	metric := &dto.Metric{Label: []*dto.LabelPair{
+		{Name: proto.String("code"), Value: proto.String("503")},
+		{Name: proto.String("env"), Value: proto.String("prod")},
+		{Name: proto.String("k8s.pod"), Value: proto.String("web-1")},
+	}}
+
+	testCases := []struct {
+		name          string
+		selector      string
+		matches       bool
+		expectedError string
+	}{
+		{name: "Metric name", selector: "http_requests_total", matches: true},
+		{name: "Other metric name", selector: "other_total", matches: false},
+		{name: "Equal", selector: `{env="prod"}`, matches: true},
+		{name: "Not equal", selector: `{env!="prod"}`, matches: false},
+		{name: "Regex", selector: `{code=~"5.."}`, matches: true},
+		{name: "Regex is anchored", selector: `{code=~"5"}`, matches: false},
+		{name: "Not regex", selector: `{code!~"5.."}`, matches: false},
+		{name: "Missing label is empty", selector: `{job=""}`, matches: true},
+		{name: "Name and matchers", selector: `http_requests_total{env="prod", code=~"5.."}`, matches: true},
+		{name: "Name label", selector: `{__name__=~"http_.*"}`, matches: true},
+		{name: "Single quotes", selector: `{env='prod'}`, matches: true},
+		{name: "Backticks", selector: "{code=~`5\\d\\d`}", matches: true},
+		{name: "Escaped quote", selector: `{env="pr\"od"}`, matches: false},
+		{name: "Trailing comma", selector: `{env="prod",}`, matches: true},
+		{name: "Quoted metric name", selector: `{"http_requests_total", env="prod"}`, matches: true},
+		{name: "Other quoted metric name", selector: `{"http.requests.total"}`, matches: false},
+		{name: "Quoted label name", selector: `{"k8s.pod"=~"web-.*"}`, matches: true},
+		{name: "Empty", selector: "", expectedError: "metric name or at least one label matcher"},
+		{name: "Empty braces", selector: "{}", expectedError: "metric name or at least one label matcher"},
+		{name: "Unquoted value", selector: "{env=prod}", expectedError: "expected a quoted label value"},
+		{name: "Unknown operator", selector: `{env>"prod"}`, expectedError: "expected one of"},
+		{name: "Unterminated", selector: `{env="prod}`, expectedError: "unterminated"},
+		{name: "Missing brace", selector: `{env="prod"`, expectedError: "expected , or }"},
+		{name: "Invalid regex", selector: `{env=~"("}`, expectedError: "invalid regex"},
+		{name: "Trailing input", selector: `up{} down`, expectedError: "unexpected"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sel, err := parseSelector(tc.selector)
+			if tc.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+					t.Fatalf("expected error containing '%s', got: %v", tc.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSelector failed: %v", err)
+			}
+			if got := sel.matches("http_requests_total", metric); got != tc.matches {
+				t.Errorf("matches returned %v, want %v", got, tc.matches)
+			}
+		})
+	}
+}
+
+// TestFilterSeries tests keeping and dropping individual series.
+func TestFilterSeries(t *testing.T) {
+	input := "# TYPE requests_total counter\n" +
+		"requests_total{env=\"dev\"} 1\n" +
+		"requests_total{env=\"prod\"} 2\n" +
+		"# TYPE up gauge\n" +
+		"up{env=\"dev\"} 1\n"
+
+	testCases := []struct {
+		name     string
+		keep     []string
+		drop     []string
+		expected string
+	}{
+		{
+			name:     "No selectors",
+			expected: input,
+		},
+		{
+			name:     "Keep",
+			keep:     []string{`{env="prod"}`},
+			expected: "# TYPE requests_total counter\nrequests_total{env=\"prod\"} 2\n",
+		},
+		{
+			name:     "Drop",
+			drop:     []string{`requests_total{env="dev"}`},
+			expected: "# TYPE requests_total counter\nrequests_total{env=\"prod\"} 2\n# TYPE up gauge\nup{env=\"dev\"} 1\n",
+		},
+		{
+			name:     "Keep then drop",
+			keep:     []string{`{env="dev"}`},
+			drop:     []string{"up"},
+			expected: "# TYPE requests_total counter\nrequests_total{env=\"dev\"} 1\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			families, err := parseMetrics(strings.NewReader(input), expfmt.FmtText)
+			if err != nil {
+				t.Fatalf("parseMetrics failed: %v", err)
+			}
+
+			var filter seriesFilter
+			for _, s := range tc.keep {
+				sel, err := parseSelector(s)
+				if err != nil {
+					t.Fatalf("parseSelector failed: %v", err)
+				}
+				filter.keep = append(filter.keep, sel)
+			}
+			for _, s := range tc.drop {
+				sel, err := parseSelector(s)
+				if err != nil {
+					t.Fatalf("parseSelector failed: %v", err)
+				}
+				filter.drop = append(filter.drop, sel)
+			}
+
+			filtered := filterSeries(families, filter)
+			body, err := encodeMetrics(filtered, expfmt.FmtText)
+			if err != nil {
+				t.Fatalf("encodeMetrics failed: %v", err)
+			}
+			if string(body) != tc.expected {
+				t.Errorf("got %q, want %q", body, tc.expected)
+			}
+			if len(families[0].Metric) != 2 {
+				t.Errorf("filterSeries modified the original family")
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package combiner
+
+import (
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// selfMetricFamilies returns buildInfo, if it isn't nil, and metrics about
+// fetching each target for a single request. results holds the result for each target, or nil if the target
+// didn't respond before the deadline.
+func selfMetricFamilies(buildInfo *dto.MetricFamily, targets []*target, results []*result) []*dto.MetricFamily {
+	up := newSelfMetricFamily("combiner_target_up", "Whether the last fetch of the upstream succeeded (1) or not (0).", dto.MetricType_GAUGE)
+	duration := newSelfMetricFamily("combiner_scrape_duration_seconds", "Time taken to fetch the upstream.", dto.MetricType_GAUGE)
+	errors := newSelfMetricFamily("combiner_scrape_errors_total", "Total number of failed fetches of the upstream.", dto.MetricType_COUNTER)
+	dnsErrors := newSelfMetricFamily("combiner_dns_errors_total", "Total number of fetches of the upstream that failed to resolve its host.", dto.MetricType_COUNTER)
+	bytes := newSelfMetricFamily("combiner_scraped_bytes", "Size of the uncompressed body fetched from the upstream.", dto.MetricType_GAUGE)
+	lastSuccess := newSelfMetricFamily("combiner_target_last_success_timestamp_seconds", "Time of the last successful fetch of the upstream, in seconds since the epoch.", dto.MetricType_GAUGE)
+	partial := newSelfMetricFamily("combiner_scrape_partial", "Whether some upstreams failed so the combined metrics are incomplete (1) or not (0).", dto.MetricType_GAUGE)
+	partial.Metric = []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(0)}}}
+
+	for i, t := range targets {
+		res := results[i]
+		value := 0.0
+		if res != nil && res.err == nil {
+			value = 1
+		} else {
+			partial.Metric[0].Gauge.Value = proto.Float64(1)
+		}
+		addSelfMetric(up, t, value)
+		addSelfMetric(errors, t, float64(t.scrapeErrorCount()))
+		addSelfMetric(dnsErrors, t, float64(t.dnsErrorCount()))
+		if res != nil {
+			addSelfMetric(duration, t, res.duration.Seconds())
+			addSelfMetric(bytes, t, float64(res.bytes))
+		}
+		if ts := t.lastSuccessTime(); !ts.IsZero() {
+			addSelfMetric(lastSuccess, t, float64(ts.UnixNano())/1e9)
+		}
+	}
+
+	var families []*dto.MetricFamily
+	if buildInfo != nil {
+		families = append(families, buildInfo)
+	}
+	// Families without metrics can't be encoded
+	for _, mf := range []*dto.MetricFamily{up, duration, errors, dnsErrors, bytes, lastSuccess, partial} {
+		if len(mf.Metric) > 0 {
+			families = append(families, mf)
+		}
+	}
+	return families
+}
+
+// newSelfMetricFamily creates an empty family for one of the combiner's own metrics.
+func newSelfMetricFamily(name, help string, typ dto.MetricType) *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name: proto.String(name),
+		Help: proto.String(help),
+		Type: typ.Enum(),
+	}
+}
+
+// addSelfMetric adds a metric for the target to a counter or gauge family.
+func addSelfMetric(mf *dto.MetricFamily, t *target, value float64) {
+	m := &dto.Metric{
+		Label: []*dto.LabelPair{{Name: proto.String("target"), Value: proto.String(t.name)}},
+	}
+	if mf.GetType() == dto.MetricType_COUNTER {
+		m.Counter = &dto.Counter{Value: proto.Float64(value)}
+	} else {
+		m.Gauge = &dto.Gauge{Value: proto.Float64(value)}
+	}
+	mf.Metric = append(mf.Metric, m)
+}
@@ -0,0 +1,129 @@
+package combiner
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// TestSelfMetrics tests the metrics about each target's fetch.
+func TestSelfMetrics(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "metric_a 1\n")
+	}))
+	defer healthy.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	agg, err := newCombiner(staticTargets([]string{healthy.URL, failing.URL}), options{selfMetrics: true, buildInfo: &dto.MetricFamily{
+		Name:   proto.String("combiner_build_info"),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+	}})
+	if err != nil {
+		t.Fatalf("newCombiner failed: %v", err)
+	}
+
+	var body string
+	for range 2 {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		rr := httptest.NewRecorder()
+		agg.ServeHTTP(rr, req)
+		body = rr.Body.String()
+	}
+
+	expectedLines := []string{
+		"# TYPE combiner_build_info gauge",
+		"# TYPE combiner_target_up gauge",
+		fmt.Sprintf("combiner_target_up{target=\"%s\"} 1", healthy.URL),
+		fmt.Sprintf("combiner_target_up{target=\"%s\"} 0", failing.URL),
+		"# TYPE combiner_scrape_errors_total counter",
+		fmt.Sprintf("combiner_scrape_errors_total{target=\"%s\"} 0", healthy.URL),
+		fmt.Sprintf("combiner_scrape_errors_total{target=\"%s\"} 2", failing.URL),
+		fmt.Sprintf("combiner_scraped_bytes{target=\"%s\"} 11", healthy.URL),
+		fmt.Sprintf("combiner_scrape_duration_seconds{target=\"%s\"} ", healthy.URL),
+		fmt.Sprintf("combiner_scrape_duration_seconds{target=\"%s\"} ", failing.URL),
+		"# TYPE combiner_target_last_success_timestamp_seconds gauge",
+		fmt.Sprintf("combiner_target_last_success_timestamp_seconds{target=\"%s\"} ", healthy.URL),
+		"# TYPE combiner_scrape_partial gauge",
+		"combiner_scrape_partial 1",
+	}
+	if unexpected := fmt.Sprintf("combiner_target_last_success_timestamp_seconds{target=\"%s\"}", failing.URL); strings.Contains(body, unexpected) {
+		t.Errorf("response body contains a last success time for a target that never succeeded. Body:\n%s", body)
+	}
+	for _, line := range expectedLines {
+		if !strings.Contains(body, line) {
+			t.Errorf("response body does not contain expected line '%s'. Body:\n%s", line, body)
+		}
+	}
+}
+
+// TestSelfMetricsMissingResult checks that a target without a result is reported as down.
+func TestSelfMetricsMissingResult(t *testing.T) {
+	targets := []*target{{url: "http://a"}, {url: "http://b"}}
+	families := selfMetricFamilies(nil, targets, []*result{nil, nil})
+
+	names := []string{}
+	for _, mf := range families {
+		names = append(names, mf.GetName())
+	}
+	if expected := "combiner_target_up,combiner_scrape_errors_total,combiner_dns_errors_total,combiner_scrape_partial"; strings.Join(names, ",") != expected {
+		t.Errorf("got families %v, want %s", names, expected)
+	}
+	for _, m := range families[0].Metric {
+		if m.GetGauge().GetValue() != 0 {
+			t.Errorf("expected target %s to be down", m.Label[0].GetValue())
+		}
+	}
+}
+
+// TestCombinerRedactsTargetURLs checks a password in a target URL isn't shown
+// in the self metrics, failed targets header or target status.
+func TestCombinerRedactsTargetURLs(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "metric_a 1\n")
+	}))
+	defer healthy.Close()
+
+	u, err := url.Parse(failing.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.User = url.UserPassword("prometheus", "secret")
+	agg, err := newCombiner(staticTargets([]string{u.String(), healthy.URL}), options{selfMetrics: true, failedTargetsHeader: true, breakerThreshold: 5, breakerCooldown: time.Minute})
+	if err != nil {
+		t.Fatalf("newCombiner failed: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	agg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+
+	redacted := u.Redacted()
+	status := agg.Targets()[0]
+	seen := map[string]string{
+		"response body":         rr.Body.String(),
+		"failed targets header": rr.Header().Get(FailedTargetsHeader),
+		"target status URL":     status.URL,
+		"last error":            fmt.Sprint(status.LastError),
+	}
+	for where, text := range seen {
+		if strings.Contains(text, "secret") {
+			t.Errorf("%s contains the password: %s", where, text)
+		}
+		if !strings.Contains(text, redacted) {
+			t.Errorf("%s does not contain the redacted URL %s: %s", where, redacted, text)
+		}
+	}
+}
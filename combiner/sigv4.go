@@ -0,0 +1,395 @@
+package combiner
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultSigV4Service is the service requests are signed for if it isn't
+// set, Amazon Managed Service for Prometheus.
+const defaultSigV4Service = "aps"
+
+// SigV4 configures signing requests with AWS Signature Version 4.
+type SigV4 struct {
+	// Region defaults to the AWS_REGION or AWS_DEFAULT_REGION environment
+	// variables.
+	Region string `yaml:"region"`
+	// Service is the service the upstream belongs to, default aps.
+	Service string `yaml:"service"`
+	// AccessKey and SecretKeyFile are static credentials. If unset the
+	// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+	// environment variables are used, or a web identity token from
+	// AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN.
+	AccessKey     string `yaml:"access_key"`
+	SecretKeyFile string `yaml:"secret_key_file"`
+	// RoleARN is a role assumed with the credentials, whose temporary
+	// credentials sign the requests.
+	RoleARN    string `yaml:"role_arn"`
+	ExternalID string `yaml:"external_id"`
+}
+
+// Validate checks the SigV4 configuration is consistent.
+func (c SigV4) Validate() error {
+	if (c.AccessKey == "") != (c.SecretKeyFile == "") {
+		return errors.New("sigv4 access_key and secret_key_file must be set together")
+	}
+	if c.RoleARN != "" && !strings.HasPrefix(c.RoleARN, "arn:") {
+		return fmt.Errorf("invalid sigv4 role_arn %q", c.RoleARN)
+	}
+	if c.ExternalID != "" && c.RoleARN == "" {
+		return errors.New("sigv4 external_id requires a role_arn")
+	}
+	return nil
+}
+
+// awsCredentials are credentials for signing requests. Temporary credentials
+// have a session token and expire.
+type awsCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	expires         time.Time
+}
+
+// awsCredentialsExpiryDelta is how long before they expire temporary
+// credentials are replaced.
+const awsCredentialsExpiryDelta = 5 * time.Minute
+
+// awsCredentialsCache holds temporary credentials until they are about to
+// expire.
+type awsCredentialsCache struct {
+	mu    sync.Mutex
+	creds awsCredentials
+}
+
+// get returns the cached credentials, calling fetch if there aren't any or
+// they are about to expire.
+func (c *awsCredentialsCache) get(ctx context.Context, now time.Time, fetch func(context.Context) (awsCredentials, error)) (awsCredentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.creds.accessKeyID != "" && now.Add(awsCredentialsExpiryDelta).Before(c.creds.expires) {
+		return c.creds, nil
+	}
+	creds, err := fetch(ctx)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	c.creds = creds
+	return creds, nil
+}
+
+// sigv4Signer signs requests for a SigV4 configuration, and assumes its role
+// if it has one.
+type sigv4Signer struct {
+	cfg       SigV4
+	region    string
+	service   string
+	secretKey *secretFile
+	// client is used to call STS, at stsURL.
+	client *http.Client
+	stsURL string
+	now    func() time.Time
+
+	webIdentity awsCredentialsCache
+	role        awsCredentialsCache
+}
+
+// sigv4Signers holds a signer for each SigV4 configuration, so targets with
+// the same settings share the credentials of an assumed role.
+var sigv4Signers = struct {
+	sync.Mutex
+	signers map[SigV4]*sigv4Signer
+}{signers: make(map[SigV4]*sigv4Signer)}
+
+// sharedSigV4Signer returns the signer for cfg, creating it with a client
+// using transport to call STS if there isn't one.
+func sharedSigV4Signer(cfg SigV4, transport http.RoundTripper) (*sigv4Signer, error) {
+	sigv4Signers.Lock()
+	defer sigv4Signers.Unlock()
+	if signer, ok := sigv4Signers.signers[cfg]; ok {
+		return signer, nil
+	}
+	signer, err := newSigV4Signer(cfg, &http.Client{Transport: transport, Timeout: time.Minute})
+	if err != nil {
+		return nil, err
+	}
+	sigv4Signers.signers[cfg] = signer
+	return signer, nil
+}
+
+// newSigV4Signer creates a signer for cfg that calls STS with client.
+func newSigV4Signer(cfg SigV4, client *http.Client) (*sigv4Signer, error) {
+	s := &sigv4Signer{cfg: cfg, region: cfg.Region, service: cmp.Or(cfg.Service, defaultSigV4Service), client: client, now: time.Now}
+	if s.region == "" {
+		s.region = cmp.Or(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"))
+	}
+	if s.region == "" {
+		return nil, errors.New("sigv4 requires a region, or the AWS_REGION environment variable")
+	}
+	s.stsURL = fmt.Sprintf("https://sts.%s.amazonaws.com/", s.region)
+	if cfg.SecretKeyFile != "" {
+		s.secretKey = newSecretFile(cfg.SecretKeyFile)
+		if _, err := s.secretKey.get(); err != nil {
+			return nil, fmt.Errorf("invalid sigv4 secret key: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// credentials returns the credentials requests are signed with.
+func (s *sigv4Signer) credentials(ctx context.Context) (awsCredentials, error) {
+	base, err := s.baseCredentials(ctx)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	if s.cfg.RoleARN == "" {
+		return base, nil
+	}
+	return s.role.get(ctx, s.now(), func(ctx context.Context) (awsCredentials, error) {
+		form := url.Values{
+			"Action":          {"AssumeRole"},
+			"Version":         {"2011-06-15"},
+			"RoleArn":         {s.cfg.RoleARN},
+			"RoleSessionName": {"prometheus-metrics-combiner"},
+		}
+		if s.cfg.ExternalID != "" {
+			form.Set("ExternalId", s.cfg.ExternalID)
+		}
+		return s.callSTS(ctx, form, &base)
+	})
+}
+
+// baseCredentials returns the static credentials from the configuration, or
+// those from the environment.
+func (s *sigv4Signer) baseCredentials(ctx context.Context) (awsCredentials, error) {
+	if s.secretKey != nil {
+		secret, err := s.secretKey.get()
+		if err != nil {
+			return awsCredentials{}, fmt.Errorf("failed to read sigv4 secret key: %w", err)
+		}
+		return awsCredentials{accessKeyID: s.cfg.AccessKey, secretAccessKey: secret}, nil
+	}
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return awsCredentials{accessKeyID: id, secretAccessKey: secret, sessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	tokenFile, roleARN := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN")
+	if tokenFile == "" || roleARN == "" {
+		return awsCredentials{}, errors.New("no AWS credentials found, set sigv4 access_key and secret_key_file, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN")
+	}
+	return s.webIdentity.get(ctx, s.now(), func(ctx context.Context) (awsCredentials, error) {
+		// The token is rotated by the platform, such as EKS, so it is read
+		// every time
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return awsCredentials{}, fmt.Errorf("failed to read web identity token: %w", err)
+		}
+		form := url.Values{
+			"Action":           {"AssumeRoleWithWebIdentity"},
+			"Version":          {"2011-06-15"},
+			"RoleArn":          {roleARN},
+			"RoleSessionName":  {cmp.Or(os.Getenv("AWS_ROLE_SESSION_NAME"), "prometheus-metrics-combiner")},
+			"WebIdentityToken": {strings.TrimSpace(string(token))},
+		}
+		return s.callSTS(ctx, form, nil)
+	})
+}
+
+// callSTS calls an STS action returning temporary credentials. The request is
+// signed with creds if they aren't nil.
+func (s *sigv4Signer) callSTS(ctx context.Context, form url.Values, creds *awsCredentials) (awsCredentials, error) {
+	action := form.Get("Action")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.stsURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("failed to create STS %s request: %w", action, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if creds != nil {
+		if err := signSigV4(req, *creds, s.region, "sts", s.now()); err != nil {
+			return awsCredentials{}, err
+		}
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("STS %s failed: %w", action, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("failed to read STS %s response: %w", action, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, fmt.Errorf("bad status from STS %s: %s: %s", action, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	type xmlCredentials struct {
+		AccessKeyID     string    `xml:"AccessKeyId"`
+		SecretAccessKey string    `xml:"SecretAccessKey"`
+		SessionToken    string    `xml:"SessionToken"`
+		Expiration      time.Time `xml:"Expiration"`
+	}
+	var result struct {
+		AssumeRole  xmlCredentials `xml:"AssumeRoleResult>Credentials"`
+		WebIdentity xmlCredentials `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return awsCredentials{}, fmt.Errorf("invalid STS %s response: %w", action, err)
+	}
+	c := result.AssumeRole
+	if action == "AssumeRoleWithWebIdentity" {
+		c = result.WebIdentity
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return awsCredentials{}, fmt.Errorf("invalid STS %s response: missing credentials", action)
+	}
+	return awsCredentials{accessKeyID: c.AccessKeyID, secretAccessKey: c.SecretAccessKey, sessionToken: c.SessionToken, expires: c.Expiration}, nil
+}
+
+// signSigV4 adds the X-Amz-Date, X-Amz-Security-Token and Authorization
+// headers signing req for service in region. Only the host and these headers
+// are signed, so headers added later by the transport don't invalidate the
+// signature.
+func signSigV4(req *http.Request, creds awsCredentials, region, service string, now time.Time) error {
+	payload := sha256.New()
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return errors.New("sigv4 can't sign a request body that can't be read again")
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return fmt.Errorf("failed to read the request body to sign: %w", err)
+		}
+		_, err = io.Copy(payload, body)
+		body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read the request body to sign: %w", err)
+		}
+	}
+
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	} else {
+		req.Header.Del("X-Amz-Security-Token")
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host, "x-amz-date": amzDate}
+	if creds.sessionToken != "" {
+		headers["x-amz-security-token"] = creds.sessionToken
+	}
+	names := slices.Sorted(maps.Keys(headers))
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(headers[name]))
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	// The escaped path is escaped again, as every service apart from S3
+	// expects
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		sigv4Escape(path, false),
+		sigv4Query(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payload.Sum(nil)),
+	}, "\n")
+	date := now.Format("20060102")
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := []byte("AWS4" + creds.secretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", creds.accessKeyID, scope, signedHeaders, signature))
+	return nil
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data with key.
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sigv4Escape percent-encodes every byte of s apart from the unreserved
+// characters, and / if slash is false.
+func sigv4Escape(s string, slash bool) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !slash) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// sigv4Query returns the canonical query string, with the parameters sorted by
+// name and then value.
+func sigv4Query(query url.Values) string {
+	var params [][2]string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, [2]string{sigv4Escape(name, true), sigv4Escape(value, true)})
+		}
+	}
+	slices.SortFunc(params, func(a, b [2]string) int {
+		return cmp.Or(strings.Compare(a[0], b[0]), strings.Compare(a[1], b[1]))
+	})
+	encoded := make([]string, len(params))
+	for i, p := range params {
+		encoded[i] = p[0] + "=" + p[1]
+	}
+	return strings.Join(encoded, "&")
+}
+
+// sigv4RoundTripper signs each request with AWS Signature Version 4.
+type sigv4RoundTripper struct {
+	signer *sigv4Signer
+	next   http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (rt *sigv4RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	creds, err := rt.signer.credentials(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	if err := signSigV4(req, creds, rt.signer.region, rt.signer.service, rt.signer.now()); err != nil {
+		return nil, err
+	}
+	return rt.next.RoundTrip(req)
+}
@@ -0,0 +1,242 @@
+package combiner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestSignSigV4 tests requests are signed like the examples in the AWS
+// Signature Version 4 test suite.
+func TestSignSigV4(t *testing.T) {
+	creds := awsCredentials{accessKeyID: "AKIDEXAMPLE", secretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name      string
+		url       string
+		signature string
+	}{
+		{name: "Vanilla", url: "http://example.amazonaws.com/", signature: "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{name: "Query order", url: "http://example.amazonaws.com/?Param2=value2&Param1=value1", signature: "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, tc.url, nil)
+			if err != nil {
+				t.Fatalf("NewRequest failed: %v", err)
+			}
+			if err := signSigV4(req, creds, "us-east-1", "service", now); err != nil {
+				t.Fatalf("signSigV4 failed: %v", err)
+			}
+			expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=" + tc.signature
+			if got := req.Header.Get("Authorization"); got != expected {
+				t.Errorf("got Authorization %q, want %q", got, expected)
+			}
+			if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+				t.Errorf("got X-Amz-Date %q", got)
+			}
+		})
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.amazonaws.com/", nil)
+	creds.sessionToken = "session"
+	if err := signSigV4(req, creds, "us-east-1", "service", now); err != nil {
+		t.Fatalf("signSigV4 failed: %v", err)
+	}
+	if got := req.Header.Get("X-Amz-Security-Token"); got != "session" {
+		t.Errorf("expected the session token to be sent, got %q", got)
+	}
+	if got := req.Header.Get("Authorization"); !strings.Contains(got, "SignedHeaders=host;x-amz-date;x-amz-security-token,") {
+		t.Errorf("expected the session token to be signed, got %q", got)
+	}
+}
+
+// stsServer is an STS endpoint that returns numbered temporary credentials
+// for AssumeRole and AssumeRoleWithWebIdentity.
+type stsServer struct {
+	*httptest.Server
+	calls atomic.Int32
+	// authorization is the Authorization header of the last call.
+	authorization atomic.Value
+}
+
+// newSTSServer starts an STS endpoint whose credentials expire after
+// expiresIn.
+func newSTSServer(t *testing.T, expiresIn time.Duration) *stsServer {
+	s := &stsServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		action := r.PostForm.Get("Action")
+		if action == "AssumeRoleWithWebIdentity" && r.PostForm.Get("WebIdentityToken") != "web-identity" {
+			http.Error(w, "<ErrorResponse><Error><Code>InvalidIdentityToken</Code></Error></ErrorResponse>", http.StatusBadRequest)
+			return
+		}
+		s.authorization.Store(r.Header.Get("Authorization"))
+		n := s.calls.Add(1)
+		fmt.Fprintf(w, "<%[1]sResponse><%[1]sResult><Credentials><AccessKeyId>ASIA%[2]d</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>session-%[2]d</SessionToken><Expiration>%[3]s</Expiration></Credentials></%[1]sResult></%[1]sResponse>",
+			action, n, time.Now().Add(expiresIn).UTC().Format(time.RFC3339))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// TestSigV4AssumeRole tests the role's temporary credentials sign requests, and
+// are replaced when they are about to expire.
+func TestSigV4AssumeRole(t *testing.T) {
+	testCases := []struct {
+		name          string
+		expiresIn     time.Duration
+		expectedCalls int32
+	}{
+		{name: "Cached", expiresIn: time.Hour, expectedCalls: 1},
+		{name: "About to expire", expiresIn: time.Minute, expectedCalls: 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sts := newSTSServer(t, tc.expiresIn)
+			cfg := SigV4{Region: "eu-west-1", AccessKey: "AKIDEXAMPLE", SecretKeyFile: writeFile(t, "secret", "wJalrXUtnFEMI\n"), RoleARN: "arn:aws:iam::123456789012:role/metrics"}
+			signer, err := newSigV4Signer(cfg, http.DefaultClient)
+			if err != nil {
+				t.Fatalf("newSigV4Signer failed: %v", err)
+			}
+			signer.stsURL = sts.URL
+
+			var creds awsCredentials
+			for range 2 {
+				if creds, err = signer.credentials(context.Background()); err != nil {
+					t.Fatalf("credentials failed: %v", err)
+				}
+			}
+			if calls := sts.calls.Load(); calls != tc.expectedCalls {
+				t.Errorf("expected %d STS calls, got %d", tc.expectedCalls, calls)
+			}
+			if expected := fmt.Sprintf("session-%d", tc.expectedCalls); creds.sessionToken != expected {
+				t.Errorf("got session token %q, want %q", creds.sessionToken, expected)
+			}
+			if auth, _ := sts.authorization.Load().(string); !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || !strings.Contains(auth, "/eu-west-1/sts/aws4_request") {
+				t.Errorf("expected AssumeRole to be signed with the static credentials for STS, got %q", auth)
+			}
+		})
+	}
+}
+
+// TestSigV4Credentials tests credentials are taken from the environment if
+// the configuration doesn't have any.
+func TestSigV4Credentials(t *testing.T) {
+	sts := newSTSServer(t, time.Hour)
+	testCases := []struct {
+		name          string
+		env           map[string]string
+		expectedKey   string
+		expectedError string
+	}{
+		{name: "Environment", env: map[string]string{"AWS_ACCESS_KEY_ID": "AKIDENV", "AWS_SECRET_ACCESS_KEY": "secret"}, expectedKey: "AKIDENV"},
+		{name: "Web identity", env: map[string]string{"AWS_WEB_IDENTITY_TOKEN_FILE": writeFile(t, "token", "web-identity\n"), "AWS_ROLE_ARN": "arn:aws:iam::123456789012:role/metrics"}, expectedKey: "ASIA1"},
+		{name: "Invalid web identity", env: map[string]string{"AWS_WEB_IDENTITY_TOKEN_FILE": writeFile(t, "token", "expired"), "AWS_ROLE_ARN": "arn:aws:iam::123456789012:role/metrics"}, expectedError: "InvalidIdentityToken"},
+		{name: "None", expectedError: "no AWS credentials found"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_ROLE_ARN", "AWS_ROLE_SESSION_NAME"} {
+				t.Setenv(name, tc.env[name])
+			}
+			signer, err := newSigV4Signer(SigV4{Region: "us-east-1"}, http.DefaultClient)
+			if err != nil {
+				t.Fatalf("newSigV4Signer failed: %v", err)
+			}
+			signer.stsURL = sts.URL
+
+			creds, err := signer.credentials(context.Background())
+			if tc.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+					t.Fatalf("expected error containing %q, got: %v", tc.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("credentials failed: %v", err)
+			}
+			if creds.accessKeyID != tc.expectedKey {
+				t.Errorf("got access key %q, want %q", creds.accessKeyID, tc.expectedKey)
+			}
+		})
+	}
+
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	if _, err := newSigV4Signer(SigV4{}, http.DefaultClient); err == nil {
+		t.Error("expected an error without a region")
+	}
+	t.Setenv("AWS_DEFAULT_REGION", "ap-southeast-2")
+	if signer, err := newSigV4Signer(SigV4{}, http.DefaultClient); err != nil || signer.region != "ap-southeast-2" {
+		t.Errorf("expected the region from the environment, got %v", err)
+	}
+}
+
+// TestSigV4Client tests targets with sigv4 send signed requests.
+func TestSigV4Client(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("Authorization"))
+	}))
+	defer upstream.Close()
+
+	cfg := &SigV4{Region: "us-west-2", AccessKey: "AKIDEXAMPLE", SecretKeyFile: writeFile(t, "secret", "wJalrXUtnFEMI")}
+	client, err := NewClient(Target{URL: upstream.URL, SigV4: cfg}, nil)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	body, _, err := fetchString(context.Background(), client, upstream.URL+"/api/v1/query?query=up")
+	if err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	if !strings.HasPrefix(body, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || !strings.Contains(body, "/us-west-2/aps/aws4_request") {
+		t.Errorf("expected a signature for aps in us-west-2, got %q", body)
+	}
+
+	if _, err := NewClient(Target{URL: upstream.URL, SigV4: &SigV4{Region: "us-west-2", AccessKey: "AKIDEXAMPLE", SecretKeyFile: "/nonexistent/secret"}}, nil); err == nil {
+		t.Error("expected an error for a missing secret key file")
+	}
+}
+
+// TestSigV4Validate tests inconsistent SigV4 settings are rejected.
+func TestSigV4Validate(t *testing.T) {
+	testCases := []struct {
+		name          string
+		target        Target
+		expectedError string
+	}{
+		{name: "From the environment", target: Target{SigV4: &SigV4{Region: "us-east-1"}}},
+		{name: "Role", target: Target{SigV4: &SigV4{RoleARN: "arn:aws:iam::123456789012:role/metrics", ExternalID: "combiner"}}},
+		{name: "Access key without secret", target: Target{SigV4: &SigV4{AccessKey: "AKIDEXAMPLE"}}, expectedError: "must be set together"},
+		{name: "Invalid role", target: Target{SigV4: &SigV4{RoleARN: "metrics"}}, expectedError: "invalid sigv4 role_arn"},
+		{name: "External ID without role", target: Target{SigV4: &SigV4{ExternalID: "combiner"}}, expectedError: "requires a role_arn"},
+		{name: "With basic auth", target: Target{SigV4: &SigV4{}, BasicAuth: &BasicAuth{Username: "u"}}, expectedError: "basic_auth and sigv4 cannot be used together"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.target.Validate()
+			if tc.expectedError == "" {
+				if err != nil {
+					t.Errorf("expected no error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+				t.Errorf("expected error containing %q, got: %v", tc.expectedError, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package combiner
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// Policies for the metrics of a target whose fetch failed.
+const (
+	// StalenessOmit leaves out the target's metrics.
+	StalenessOmit = "omit"
+	// StalenessCache serves the target's last successfully fetched metrics
+	// unchanged.
+	StalenessCache = "cache"
+	// StalenessMark serves the target's last successfully fetched series
+	// with the Prometheus stale marker as their value, so they end
+	// immediately instead of when Prometheus' lookback period expires.
+	StalenessMark = "mark"
+)
+
+// StalenessPolicies lists all staleness policies.
+var StalenessPolicies = []string{StalenessOmit, StalenessCache, StalenessMark}
+
+// staleNaN is the NaN value Prometheus uses to mark a series as stale.
+const staleNaN = 0x7ff0000000000002
+
+// stalenessPolicy returns the staleness policy, which is StalenessCache if
+// empty and maxAge is set, otherwise StalenessOmit.
+func stalenessPolicy(policy string, maxAge time.Duration) (string, error) {
+	switch {
+	case policy == "" && maxAge > 0:
+		return StalenessCache, nil
+	case policy == "":
+		return StalenessOmit, nil
+	case !slices.Contains(StalenessPolicies, policy):
+		return "", fmt.Errorf("invalid staleness policy %q, must be one of %s", policy, strings.Join(StalenessPolicies, ", "))
+	case policy != StalenessOmit && maxAge == 0:
+		return "", fmt.Errorf("the %s staleness policy requires a serve stale max age", policy)
+	}
+	return policy, nil
+}
+
+// markStale sets the value of the counter, gauge and untyped series in
+// families to the stale marker. Histograms and summaries are removed since
+// their counts can't be marked.
+func markStale(families []*dto.MetricFamily) []*dto.MetricFamily {
+	var marked []*dto.MetricFamily
+	for _, mf := range families {
+		var metrics []*dto.Metric
+		for _, m := range mf.Metric {
+			switch {
+			case m.Counter != nil:
+				m.Counter.Value = proto.Float64(math.Float64frombits(staleNaN))
+			case m.Gauge != nil:
+				m.Gauge.Value = proto.Float64(math.Float64frombits(staleNaN))
+			case m.Untyped != nil:
+				m.Untyped.Value = proto.Float64(math.Float64frombits(staleNaN))
+			default:
+				continue
+			}
+			metrics = append(metrics, m)
+		}
+		if len(metrics) > 0 {
+			mf.Metric = metrics
+			marked = append(marked, mf)
+		}
+	}
+	return marked
+}
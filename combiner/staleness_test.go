@@ -0,0 +1,138 @@
+package combiner
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// TestCombinerStalenessPolicy tests how the metrics of a failed target are
+// served with each staleness policy.
+func TestCombinerStalenessPolicy(t *testing.T) {
+	testCases := []struct {
+		name     string
+		policy   string
+		maxAge   time.Duration
+		expected string
+	}{
+		{
+			name:     "Omit",
+			policy:   StalenessOmit,
+			maxAge:   time.Hour,
+			expected: "# TYPE up gauge\nup{instance=\"b\"} 1\n",
+		},
+		{
+			name:     "Default with a max age",
+			maxAge:   time.Hour,
+			expected: "# TYPE requests_total counter\nrequests_total{instance=\"a\"} 5\n# TYPE rpc_seconds histogram\nrpc_seconds_bucket{instance=\"a\",le=\"+Inf\"} 1\nrpc_seconds_sum{instance=\"a\"} 1\nrpc_seconds_count{instance=\"a\"} 1\n# TYPE up gauge\nup{instance=\"a\"} 1\nup{instance=\"b\"} 1\n",
+		},
+		{
+			name:     "Mark",
+			policy:   StalenessMark,
+			maxAge:   time.Hour,
+			expected: "# TYPE requests_total counter\nrequests_total{instance=\"a\"} NaN\n# TYPE up gauge\nup{instance=\"a\"} NaN\nup{instance=\"b\"} 1\n",
+		},
+		{
+			name:     "Mark too old",
+			policy:   StalenessMark,
+			maxAge:   time.Nanosecond,
+			expected: "# TYPE up gauge\nup{instance=\"b\"} 1\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var failing atomic.Bool
+			flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if failing.Load() {
+					http.Error(w, "internal server error", http.StatusInternalServerError)
+					return
+				}
+				fmt.Fprint(w, "# TYPE requests_total counter\nrequests_total 5\n# TYPE up gauge\nup 1\n")
+				fmt.Fprint(w, "# TYPE rpc_seconds histogram\nrpc_seconds_bucket{le=\"+Inf\"} 1\nrpc_seconds_sum 1\nrpc_seconds_count 1\n")
+			}))
+			defer flaky.Close()
+			healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "# TYPE up gauge\nup 1\n")
+			}))
+			defer healthy.Close()
+
+			targets := []Target{
+				{URL: flaky.URL, Labels: map[string]string{"instance": "a"}},
+				{URL: healthy.URL, Labels: map[string]string{"instance": "b"}},
+			}
+			agg, err := New(targets, Options{StalenessPolicy: tc.policy, ServeStaleMaxAge: tc.maxAge})
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+
+			agg.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+			time.Sleep(time.Millisecond)
+			failing.Store(true)
+
+			rr := httptest.NewRecorder()
+			agg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+			}
+			if rr.Body.String() != tc.expected {
+				t.Errorf("got %q, want %q", rr.Body.String(), tc.expected)
+			}
+		})
+	}
+}
+
+// TestMarkStale tests the values are set to the Prometheus stale marker.
+func TestMarkStale(t *testing.T) {
+	input := "# TYPE a counter\na 1\n# TYPE b gauge\nb 2\nc 3\n# TYPE d summary\nd_sum 1\nd_count 1\n"
+	families, err := parseMetrics(strings.NewReader(input), expfmt.FmtText)
+	if err != nil {
+		t.Fatalf("parseMetrics failed: %v", err)
+	}
+	marked := markStale(families)
+	if len(marked) != 3 {
+		t.Fatalf("expected 3 families, got %d", len(marked))
+	}
+	for _, mf := range marked {
+		if v := metricValue(mf.Metric[0]); math.Float64bits(v) != staleNaN {
+			t.Errorf("expected %s to be marked stale, got %v", mf.GetName(), v)
+		}
+	}
+}
+
+// TestStalenessPolicyOption tests the staleness policy is resolved and
+// validated.
+func TestStalenessPolicyOption(t *testing.T) {
+	testCases := []struct {
+		name        string
+		policy      string
+		maxAge      time.Duration
+		expected    string
+		expectedErr bool
+	}{
+		{name: "Default", expected: StalenessOmit},
+		{name: "Default with a max age", maxAge: time.Minute, expected: StalenessCache},
+		{name: "Omit with a max age", policy: StalenessOmit, maxAge: time.Minute, expected: StalenessOmit},
+		{name: "Mark", policy: StalenessMark, maxAge: time.Minute, expected: StalenessMark},
+		{name: "Cache without a max age", policy: StalenessCache, expectedErr: true},
+		{name: "Invalid", policy: "drop", maxAge: time.Minute, expectedErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy, err := stalenessPolicy(tc.policy, tc.maxAge)
+			if (err != nil) != tc.expectedErr {
+				t.Fatalf("expected error %v, got %v", tc.expectedErr, err)
+			}
+			if policy != tc.expected {
+				t.Errorf("got policy %q, want %q", policy, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package combiner
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// Target configures a single upstream target.
+type Target struct {
+	URL       string    `yaml:"url"`
+	TLSConfig TLSConfig `yaml:"tls_config"`
+	// BearerTokenFile is a file containing a token sent in the Authorization header.
+	BearerTokenFile string `yaml:"bearer_token_file"`
+	// BasicAuth sends HTTP basic auth credentials to the upstream.
+	BasicAuth *BasicAuth `yaml:"basic_auth"`
+	// OAuth2 sends an access token fetched with the OAuth2 client
+	// credentials grant.
+	OAuth2 *OAuth2 `yaml:"oauth2"`
+	// SigV4 signs requests with AWS Signature Version 4.
+	SigV4 *SigV4 `yaml:"sigv4"`
+	// GoogleIDToken sends an ID token for a Google service account.
+	GoogleIDToken *GoogleIDToken `yaml:"google_id_token"`
+	// AzureManagedIdentity sends an access token for an Azure managed
+	// identity.
+	AzureManagedIdentity *AzureManagedIdentity `yaml:"azure_managed_identity"`
+	// Headers are extra request headers sent on every fetch.
+	Headers map[string]string `yaml:"headers"`
+	// ProxyURL is a forward proxy used for this target instead of the
+	// HTTP_PROXY/HTTPS_PROXY/NO_PROXY environment variables.
+	ProxyURL string `yaml:"proxy_url"`
+	// Labels are added to every series fetched from this target, replacing
+	// labels with the same name.
+	Labels map[string]string `yaml:"labels"`
+	// LabelConflict is how Labels already present on a series are resolved,
+	// one of LabelConflictPolicies.
+	LabelConflict string `yaml:"label_conflict"`
+	// MetricPrefix is prepended to the name of every metric fetched from this target.
+	MetricPrefix string `yaml:"metric_prefix"`
+	// HostsFile is a list of hosts substituted for {host} in URL, creating a
+	// target for each. It is cleared when the targets are expanded.
+	HostsFile string `yaml:"hosts_file"`
+}
+
+// BasicAuth configures HTTP basic auth for an upstream.
+type BasicAuth struct {
+	Username string `yaml:"username"`
+	// PasswordFile is a file containing the password, re-read periodically.
+	PasswordFile string `yaml:"password_file"`
+}
+
+// TLSConfig configures TLS for connections to an upstream.
+type TLSConfig struct {
+	// CAFile is a PEM file of CA certificates used to verify the upstream instead of the system roots.
+	CAFile string `yaml:"ca_file"`
+	// CertFile and KeyFile are a PEM client certificate and key presented to upstreams that require mutual TLS.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// InsecureSkipVerify disables verification of the upstream's certificate.
+	// It can only be set per target so verification stays enabled for everything else.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+}
+
+// Validate checks the target configuration is consistent.
+func (t Target) Validate() error {
+	if err := t.TLSConfig.Validate(); err != nil {
+		return err
+	}
+	if t.BasicAuth != nil && t.BasicAuth.Username == "" {
+		return fmt.Errorf("basic_auth requires a username")
+	}
+	if t.OAuth2 != nil {
+		if err := t.OAuth2.Validate(); err != nil {
+			return err
+		}
+	}
+	if t.SigV4 != nil {
+		if err := t.SigV4.Validate(); err != nil {
+			return err
+		}
+	}
+	if t.GoogleIDToken != nil {
+		if err := t.GoogleIDToken.Validate(); err != nil {
+			return err
+		}
+	}
+	if t.AzureManagedIdentity != nil {
+		if err := t.AzureManagedIdentity.Validate(); err != nil {
+			return err
+		}
+	}
+	auth := t.authMethods()
+	if len(auth) > 1 {
+		return fmt.Errorf("%s cannot be used together", strings.Join(auth, " and "))
+	}
+	if t.ProxyURL != "" {
+		if _, err := parseProxyURL(t.ProxyURL); err != nil {
+			return err
+		}
+	}
+	for name := range t.Headers {
+		if http.CanonicalHeaderKey(name) == "Authorization" && len(auth) > 0 {
+			return fmt.Errorf("the Authorization header cannot be set together with %s", auth[0])
+		}
+	}
+	for name := range t.Labels {
+		if !model.UTF8Validation.IsValidLabelName(name) || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+	}
+	if t.LabelConflict != "" && !slices.Contains(LabelConflictPolicies, t.LabelConflict) {
+		return fmt.Errorf("invalid label_conflict %q, must be one of %s", t.LabelConflict, strings.Join(LabelConflictPolicies, ", "))
+	}
+	if t.MetricPrefix != "" && !model.UTF8Validation.IsValidMetricName(t.MetricPrefix) {
+		return fmt.Errorf("invalid metric_prefix %q", t.MetricPrefix)
+	}
+	return nil
+}
+
+// authMethods returns the names of the authentication settings the target
+// uses.
+func (t Target) authMethods() []string {
+	var methods []string
+	if t.BasicAuth != nil {
+		methods = append(methods, "basic_auth")
+	}
+	if t.BearerTokenFile != "" {
+		methods = append(methods, "bearer_token_file")
+	}
+	if t.OAuth2 != nil {
+		methods = append(methods, "oauth2")
+	}
+	if t.SigV4 != nil {
+		methods = append(methods, "sigv4")
+	}
+	if t.GoogleIDToken != nil {
+		methods = append(methods, "google_id_token")
+	}
+	if t.AzureManagedIdentity != nil {
+		methods = append(methods, "azure_managed_identity")
+	}
+	return methods
+}
+
+// HasCredentials reports whether the target sets its own authentication,
+// including an Authorization header.
+func (t Target) HasCredentials() bool {
+	if len(t.authMethods()) > 0 {
+		return true
+	}
+	for name := range t.Headers {
+		if http.CanonicalHeaderKey(name) == "Authorization" {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the TLS configuration is consistent.
+func (c TLSConfig) Validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("cert_file and key_file must be set together")
+	}
+	return nil
+}
+
+// WithDefaults returns a copy of the target configuration where unset fields
+// are taken from defaults.
+func (t Target) WithDefaults(defaults Target) Target {
+	if t.TLSConfig.CAFile == "" {
+		t.TLSConfig.CAFile = defaults.TLSConfig.CAFile
+	}
+	if t.TLSConfig.CertFile == "" && t.TLSConfig.KeyFile == "" {
+		t.TLSConfig.CertFile = defaults.TLSConfig.CertFile
+		t.TLSConfig.KeyFile = defaults.TLSConfig.KeyFile
+	}
+	if !t.HasCredentials() {
+		t.BearerTokenFile = defaults.BearerTokenFile
+	}
+	if t.LabelConflict == "" {
+		t.LabelConflict = defaults.LabelConflict
+	}
+	return t
+}
+
+// parseProxyURL parses and checks a proxy URL.
+func parseProxyURL(proxyURL string) (*url.URL, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy_url: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("invalid proxy_url %s: scheme must be http, https or socks5", proxyURL)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy_url %s: missing host", proxyURL)
+	}
+	return u, nil
+}
+
+// metricsPath is the path requested from upstreams whose URL doesn't give
+// one, like Prometheus' default metrics_path.
+const metricsPath = "/metrics"
+
+// NormalizeURL checks a target URL, which can be a bare host:port such as
+// exporter:9100, optionally followed by a path. A bare host:port gets scheme
+// and, if it has no path, path, so exporter:9100 becomes
+// http://exporter:9100/metrics with the defaults. Empty scheme and path
+// default to http and /metrics.
+func NormalizeURL(rawURL, scheme, path string) (string, error) {
+	if scheme == "" {
+		scheme = "http"
+	}
+	if path == "" {
+		path = metricsPath
+	}
+
+	bare := !strings.Contains(rawURL, "://") && !strings.HasPrefix(rawURL, "unix:")
+	if bare {
+		rawURL = scheme + "://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+	case "unix":
+		if _, _, err := splitUnixURL(u); err != nil {
+			return "", err
+		}
+		return rawURL, nil
+	default:
+		return "", fmt.Errorf("invalid URL %s: unsupported scheme %q, must be http, https or unix", u.Redacted(), u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("invalid URL %s: missing host", u.Redacted())
+	}
+	if bare && u.Path == "" {
+		u.Path = path
+		return u.String(), nil
+	}
+	return rawURL, nil
+}
@@ -0,0 +1,61 @@
+package combiner
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ErrTooFewSucceeded is returned by Gather when fewer targets were fetched
+// successfully than the MinSuccess option requires.
+var ErrTooFewSucceeded = errors.New("too few upstreams succeeded")
+
+// SuccessThreshold is the minimum number of targets that must be fetched
+// successfully for the combined result to be served, either an absolute
+// Count or a Percent of the targets. The zero value requires one target.
+type SuccessThreshold struct {
+	// Count is the number of targets, capped to the number being fetched.
+	Count int
+	// Percent is the percentage of the targets being fetched, rounded up.
+	Percent float64
+}
+
+// ParseSuccessThreshold parses a threshold such as 3 or 80%.
+func ParseSuccessThreshold(s string) (SuccessThreshold, error) {
+	var t SuccessThreshold
+	var err error
+	if p, ok := strings.CutSuffix(s, "%"); ok {
+		if t.Percent, err = strconv.ParseFloat(p, 64); err != nil {
+			return t, fmt.Errorf("invalid percentage %q", s)
+		}
+	} else if t.Count, err = strconv.Atoi(s); err != nil {
+		return t, fmt.Errorf("invalid success threshold %q, must be a number or percentage", s)
+	}
+	return t, t.validate()
+}
+
+// validate checks the threshold is in range.
+func (t SuccessThreshold) validate() error {
+	if t.Count < 0 {
+		return errors.New("the success threshold count must not be negative")
+	}
+	if t.Percent < 0 || t.Percent > 100 || math.IsNaN(t.Percent) {
+		return errors.New("the success threshold percentage must be between 0 and 100")
+	}
+	if t.Count > 0 && t.Percent > 0 {
+		return errors.New("the success threshold must be a count or a percentage, not both")
+	}
+	return nil
+}
+
+// required returns how many of n targets must succeed, at least one.
+func (t SuccessThreshold) required(n int) int {
+	required := max(1, min(t.Count, n))
+	if t.Percent > 0 {
+		// Allow for floating point error so exact percentages don't round up
+		required = max(required, int(math.Ceil(t.Percent*float64(n)/100-1e-9)))
+	}
+	return required
+}
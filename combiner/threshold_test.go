@@ -0,0 +1,54 @@
+package combiner
+
+import "testing"
+
+// TestParseSuccessThreshold tests parsing counts and percentages.
+func TestParseSuccessThreshold(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected SuccessThreshold
+		valid    bool
+	}{
+		{"3", SuccessThreshold{Count: 3}, true},
+		{"80%", SuccessThreshold{Percent: 80}, true},
+		{"12.5%", SuccessThreshold{Percent: 12.5}, true},
+		{"0", SuccessThreshold{}, true},
+		{"-1", SuccessThreshold{}, false},
+		{"101%", SuccessThreshold{}, false},
+		{"half", SuccessThreshold{}, false},
+		{"%", SuccessThreshold{}, false},
+	}
+	for _, tc := range testCases {
+		got, err := ParseSuccessThreshold(tc.input)
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: expected valid %v, got error %v", tc.input, tc.valid, err)
+			continue
+		}
+		if tc.valid && got != tc.expected {
+			t.Errorf("%s: got %+v, want %+v", tc.input, got, tc.expected)
+		}
+	}
+}
+
+// TestSuccessThresholdRequired tests how many targets must succeed.
+func TestSuccessThresholdRequired(t *testing.T) {
+	testCases := []struct {
+		threshold SuccessThreshold
+		targets   int
+		expected  int
+	}{
+		{SuccessThreshold{}, 5, 1},
+		{SuccessThreshold{Count: 3}, 5, 3},
+		{SuccessThreshold{Count: 3}, 2, 2},
+		{SuccessThreshold{Percent: 80}, 10, 8},
+		{SuccessThreshold{Percent: 80}, 4, 4},
+		{SuccessThreshold{Percent: 70}, 10, 7},
+		{SuccessThreshold{Percent: 1}, 5, 1},
+		{SuccessThreshold{Percent: 100}, 3, 3},
+	}
+	for _, tc := range testCases {
+		if got := tc.threshold.required(tc.targets); got != tc.expected {
+			t.Errorf("%+v of %d targets: got %d, want %d", tc.threshold, tc.targets, got, tc.expected)
+		}
+	}
+}
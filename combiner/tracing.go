@@ -0,0 +1,15 @@
+package combiner
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of the spans created by the package.
+const tracerName = "github.com/manics/prometheus-metrics-combiner/combiner"
+
+// tracer returns the tracer used for all spans. It is looked up from the
+// global provider each time so it follows the provider set by the program, for example with otel.SetTracerProvider.
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
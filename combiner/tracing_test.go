@@ -0,0 +1,85 @@
+package combiner
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// TestTracing tests that a request and each upstream fetch are traced.
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	oldProvider, oldPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	defer func() {
+		otel.SetTracerProvider(oldProvider)
+		otel.SetTextMapPropagator(oldPropagator)
+	}()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var traceparent string
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("Traceparent")
+		fmt.Fprintln(w, "metric_a 1")
+	}))
+	defer healthy.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	agg, err := newCombiner(staticTargets([]string{healthy.URL, failing.URL}), options{})
+	if err != nil {
+		t.Fatalf("newCombiner failed: %v", err)
+	}
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	agg.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans, got %d", len(spans))
+	}
+
+	var root sdktrace.ReadOnlySpan
+	fetches := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range spans {
+		switch s.Name() {
+		case "combine":
+			root = s
+		case "fetch":
+			for _, attr := range s.Attributes() {
+				if attr.Key == "url.full" {
+					fetches[attr.Value.AsString()] = s
+				}
+			}
+		}
+	}
+	if root == nil {
+		t.Fatal("no combine span")
+	}
+	for url, expectedStatus := range map[string]codes.Code{healthy.URL: codes.Unset, failing.URL: codes.Error} {
+		s, ok := fetches[url]
+		if !ok {
+			t.Errorf("no fetch span for %s", url)
+			continue
+		}
+		if s.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("fetch span for %s is not a child of the combine span", url)
+		}
+		if s.Status().Code != expectedStatus {
+			t.Errorf("expected status %v for %s, got %v", expectedStatus, url, s.Status().Code)
+		}
+	}
+
+	if traceparent == "" {
+		t.Error("trace context was not propagated to the upstream")
+	}
+}
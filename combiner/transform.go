@@ -0,0 +1,42 @@
+package combiner
+
+import (
+	"context"
+	"fmt"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Transformer modifies the combined metrics after they are fetched and
+// before they are served or pushed, for example to rename metrics or add
+// synthetic ones.
+type Transformer interface {
+	// Transform returns the transformed families. The families and their
+	// metrics may be shared with earlier results, so they must not be
+	// modified in place. Return new or cloned families instead. Families in
+	// the result with the same name are merged.
+	Transform(ctx context.Context, families []*dto.MetricFamily) ([]*dto.MetricFamily, error)
+}
+
+// TransformerFunc implements Transformer with a function.
+type TransformerFunc func(ctx context.Context, families []*dto.MetricFamily) ([]*dto.MetricFamily, error)
+
+// Transform implements Transformer.
+func (f TransformerFunc) Transform(ctx context.Context, families []*dto.MetricFamily) ([]*dto.MetricFamily, error) {
+	return f(ctx, families)
+}
+
+// transform passes families through each of the transformers in order,
+// merging the result of each so the next sees a single family per name.
+func transform(ctx context.Context, transformers []Transformer, families []*dto.MetricFamily, policy string) ([]*dto.MetricFamily, error) {
+	for i, t := range transformers {
+		var err error
+		if families, err = t.Transform(ctx, families); err != nil {
+			return nil, fmt.Errorf("transformer %d failed: %w", i, err)
+		}
+		if families, err = mergeFamilies(families, policy); err != nil {
+			return nil, err
+		}
+	}
+	return families, nil
+}
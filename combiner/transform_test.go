@@ -0,0 +1,103 @@
+package combiner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// renameTransformer renames the families called from to to.
+func renameTransformer(from, to string) Transformer {
+	return TransformerFunc(func(ctx context.Context, families []*dto.MetricFamily) ([]*dto.MetricFamily, error) {
+		out := make([]*dto.MetricFamily, len(families))
+		for i, mf := range families {
+			if mf.GetName() == from {
+				mf = &dto.MetricFamily{Name: proto.String(to), Help: mf.Help, Type: mf.Type, Metric: mf.Metric}
+			}
+			out[i] = mf
+		}
+		return out, nil
+	})
+}
+
+// TestCombinerTransformers tests custom transforms are applied in order to
+// the combined metrics.
+func TestCombinerTransformers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "old_name 1\nother 2\n")
+	}))
+	defer server.Close()
+
+	countFamilies := TransformerFunc(func(ctx context.Context, families []*dto.MetricFamily) ([]*dto.MetricFamily, error) {
+		return append(families, &dto.MetricFamily{
+			Name:   proto.String("family_count"),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(float64(len(families)))}}},
+		}), nil
+	})
+	failing := TransformerFunc(func(ctx context.Context, families []*dto.MetricFamily) ([]*dto.MetricFamily, error) {
+		return nil, errors.New("broken")
+	})
+
+	testCases := []struct {
+		name           string
+		transformers   []Transformer
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "No transformers",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "# TYPE old_name untyped\nold_name 1\n# TYPE other untyped\nother 2\n",
+		},
+		{
+			name:           "Rename then add a synthetic metric",
+			transformers:   []Transformer{renameTransformer("old_name", "new_name"), countFamilies},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "# TYPE family_count gauge\nfamily_count 2\n# TYPE new_name untyped\nnew_name 1\n# TYPE other untyped\nother 2\n",
+		},
+		{
+			name:           "Renamed families are merged",
+			transformers:   []Transformer{renameTransformer("old_name", "other")},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "# TYPE other untyped\nother 1\n",
+		},
+		{
+			name:           "Failing transformer",
+			transformers:   []Transformer{failing},
+			expectedStatus: http.StatusInternalServerError,
+			expectedBody:   "broken",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := New(staticTargets([]string{server.URL}), Options{Transformers: tc.transformers})
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			rr := httptest.NewRecorder()
+			c.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d", tc.expectedStatus, rr.Code)
+			}
+			if tc.expectedStatus == http.StatusOK && rr.Body.String() != tc.expectedBody {
+				t.Errorf("got %q, want %q", rr.Body.String(), tc.expectedBody)
+			}
+			if tc.expectedStatus != http.StatusOK && !strings.Contains(rr.Body.String(), tc.expectedBody) {
+				t.Errorf("expected the error to contain %q, got %q", tc.expectedBody, rr.Body.String())
+			}
+		})
+	}
+
+	if _, err := New(nil, Options{Transformers: []Transformer{nil}}); err == nil {
+		t.Error("expected a nil transformer to be rejected")
+	}
+}
@@ -0,0 +1,60 @@
+package combiner
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// splitUnixURL returns the socket and the request path of a URL of the form
+// unix:///path/to/exporter.sock[:/request/path]. The request path defaults to
+// /metrics.
+func splitUnixURL(u *url.URL) (socket, path string, err error) {
+	if u.Host != "" {
+		return "", "", fmt.Errorf("invalid Unix socket URL %s: the socket path must be absolute, as in unix:///path/to/exporter.sock", u.Redacted())
+	}
+	socket, path, found := strings.Cut(u.Path, ":")
+	if !found || path == "" {
+		path = metricsPath
+	}
+	if socket == "" {
+		return "", "", fmt.Errorf("invalid Unix socket URL %s: missing socket path", u.Redacted())
+	}
+	if !strings.HasPrefix(path, "/") {
+		return "", "", fmt.Errorf("invalid Unix socket URL %s: the request path must start with /", u.Redacted())
+	}
+	return socket, path, nil
+}
+
+// unixSocketTransport returns a copy of base that connects to socket for
+// every request, whatever its host.
+func unixSocketTransport(base *http.Transport, socket string) *http.Transport {
+	transport := base.Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "unix", socket)
+	}
+	return transport
+}
+
+// unixSocketRoundTripper sends requests for unix:// URLs as plain HTTP
+// requests for their request path, to a transport connected to the socket.
+type unixSocketRoundTripper struct {
+	path string
+	next http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (rt *unixSocketRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL = &url.URL{Scheme: "http", Host: "localhost", Path: rt.path, RawQuery: req.URL.RawQuery}
+	// A Host header set for the target is kept
+	if req.Host == "" {
+		req.Host = "localhost"
+	}
+	return rt.next.RoundTrip(req)
+}
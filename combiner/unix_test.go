@@ -0,0 +1,96 @@
+package combiner
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestSplitUnixURL tests the socket and request path are taken from unix://
+// URLs.
+func TestSplitUnixURL(t *testing.T) {
+	testCases := []struct {
+		url            string
+		expectedSocket string
+		expectedPath   string
+		expectedError  string
+	}{
+		{url: "unix:///var/run/exporter.sock", expectedSocket: "/var/run/exporter.sock", expectedPath: "/metrics"},
+		{url: "unix:///var/run/exporter.sock:/probe", expectedSocket: "/var/run/exporter.sock", expectedPath: "/probe"},
+		{url: "unix:///var/run/exporter.sock:", expectedSocket: "/var/run/exporter.sock", expectedPath: "/metrics"},
+		{url: "unix://var/run/exporter.sock", expectedError: "must be absolute"},
+		{url: "unix:///var/run/exporter.sock:probe", expectedError: "must start with /"},
+		{url: "unix://", expectedError: "missing socket path"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.url, func(t *testing.T) {
+			u, err := url.Parse(tc.url)
+			if err != nil {
+				t.Fatalf("url.Parse failed: %v", err)
+			}
+			socket, path, err := splitUnixURL(u)
+			if tc.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+					t.Fatalf("expected error containing '%s', got: %v", tc.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("splitUnixURL failed: %v", err)
+			}
+			if socket != tc.expectedSocket || path != tc.expectedPath {
+				t.Errorf("got %s and %s, want %s and %s", socket, path, tc.expectedSocket, tc.expectedPath)
+			}
+		})
+	}
+}
+
+// TestCombinerUnixSocket tests upstreams listening on a Unix socket are
+// fetched.
+func TestCombinerUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "exporter.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "# TYPE requests gauge\nrequests{path=%q,query=%q} 1\n", r.URL.Path, r.URL.RawQuery)
+	}))
+	server.Listener = l
+	server.Start()
+	defer server.Close()
+
+	testCases := []struct {
+		name     string
+		url      string
+		expected string
+	}{
+		{name: "Default path", url: "unix://" + socket, expected: "# TYPE requests gauge\nrequests{path=\"/metrics\",query=\"\"} 1\n"},
+		{name: "Request path", url: "unix://" + socket + ":/probe?module=a", expected: "# TYPE requests gauge\nrequests{path=\"/probe\",query=\"module=a\"} 1\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			agg, err := New(staticTargets([]string{tc.url}), Options{})
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			rr := httptest.NewRecorder()
+			agg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+			}
+			if rr.Body.String() != tc.expected {
+				t.Errorf("got %q, want %q", rr.Body.String(), tc.expected)
+			}
+		})
+	}
+
+	if _, err := New([]Target{{URL: "unix://" + socket, ProxyURL: "http://proxy:3128"}}, Options{}); err == nil {
+		t.Error("expected an error for a Unix socket target with a proxy")
+	}
+}
@@ -0,0 +1,192 @@
+package combiner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// URLPolicy restricts the upstreams that can be fetched, since the combiner
+// fetches whatever URLs it is configured with or discovers. The zero value
+// allows everything.
+type URLPolicy struct {
+	// Schemes are the allowed URL schemes, if empty any scheme is allowed.
+	Schemes []string
+	// Ports are the allowed ports, if empty any port is allowed. URLs without
+	// a port use the default for their scheme.
+	Ports []int
+	// AllowCIDRs are the only networks that can be connected to, if empty
+	// any address not in DenyCIDRs is allowed.
+	AllowCIDRs []string
+	// DenyCIDRs are networks that can't be connected to, for example
+	// 169.254.0.0/16 to block cloud metadata endpoints.
+	DenyCIDRs []string
+}
+
+// urlPolicy is a URLPolicy with the networks parsed.
+type urlPolicy struct {
+	schemes []string
+	ports   []int
+	allow   []netip.Prefix
+	deny    []netip.Prefix
+	// resolver looks up the host names of requests sent through a proxy.
+	resolver hostResolver
+}
+
+// compile parses the networks.
+func (p URLPolicy) compile() (*urlPolicy, error) {
+	policy := &urlPolicy{schemes: p.Schemes, ports: p.Ports, resolver: net.DefaultResolver}
+	for _, port := range p.Ports {
+		if port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid allowed port %d", port)
+		}
+	}
+	for _, s := range p.AllowCIDRs {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed CIDR: %w", err)
+		}
+		policy.allow = append(policy.allow, prefix.Masked())
+	}
+	for _, s := range p.DenyCIDRs {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid denied CIDR: %w", err)
+		}
+		policy.deny = append(policy.deny, prefix.Masked())
+	}
+	return policy, nil
+}
+
+// checksAddresses reports whether the addresses connected to must be checked.
+func (p *urlPolicy) checksAddresses() bool {
+	return len(p.allow) > 0 || len(p.deny) > 0
+}
+
+// checkURL checks the scheme and port of u, and its host if it is an IP
+// address. Host names are checked when they are resolved.
+func (p *urlPolicy) checkURL(u *url.URL) error {
+	if len(p.schemes) > 0 && !slices.Contains(p.schemes, u.Scheme) {
+		return fmt.Errorf("scheme %q is not allowed", u.Scheme)
+	}
+	// Unix sockets don't have a port
+	if len(p.ports) > 0 && u.Scheme != "unix" {
+		port := u.Port()
+		if port == "" {
+			switch u.Scheme {
+			case "http":
+				port = "80"
+			case "https":
+				port = "443"
+			}
+		}
+		n, err := strconv.Atoi(port)
+		if err != nil || !slices.Contains(p.ports, n) {
+			return fmt.Errorf("port %q is not allowed", port)
+		}
+	}
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil {
+		return p.checkAddr(addr)
+	}
+	return nil
+}
+
+// checkAddr checks addr is in an allowed network and not a denied one.
+func (p *urlPolicy) checkAddr(addr netip.Addr) error {
+	addr = addr.Unmap()
+	if len(p.allow) > 0 && !slices.ContainsFunc(p.allow, func(n netip.Prefix) bool { return n.Contains(addr) }) {
+		return fmt.Errorf("address %s is not in an allowed network", addr)
+	}
+	if slices.ContainsFunc(p.deny, func(n netip.Prefix) bool { return n.Contains(addr) }) {
+		return fmt.Errorf("address %s is in a denied network", addr)
+	}
+	return nil
+}
+
+// checkHost checks host, or every address it resolves to if it's a name.
+func (p *urlPolicy) checkHost(ctx context.Context, host string) error {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return p.checkAddr(addr)
+	}
+	addrs, err := p.resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("%w %s: %w", ErrDNS, host, err)
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("%w %s: no addresses found", ErrDNS, host)
+	}
+	for _, addr := range addrs {
+		if err := p.checkAddr(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// control checks the address of each connection after the host name has been
+// resolved, so a name can't be used to reach a denied address.
+func (p *urlPolicy) control(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	return p.checkAddr(addrPort.Addr())
+}
+
+// transport returns a copy of base, or http.DefaultTransport if it is nil,
+// that only connects to addresses allowed by the policy.
+func (p *urlPolicy) transport(base *http.Transport) *http.Transport {
+	if base == nil {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+	transport := base.Clone()
+	// The same settings as http.DefaultTransport
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: p.control}
+	transport.DialContext = dialer.DialContext
+	return transport
+}
+
+// proxyCheckRoundTripper checks the addresses of the host of each request
+// sent through a proxy. The proxy resolves the host itself, so otherwise only
+// the proxy's address would be checked when it is connected to.
+type proxyCheckRoundTripper struct {
+	policy *urlPolicy
+	// proxy returns the proxy for a request, nil if it is sent directly.
+	proxy func(*http.Request) (*url.URL, error)
+	next  http.RoundTripper
+}
+
+// RoundTrip checks the request's host if it's sent through a proxy before
+// sending it.
+func (rt *proxyCheckRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	proxyURL, err := rt.proxy(req)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL != nil {
+		if err := rt.policy.checkHost(req.Context(), req.URL.Hostname()); err != nil {
+			return nil, fmt.Errorf("request to %s through a proxy refused: %w", req.URL.Redacted(), err)
+		}
+	}
+	return rt.next.RoundTrip(req)
+}
+
+// checkRedirect refuses redirects to URLs that aren't allowed, otherwise
+// following up to 10 redirects like the default http.Client.
+func (p *urlPolicy) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if err := p.checkURL(req.URL); err != nil {
+		return fmt.Errorf("redirect to %s refused: %w", req.URL.Redacted(), err)
+	}
+	return nil
+}
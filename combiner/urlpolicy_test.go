@@ -0,0 +1,209 @@
+package combiner
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// TestURLPolicyCheckURL tests the scheme, port and address checks of URLs.
+func TestURLPolicyCheckURL(t *testing.T) {
+	testCases := []struct {
+		name        string
+		policy      URLPolicy
+		url         string
+		expectedErr string
+	}{
+		{"Zero policy", URLPolicy{}, "gopher://169.254.169.254:70/", ""},
+		{"Allowed scheme", URLPolicy{Schemes: []string{"https"}}, "https://a/", ""},
+		{"Refused scheme", URLPolicy{Schemes: []string{"https"}}, "http://a/", `scheme "http" is not allowed`},
+		{"Allowed port", URLPolicy{Ports: []int{9100}}, "http://a:9100/metrics", ""},
+		{"Default port", URLPolicy{Ports: []int{443}}, "https://a/metrics", ""},
+		{"Refused port", URLPolicy{Ports: []int{9100}}, "http://a/metrics", `port "80" is not allowed`},
+		{"Denied address", URLPolicy{DenyCIDRs: []string{"169.254.0.0/16"}}, "http://169.254.169.254/", "in a denied network"},
+		{"Denied IPv6 address", URLPolicy{DenyCIDRs: []string{"fe80::/10"}}, "http://[fe80::1]:9100/", "in a denied network"},
+		{"Address outside allowed networks", URLPolicy{AllowCIDRs: []string{"10.0.0.0/8"}}, "http://192.168.0.1/", "not in an allowed network"},
+		{"Address inside allowed networks", URLPolicy{AllowCIDRs: []string{"10.0.0.0/8"}}, "http://10.1.2.3/", ""},
+		{"Host name checked when resolved", URLPolicy{AllowCIDRs: []string{"10.0.0.0/8"}}, "http://exporter/", ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy, err := tc.policy.compile()
+			if err != nil {
+				t.Fatalf("compile failed: %v", err)
+			}
+			u, err := url.Parse(tc.url)
+			if err != nil {
+				t.Fatalf("invalid URL: %v", err)
+			}
+			err = policy.checkURL(u)
+			if tc.expectedErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if tc.expectedErr != "" && (err == nil || !strings.Contains(err.Error(), tc.expectedErr)) {
+				t.Errorf("expected error containing %q, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+// TestURLPolicyInvalid tests invalid policies are rejected.
+func TestURLPolicyInvalid(t *testing.T) {
+	for _, policy := range []URLPolicy{
+		{Ports: []int{0}},
+		{AllowCIDRs: []string{"10.0.0.1"}},
+		{DenyCIDRs: []string{"not-a-network"}},
+	} {
+		if _, err := New(nil, Options{URLPolicy: policy}); err == nil {
+			t.Errorf("expected %+v to be rejected", policy)
+		}
+	}
+}
+
+// TestCombinerURLPolicy tests host names are checked when they are resolved
+// and redirects to URLs that aren't allowed are refused.
+func TestCombinerURLPolicy(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "other_metric 1")
+	}))
+	defer other.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, other.URL+"/metrics", http.StatusFound)
+			return
+		}
+		fmt.Fprintln(w, "upstream_metric 1")
+	}))
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("invalid server URL: %v", err)
+	}
+	port, err := strconv.Atoi(serverURL.Port())
+	if err != nil {
+		t.Fatalf("invalid server port: %v", err)
+	}
+	localhost := "http://localhost:" + serverURL.Port()
+
+	testCases := []struct {
+		name           string
+		policy         URLPolicy
+		url            string
+		expectedStatus int
+	}{
+		{"Allowed", URLPolicy{AllowCIDRs: []string{"127.0.0.0/8", "::1/128"}}, localhost + "/metrics", http.StatusOK},
+		{"Resolved to a denied address", URLPolicy{DenyCIDRs: []string{"127.0.0.0/8", "::1/128"}}, localhost + "/metrics", http.StatusInternalServerError},
+		{"Redirect without a policy", URLPolicy{}, server.URL + "/redirect", http.StatusOK},
+		{"Redirect to a refused port", URLPolicy{Ports: []int{port}}, server.URL + "/redirect", http.StatusInternalServerError},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := New(staticTargets([]string{tc.url}), Options{URLPolicy: tc.policy})
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			rr := httptest.NewRecorder()
+			c.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d: %s", tc.expectedStatus, rr.Code, rr.Body.String())
+			}
+		})
+	}
+
+	if _, err := New(staticTargets([]string{server.URL}), Options{URLPolicy: URLPolicy{DenyCIDRs: []string{"127.0.0.0/8"}}}); err == nil {
+		t.Error("expected a target with a denied address to be rejected")
+	}
+}
+
+// TestCombinerURLPolicyProxy tests the host of a request sent through a proxy
+// is resolved and checked, since the proxy's address is all that's checked
+// when connecting.
+func TestCombinerURLPolicyProxy(t *testing.T) {
+	var proxied atomic.Int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Add(1)
+		fmt.Fprintln(w, "proxied_metric 1")
+	}))
+	defer proxy.Close()
+
+	resolver := &fakeResolver{hosts: map[string][]netip.Addr{
+		"exporter.internal": {netip.MustParseAddr("10.0.0.1")},
+		"metadata.internal": {netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("169.254.169.254")},
+	}}
+
+	testCases := []struct {
+		name           string
+		url            string
+		expectedStatus int
+		expectedFetch  int32
+	}{
+		{"Allowed host", "http://exporter.internal/metrics", http.StatusOK, 1},
+		{"Host resolving to a denied address", "http://metadata.internal/metrics", http.StatusInternalServerError, 0},
+		{"Unresolvable host", "http://unknown.internal/metrics", http.StatusInternalServerError, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			proxied.Store(0)
+			opts, err := Options{URLPolicy: URLPolicy{DenyCIDRs: []string{"169.254.0.0/16"}}}.compile()
+			if err != nil {
+				t.Fatalf("compile failed: %v", err)
+			}
+			opts.urlPolicy.resolver = resolver
+			c, err := newCombiner([]Target{{URL: tc.url, ProxyURL: proxy.URL}}, opts)
+			if err != nil {
+				t.Fatalf("newCombiner failed: %v", err)
+			}
+			rr := httptest.NewRecorder()
+			c.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d: %s", tc.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if n := proxied.Load(); n != tc.expectedFetch {
+				t.Errorf("proxy received %d requests, want %d", n, tc.expectedFetch)
+			}
+		})
+	}
+}
+
+// TestURLPolicyCredentialTransport tests token endpoints are fetched without
+// the URL policy's network checks, so metadata endpoints in denied networks
+// can still issue credentials.
+func TestURLPolicyCredentialTransport(t *testing.T) {
+	tokens := newTokenServer(t, 3600)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "upstream_metric 1")
+	}))
+	defer upstream.Close()
+
+	opts, err := Options{URLPolicy: URLPolicy{DenyCIDRs: []string{"127.0.0.0/8", "::1/128"}}}.compile()
+	if err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+	cfg := Target{URL: upstream.URL, OAuth2: &OAuth2{
+		ClientID:         "combiner",
+		ClientSecretFile: writeFile(t, "secret", "hunter2\n"),
+		TokenURL:         tokens.URL,
+	}}
+	client, err := newClient(cfg, opts.transport, opts.credentialTransport, opts.urlPolicy)
+	if err != nil {
+		t.Fatalf("newClient failed: %v", err)
+	}
+
+	_, err = client.Get(upstream.URL)
+	if err == nil || !strings.Contains(err.Error(), "in a denied network") {
+		t.Errorf("expected the upstream to be refused, got %v", err)
+	}
+	if n := tokens.issued.Load(); n != 1 {
+		t.Errorf("token endpoint issued %d tokens, want 1", n)
+	}
+}
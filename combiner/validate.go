@@ -0,0 +1,160 @@
+package combiner
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrInvalidOutput is returned when the combined metrics contain invalid
+// series and the validation mode is ValidationFail.
+var ErrInvalidOutput = errors.New("invalid series in the combined metrics")
+
+// Modes for handling invalid series in the combined metrics.
+const (
+	// ValidationDrop removes invalid series.
+	ValidationDrop = "drop"
+	// ValidationWarn logs invalid series and serves them anyway.
+	ValidationWarn = "warn"
+	// ValidationFail fails the request with ErrInvalidOutput.
+	ValidationFail = "fail"
+)
+
+// ValidationModes lists all validation modes.
+var ValidationModes = []string{ValidationDrop, ValidationWarn, ValidationFail}
+
+// validateSeries checks a series of the family mf would be accepted by
+// Prometheus: the names and label values are valid UTF-8, labels aren't
+// repeated or reserved, the value matches the type of the family, counters
+// aren't negative, histogram buckets are cumulative and summary quantiles are
+// between 0 and 1.
+func validateSeries(mf *dto.MetricFamily, m *dto.Metric) error {
+	if !model.UTF8Validation.IsValidMetricName(mf.GetName()) {
+		return fmt.Errorf("invalid metric name %q", mf.GetName())
+	}
+	seen := make(map[string]bool, len(m.Label))
+	for _, l := range m.Label {
+		name := l.GetName()
+		switch {
+		case !model.UTF8Validation.IsValidLabelName(name):
+			return fmt.Errorf("invalid label name %q", name)
+		case seen[name]:
+			return fmt.Errorf("repeated label %q", name)
+		case name == model.MetricNameLabel,
+			name == model.BucketLabel && (mf.GetType() == dto.MetricType_HISTOGRAM || mf.GetType() == dto.MetricType_GAUGE_HISTOGRAM),
+			name == model.QuantileLabel && mf.GetType() == dto.MetricType_SUMMARY:
+			return fmt.Errorf("reserved label %q", name)
+		case !utf8.ValidString(l.GetValue()):
+			return fmt.Errorf("invalid value for label %q", name)
+		}
+		seen[name] = true
+	}
+
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		if m.Counter == nil {
+			return errors.New("counter without a counter value")
+		}
+		if m.Counter.GetValue() < 0 {
+			return fmt.Errorf("negative counter value %v", m.Counter.GetValue())
+		}
+	case dto.MetricType_GAUGE:
+		if m.Gauge == nil {
+			return errors.New("gauge without a gauge value")
+		}
+	case dto.MetricType_UNTYPED:
+		if m.Untyped == nil {
+			return errors.New("untyped metric without an untyped value")
+		}
+	case dto.MetricType_SUMMARY:
+		if m.Summary == nil {
+			return errors.New("summary without a summary value")
+		}
+		for _, q := range m.Summary.Quantile {
+			if q.GetQuantile() < 0 || q.GetQuantile() > 1 || math.IsNaN(q.GetQuantile()) {
+				return fmt.Errorf("quantile %v isn't between 0 and 1", q.GetQuantile())
+			}
+		}
+	case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+		if m.Histogram == nil {
+			return errors.New("histogram without a histogram value")
+		}
+		for i, b := range m.Histogram.Bucket {
+			if i == 0 {
+				continue
+			}
+			prev := m.Histogram.Bucket[i-1]
+			if b.GetUpperBound() <= prev.GetUpperBound() {
+				return fmt.Errorf("bucket le=%v isn't after le=%v", b.GetUpperBound(), prev.GetUpperBound())
+			}
+			if bucketCount(b) < bucketCount(prev) {
+				return fmt.Errorf("bucket le=%v has a lower count than le=%v", b.GetUpperBound(), prev.GetUpperBound())
+			}
+		}
+	}
+	return nil
+}
+
+// validateFamilies checks every series in families with validateSeries and
+// handles the invalid ones according to mode. It returns the families, with
+// invalid series removed for ValidationDrop, and the number of invalid series.
+// The families are modified in place.
+func validateFamilies(families []*dto.MetricFamily, mode string) ([]*dto.MetricFamily, int, error) {
+	var invalid int
+	var firstErr error
+	for _, mf := range families {
+		var valid []*dto.Metric
+		for _, m := range mf.Metric {
+			if err := validateSeries(mf, m); err != nil {
+				invalid++
+				if firstErr == nil {
+					firstErr = fmt.Errorf("%s: %w", seriesString(mf.GetName(), m), err)
+				}
+				continue
+			}
+			valid = append(valid, m)
+		}
+		if mode == ValidationDrop {
+			mf.Metric = valid
+		}
+	}
+	if invalid == 0 {
+		return families, 0, nil
+	}
+
+	switch mode {
+	case ValidationFail:
+		return nil, invalid, fmt.Errorf("%w: %d series, the first is %w", ErrInvalidOutput, invalid, firstErr)
+	case ValidationDrop:
+		slog.Warn("Dropping invalid series from the combined metrics", "count", invalid, "first", firstErr)
+		// Families without metrics can't be encoded
+		families = slices.DeleteFunc(families, func(mf *dto.MetricFamily) bool { return len(mf.Metric) == 0 })
+	default:
+		slog.Warn("Serving invalid series in the combined metrics", "count", invalid, "first", firstErr)
+	}
+	return families, invalid, nil
+}
+
+// invalidSeriesMetricFamily returns the self-metric for the number of invalid
+// series found in the combined metrics.
+func invalidSeriesMetricFamily(invalid int) *dto.MetricFamily {
+	mf := newSelfMetricFamily("combiner_invalid_series", "Number of invalid series found in the combined metrics.", dto.MetricType_GAUGE)
+	mf.Metric = []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(float64(invalid))}}}
+	return mf
+}
+
+// insertFamily adds mf to families sorted by name.
+func insertFamily(families []*dto.MetricFamily, mf *dto.MetricFamily) []*dto.MetricFamily {
+	i, _ := slices.BinarySearchFunc(families, mf.GetName(), func(f *dto.MetricFamily, name string) int {
+		return strings.Compare(f.GetName(), name)
+	})
+	return slices.Insert(families, i, mf)
+}
@@ -0,0 +1,191 @@
+package combiner
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+)
+
+// TestValidateSeries tests invalid series are detected.
+func TestValidateSeries(t *testing.T) {
+	label := func(name, value string) *dto.LabelPair {
+		return &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)}
+	}
+	family := func(name string, typ dto.MetricType) *dto.MetricFamily {
+		return &dto.MetricFamily{Name: proto.String(name), Type: typ.Enum()}
+	}
+	bucket := func(le float64, count uint64) *dto.Bucket {
+		return &dto.Bucket{UpperBound: proto.Float64(le), CumulativeCount: proto.Uint64(count)}
+	}
+
+	testCases := []struct {
+		name          string
+		family        *dto.MetricFamily
+		metric        *dto.Metric
+		expectedError string
+	}{
+		{
+			name:   "Valid counter",
+			family: family("requests_total", dto.MetricType_COUNTER),
+			metric: &dto.Metric{Label: []*dto.LabelPair{label("code", "200")}, Counter: &dto.Counter{Value: proto.Float64(1)}},
+		},
+		{
+			name:   "UTF-8 names",
+			family: family("http.server.requests", dto.MetricType_GAUGE),
+			metric: &dto.Metric{Label: []*dto.LabelPair{label("http.route", "/")}, Gauge: &dto.Gauge{Value: proto.Float64(1)}},
+		},
+		{
+			name:          "Invalid metric name",
+			family:        family("a\xff", dto.MetricType_GAUGE),
+			metric:        &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(1)}},
+			expectedError: "invalid metric name",
+		},
+		{
+			name:          "Invalid label value",
+			family:        family("a", dto.MetricType_GAUGE),
+			metric:        &dto.Metric{Label: []*dto.LabelPair{label("b", "\xff")}, Gauge: &dto.Gauge{Value: proto.Float64(1)}},
+			expectedError: "invalid value for label",
+		},
+		{
+			name:          "Repeated label",
+			family:        family("a", dto.MetricType_GAUGE),
+			metric:        &dto.Metric{Label: []*dto.LabelPair{label("b", "1"), label("b", "2")}, Gauge: &dto.Gauge{Value: proto.Float64(1)}},
+			expectedError: "repeated label",
+		},
+		{
+			name:          "Reserved histogram label",
+			family:        family("a", dto.MetricType_HISTOGRAM),
+			metric:        &dto.Metric{Label: []*dto.LabelPair{label("le", "1")}, Histogram: &dto.Histogram{}},
+			expectedError: "reserved label",
+		},
+		{
+			name:          "Wrong value type",
+			family:        family("a", dto.MetricType_COUNTER),
+			metric:        &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(1)}},
+			expectedError: "counter without a counter value",
+		},
+		{
+			name:          "Negative counter",
+			family:        family("a", dto.MetricType_COUNTER),
+			metric:        &dto.Metric{Counter: &dto.Counter{Value: proto.Float64(-1)}},
+			expectedError: "negative counter value",
+		},
+		{
+			name:          "Quantile out of range",
+			family:        family("a", dto.MetricType_SUMMARY),
+			metric:        &dto.Metric{Summary: &dto.Summary{Quantile: []*dto.Quantile{{Quantile: proto.Float64(1.5), Value: proto.Float64(1)}}}},
+			expectedError: "isn't between 0 and 1",
+		},
+		{
+			name:          "Unordered buckets",
+			family:        family("a", dto.MetricType_HISTOGRAM),
+			metric:        &dto.Metric{Histogram: &dto.Histogram{Bucket: []*dto.Bucket{bucket(2, 1), bucket(1, 2)}}},
+			expectedError: "isn't after",
+		},
+		{
+			name:          "Buckets not cumulative",
+			family:        family("a", dto.MetricType_HISTOGRAM),
+			metric:        &dto.Metric{Histogram: &dto.Histogram{Bucket: []*dto.Bucket{bucket(1, 2), bucket(2, 1)}}},
+			expectedError: "lower count",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateSeries(tc.family, tc.metric)
+			if tc.expectedError == "" {
+				if err != nil {
+					t.Errorf("expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+				t.Errorf("expected error containing '%s', got: %v", tc.expectedError, err)
+			}
+		})
+	}
+}
+
+// TestCombinerOutputValidation tests each way of handling invalid series.
+func TestCombinerOutputValidation(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# TYPE errors_total counter\nerrors_total{code=\"500\"} -1\nerrors_total{code=\"503\"} 2\n")
+		fmt.Fprint(w, "# TYPE broken counter\nbroken -5\n# TYPE up gauge\nup 1\n")
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		name           string
+		mode           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "Disabled",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "# TYPE broken counter\nbroken -5\n# TYPE errors_total counter\nerrors_total{code=\"500\"} -1\nerrors_total{code=\"503\"} 2\n# TYPE up gauge\nup 1\n",
+		},
+		{
+			name:           "Drop",
+			mode:           ValidationDrop,
+			expectedStatus: http.StatusOK,
+			expectedBody:   "# TYPE errors_total counter\nerrors_total{code=\"503\"} 2\n# TYPE up gauge\nup 1\n",
+		},
+		{
+			name:           "Warn",
+			mode:           ValidationWarn,
+			expectedStatus: http.StatusOK,
+			expectedBody:   "# TYPE broken counter\nbroken -5\n# TYPE errors_total counter\nerrors_total{code=\"500\"} -1\nerrors_total{code=\"503\"} 2\n# TYPE up gauge\nup 1\n",
+		},
+		{
+			name:           "Fail",
+			mode:           ValidationFail,
+			expectedStatus: http.StatusInternalServerError,
+			expectedBody:   "Failed to combine metrics: invalid series in the combined metrics: 2 series, the first is broken{}: negative counter value -5\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			agg, err := New(staticTargets([]string{server.URL}), Options{OutputValidation: tc.mode})
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			rr := httptest.NewRecorder()
+			agg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d", tc.expectedStatus, rr.Code)
+			}
+			if rr.Body.String() != tc.expectedBody {
+				t.Errorf("got %q, want %q", rr.Body.String(), tc.expectedBody)
+			}
+		})
+	}
+
+	// The number of invalid series is a self-metric
+	agg, err := New(staticTargets([]string{server.URL}), Options{OutputValidation: ValidationWarn, SelfMetrics: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	agg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	families, err := parseMetrics(rr.Body, expfmt.FmtText)
+	if err != nil {
+		t.Fatalf("parseMetrics failed: %v", err)
+	}
+	for _, mf := range families {
+		if mf.GetName() == "combiner_invalid_series" {
+			if v := mf.Metric[0].GetGauge().GetValue(); v != 2 {
+				t.Errorf("expected 2 invalid series, got %v", v)
+			}
+			return
+		}
+	}
+	t.Error("expected a combiner_invalid_series metric")
+}
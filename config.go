@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/manics/prometheus-metrics-combiner/combiner"
+	"go.yaml.in/yaml/v3"
+)
+
+// config is the contents of the configuration file.
+type config struct {
+	Targets []combiner.Target `yaml:"targets"`
+	// DNSSDConfigs discover targets from DNS SRV records.
+	DNSSDConfigs []dnsSDConfig `yaml:"dns_sd_configs"`
+	// FileSDConfigs discover targets from files in the Prometheus file_sd format.
+	FileSDConfigs []fileSDConfig `yaml:"file_sd_configs"`
+	// HTTPSDConfigs discover targets from URLs in the Prometheus http_sd format.
+	HTTPSDConfigs []httpSDConfig `yaml:"http_sd_configs"`
+	// KubernetesSDConfigs discover targets from Kubernetes pods.
+	KubernetesSDConfigs []kubernetesSDConfig `yaml:"kubernetes_sd_configs"`
+	// Groups are combined separately and served on their own paths.
+	Groups []groupConfig `yaml:"groups"`
+	// Scales convert the values of metrics served on the metrics path.
+	Scales []combiner.Scale `yaml:"scales"`
+	// Aggregations combine metrics across the targets served on the metrics
+	// path.
+	Aggregations []combiner.Aggregation `yaml:"aggregations"`
+}
+
+// loadConfig reads and validates a configuration file.
+func loadConfig(path string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+
+	var cfg config
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	for i, t := range cfg.Targets {
+		if t.URL == "" {
+			return nil, fmt.Errorf("target %d in config file %s has no url", i, path)
+		}
+		if err := t.Validate(); err != nil {
+			return nil, fmt.Errorf("target %s in config file %s: %w", combiner.RedactURL(t.URL), path, err)
+		}
+	}
+	if cfg.Targets, err = expandTargets(cfg.Targets); err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	names := make(map[string]bool, len(cfg.Groups))
+	for i, g := range cfg.Groups {
+		if err := g.validate(); err != nil {
+			return nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+		if names[g.Name] {
+			return nil, fmt.Errorf("config file %s: duplicate group name %s", path, g.Name)
+		}
+		names[g.Name] = true
+		if cfg.Groups[i].Targets, err = expandTargets(g.Targets); err != nil {
+			return nil, fmt.Errorf("config file %s: group %s: %w", path, g.Name, err)
+		}
+	}
+	for _, s := range cfg.Scales {
+		if err := s.Validate(); err != nil {
+			return nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+	for _, a := range cfg.Aggregations {
+		if err := a.Validate(); err != nil {
+			return nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+	for i, c := range cfg.DNSSDConfigs {
+		if err := c.validate(); err != nil {
+			return nil, fmt.Errorf("dns_sd_configs %d in config file %s: %w", i, path, err)
+		}
+	}
+	for i, c := range cfg.FileSDConfigs {
+		if err := c.validate(); err != nil {
+			return nil, fmt.Errorf("file_sd_configs %d in config file %s: %w", i, path, err)
+		}
+	}
+	for i, c := range cfg.HTTPSDConfigs {
+		if err := c.validate(); err != nil {
+			return nil, fmt.Errorf("http_sd_configs %d in config file %s: %w", i, path, err)
+		}
+	}
+	for i, c := range cfg.KubernetesSDConfigs {
+		if err := c.validate(); err != nil {
+			return nil, fmt.Errorf("kubernetes_sd_configs %d in config file %s: %w", i, path, err)
+		}
+	}
+	return &cfg, nil
+}
+
+// sourceOptions are the flags selecting where targets come from.
+type sourceOptions struct {
+	urls []string
+	// urlLists are URLs serving plain text lists of upstream URLs, fetched
+	// again every urlListRefreshInterval.
+	urlLists               []string
+	urlListRefreshInterval time.Duration
+	configFile             string
+}
+
+// loadSources combines the targets given by URL, the URL lists, and the
+// targets, discovery configs and groups in the config file, if any, and
+// applies the global defaults.
+func loadSources(opts sourceOptions, defaults combiner.Target) (targetSources, error) {
+	var sources targetSources
+	static, err := expandTargets(staticTargets(opts.urls))
+	if err != nil {
+		return sources, err
+	}
+	sources.static = static
+	for _, u := range opts.urlLists {
+		sources.discoverers = append(sources.discoverers, newURLListDiscoverer(u, opts.urlListRefreshInterval, defaults))
+	}
+	if opts.configFile != "" {
+		cfg, err := loadConfig(opts.configFile)
+		if err != nil {
+			return sources, err
+		}
+		sources.static = append(sources.static, cfg.Targets...)
+		sources.scales = cfg.Scales
+		sources.aggregations = cfg.Aggregations
+		for _, c := range cfg.DNSSDConfigs {
+			sources.discoverers = append(sources.discoverers, newDNSDiscoverer(c, defaults))
+		}
+		for _, c := range cfg.FileSDConfigs {
+			sources.discoverers = append(sources.discoverers, newFileDiscoverer(c, defaults))
+		}
+		for _, c := range cfg.HTTPSDConfigs {
+			sources.discoverers = append(sources.discoverers, newHTTPDiscoverer(c, defaults))
+		}
+		for _, c := range cfg.KubernetesSDConfigs {
+			sources.discoverers = append(sources.discoverers, newKubernetesDiscoverer(c, defaults))
+		}
+		for _, g := range cfg.Groups {
+			sources.groups = append(sources.groups, g.withDefaults(defaults))
+		}
+	}
+	for i := range sources.static {
+		sources.static[i] = sources.static[i].WithDefaults(defaults)
+	}
+
+	if len(sources.static) == 0 && len(sources.discoverers) == 0 && len(sources.groups) == 0 {
+		return sources, fmt.Errorf("at least one upstream URL must be specified with the -url or -url-list-url flags or in the config file")
+	}
+	return sources, nil
+}
+
+// staticTargets creates target configurations for a list of URLs.
+func staticTargets(urls []string) []combiner.Target {
+	targets := make([]combiner.Target, len(urls))
+	for i, u := range urls {
+		targets[i] = combiner.Target{URL: u}
+	}
+	return targets
+}
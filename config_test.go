@@ -0,0 +1,285 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/manics/prometheus-metrics-combiner/combiner"
+)
+
+// writeFile writes content to a file in a temporary directory and returns its path.
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+	return path
+}
+
+// TestLoadConfig tests parsing and validation of the configuration file.
+func TestLoadConfig(t *testing.T) {
+	testCases := []struct {
+		name          string
+		content       string
+		expected      *config
+		expectedError string
+	}{
+		{
+			name: "Valid config",
+			content: `
+targets:
+  - url: http://localhost:9100/metrics
+  - url: https://exporter.internal/metrics
+    tls_config:
+      ca_file: /etc/ssl/internal-ca.pem
+    labels:
+      source: node1
+    metric_prefix: svc1_
+  - url: http://localhost:8080/metrics
+    labels:
+      http.route: /
+    metric_prefix: app.
+`,
+			expected: &config{Targets: []combiner.Target{
+				{URL: "http://localhost:9100/metrics"},
+				{URL: "https://exporter.internal/metrics", TLSConfig: combiner.TLSConfig{CAFile: "/etc/ssl/internal-ca.pem"}, Labels: map[string]string{"source": "node1"}, MetricPrefix: "svc1_"},
+				{URL: "http://localhost:8080/metrics", Labels: map[string]string{"http.route": "/"}, MetricPrefix: "app."},
+			}},
+		},
+		{
+			name:          "Unknown field",
+			content:       "targets:\n  - url: http://localhost\n    unknown: 1\n",
+			expectedError: "field unknown not found",
+		},
+		{
+			name:          "Basic auth without username",
+			content:       "targets:\n  - url: http://localhost\n    basic_auth:\n      password_file: /tmp/p\n",
+			expectedError: "requires a username",
+		},
+		{
+			name:          "Basic auth and bearer token",
+			content:       "targets:\n  - url: http://localhost\n    bearer_token_file: /tmp/t\n    basic_auth:\n      username: u\n",
+			expectedError: "cannot be used together",
+		},
+		{
+			name:          "Authorization header with basic auth",
+			content:       "targets:\n  - url: http://localhost\n    basic_auth:\n      username: u\n    headers:\n      authorization: x\n",
+			expectedError: "Authorization header cannot be set",
+		},
+		{
+			name:          "Invalid label name",
+			content:       "targets:\n  - url: http://localhost\n    labels:\n      \"\": x\n",
+			expectedError: "invalid label name",
+		},
+		{
+			name:          "Reserved label name",
+			content:       "targets:\n  - url: http://localhost\n    labels:\n      __name__: x\n",
+			expectedError: "invalid label name",
+		},
+		{
+			name:          "Invalid label conflict policy",
+			content:       "targets:\n  - url: http://localhost\n    label_conflict: ignore\n",
+			expectedError: "invalid label_conflict",
+		},
+		{
+			name: "DNS discovery",
+			content: `
+dns_sd_configs:
+  - names: [_metrics._tcp.exporters.internal]
+    refresh_interval: 1m
+    scheme: https
+    metrics_path: /custom
+    labels:
+      source: dns
+`,
+			expected: &config{DNSSDConfigs: []dnsSDConfig{{
+				Names:           []string{"_metrics._tcp.exporters.internal"},
+				RefreshInterval: time.Minute,
+				Scheme:          "https",
+				MetricsPath:     "/custom",
+				Target:          combiner.Target{Labels: map[string]string{"source": "dns"}},
+			}}},
+		},
+		{
+			name:          "DNS discovery without names",
+			content:       "dns_sd_configs:\n  - scheme: http\n",
+			expectedError: "at least one name",
+		},
+		{
+			name:          "DNS discovery with a url",
+			content:       "dns_sd_configs:\n  - names: [a]\n    url: http://localhost\n",
+			expectedError: "url can't be set",
+		},
+		{
+			name:          "DNS discovery with an invalid scheme",
+			content:       "dns_sd_configs:\n  - names: [a]\n    scheme: ftp\n",
+			expectedError: "invalid scheme",
+		},
+		{
+			name:     "File discovery",
+			content:  "file_sd_configs:\n  - files: [targets/*.json]\n    metrics_path: /custom\n",
+			expected: &config{FileSDConfigs: []fileSDConfig{{Files: []string{"targets/*.json"}, MetricsPath: "/custom"}}},
+		},
+		{
+			name:          "File discovery with an unknown extension",
+			content:       "file_sd_configs:\n  - files: [targets.txt]\n",
+			expectedError: "must end in .json",
+		},
+		{
+			name:     "HTTP discovery",
+			content:  "http_sd_configs:\n  - sd_url: http://sd.internal/targets\n    refresh_interval: 2m\n",
+			expected: &config{HTTPSDConfigs: []httpSDConfig{{URL: "http://sd.internal/targets", RefreshInterval: 2 * time.Minute}}},
+		},
+		{
+			name:          "HTTP discovery with url instead of sd_url",
+			content:       "http_sd_configs:\n  - url: http://sd.internal/targets\n",
+			expectedError: "use sd_url",
+		},
+		{
+			name: "Groups",
+			content: `
+groups:
+  - name: web
+    labels:
+      team: web
+    exclude_prefixes: [go_]
+    targets:
+      - url: http://web-{1..2}:9100/metrics
+`,
+			expected: &config{Groups: []groupConfig{{
+				Name:    "web",
+				Labels:  map[string]string{"team": "web"},
+				Filters: combiner.Filter{ExcludePrefixes: []string{"go_"}},
+				Targets: []combiner.Target{{URL: "http://web-1:9100/metrics"}, {URL: "http://web-2:9100/metrics"}},
+			}}},
+		},
+		{
+			name:          "Group with an invalid name",
+			content:       "groups:\n  - name: a/b\n    targets:\n      - url: http://localhost\n",
+			expectedError: "invalid group name",
+		},
+		{
+			name:          "Duplicate groups",
+			content:       "groups:\n  - name: a\n    targets:\n      - url: http://localhost\n  - name: a\n    targets:\n      - url: http://localhost\n",
+			expectedError: "duplicate group name",
+		},
+		{
+			name:          "Group with an invalid selector",
+			content:       "groups:\n  - name: a\n    keep_series: ['{']\n    targets:\n      - url: http://localhost\n",
+			expectedError: "invalid series selector",
+		},
+		{
+			name: "Scales and aggregations",
+			content: `
+scales:
+  - metric: latency_milliseconds
+    divide: 1000
+    name: latency_seconds
+aggregations:
+  - metric: http_requests_total
+    without: [instance]
+groups:
+  - name: web
+    aggregations:
+      - metric: up
+        op: max
+        name: web_up
+    targets:
+      - url: http://web:9100/metrics
+`,
+			expected: &config{
+				Scales:       []combiner.Scale{{Metric: "latency_milliseconds", Divide: 1000, Name: "latency_seconds"}},
+				Aggregations: []combiner.Aggregation{{Metric: "http_requests_total", Without: []string{"instance"}}},
+				Groups: []groupConfig{{
+					Name:         "web",
+					Aggregations: []combiner.Aggregation{{Metric: "up", Op: combiner.AggregateMax, Name: "web_up"}},
+					Targets:      []combiner.Target{{URL: "http://web:9100/metrics"}},
+				}},
+			},
+		},
+		{
+			name:          "Aggregation with by and without",
+			content:       "aggregations:\n  - metric: up\n    by: [job]\n    without: [instance]\n",
+			expectedError: "can't set both by and without",
+		},
+		{
+			name:          "Scale without a factor",
+			content:       "scales:\n  - metric: latency_milliseconds\n",
+			expectedError: "must set one of multiply or divide",
+		},
+		{
+			name:    "Group staleness policy",
+			content: "groups:\n  - name: a\n    staleness_policy: mark\n    serve_stale_max_age: 5m\n    targets:\n      - url: http://localhost\n",
+			expected: &config{
+				Groups: []groupConfig{{
+					Name:             "a",
+					StalenessPolicy:  combiner.StalenessMark,
+					ServeStaleMaxAge: 5 * time.Minute,
+					Targets:          []combiner.Target{{URL: "http://localhost"}},
+				}},
+			},
+		},
+		{
+			name:          "Group invalid staleness policy",
+			content:       "groups:\n  - name: a\n    staleness_policy: drop\n    targets:\n      - url: http://localhost\n",
+			expectedError: "invalid staleness policy",
+		},
+		{
+			name:          "Group aggregation without a metric",
+			content:       "groups:\n  - name: a\n    aggregations:\n      - by: [job]\n    targets:\n      - url: http://localhost\n",
+			expectedError: "invalid aggregation metric name",
+		},
+		{
+			name: "Kubernetes discovery",
+			content: `
+kubernetes_sd_configs:
+  - namespace: monitoring
+    label_selector: app=exporter
+    port_name: metrics
+`,
+			expected: &config{KubernetesSDConfigs: []kubernetesSDConfig{{
+				Namespace:     "monitoring",
+				LabelSelector: "app=exporter",
+				PortName:      "metrics",
+			}}},
+		},
+		{
+			name:          "Kubernetes discovery without a port name",
+			content:       "kubernetes_sd_configs:\n  - label_selector: app=exporter\n",
+			expectedError: "port_name is required",
+		},
+		{
+			name:          "Kubernetes discovery with an invalid API server",
+			content:       "kubernetes_sd_configs:\n  - port_name: metrics\n    api_server: localhost:8001\n",
+			expectedError: "invalid api_server",
+		},
+		{
+			name:          "Missing url",
+			content:       "targets:\n  - tls_config: {}\n",
+			expectedError: "has no url",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := loadConfig(writeFile(t, "config.yaml", tc.content))
+			if tc.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+					t.Fatalf("expected error containing '%s', got: %v", tc.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfig failed: %v", err)
+			}
+			if !reflect.DeepEqual(cfg, tc.expected) {
+				t.Errorf("loadConfig returned wrong config: got %+v, want %+v", cfg, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/manics/prometheus-metrics-combiner/combiner"
+)
+
+// defaultRefreshInterval is how often discovered targets are refreshed if the
+// discovery config doesn't say.
+const defaultRefreshInterval = 30 * time.Second
+
+// discoverer finds targets that can change while the combiner is running.
+type discoverer interface {
+	// run calls update with the discovered targets whenever they may have
+	// changed, until ctx is cancelled.
+	run(ctx context.Context, update func([]combiner.Target))
+}
+
+// targetSources are the static targets, the discoverers and the groups
+// configured by the flags and config file.
+type targetSources struct {
+	static      []combiner.Target
+	discoverers []discoverer
+	// groups are served separately from the other targets.
+	groups []groupConfig
+	// scales and aggregations are applied to the targets that aren't in a
+	// group.
+	scales       []combiner.Scale
+	aggregations []combiner.Aggregation
+}
+
+// discoveryManager keeps the combiner's targets up to date with the static
+// targets and the latest targets found by each discoverer.
+type discoveryManager struct {
+	combiner *combiner.Combiner
+
+	mu          sync.Mutex
+	static      []combiner.Target
+	discoverers []discoverer
+	// discovered holds the latest targets from each discoverer.
+	discovered [][]combiner.Target
+	// generation is incremented when the discoverers are replaced, so updates
+	// from stopped discoverers are ignored.
+	generation int
+	cancel     context.CancelFunc
+}
+
+// newDiscoveryManager creates a manager that updates the targets of c.
+func newDiscoveryManager(c *combiner.Combiner) *discoveryManager {
+	return &discoveryManager{combiner: c}
+}
+
+// apply replaces the static targets and discoverers. The new discoverers run
+// until ctx is cancelled or apply is called again. Discoverers that are
+// unchanged keep their previous targets until they next update, so reloading
+// the configuration doesn't briefly remove discovered targets.
+func (m *discoveryManager) apply(ctx context.Context, sources targetSources) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	discovered := make([][]combiner.Target, len(sources.discoverers))
+	for i, d := range sources.discoverers {
+		for j, old := range m.discoverers {
+			if reflect.DeepEqual(d, old) {
+				discovered[i] = m.discovered[j]
+				break
+			}
+		}
+	}
+	if err := m.combiner.SetTargets(combineTargets(sources.static, discovered)); err != nil {
+		return err
+	}
+
+	if m.cancel != nil {
+		m.cancel()
+	}
+	m.static = sources.static
+	m.discoverers = sources.discoverers
+	m.discovered = discovered
+	m.generation++
+
+	ctx, m.cancel = context.WithCancel(ctx)
+	for i, d := range sources.discoverers {
+		generation := m.generation
+		go d.run(ctx, func(targets []combiner.Target) {
+			m.update(generation, i, targets)
+		})
+	}
+	return nil
+}
+
+// update records the targets found by a discoverer and updates the
+// combiner if they have changed.
+func (m *discoveryManager) update(generation, index int, targets []combiner.Target) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Targets that aren't allowed are dropped rather than rejecting the update
+	targets = slices.DeleteFunc(slices.Clone(targets), func(t combiner.Target) bool {
+		if err := m.combiner.CheckURL(t.URL); err != nil {
+			slog.Warn("Ignoring discovered target", "target", combiner.RedactURL(t.URL), "err", err)
+			return true
+		}
+		return false
+	})
+	if generation != m.generation || reflect.DeepEqual(targets, m.discovered[index]) {
+		return
+	}
+	discovered := slices.Clone(m.discovered)
+	discovered[index] = targets
+	if err := m.combiner.SetTargets(combineTargets(m.static, discovered)); err != nil {
+		slog.Error("Failed to update discovered targets", "err", err)
+		return
+	}
+	m.discovered = discovered
+	slog.Info("Discovered targets changed", "targets", len(targets))
+}
+
+var (
+	// errTargetExists is returned when adding a target whose URL is already
+	// being fetched.
+	errTargetExists = errors.New("a target with this URL already exists")
+	// errTargetNotFound is returned when removing a URL that isn't a static
+	// target.
+	errTargetNotFound = errors.New("no static target with this URL")
+)
+
+// addTarget adds a static target until the next time apply is called.
+func (m *discoveryManager) addTarget(t combiner.Target) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if slices.ContainsFunc(combineTargets(m.static, m.discovered), func(existing combiner.Target) bool { return existing.URL == t.URL }) {
+		return errTargetExists
+	}
+	static := append(slices.Clone(m.static), t)
+	if err := m.combiner.SetTargets(combineTargets(static, m.discovered)); err != nil {
+		return err
+	}
+	m.static = static
+	return nil
+}
+
+// removeTarget removes the static target with url until the next time apply
+// is called. Discovered targets can't be removed.
+func (m *discoveryManager) removeTarget(url string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	static := slices.DeleteFunc(slices.Clone(m.static), func(t combiner.Target) bool { return t.URL == url })
+	if len(static) == len(m.static) {
+		return errTargetNotFound
+	}
+	if err := m.combiner.SetTargets(combineTargets(static, m.discovered)); err != nil {
+		return err
+	}
+	m.static = static
+	return nil
+}
+
+// combineTargets returns the static targets followed by the targets of each
+// discoverer in order.
+func combineTargets(static []combiner.Target, discovered [][]combiner.Target) []combiner.Target {
+	return slices.Concat(append([][]combiner.Target{static}, discovered...)...)
+}
+
+// poll calls discover immediately and then every interval until ctx is
+// cancelled, passing the targets to update. If discover fails the error is
+// logged and the previous targets are kept.
+func poll(ctx context.Context, interval time.Duration, discover func(context.Context) ([]combiner.Target, error), update func([]combiner.Target)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		targets, err := discover(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Warn("Target discovery failed, keeping the previous targets", "err", err)
+		} else {
+			update(targets)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
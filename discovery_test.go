@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/manics/prometheus-metrics-combiner/combiner"
+)
+
+// fakeDiscoverer passes on the targets sent to its channel.
+type fakeDiscoverer struct {
+	updates chan []combiner.Target
+}
+
+// run implements discoverer.
+func (d *fakeDiscoverer) run(ctx context.Context, update func([]combiner.Target)) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case targets := <-d.updates:
+			update(targets)
+		}
+	}
+}
+
+// targetURLs returns the URLs of the combiner's current targets.
+func targetURLs(c *combiner.Combiner) []string {
+	var urls []string
+	for _, t := range c.Targets() {
+		urls = append(urls, t.URL)
+	}
+	return urls
+}
+
+// waitForTargets waits for the combiner's targets to have the expected URLs.
+func waitForTargets(t *testing.T, c *combiner.Combiner, expected []string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !reflect.DeepEqual(targetURLs(c), expected) {
+		if time.Now().After(deadline) {
+			t.Fatalf("got targets %v, want %v", targetURLs(c), expected)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestDiscoveryManager tests combining static and discovered targets.
+func TestDiscoveryManager(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	agg, err := combiner.New(nil, combiner.Options{})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	m := newDiscoveryManager(agg)
+
+	d1 := &fakeDiscoverer{updates: make(chan []combiner.Target)}
+	d2 := &fakeDiscoverer{updates: make(chan []combiner.Target)}
+	if err := m.apply(ctx, targetSources{static: staticTargets([]string{"http://a"}), discoverers: []discoverer{d1, d2}}); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	waitForTargets(t, agg, []string{"http://a"})
+
+	d2.updates <- staticTargets([]string{"http://d2"})
+	d1.updates <- staticTargets([]string{"http://d1"})
+	waitForTargets(t, agg, []string{"http://a", "http://d1", "http://d2"})
+
+	// Unchanged discoverers keep their targets when the static targets change
+	if err := m.apply(ctx, targetSources{static: staticTargets([]string{"http://b"}), discoverers: []discoverer{d1, d2}}); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	if urls := targetURLs(agg); !reflect.DeepEqual(urls, []string{"http://b", "http://d1", "http://d2"}) {
+		t.Errorf("discovered targets were not kept, got %v", urls)
+	}
+
+	// Removed discoverers are stopped and their targets removed, even if
+	// the remaining ones move
+	d3 := &fakeDiscoverer{updates: make(chan []combiner.Target)}
+	if err := m.apply(ctx, targetSources{static: staticTargets([]string{"http://b"}), discoverers: []discoverer{d2, d3}}); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	if urls := targetURLs(agg); !reflect.DeepEqual(urls, []string{"http://b", "http://d2"}) {
+		t.Errorf("expected only the targets of the remaining discoverer to be kept, got %v", urls)
+	}
+	d3.updates <- staticTargets([]string{"http://d3"})
+	waitForTargets(t, agg, []string{"http://b", "http://d2", "http://d3"})
+
+	invalid := targetSources{static: []combiner.Target{{URL: "http://c", TLSConfig: combiner.TLSConfig{CAFile: "/nonexistent/ca.pem"}}}}
+	if err := m.apply(ctx, invalid); err == nil {
+		t.Error("expected an error for an invalid target")
+	}
+	d3.updates <- staticTargets([]string{"http://d3-new"})
+	waitForTargets(t, agg, []string{"http://b", "http://d2", "http://d3-new"})
+}
+
+// TestDiscoveryManagerURLPolicy tests discovered targets that aren't allowed
+// are dropped without rejecting the others.
+func TestDiscoveryManagerURLPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	agg, err := combiner.New(nil, combiner.Options{URLPolicy: combiner.URLPolicy{DenyCIDRs: []string{"169.254.0.0/16"}}})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	m := newDiscoveryManager(agg)
+
+	d := &fakeDiscoverer{updates: make(chan []combiner.Target)}
+	if err := m.apply(ctx, targetSources{static: staticTargets([]string{"http://a"}), discoverers: []discoverer{d}}); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	d.updates <- staticTargets([]string{"http://169.254.169.254/", "http://d1"})
+	waitForTargets(t, agg, []string{"http://a", "http://d1"})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/manics/prometheus-metrics-combiner/combiner"
+)
+
+// dnsSDConfig discovers targets from DNS SRV records, fetching every host and
+// port they return.
+type dnsSDConfig struct {
+	// Names are the SRV records to resolve, such as _metrics._tcp.exporters.internal.
+	Names []string `yaml:"names"`
+	// RefreshInterval is how often the records are resolved again.
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	// Scheme and MetricsPath are used to build the URL of each host and port.
+	Scheme      string `yaml:"scheme"`
+	MetricsPath string `yaml:"metrics_path"`
+	// Target holds the settings applied to every discovered target, its URL
+	// must not be set.
+	Target combiner.Target `yaml:",inline"`
+}
+
+// validate checks the DNS discovery configuration is consistent.
+func (c dnsSDConfig) validate() error {
+	if len(c.Names) == 0 {
+		return fmt.Errorf("at least one name is required")
+	}
+	if c.RefreshInterval < 0 {
+		return fmt.Errorf("refresh_interval must not be negative")
+	}
+	return validateDiscoveryTarget(c.Scheme, c.MetricsPath, c.Target)
+}
+
+// validateDiscoveryTarget checks the settings used to build discovered targets.
+func validateDiscoveryTarget(scheme, metricsPath string, t combiner.Target) error {
+	switch scheme {
+	case "", "http", "https":
+	default:
+		return fmt.Errorf("invalid scheme %q, must be http or https", scheme)
+	}
+	if metricsPath != "" && !strings.HasPrefix(metricsPath, "/") {
+		return fmt.Errorf("metrics_path must start with /")
+	}
+	if t.URL != "" {
+		return fmt.Errorf("url can't be set for discovered targets")
+	}
+	if t.HostsFile != "" {
+		return fmt.Errorf("hosts_file can't be set for discovered targets")
+	}
+	return t.Validate()
+}
+
+// discoveredTarget returns a copy of template fetching the given host and
+// port with scheme and path, which default to http and /metrics.
+func discoveredTarget(template combiner.Target, scheme, host string, port uint16, path string) combiner.Target {
+	if scheme == "" {
+		scheme = "http"
+	}
+	if path == "" {
+		path = "/metrics"
+	}
+	u := url.URL{Scheme: scheme, Host: net.JoinHostPort(host, strconv.Itoa(int(port))), Path: path}
+	template.URL = u.String()
+	return template
+}
+
+// srvResolver looks up SRV records, it is implemented by net.Resolver.
+type srvResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// dnsDiscoverer periodically resolves SRV records into targets.
+type dnsDiscoverer struct {
+	cfg dnsSDConfig
+	// template is cfg.Target with the global defaults applied.
+	template combiner.Target
+	resolver srvResolver
+}
+
+// newDNSDiscoverer creates a discoverer for a DNS discovery configuration.
+func newDNSDiscoverer(cfg dnsSDConfig, defaults combiner.Target) *dnsDiscoverer {
+	return &dnsDiscoverer{cfg: cfg, template: cfg.Target.WithDefaults(defaults), resolver: net.DefaultResolver}
+}
+
+// discover resolves all the names, returning a target for each distinct host
+// and port sorted by URL. It fails if any name can't be resolved, so a
+// transient DNS failure doesn't remove targets.
+func (d *dnsDiscoverer) discover(ctx context.Context) ([]combiner.Target, error) {
+	var targets []combiner.Target
+	for _, name := range d.cfg.Names {
+		_, records, err := d.resolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve SRV record %s: %w", name, err)
+		}
+		for _, srv := range records {
+			host := strings.TrimSuffix(srv.Target, ".")
+			targets = append(targets, discoveredTarget(d.template, d.cfg.Scheme, host, srv.Port, d.cfg.MetricsPath))
+		}
+	}
+
+	slices.SortFunc(targets, func(a, b combiner.Target) int { return strings.Compare(a.URL, b.URL) })
+	return slices.CompactFunc(targets, func(a, b combiner.Target) bool { return a.URL == b.URL }), nil
+}
+
+// run implements discoverer.
+func (d *dnsDiscoverer) run(ctx context.Context, update func([]combiner.Target)) {
+	interval := d.cfg.RefreshInterval
+	if interval == 0 {
+		interval = defaultRefreshInterval
+	}
+	poll(ctx, interval, d.discover, update)
+}
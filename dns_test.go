@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/manics/prometheus-metrics-combiner/combiner"
+)
+
+// fakeSRVResolver returns fixed SRV records for each name.
+type fakeSRVResolver map[string][]*net.SRV
+
+// LookupSRV implements srvResolver.
+func (r fakeSRVResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	records, ok := r[name]
+	if !ok {
+		return "", nil, errors.New("no such host")
+	}
+	return name, records, nil
+}
+
+// TestDNSDiscoverer tests building targets from SRV records.
+func TestDNSDiscoverer(t *testing.T) {
+	resolver := fakeSRVResolver{
+		"_metrics._tcp.a": {{Target: "host2.example.", Port: 9100}, {Target: "host1.example.", Port: 9100}},
+		"_metrics._tcp.b": {{Target: "host1.example.", Port: 9100}, {Target: "host3.example.", Port: 8080}},
+	}
+
+	testCases := []struct {
+		name          string
+		cfg           dnsSDConfig
+		expected      []string
+		expectedError bool
+	}{
+		{
+			name:     "Defaults",
+			cfg:      dnsSDConfig{Names: []string{"_metrics._tcp.a"}},
+			expected: []string{"http://host1.example:9100/metrics", "http://host2.example:9100/metrics"},
+		},
+		{
+			name:     "Scheme and path",
+			cfg:      dnsSDConfig{Names: []string{"_metrics._tcp.a"}, Scheme: "https", MetricsPath: "/m"},
+			expected: []string{"https://host1.example:9100/m", "https://host2.example:9100/m"},
+		},
+		{
+			name:     "Duplicates across names",
+			cfg:      dnsSDConfig{Names: []string{"_metrics._tcp.a", "_metrics._tcp.b"}},
+			expected: []string{"http://host1.example:9100/metrics", "http://host2.example:9100/metrics", "http://host3.example:8080/metrics"},
+		},
+		{
+			name:          "Unresolvable name",
+			cfg:           dnsSDConfig{Names: []string{"_metrics._tcp.a", "_metrics._tcp.missing"}},
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newDNSDiscoverer(tc.cfg, combiner.Target{LabelConflict: combiner.LabelConflictKeep})
+			d.resolver = resolver
+
+			targets, err := d.discover(context.Background())
+			if tc.expectedError {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("discover failed: %v", err)
+			}
+
+			var urls []string
+			for _, target := range targets {
+				urls = append(urls, target.URL)
+				if target.LabelConflict != combiner.LabelConflictKeep {
+					t.Errorf("defaults were not applied to %s", target.URL)
+				}
+			}
+			if !reflect.DeepEqual(urls, tc.expected) {
+				t.Errorf("got %v, want %v", urls, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/manics/prometheus-metrics-combiner/combiner"
+)
+
+// maxExpandedURLs limits how many URLs a single template can expand to, to
+// catch mistakes such as {1..1000000}.
+const maxExpandedURLs = 10000
+
+// expandTargets replaces each target whose URL is a template with a copy for
+// every URL it expands to. Templates can contain:
+//   - {N..M}, the integers from N to M, zero padded to the width of N if it
+//     starts with 0, such as {01..20}
+//   - {a,b,c}, each of the comma separated values
+//   - {host}, each line of the target's hosts_file
+//
+// A template with several of these expands to every combination.
+func expandTargets(targets []combiner.Target) ([]combiner.Target, error) {
+	var expanded []combiner.Target
+	for _, t := range targets {
+		var hosts []string
+		if t.HostsFile != "" {
+			if !strings.Contains(t.URL, "{host}") {
+				return nil, fmt.Errorf("target %s has a hosts_file but its url doesn't contain {host}", combiner.RedactURL(t.URL))
+			}
+			var err error
+			if hosts, err = readHostsFile(t.HostsFile); err != nil {
+				return nil, err
+			}
+		}
+		urls, err := expandURL(t.URL, hosts)
+		if err != nil {
+			return nil, fmt.Errorf("invalid url template %s: %w", combiner.RedactURL(t.URL), err)
+		}
+		t.HostsFile = ""
+		for _, u := range urls {
+			t.URL = u
+			expanded = append(expanded, t)
+		}
+	}
+	return expanded, nil
+}
+
+// expandURL expands the braces in pattern. hosts is nil if there is no hosts
+// file, in which case {host} is an error.
+func expandURL(pattern string, hosts []string) ([]string, error) {
+	start := strings.IndexByte(pattern, '{')
+	if start < 0 {
+		return []string{pattern}, nil
+	}
+	end := strings.IndexByte(pattern[start:], '}')
+	if end < 0 {
+		return nil, fmt.Errorf("unclosed {")
+	}
+	end += start
+
+	alternatives, err := braceAlternatives(pattern[start+1:end], hosts)
+	if err != nil {
+		return nil, err
+	}
+	rest, err := expandURL(pattern[end+1:], hosts)
+	if err != nil {
+		return nil, err
+	}
+	if len(alternatives)*len(rest) > maxExpandedURLs {
+		return nil, fmt.Errorf("expands to more than %d urls", maxExpandedURLs)
+	}
+
+	urls := make([]string, 0, len(alternatives)*len(rest))
+	for _, a := range alternatives {
+		for _, r := range rest {
+			urls = append(urls, pattern[:start]+a+r)
+		}
+	}
+	return urls, nil
+}
+
+// braceAlternatives returns the values of a single brace expression, without
+// the braces.
+func braceAlternatives(expr string, hosts []string) ([]string, error) {
+	if expr == "host" {
+		if hosts == nil {
+			return nil, fmt.Errorf("{host} requires a hosts_file")
+		}
+		return hosts, nil
+	}
+
+	if from, to, ok := strings.Cut(expr, ".."); ok {
+		lo, err1 := strconv.Atoi(from)
+		hi, err2 := strconv.Atoi(to)
+		if err1 != nil || err2 != nil || lo < 0 || lo > hi {
+			return nil, fmt.Errorf("invalid range {%s}", expr)
+		}
+		if hi-lo >= maxExpandedURLs {
+			return nil, fmt.Errorf("expands to more than %d urls", maxExpandedURLs)
+		}
+		width := 0
+		if len(from) > 1 && strings.HasPrefix(from, "0") {
+			width = len(from)
+		}
+		values := make([]string, 0, hi-lo+1)
+		for i := lo; i <= hi; i++ {
+			values = append(values, fmt.Sprintf("%0*d", width, i))
+		}
+		return values, nil
+	}
+
+	if strings.Contains(expr, ",") {
+		return strings.Split(expr, ","), nil
+	}
+	return nil, fmt.Errorf("invalid template {%s}, must be a range such as {1..10}, a list such as {a,b} or {host}", expr)
+}
+
+// readHostsFile reads a list of hosts, one per line. Blank lines and lines
+// starting with # are ignored.
+func readHostsFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hosts file: %w", err)
+	}
+	defer f.Close()
+
+	hosts := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hosts = append(hosts, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read hosts file %s: %w", path, err)
+	}
+	return hosts, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/manics/prometheus-metrics-combiner/combiner"
+)
+
+// TestExpandURL tests expanding URL templates.
+func TestExpandURL(t *testing.T) {
+	testCases := []struct {
+		name          string
+		pattern       string
+		hosts         []string
+		expected      []string
+		expectedError bool
+	}{
+		{
+			name:     "No template",
+			pattern:  "http://localhost:9100/metrics",
+			expected: []string{"http://localhost:9100/metrics"},
+		},
+		{
+			name:     "Range",
+			pattern:  "http://node-{1..3}:9100/metrics",
+			expected: []string{"http://node-1:9100/metrics", "http://node-2:9100/metrics", "http://node-3:9100/metrics"},
+		},
+		{
+			name:     "Zero padded range",
+			pattern:  "http://node-{08..10}:9100/metrics",
+			expected: []string{"http://node-08:9100/metrics", "http://node-09:9100/metrics", "http://node-10:9100/metrics"},
+		},
+		{
+			name:     "List and range",
+			pattern:  "http://{web,db}-{1..2}:9100/metrics",
+			expected: []string{"http://web-1:9100/metrics", "http://web-2:9100/metrics", "http://db-1:9100/metrics", "http://db-2:9100/metrics"},
+		},
+		{
+			name:     "Hosts",
+			pattern:  "https://{host}:9100/metrics",
+			hosts:    []string{"a.example", "b.example"},
+			expected: []string{"https://a.example:9100/metrics", "https://b.example:9100/metrics"},
+		},
+		{
+			name:          "Host without hosts file",
+			pattern:       "https://{host}:9100/metrics",
+			expectedError: true,
+		},
+		{
+			name:          "Reversed range",
+			pattern:       "http://node-{3..1}:9100/metrics",
+			expectedError: true,
+		},
+		{
+			name:          "Too many URLs",
+			pattern:       "http://node-{1..1000}-{1..1000}:9100/metrics",
+			expectedError: true,
+		},
+		{
+			name:          "Unclosed brace",
+			pattern:       "http://node-{1..3:9100/metrics",
+			expectedError: true,
+		},
+		{
+			name:          "Unknown template",
+			pattern:       "http://{node}:9100/metrics",
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			urls, err := expandURL(tc.pattern, tc.hosts)
+			if tc.expectedError {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", urls)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expandURL failed: %v", err)
+			}
+			if !reflect.DeepEqual(urls, tc.expected) {
+				t.Errorf("got %v, want %v", urls, tc.expected)
+			}
+		})
+	}
+}
+
+// TestExpandTargets tests that expanded targets keep their settings.
+func TestExpandTargets(t *testing.T) {
+	hostsFile := writeFile(t, "hosts.txt", "# web servers\nweb1\n\n web2 \n")
+	targets, err := expandTargets([]combiner.Target{
+		{URL: "http://{host}:9100/metrics", HostsFile: hostsFile, Labels: map[string]string{"role": "web"}},
+		{URL: "http://db:9100/metrics"},
+	})
+	if err != nil {
+		t.Fatalf("expandTargets failed: %v", err)
+	}
+
+	expected := []combiner.Target{
+		{URL: "http://web1:9100/metrics", Labels: map[string]string{"role": "web"}},
+		{URL: "http://web2:9100/metrics", Labels: map[string]string{"role": "web"}},
+		{URL: "http://db:9100/metrics"},
+	}
+	if !reflect.DeepEqual(targets, expected) {
+		t.Errorf("got %+v, want %+v", targets, expected)
+	}
+
+	if _, err := expandTargets([]combiner.Target{{URL: "http://db:9100/metrics", HostsFile: hostsFile}}); err == nil {
+		t.Error("expected an error for a hosts_file without {host}")
+	}
+}
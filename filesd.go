@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/manics/prometheus-metrics-combiner/combiner"
+	"github.com/prometheus/common/model"
+	"go.yaml.in/yaml/v3"
+)
+
+// defaultFileRefreshInterval is how often target files are re-read in case a
+// change was missed by the file watcher.
+const defaultFileRefreshInterval = 5 * time.Minute
+
+// targetGroup is a group of targets sharing labels, in the format used by
+// Prometheus file and HTTP service discovery.
+type targetGroup struct {
+	// Targets are host:port addresses.
+	Targets []string          `yaml:"targets" json:"targets"`
+	Labels  map[string]string `yaml:"labels" json:"labels"`
+}
+
+// groupTargets returns a copy of template for each address in groups, using
+// scheme and path to build the URL, sorted by URL. The labels of each group
+// are added to the template's labels, apart from labels starting with __
+// which Prometheus uses for metadata.
+func groupTargets(template combiner.Target, scheme, path string, groups []targetGroup) ([]combiner.Target, error) {
+	var targets []combiner.Target
+	for _, g := range groups {
+		labels := maps.Clone(template.Labels)
+		for name, value := range g.Labels {
+			if strings.HasPrefix(name, model.ReservedLabelPrefix) {
+				continue
+			}
+			if !model.UTF8Validation.IsValidLabelName(name) {
+				return nil, fmt.Errorf("invalid label name %q", name)
+			}
+			if labels == nil {
+				labels = make(map[string]string)
+			}
+			labels[name] = value
+		}
+
+		for _, address := range g.Targets {
+			host, port, err := splitTargetAddress(address, scheme)
+			if err != nil {
+				return nil, err
+			}
+			t := discoveredTarget(template, scheme, host, port, path)
+			t.Labels = labels
+			targets = append(targets, t)
+		}
+	}
+
+	slices.SortFunc(targets, func(a, b combiner.Target) int { return strings.Compare(a.URL, b.URL) })
+	return slices.CompactFunc(targets, func(a, b combiner.Target) bool { return a.URL == b.URL }), nil
+}
+
+// splitTargetAddress splits a host:port address. If the port is missing the
+// default port for scheme is used.
+func splitTargetAddress(address, scheme string) (string, uint16, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		var addrErr *net.AddrError
+		if !errors.As(err, &addrErr) || addrErr.Err != "missing port in address" {
+			return "", 0, fmt.Errorf("invalid target address %q: %w", address, err)
+		}
+		if scheme == "https" {
+			return address, 443, nil
+		}
+		return address, 80, nil
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || host == "" {
+		return "", 0, fmt.Errorf("invalid target address %q", address)
+	}
+	return host, uint16(port), nil
+}
+
+// fileSDConfig discovers targets from files in the Prometheus file_sd format,
+// which are watched for changes.
+type fileSDConfig struct {
+	// Files are paths or glob patterns of JSON or YAML files.
+	Files []string `yaml:"files"`
+	// RefreshInterval is how often the files are re-read even if no change is
+	// seen.
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	// Scheme and MetricsPath are used to build the URL of each target.
+	Scheme      string `yaml:"scheme"`
+	MetricsPath string `yaml:"metrics_path"`
+	// Target holds the settings applied to every discovered target, its URL
+	// must not be set.
+	Target combiner.Target `yaml:",inline"`
+}
+
+// validate checks the file discovery configuration is consistent.
+func (c fileSDConfig) validate() error {
+	if len(c.Files) == 0 {
+		return fmt.Errorf("at least one file is required")
+	}
+	for _, pattern := range c.Files {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid file pattern %q: %w", pattern, err)
+		}
+		switch filepath.Ext(pattern) {
+		case ".json", ".yml", ".yaml":
+		default:
+			return fmt.Errorf("file %q must end in .json, .yml or .yaml", pattern)
+		}
+	}
+	if c.RefreshInterval < 0 {
+		return fmt.Errorf("refresh_interval must not be negative")
+	}
+	return validateDiscoveryTarget(c.Scheme, c.MetricsPath, c.Target)
+}
+
+// fileDiscoverer reads targets from files, re-reading them when they change.
+type fileDiscoverer struct {
+	cfg fileSDConfig
+	// template is cfg.Target with the global defaults applied.
+	template combiner.Target
+}
+
+// newFileDiscoverer creates a discoverer for a file discovery configuration.
+func newFileDiscoverer(cfg fileSDConfig, defaults combiner.Target) *fileDiscoverer {
+	return &fileDiscoverer{cfg: cfg, template: cfg.Target.WithDefaults(defaults)}
+}
+
+// discover reads all the files matching the patterns. It fails if any file
+// can't be read or parsed, for example while it is being written, so the
+// previous targets are kept until the next change.
+func (d *fileDiscoverer) discover() ([]combiner.Target, error) {
+	var groups []targetGroup
+	for _, pattern := range d.cfg.Files {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			g, err := readTargetGroups(path)
+			if err != nil {
+				return nil, err
+			}
+			groups = append(groups, g...)
+		}
+	}
+	return groupTargets(d.template, d.cfg.Scheme, d.cfg.MetricsPath, groups)
+}
+
+// readTargetGroups reads a file of target groups. JSON is parsed as YAML,
+// since it is a subset.
+func readTargetGroups(path string) ([]targetGroup, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read target file: %w", err)
+	}
+	var groups []targetGroup
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&groups); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse target file %s: %w", path, err)
+	}
+	return groups, nil
+}
+
+// run implements discoverer. The directories containing the files are
+// watched, since files are often replaced by renaming which a watch on the
+// file itself would miss.
+func (d *fileDiscoverer) run(ctx context.Context, update func([]combiner.Target)) {
+	interval := d.cfg.RefreshInterval
+	if interval == 0 {
+		interval = defaultFileRefreshInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Without a watcher the nil channels block, so the files are only re-read
+	// every interval.
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Warn("Failed to watch target files, re-reading them periodically", "err", err)
+	} else {
+		defer watcher.Close()
+		events, errs = watcher.Events, watcher.Errors
+		for _, dir := range d.dirs() {
+			if err := watcher.Add(dir); err != nil {
+				slog.Warn("Failed to watch target file directory", "dir", dir, "err", err)
+			}
+		}
+	}
+
+	for {
+		targets, err := d.discover()
+		if err != nil {
+			slog.Warn("Target discovery failed, keeping the previous targets", "err", err)
+		} else {
+			update(targets)
+		}
+
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				break wait
+			case <-events:
+				break wait
+			case err := <-errs:
+				slog.Warn("Error watching target files", "err", err)
+			}
+		}
+	}
+}
+
+// dirs returns the distinct directories containing the file patterns.
+func (d *fileDiscoverer) dirs() []string {
+	var dirs []string
+	for _, pattern := range d.cfg.Files {
+		dirs = append(dirs, filepath.Dir(pattern))
+	}
+	slices.Sort(dirs)
+	return slices.Compact(dirs)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/manics/prometheus-metrics-combiner/combiner"
+)
+
+// TestGroupTargets tests building targets from Prometheus target groups.
+func TestGroupTargets(t *testing.T) {
+	testCases := []struct {
+		name          string
+		template      combiner.Target
+		scheme        string
+		groups        []targetGroup
+		expected      []combiner.Target
+		expectedError bool
+	}{
+		{
+			name: "Group labels",
+			template: combiner.Target{
+				Labels: map[string]string{"source": "file", "env": "dev"},
+			},
+			groups: []targetGroup{
+				{Targets: []string{"host2:9100", "host1:9100"}, Labels: map[string]string{"env": "prod", "__meta_x": "y"}},
+				{Targets: []string{"host3:8080"}},
+			},
+			expected: []combiner.Target{
+				{URL: "http://host1:9100/metrics", Labels: map[string]string{"source": "file", "env": "prod"}},
+				{URL: "http://host2:9100/metrics", Labels: map[string]string{"source": "file", "env": "prod"}},
+				{URL: "http://host3:8080/metrics", Labels: map[string]string{"source": "file", "env": "dev"}},
+			},
+		},
+		{
+			name:   "Default port",
+			scheme: "https",
+			groups: []targetGroup{{Targets: []string{"host1", "[::1]:9100"}}},
+			expected: []combiner.Target{
+				{URL: "https://[::1]:9100/metrics"},
+				{URL: "https://host1:443/metrics"},
+			},
+		},
+		{
+			name:          "Invalid port",
+			groups:        []targetGroup{{Targets: []string{"host1:http"}}},
+			expectedError: true,
+		},
+		{
+			name:     "UTF-8 label",
+			groups:   []targetGroup{{Targets: []string{"host1:80"}, Labels: map[string]string{"http.route": "/"}}},
+			expected: []combiner.Target{{URL: "http://host1:80/metrics", Labels: map[string]string{"http.route": "/"}}},
+		},
+		{
+			name:          "Invalid label",
+			groups:        []targetGroup{{Targets: []string{"host1:80"}, Labels: map[string]string{"\xff": "c"}}},
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			targets, err := groupTargets(tc.template, tc.scheme, "", tc.groups)
+			if tc.expectedError {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("groupTargets failed: %v", err)
+			}
+			if !reflect.DeepEqual(targets, tc.expected) {
+				t.Errorf("got %+v, want %+v", targets, tc.expected)
+			}
+		})
+	}
+}
+
+// TestFileDiscoverer tests that changes to target files are picked up.
+func TestFileDiscoverer(t *testing.T) {
+	dir := t.TempDir()
+	writeTargets := func(name, content string) {
+		// Replace the file by renaming, as config management tools do
+		tmp := filepath.Join(dir, "tmp")
+		if err := os.WriteFile(tmp, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTargets("a.json", `[{"targets": ["host1:9100"], "labels": {"job": "a"}}]`)
+	writeTargets("b.yml", "- targets: [host2:9100]\n")
+
+	d := newFileDiscoverer(fileSDConfig{
+		Files:           []string{filepath.Join(dir, "*.json"), filepath.Join(dir, "*.yml")},
+		RefreshInterval: time.Hour,
+	}, combiner.Target{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan []string, 10)
+	go d.run(ctx, func(targets []combiner.Target) {
+		var urls []string
+		for _, target := range targets {
+			urls = append(urls, target.URL)
+		}
+		updates <- urls
+	})
+
+	waitFor := func(expected []string) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case urls := <-updates:
+				if reflect.DeepEqual(urls, expected) {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("timed out waiting for targets %v", expected)
+			}
+		}
+	}
+
+	waitFor([]string{"http://host1:9100/metrics", "http://host2:9100/metrics"})
+	writeTargets("a.json", `[{"targets": ["host1:9100", "host3:9100"]}]`)
+	waitFor([]string{"http://host1:9100/metrics", "http://host2:9100/metrics", "http://host3:9100/metrics"})
+	if err := os.Remove(filepath.Join(dir, "b.yml")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor([]string{"http://host1:9100/metrics", "http://host3:9100/metrics"})
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/manics/prometheus-metrics-combiner/combiner"
+)
+
+// validGroupName matches the names of groups, which are used in URL paths.
+var validGroupName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// groupConfig is a named set of targets that are combined separately from the
+// other targets and served on their own path.
+type groupConfig struct {
+	Name    string            `yaml:"name"`
+	Targets []combiner.Target `yaml:"targets"`
+	// Labels are added to every target in the group, labels set on a target
+	// take precedence.
+	Labels map[string]string `yaml:"labels"`
+	// OAuth2 authenticates every target in the group that doesn't set its
+	// own credentials.
+	OAuth2 *combiner.OAuth2 `yaml:"oauth2"`
+	// Filters are applied to the group instead of the filter flags.
+	Filters combiner.Filter `yaml:",inline"`
+	// Scales convert the values of the group's metrics.
+	Scales []combiner.Scale `yaml:"scales"`
+	// Aggregations combine metrics across the group's targets.
+	Aggregations []combiner.Aggregation `yaml:"aggregations"`
+	// StalenessPolicy and ServeStaleMaxAge replace the -staleness-policy and
+	// -serve-stale-max-age flags for the group if set.
+	StalenessPolicy  string        `yaml:"staleness_policy"`
+	ServeStaleMaxAge time.Duration `yaml:"serve_stale_max_age"`
+}
+
+// validate checks the group configuration is consistent.
+func (c groupConfig) validate() error {
+	if !validGroupName.MatchString(c.Name) {
+		return fmt.Errorf("invalid group name %q, must only contain letters, digits, _ and -", c.Name)
+	}
+	if len(c.Targets) == 0 {
+		return fmt.Errorf("group %s has no targets", c.Name)
+	}
+	for i, t := range c.Targets {
+		if t.URL == "" {
+			return fmt.Errorf("target %d in group %s has no url", i, c.Name)
+		}
+		if err := t.Validate(); err != nil {
+			return fmt.Errorf("target %s in group %s: %w", combiner.RedactURL(t.URL), c.Name, err)
+		}
+	}
+	if c.OAuth2 != nil {
+		if err := c.OAuth2.Validate(); err != nil {
+			return fmt.Errorf("group %s: %w", c.Name, err)
+		}
+	}
+	if err := c.Filters.Validate(); err != nil {
+		return fmt.Errorf("group %s: %w", c.Name, err)
+	}
+	for _, s := range c.Scales {
+		if err := s.Validate(); err != nil {
+			return fmt.Errorf("group %s: %w", c.Name, err)
+		}
+	}
+	for _, a := range c.Aggregations {
+		if err := a.Validate(); err != nil {
+			return fmt.Errorf("group %s: %w", c.Name, err)
+		}
+	}
+	if c.StalenessPolicy != "" && !slices.Contains(combiner.StalenessPolicies, c.StalenessPolicy) {
+		return fmt.Errorf("group %s: invalid staleness policy %q, must be one of %s", c.Name, c.StalenessPolicy, strings.Join(combiner.StalenessPolicies, ", "))
+	}
+	if c.ServeStaleMaxAge < 0 {
+		return fmt.Errorf("group %s: serve_stale_max_age must not be negative", c.Name)
+	}
+	return nil
+}
+
+// withDefaults returns a copy of the group where the group labels, OAuth2
+// settings and the global defaults have been applied to each target.
+func (c groupConfig) withDefaults(defaults combiner.Target) groupConfig {
+	targets := make([]combiner.Target, len(c.Targets))
+	for i, t := range c.Targets {
+		if len(c.Labels) > 0 {
+			labels := maps.Clone(c.Labels)
+			maps.Copy(labels, t.Labels)
+			t.Labels = labels
+		}
+		if c.OAuth2 != nil && !t.HasCredentials() {
+			t.OAuth2 = c.OAuth2
+		}
+		targets[i] = t.WithDefaults(defaults)
+	}
+	c.Targets = targets
+	return c
+}
+
+// metricsGroup is a group's combiner.
+type metricsGroup struct {
+	filters      combiner.Filter
+	scales       []combiner.Scale
+	aggregations []combiner.Aggregation
+	// stalenessPolicy and serveStaleMaxAge are the group's settings, empty
+	// if inherited.
+	stalenessPolicy  string
+	serveStaleMaxAge time.Duration
+	combiner         *combiner.Combiner
+	// cancel stops the background scrape of the group, if any.
+	cancel context.CancelFunc
+}
+
+// groupManager serves the combiner of each group by name.
+type groupManager struct {
+	// opts are the options for each group's combiner, apart from the filters,
+	// scales and aggregations. The staleness options are the defaults.
+	opts combiner.Options
+
+	mu     sync.RWMutex
+	groups map[string]*metricsGroup
+}
+
+// newGroupManager creates a manager whose groups are combined with opts.
+func newGroupManager(opts combiner.Options) *groupManager {
+	return &groupManager{opts: opts, groups: make(map[string]*metricsGroup)}
+}
+
+// apply replaces the groups. Groups whose filters, scales, aggregations and
+// staleness settings haven't changed keep their
+// combiner, and so their circuit breaker and cache state, and only have their
+// targets updated. In background mode each new group is scraped until ctx is
+// cancelled or it is removed.
+func (m *groupManager) apply(ctx context.Context, configs []groupConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Create the new combiners first, so an invalid group usually leaves the
+	// existing groups unchanged
+	groups := make(map[string]*metricsGroup, len(configs))
+	// closeNew closes the combiners created for groups, which aren't used if
+	// the groups can't be applied
+	closeNew := func() {
+		for name, g := range groups {
+			if g != m.groups[name] {
+				g.combiner.Close()
+			}
+		}
+	}
+	for _, c := range configs {
+		if old, ok := m.groups[c.Name]; ok && reflect.DeepEqual(old.filters, c.Filters) &&
+			reflect.DeepEqual(old.scales, c.Scales) && reflect.DeepEqual(old.aggregations, c.Aggregations) &&
+			old.stalenessPolicy == c.StalenessPolicy && old.serveStaleMaxAge == c.ServeStaleMaxAge {
+			groups[c.Name] = old
+			continue
+		}
+		opts := m.opts
+		opts.Filter = c.Filters
+		opts.Scales = c.Scales
+		opts.Aggregations = c.Aggregations
+		opts.StalenessPolicy = cmp.Or(c.StalenessPolicy, opts.StalenessPolicy)
+		opts.ServeStaleMaxAge = cmp.Or(c.ServeStaleMaxAge, opts.ServeStaleMaxAge)
+		comb, err := combiner.New(c.Targets, opts)
+		if err != nil {
+			closeNew()
+			return fmt.Errorf("group %s: %w", c.Name, err)
+		}
+		groups[c.Name] = &metricsGroup{
+			filters:          c.Filters,
+			scales:           c.Scales,
+			aggregations:     c.Aggregations,
+			stalenessPolicy:  c.StalenessPolicy,
+			serveStaleMaxAge: c.ServeStaleMaxAge,
+			combiner:         comb,
+		}
+	}
+	for _, c := range configs {
+		if g := groups[c.Name]; g == m.groups[c.Name] {
+			if err := g.combiner.SetTargets(c.Targets); err != nil {
+				closeNew()
+				return fmt.Errorf("group %s: %w", c.Name, err)
+			}
+		}
+	}
+
+	for name, g := range m.groups {
+		if groups[name] != g {
+			if g.cancel != nil {
+				g.cancel()
+			}
+			g.combiner.Close()
+		}
+	}
+	for _, g := range groups {
+		if g.cancel == nil && m.opts.ScrapeInterval > 0 {
+			var groupCtx context.Context
+			groupCtx, g.cancel = context.WithCancel(ctx)
+			go g.combiner.Run(groupCtx)
+		}
+	}
+	m.groups = groups
+	return nil
+}
+
+// close cancels the upstream fetches still running to refresh each group.
+func (m *groupManager) close() {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, g := range m.groups {
+		g.combiner.Close()
+	}
+}
+
+// targets returns the status of the targets of each group.
+func (m *groupManager) targets() map[string][]combiner.TargetStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	targets := make(map[string][]combiner.TargetStatus, len(m.groups))
+	for name, g := range m.groups {
+		targets[name] = g.combiner.Targets()
+	}
+	return targets
+}
+
+// ServeHTTP serves the combined metrics of the group named in the path, or
+// 404 if there is no such group.
+func (m *groupManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.RLock()
+	g, ok := m.groups[r.PathValue("group")]
+	m.mu.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	g.combiner.ServeHTTP(w, r)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/manics/prometheus-metrics-combiner/combiner"
+)
+
+// TestGroupManager tests serving each group's targets on its own path.
+func TestGroupManager(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "http_requests_total 1\ngo_goroutines 5\n")
+	}))
+	defer web.Close()
+	db := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "db_queries_total 2\n")
+	}))
+	defer db.Close()
+
+	m := newGroupManager(combiner.Options{})
+	configs := []groupConfig{
+		{
+			Name:    "web",
+			Targets: []combiner.Target{{URL: web.URL}},
+			Labels:  map[string]string{"team": "web"},
+			Filters: combiner.Filter{ExcludePrefixes: []string{"go_"}},
+		},
+		{Name: "db", Targets: []combiner.Target{{URL: db.URL}}},
+	}
+	for i := range configs {
+		configs[i] = configs[i].withDefaults(combiner.Target{})
+	}
+	if err := m.apply(context.Background(), configs); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics/{group}", m)
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr
+	}
+
+	testCases := []struct {
+		path           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			path:           "/metrics/web",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "# TYPE http_requests_total untyped\nhttp_requests_total{team=\"web\"} 1\n",
+		},
+		{
+			path:           "/metrics/db",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "# TYPE db_queries_total untyped\ndb_queries_total 2\n",
+		},
+		{
+			path:           "/metrics/missing",
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+	for _, tc := range testCases {
+		rr := get(tc.path)
+		if rr.Code != tc.expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", tc.path, tc.expectedStatus, rr.Code)
+		}
+		if tc.expectedBody != "" && rr.Body.String() != tc.expectedBody {
+			t.Errorf("%s: got %q, want %q", tc.path, rr.Body.String(), tc.expectedBody)
+		}
+	}
+
+	// Groups with unchanged filters keep their combiner, removed groups are
+	// no longer served
+	webCombiner := m.groups["web"].combiner
+	configs[0].Targets = append(configs[0].Targets, combiner.Target{URL: db.URL})
+	if err := m.apply(context.Background(), configs[:1]); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	if m.groups["web"].combiner != webCombiner {
+		t.Error("expected the web group to keep its combiner")
+	}
+	if n := len(webCombiner.Targets()); n != 2 {
+		t.Errorf("expected the web group to have 2 targets, got %d", n)
+	}
+	if rr := get("/metrics/db"); rr.Code != http.StatusNotFound {
+		t.Errorf("expected the removed group to return %d, got %d", http.StatusNotFound, rr.Code)
+	}
+
+	// Changing the staleness settings replaces the combiner
+	configs[0].StalenessPolicy = combiner.StalenessMark
+	configs[0].ServeStaleMaxAge = time.Minute
+	if err := m.apply(context.Background(), configs[:1]); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	if m.groups["web"].combiner == webCombiner {
+		t.Error("expected the web group to get a new combiner")
+	}
+
+	// The cache and mark policies need a max age from the group or the options
+	configs[0].ServeStaleMaxAge = 0
+	if err := m.apply(context.Background(), configs[:1]); err == nil {
+		t.Error("expected an error for the mark policy without a max age")
+	}
+}
+
+// TestGroupOAuth2 tests the group's OAuth2 settings are used for targets
+// without their own credentials.
+func TestGroupOAuth2(t *testing.T) {
+	oauth2 := &combiner.OAuth2{ClientID: "combiner", ClientSecretFile: "/etc/secret", TokenURL: "https://auth.example.com/token"}
+	group := groupConfig{
+		Name:   "internal",
+		OAuth2: oauth2,
+		Targets: []combiner.Target{
+			{URL: "http://app-1/metrics"},
+			{URL: "http://app-2/metrics", BasicAuth: &combiner.BasicAuth{Username: "prometheus"}},
+			{URL: "http://app-3/metrics", Headers: map[string]string{"authorization": "Bearer x"}},
+		},
+	}
+	if err := group.validate(); err != nil {
+		t.Fatalf("validate failed: %v", err)
+	}
+
+	got := group.withDefaults(combiner.Target{BearerTokenFile: "/etc/token"})
+	expected := []struct {
+		oauth2      bool
+		bearerToken string
+	}{
+		{oauth2: true},
+		{},
+		{},
+	}
+	for i, e := range expected {
+		target := got.Targets[i]
+		if (target.OAuth2 != nil) != e.oauth2 || target.BearerTokenFile != e.bearerToken {
+			t.Errorf("target %s: got oauth2 %v and bearer token %q, want oauth2 %v and bearer token %q", target.URL, target.OAuth2 != nil, target.BearerTokenFile, e.oauth2, e.bearerToken)
+		}
+	}
+
+	group.OAuth2 = &combiner.OAuth2{ClientID: "combiner"}
+	if err := group.validate(); err == nil {
+		t.Error("expected an error for incomplete oauth2 settings")
+	}
+}
+
+// TestGroupManagerClosesReplacedCombiners tests the combiners of removed and
+// replaced groups are closed, so their shared fetches don't keep running.
+func TestGroupManagerClosesReplacedCombiners(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "metric_a 1\n")
+	}))
+	defer upstream.Close()
+
+	m := newGroupManager(combiner.Options{CoalesceRequests: true})
+	configs := []groupConfig{
+		{Name: "web", Targets: []combiner.Target{{URL: upstream.URL}}},
+		{Name: "db", Targets: []combiner.Target{{URL: upstream.URL}}},
+	}
+	if err := m.apply(context.Background(), configs); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	web, db := m.groups["web"].combiner, m.groups["db"].combiner
+
+	// The web group is replaced and the db group removed
+	configs[0].Filters = combiner.Filter{Prefixes: []string{"metric_"}}
+	if err := m.apply(context.Background(), configs[:1]); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	for name, c := range map[string]*combiner.Combiner{"web": web, "db": db} {
+		rr := httptest.NewRecorder()
+		c.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+		if body := rr.Body.String(); body != "" {
+			t.Errorf("expected the old %s combiner to be closed, got %q", name, body)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	m.groups["web"].combiner.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if expected := "# TYPE metric_a untyped\nmetric_a 1\n"; rr.Body.String() != expected {
+		t.Errorf("got %q, want %q", rr.Body.String(), expected)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/manics/prometheus-metrics-combiner/combiner"
+)
+
+const (
+	// defaultHTTPRefreshInterval is how often the HTTP discovery URL is polled
+	// if the config doesn't say, the same as Prometheus.
+	defaultHTTPRefreshInterval = time.Minute
+	// httpSDTimeout limits each request to the HTTP discovery URL.
+	httpSDTimeout = 30 * time.Second
+)
+
+// httpSDConfig discovers targets from a URL serving the Prometheus HTTP
+// service discovery format.
+type httpSDConfig struct {
+	// URL returns a JSON list of target groups. It isn't called url as in
+	// Prometheus, since that is a target setting.
+	URL string `yaml:"sd_url"`
+	// RefreshInterval is how often the URL is polled.
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	// Scheme and MetricsPath are used to build the URL of each target.
+	Scheme      string `yaml:"scheme"`
+	MetricsPath string `yaml:"metrics_path"`
+	// Target holds the settings applied to every discovered target, its URL
+	// must not be set.
+	Target combiner.Target `yaml:",inline"`
+}
+
+// validate checks the HTTP discovery configuration is consistent.
+func (c httpSDConfig) validate() error {
+	if c.Target.URL != "" {
+		return fmt.Errorf("url can't be set for discovered targets, use sd_url for the discovery URL")
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid sd_url %q", c.URL)
+	}
+	if c.RefreshInterval < 0 {
+		return fmt.Errorf("refresh_interval must not be negative")
+	}
+	return validateDiscoveryTarget(c.Scheme, c.MetricsPath, c.Target)
+}
+
+// httpDiscoverer polls a URL for target groups.
+type httpDiscoverer struct {
+	cfg httpSDConfig
+	// template is cfg.Target with the global defaults applied.
+	template combiner.Target
+}
+
+// newHTTPDiscoverer creates a discoverer for an HTTP discovery configuration.
+func newHTTPDiscoverer(cfg httpSDConfig, defaults combiner.Target) *httpDiscoverer {
+	return &httpDiscoverer{cfg: cfg, template: cfg.Target.WithDefaults(defaults)}
+}
+
+// discover fetches the target groups from the URL.
+func (d *httpDiscoverer) discover(ctx context.Context) ([]combiner.Target, error) {
+	ctx, cancel := context.WithTimeout(ctx, httpSDTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.cfg.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch targets from %s: %w", d.cfg.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status fetching targets from %s: %s", d.cfg.URL, resp.Status)
+	}
+
+	var groups []targetGroup
+	if err := json.NewDecoder(resp.Body).Decode(&groups); err != nil {
+		return nil, fmt.Errorf("failed to decode targets from %s: %w", d.cfg.URL, err)
+	}
+	return groupTargets(d.template, d.cfg.Scheme, d.cfg.MetricsPath, groups)
+}
+
+// run implements discoverer.
+func (d *httpDiscoverer) run(ctx context.Context, update func([]combiner.Target)) {
+	interval := d.cfg.RefreshInterval
+	if interval == 0 {
+		interval = defaultHTTPRefreshInterval
+	}
+	poll(ctx, interval, d.discover, update)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/manics/prometheus-metrics-combiner/combiner"
+)
+
+// TestHTTPDiscoverer tests fetching target groups from a URL.
+func TestHTTPDiscoverer(t *testing.T) {
+	testCases := []struct {
+		name          string
+		status        int
+		body          string
+		expected      []combiner.Target
+		expectedError bool
+	}{
+		{
+			name:   "Target groups",
+			status: http.StatusOK,
+			body:   `[{"targets": ["host1:9100"], "labels": {"env": "prod"}}, {"targets": ["host2:9100"]}]`,
+			expected: []combiner.Target{
+				{URL: "http://host1:9100/metrics", Labels: map[string]string{"source": "http", "env": "prod"}},
+				{URL: "http://host2:9100/metrics", Labels: map[string]string{"source": "http"}},
+			},
+		},
+		{
+			name:   "No targets",
+			status: http.StatusOK,
+			body:   `[]`,
+		},
+		{
+			name:          "Bad status",
+			status:        http.StatusInternalServerError,
+			expectedError: true,
+		},
+		{
+			name:          "Invalid JSON",
+			status:        http.StatusOK,
+			body:          `{"targets": []}`,
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tc.status)
+				fmt.Fprint(w, tc.body)
+			}))
+			defer server.Close()
+
+			d := newHTTPDiscoverer(httpSDConfig{
+				URL:    server.URL,
+				Target: combiner.Target{Labels: map[string]string{"source": "http"}},
+			}, combiner.Target{})
+			targets, err := d.discover(context.Background())
+			if tc.expectedError {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("discover failed: %v", err)
+			}
+			if !reflect.DeepEqual(targets, tc.expected) {
+				t.Errorf("got %+v, want %+v", targets, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/manics/prometheus-metrics-combiner/combiner"
+)
+
+const (
+	// kubeServiceAccountDir holds the credentials mounted into pods.
+	kubeServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// kubeRetryInterval is how long to wait before listing pods again after
+	// an error.
+	kubeRetryInterval = 5 * time.Second
+	// kubeWatchTimeout is how long the API server keeps a watch open.
+	kubeWatchTimeout = 5 * time.Minute
+)
+
+// kubernetesSDConfig discovers targets from the pods matching a label
+// selector, fetching the container port with the given name.
+type kubernetesSDConfig struct {
+	// APIServer is the URL of the Kubernetes API server, such as
+	// http://localhost:8001 from kubectl proxy. If empty the in-cluster
+	// service account is used.
+	APIServer string `yaml:"api_server"`
+	// Namespace to discover pods in, all namespaces if empty.
+	Namespace     string `yaml:"namespace"`
+	LabelSelector string `yaml:"label_selector"`
+	// PortName is the name of the container port to fetch.
+	PortName string `yaml:"port_name"`
+	// Scheme and MetricsPath are used to build the URL of each pod.
+	Scheme      string `yaml:"scheme"`
+	MetricsPath string `yaml:"metrics_path"`
+	// Target holds the settings applied to every discovered target, its URL
+	// must not be set.
+	Target combiner.Target `yaml:",inline"`
+}
+
+// validate checks the Kubernetes discovery configuration is consistent.
+func (c kubernetesSDConfig) validate() error {
+	if c.PortName == "" {
+		return fmt.Errorf("port_name is required")
+	}
+	if c.APIServer != "" {
+		if u, err := url.Parse(c.APIServer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid api_server %q", c.APIServer)
+		}
+	}
+	return validateDiscoveryTarget(c.Scheme, c.MetricsPath, c.Target)
+}
+
+// kubePod is the subset of a Kubernetes pod used for discovery.
+type kubePod struct {
+	Metadata struct {
+		Name              string  `json:"name"`
+		Namespace         string  `json:"namespace"`
+		ResourceVersion   string  `json:"resourceVersion"`
+		DeletionTimestamp *string `json:"deletionTimestamp"`
+	} `json:"metadata"`
+	Spec struct {
+		Containers []struct {
+			Ports []struct {
+				Name          string `json:"name"`
+				ContainerPort uint16 `json:"containerPort"`
+			} `json:"ports"`
+		} `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		PodIP      string `json:"podIP"`
+		Conditions []struct {
+			Type   string `json:"type"`
+			Status string `json:"status"`
+		} `json:"conditions"`
+	} `json:"status"`
+}
+
+// key identifies the pod across namespaces.
+func (p *kubePod) key() string {
+	return p.Metadata.Namespace + "/" + p.Metadata.Name
+}
+
+// ready reports whether the pod is ready to serve and not being deleted.
+func (p *kubePod) ready() bool {
+	if p.Metadata.DeletionTimestamp != nil || p.Status.PodIP == "" {
+		return false
+	}
+	for _, c := range p.Status.Conditions {
+		if c.Type == "Ready" {
+			return c.Status == "True"
+		}
+	}
+	return false
+}
+
+// port returns the container port with the given name.
+func (p *kubePod) port(name string) (uint16, bool) {
+	for _, c := range p.Spec.Containers {
+		for _, port := range c.Ports {
+			if port.Name == name {
+				return port.ContainerPort, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// kubePodList is a list of pods returned by the API server.
+type kubePodList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []kubePod `json:"items"`
+}
+
+// kubeWatchEvent is a single change sent by a watch.
+type kubeWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// kubeStatus is the object of an ERROR watch event.
+type kubeStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// errKubeWatchExpired is returned when the resource version being watched is
+// too old and the pods must be listed again.
+var errKubeWatchExpired = errors.New("watch expired")
+
+// kubeAPI is a client for the pods API of a Kubernetes API server.
+type kubeAPI struct {
+	baseURL string
+	client  *http.Client
+}
+
+// newKubeAPI creates a client for apiServer, or for the cluster the
+// combiner is running in if it is empty.
+func newKubeAPI(apiServer string) (*kubeAPI, error) {
+	if apiServer != "" {
+		return &kubeAPI{baseURL: strings.TrimSuffix(apiServer, "/"), client: &http.Client{}}, nil
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set")
+	}
+	base := "https://" + net.JoinHostPort(host, port)
+	client, err := combiner.NewClient(combiner.Target{
+		URL:             base,
+		TLSConfig:       combiner.TLSConfig{CAFile: kubeServiceAccountDir + "/ca.crt"},
+		BearerTokenFile: kubeServiceAccountDir + "/token",
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &kubeAPI{baseURL: base, client: client}, nil
+}
+
+// podsURL returns the URL for listing or watching the pods in namespace, or
+// all namespaces if it is empty, matching selector.
+func (k *kubeAPI) podsURL(namespace, selector string, params url.Values) string {
+	path := "/api/v1/pods"
+	if namespace != "" {
+		path = "/api/v1/namespaces/" + url.PathEscape(namespace) + "/pods"
+	}
+	if selector != "" {
+		params.Set("labelSelector", selector)
+	}
+	return k.baseURL + path + "?" + params.Encode()
+}
+
+// get sends a GET request, failing if the response isn't 200 OK.
+func (k *kubeAPI) get(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("bad status from Kubernetes API for %s: %s", u, resp.Status)
+	}
+	return resp, nil
+}
+
+// listPods lists the pods in namespace matching selector.
+func (k *kubeAPI) listPods(ctx context.Context, namespace, selector string) (*kubePodList, error) {
+	resp, err := k.get(ctx, k.podsURL(namespace, selector, url.Values{}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var list kubePodList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to decode pod list: %w", err)
+	}
+	return &list, nil
+}
+
+// watchPods watches the pods in namespace matching selector for changes
+// after resourceVersion, calling handle for each added, modified or deleted
+// pod. It returns the last resource version seen when the watch ends.
+func (k *kubeAPI) watchPods(ctx context.Context, namespace, selector, resourceVersion string, handle func(eventType string, pod *kubePod)) (string, error) {
+	params := url.Values{
+		"watch":               {"1"},
+		"resourceVersion":     {resourceVersion},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {fmt.Sprint(int(kubeWatchTimeout.Seconds()))},
+	}
+	resp, err := k.get(ctx, k.podsURL(namespace, selector, params))
+	if err != nil {
+		return resourceVersion, fmt.Errorf("failed to watch pods: %w", err)
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event kubeWatchEvent
+		if err := dec.Decode(&event); err != nil {
+			if errors.Is(err, io.EOF) {
+				return resourceVersion, nil
+			}
+			return resourceVersion, fmt.Errorf("failed to decode watch event: %w", err)
+		}
+
+		if event.Type == "ERROR" {
+			var status kubeStatus
+			json.Unmarshal(event.Object, &status)
+			if status.Code == http.StatusGone {
+				return resourceVersion, errKubeWatchExpired
+			}
+			return resourceVersion, fmt.Errorf("watch error from Kubernetes API: %s", status.Message)
+		}
+
+		var pod kubePod
+		if err := json.Unmarshal(event.Object, &pod); err != nil {
+			return resourceVersion, fmt.Errorf("failed to decode pod: %w", err)
+		}
+		resourceVersion = pod.Metadata.ResourceVersion
+		if event.Type != "BOOKMARK" {
+			handle(event.Type, &pod)
+		}
+	}
+}
+
+// kubernetesDiscoverer watches the pods matching a label selector.
+type kubernetesDiscoverer struct {
+	cfg kubernetesSDConfig
+	// template is cfg.Target with the global defaults applied.
+	template combiner.Target
+}
+
+// newKubernetesDiscoverer creates a discoverer for a Kubernetes discovery
+// configuration.
+func newKubernetesDiscoverer(cfg kubernetesSDConfig, defaults combiner.Target) *kubernetesDiscoverer {
+	return &kubernetesDiscoverer{cfg: cfg, template: cfg.Target.WithDefaults(defaults)}
+}
+
+// targets returns a target for each ready pod with the configured port,
+// sorted by URL. Each target has namespace and pod labels unless the
+// template sets them.
+func (d *kubernetesDiscoverer) targets(pods map[string]*kubePod) []combiner.Target {
+	var targets []combiner.Target
+	for _, pod := range pods {
+		port, ok := pod.port(d.cfg.PortName)
+		if !ok || !pod.ready() {
+			continue
+		}
+		t := discoveredTarget(d.template, d.cfg.Scheme, pod.Status.PodIP, port, d.cfg.MetricsPath)
+		t.Labels = map[string]string{"namespace": pod.Metadata.Namespace, "pod": pod.Metadata.Name}
+		maps.Copy(t.Labels, d.template.Labels)
+		targets = append(targets, t)
+	}
+	slices.SortFunc(targets, func(a, b combiner.Target) int { return strings.Compare(a.URL, b.URL) })
+	return targets
+}
+
+// run implements discoverer. The pods are listed and then watched for
+// changes, listing them again if the watch fails.
+func (d *kubernetesDiscoverer) run(ctx context.Context, update func([]combiner.Target)) {
+	api, err := newKubeAPI(d.cfg.APIServer)
+	if err != nil {
+		slog.Error("Kubernetes discovery failed", "err", err)
+		return
+	}
+
+	for {
+		err := d.listAndWatch(ctx, api, update)
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, errKubeWatchExpired) {
+			continue
+		}
+		slog.Warn("Kubernetes discovery failed, keeping the previous targets", "err", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(kubeRetryInterval):
+		}
+	}
+}
+
+// listAndWatch lists the pods and then watches them until an error occurs.
+func (d *kubernetesDiscoverer) listAndWatch(ctx context.Context, api *kubeAPI, update func([]combiner.Target)) error {
+	list, err := api.listPods(ctx, d.cfg.Namespace, d.cfg.LabelSelector)
+	if err != nil {
+		return err
+	}
+	pods := make(map[string]*kubePod, len(list.Items))
+	for i := range list.Items {
+		pods[list.Items[i].key()] = &list.Items[i]
+	}
+	update(d.targets(pods))
+
+	resourceVersion := list.Metadata.ResourceVersion
+	for {
+		resourceVersion, err = api.watchPods(ctx, d.cfg.Namespace, d.cfg.LabelSelector, resourceVersion, func(eventType string, pod *kubePod) {
+			if eventType == "DELETED" {
+				delete(pods, pod.key())
+			} else {
+				pods[pod.key()] = pod
+			}
+			update(d.targets(pods))
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/manics/prometheus-metrics-combiner/combiner"
+)
+
+// testPod returns the JSON of a pod with a metrics port.
+func testPod(name, ip string, ready bool) map[string]any {
+	status := "False"
+	if ready {
+		status = "True"
+	}
+	return map[string]any{
+		"metadata": map[string]any{"name": name, "namespace": "default", "resourceVersion": name},
+		"spec": map[string]any{"containers": []any{map[string]any{
+			"ports": []any{map[string]any{"name": "metrics", "containerPort": 9100}},
+		}}},
+		"status": map[string]any{
+			"podIP":      ip,
+			"conditions": []any{map[string]any{"type": "Ready", "status": status}},
+		},
+	}
+}
+
+// TestKubernetesDiscovererTargets tests which pods become targets.
+func TestKubernetesDiscovererTargets(t *testing.T) {
+	testCases := []struct {
+		name     string
+		cfg      kubernetesSDConfig
+		pod      map[string]any
+		expected []combiner.Target
+	}{
+		{
+			name: "Ready pod",
+			cfg:  kubernetesSDConfig{PortName: "metrics"},
+			pod:  testPod("a", "10.0.0.1", true),
+			expected: []combiner.Target{{
+				URL:    "http://10.0.0.1:9100/metrics",
+				Labels: map[string]string{"namespace": "default", "pod": "a"},
+			}},
+		},
+		{
+			name: "Template labels take precedence",
+			cfg: kubernetesSDConfig{PortName: "metrics", Scheme: "https", MetricsPath: "/m", Target: combiner.Target{
+				Labels: map[string]string{"pod": "exporter", "env": "prod"},
+			}},
+			pod: testPod("a", "10.0.0.1", true),
+			expected: []combiner.Target{{
+				URL:    "https://10.0.0.1:9100/m",
+				Labels: map[string]string{"namespace": "default", "pod": "exporter", "env": "prod"},
+			}},
+		},
+		{
+			name: "Not ready",
+			cfg:  kubernetesSDConfig{PortName: "metrics"},
+			pod:  testPod("a", "10.0.0.1", false),
+		},
+		{
+			name: "No IP",
+			cfg:  kubernetesSDConfig{PortName: "metrics"},
+			pod:  testPod("a", "", true),
+		},
+		{
+			name: "Missing port",
+			cfg:  kubernetesSDConfig{PortName: "http"},
+			pod:  testPod("a", "10.0.0.1", true),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, _ := json.Marshal(tc.pod)
+			var pod kubePod
+			if err := json.Unmarshal(data, &pod); err != nil {
+				t.Fatal(err)
+			}
+
+			d := newKubernetesDiscoverer(tc.cfg, combiner.Target{})
+			targets := d.targets(map[string]*kubePod{pod.key(): &pod})
+			if !reflect.DeepEqual(targets, tc.expected) {
+				t.Errorf("got %+v, want %+v", targets, tc.expected)
+			}
+		})
+	}
+}
+
+// TestKubernetesDiscovererWatch tests listing pods and following the changes
+// sent by a watch.
+func TestKubernetesDiscovererWatch(t *testing.T) {
+	watches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/default/pods" || r.URL.Query().Get("labelSelector") != "app=exporter" {
+			http.NotFound(w, r)
+			return
+		}
+		enc := json.NewEncoder(w)
+		if r.URL.Query().Get("watch") == "" {
+			enc.Encode(map[string]any{
+				"metadata": map[string]any{"resourceVersion": "1"},
+				"items":    []any{testPod("a", "10.0.0.1", true), testPod("b", "10.0.0.2", false)},
+			})
+			return
+		}
+
+		watches++
+		switch watches {
+		case 1:
+			if rv := r.URL.Query().Get("resourceVersion"); rv != "1" {
+				t.Errorf("expected the watch to start from the list, got resource version %q", rv)
+			}
+			enc.Encode(map[string]any{"type": "MODIFIED", "object": testPod("b", "10.0.0.2", true)})
+			enc.Encode(map[string]any{"type": "BOOKMARK", "object": map[string]any{"metadata": map[string]any{"resourceVersion": "5"}}})
+		case 2:
+			if rv := r.URL.Query().Get("resourceVersion"); rv != "5" {
+				t.Errorf("expected the watch to resume from the bookmark, got resource version %q", rv)
+			}
+			enc.Encode(map[string]any{"type": "DELETED", "object": testPod("a", "10.0.0.1", true)})
+			enc.Encode(map[string]any{"type": "ERROR", "object": map[string]any{"code": 410, "message": "too old"}})
+		}
+	}))
+	defer server.Close()
+
+	api, err := newKubeAPI(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newKubernetesDiscoverer(kubernetesSDConfig{Namespace: "default", LabelSelector: "app=exporter", PortName: "metrics"}, combiner.Target{})
+
+	var updates [][]string
+	err = d.listAndWatch(context.Background(), api, func(targets []combiner.Target) {
+		var urls []string
+		for _, target := range targets {
+			urls = append(urls, target.URL)
+		}
+		updates = append(updates, urls)
+	})
+	if !errors.Is(err, errKubeWatchExpired) {
+		t.Errorf("expected the watch to expire, got %v", err)
+	}
+
+	expected := [][]string{
+		{"http://10.0.0.1:9100/metrics"},
+		{"http://10.0.0.1:9100/metrics", "http://10.0.0.2:9100/metrics"},
+		{"http://10.0.0.2:9100/metrics"},
+	}
+	if !reflect.DeepEqual(updates, expected) {
+		t.Errorf("got updates %v, want %v", updates, expected)
+	}
+}
+
+// TestNewKubeAPIOutsideCluster tests that the in-cluster configuration
+// requires the service environment variables.
+func TestNewKubeAPIOutsideCluster(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	if _, err := newKubeAPI(""); err == nil {
+		t.Error("expected an error outside a cluster")
+	}
+}
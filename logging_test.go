@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// TestNewLogger tests creating loggers with different levels and formats.
+func TestNewLogger(t *testing.T) {
+	testCases := []struct {
+		name          string
+		level         string
+		format        string
+		expectedLines int
+		expectedError string
+	}{
+		{name: "Info text", level: "info", format: "text", expectedLines: 2},
+		{name: "Debug json", level: "debug", format: "json", expectedLines: 3},
+		{name: "Warn is case insensitive", level: "WARN", format: "text", expectedLines: 1},
+		{name: "Invalid level", level: "verbose", format: "text", expectedError: "invalid log level"},
+		{name: "Invalid format", level: "info", format: "logfmt", expectedError: "invalid log format"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger, err := newLogger(&buf, tc.level, tc.format)
+			if tc.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+					t.Fatalf("expected error containing '%s', got: %v", tc.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newLogger failed: %v", err)
+			}
+
+			logger.Debug("debug message")
+			logger.Info("info message")
+			logger.Warn("warn message", "target", "http://localhost:9100/metrics")
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			if len(lines) != tc.expectedLines {
+				t.Errorf("expected %d lines, got %d:\n%s", tc.expectedLines, len(lines), buf.String())
+			}
+			if tc.format == "json" {
+				var entry map[string]any
+				if err := json.Unmarshal([]byte(lines[len(lines)-1]), &entry); err != nil {
+					t.Fatalf("log line is not JSON: %v", err)
+				}
+				if entry["target"] != "http://localhost:9100/metrics" {
+					t.Errorf("expected target field in log entry, got %v", entry)
+				}
+			}
+		})
+	}
+}
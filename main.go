@@ -1,46 +1,26 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
+	"maps"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"reflect"
+	"slices"
+	"strconv"
 	"strings"
-	"sync"
-)
-
-// result holds the outcome of a single HTTP fetch.
-type result struct {
-	body string
-	err  error
-}
-
-// fetchURL fetches the content of a given URL and sends the result to a channel.
-func fetchURL(url string, ch chan<- result, wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	resp, err := http.Get(url)
-	if err != nil {
-		ch <- result{err: fmt.Errorf("failed to get %s: %w", url, err)}
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		ch <- result{err: fmt.Errorf("bad status for %s: %s", url, resp.Status)}
-		return
-	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		ch <- result{err: fmt.Errorf("failed to read body from %s: %w", url, err)}
-		return
-	}
+	"syscall"
+	"time"
 
-	ch <- result{body: string(body)}
-}
+	"github.com/manics/prometheus-metrics-combiner/combiner"
+)
 
 // stringList is a custom flag.Value type to allow multiple string flags
 type stringList []string
@@ -56,105 +36,544 @@ func (s *stringList) Set(value string) error {
 	return nil
 }
 
-// aggregatorHandler fetches content from multiple URLs, concatenates their bodies, and writes the result back.
-func aggregatorHandler(w http.ResponseWriter, r *http.Request, urls []string, prefixes []string, verbose *bool) {
+func main() {
+	port := flag.Int("port", 8080, "Port for the HTTP server to listen on")
+	listenSocket := flag.String("listen-socket", "", "Path of a Unix domain socket to listen on instead of -port")
+
+	var listens stringList
+	flag.Var(&listens, "listen", "Address to listen on as [unix:|systemd:]ADDRESS[=GROUP,...] where GROUP is one of metrics, health, lifecycle, pprof or admin, can be specified multiple times. Overrides -port and -listen-socket")
+	listenIPFamily := flag.String("listen-ip-family", combiner.IPFamilyDual, "IP family of the TCP addresses to listen on: dual, ipv4 or ipv6")
+	proxyProtocolEnabled := flag.Bool("proxy-protocol", false, "Read the HAProxy PROXY protocol header sent by a load balancer at the start of each connection, so the client's address is used for logging and -allow-cidr")
+	var proxyProtocolTrustedCIDRs stringList
+	flag.Var(&proxyProtocolTrustedCIDRs, "proxy-protocol-trusted-cidr", "Network of the load balancers sending -proxy-protocol headers, connections from other addresses are used as they are. By default every connection must send a header (can be specified multiple times)")
+	systemdSocket := flag.Bool("systemd-socket", false, "Serve all handlers on every socket passed by systemd socket activation instead of binding -port")
+
+	telemetryPath := flag.String("telemetry-path", "/metrics", "Path under which to serve the combined metrics")
+	logLevel := flag.String("log-level", "info", "Only log messages with this level or above: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "Log format: text or json")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "OTLP/HTTP endpoint to export traces of each request and upstream fetch to, for example http://localhost:4318/v1/traces. Tracing is disabled if empty")
+	enableAccessLog := flag.Bool("access-log", false, "Log every request to the server with its method, path, client, status, size and duration")
+	verbose := flag.Bool("verbose", false, "Enable verbose logging, the same as -log-level=debug")
+	showVersion := flag.Bool("version", false, "Print the version and exit")
+	timeout := flag.Duration("timeout", 10*time.Second, "Maximum total time to spend fetching upstreams for a single request, 0 to disable")
+	timeoutOffset := flag.Duration("timeout-offset", 500*time.Millisecond, "Time subtracted from the X-Prometheus-Scrape-Timeout-Seconds header, to combine and send the partial results before Prometheus gives up")
+	coalesceRequests := flag.Bool("coalesce-requests", false, "Concurrent requests share a single fetch of the upstreams and get the same result, without caching it. Always done with -cache-ttl")
+	cacheTTL := flag.Duration("cache-ttl", 0, "Reuse the combined result for requests within this time of it being fetched, instead of fetching the upstreams again. 0 to disable")
+	cacheStaleTTL := flag.Duration("cache-stale-ttl", 0, "After -cache-ttl expires keep serving the cached result for up to this long while it is refreshed in the background")
+	maxConcurrentFetches := flag.Int("max-concurrent-fetches", 0, "Maximum number of upstreams fetched at the same time for each request, further fetches wait for one to finish. 0 for no limit")
+	maxBodySize := flag.Int("max-body-size", 0, "Maximum size in bytes of an uncompressed upstream body, fetches of larger bodies fail. 0 for no limit")
+	minSuccess := flag.String("min-success", "", "Minimum number of upstreams, or percentage such as 80%, that must be fetched successfully, otherwise requests fail with 500 instead of returning partial results. Defaults to 1")
+	serveStaleMaxAge := flag.Duration("serve-stale-max-age", 0, "When fetching an upstream fails serve the metrics from its last successful fetch instead, if it was within this long. 0 to disable")
+	stalenessPolicy := flag.String("staleness-policy", "", "How the metrics of an upstream that failed are served: omit them, cache to serve its last metrics from within -serve-stale-max-age, or mark to serve them with the Prometheus stale marker. Defaults to cache if -serve-stale-max-age is set, otherwise omit")
+	scrapeInterval := flag.Duration("scrape-interval", 0, "Fetch upstreams in the background on this interval and serve the latest result, instead of fetching them for every request. 0 to disable")
+	scrapeJitter := flag.Duration("scrape-jitter", 0, "Spread the fetches of each -scrape-interval background scrape over this duration, each upstream is fetched after a fixed offset. Must be less than -scrape-interval")
+	breakerThreshold := flag.Int("breaker-threshold", 0, "Number of consecutive failures after which a target's circuit breaker opens, 0 to disable")
+	breakerCooldown := flag.Duration("breaker-cooldown", 30*time.Second, "Time a target's circuit breaker stays open before a trial fetch is allowed")
+	selfMetrics := flag.Bool("self-metrics", false, "Add combiner_build_info and combiner_scrape_partial, and combiner_target_up, combiner_scrape_duration_seconds, combiner_scrape_errors_total and combiner_scraped_bytes metrics for each upstream to the output")
+	failedTargetsHeader := flag.Bool("failed-targets-header", false, "List the upstreams that failed in the X-Combiner-Failed-Targets header of responses with partial results")
+	injectTimestamps := flag.Bool("inject-timestamps", false, "Add the time each upstream was fetched as the timestamp of its samples that don't have one, useful with -scrape-interval and -cache-ttl")
+	stripTimestamps := flag.Bool("strip-timestamps", false, "Remove the timestamps of samples from upstreams, so Prometheus uses the scrape time. Applied before -inject-timestamps")
+	outputValidation := flag.String("output-validation", "", "Check the combined metrics are valid before serving them, and drop invalid series, warn about them, or fail the request: drop, warn or fail. Empty to disable")
+	sortSeries := flag.Bool("sort-series", false, "Sort the series of each metric by their labels, so the output is stable however upstreams order them. Metrics are always sorted by name")
+	duplicatePolicy := flag.String("duplicate-policy", combiner.DuplicateFirst, "How to resolve a series exposed by more than one upstream: first, last, sum or error. first and last refer to the order of the upstreams")
+	rateLimit := flag.Float64("rate-limit", 0, "Maximum number of requests per second to the metrics endpoint from all clients, further requests get 429 Too Many Requests. 0 for no limit")
+	rateLimitBurst := flag.Int("rate-limit-burst", 10, "Number of requests allowed in a burst above -rate-limit")
+	clientRateLimit := flag.Float64("client-rate-limit", 0, "Maximum number of requests per second to the metrics endpoint from each client IP address. 0 for no limit")
+	clientRateLimitBurst := flag.Int("client-rate-limit-burst", 5, "Number of requests allowed in a burst above -client-rate-limit")
+	maxConcurrentRequests := flag.Int("max-concurrent-requests", 0, "Maximum number of requests to the metrics endpoint served at the same time, further requests get 503 Service Unavailable. 0 for no limit")
+	basicAuthUsersFile := flag.String("basic-auth-users-file", "", "YAML file mapping usernames to bcrypt password hashes, if set clients must use basic auth")
+	authTokensFile := flag.String("auth-tokens-file", "", "File of bearer tokens, one per line, if set clients may authenticate by presenting one of them")
+	configFile := flag.String("config-file", "", "Optional YAML configuration file with additional targets and per-target settings")
+	readyMinUpstreams := flag.Int("ready-min-upstreams", 0, "Minimum number of upstreams that must have been fetched successfully within -ready-max-age for /ready to succeed")
+	readyMaxAge := flag.Duration("ready-max-age", 5*time.Minute, "How recently an upstream must have been fetched successfully to count towards -ready-min-upstreams")
+	enableLifecycle := flag.Bool("web-enable-lifecycle", false, "Enable the /-/reload endpoint to re-read the config file on POST")
+	enableAdminAPI := flag.Bool("web-enable-admin-api", false, "Enable POST and DELETE on /api/v1/targets to add and remove targets while running, requires -basic-auth-users-file or -auth-tokens-file")
+	adminAPIPersist := flag.Bool("web-admin-api-persist", false, "Write targets added and removed with the admin API to the targets in -config-file, so they are kept on reload and restart")
+	enablePprof := flag.Bool("enable-pprof", false, "Enable the net/http/pprof profiling endpoints on /debug/pprof/")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 15*time.Second, "Time to wait for in-flight requests to complete on shutdown before cancelling them")
+	tlsCertFile := flag.String("tls-cert-file", "", "PEM certificate for serving over HTTPS instead of HTTP")
+	tlsKeyFile := flag.String("tls-key-file", "", "PEM private key for -tls-cert-file")
+	tlsClientCAFile := flag.String("tls-client-ca-file", "", "PEM file of CA certificates, if set clients must present a certificate signed by one of them")
+
+	remoteWriteURL := flag.String("remote-write-url", "", "Prometheus remote write endpoint to push the combined metrics to every -remote-write-interval, for example http://prometheus:9090/api/v1/write")
+	remoteWriteInterval := flag.Duration("remote-write-interval", 30*time.Second, "How often to push the combined metrics to -remote-write-url")
+	remoteWriteBearerTokenFile := flag.String("remote-write-bearer-token-file", "", "File containing a bearer token sent to -remote-write-url")
+
+	pushgatewayURL := flag.String("pushgateway-url", "", "Pushgateway to push the combined metrics to every -pushgateway-interval, for example http://pushgateway:9091")
+	pushgatewayJob := flag.String("pushgateway-job", "combiner", "Job name of the group pushed to -pushgateway-url")
+	pushgatewayInstance := flag.String("pushgateway-instance", "", "Optional instance name of the group pushed to -pushgateway-url")
+	pushgatewayInterval := flag.Duration("pushgateway-interval", 30*time.Second, "How often to push the combined metrics to -pushgateway-url")
+	pushgatewayBearerTokenFile := flag.String("pushgateway-bearer-token-file", "", "File containing a bearer token sent to -pushgateway-url")
+
+	graphiteAddress := flag.String("graphite-address", "", "Carbon plaintext listener to send the combined metrics to every -graphite-interval, for example carbon:2003")
+	graphitePrefix := flag.String("graphite-prefix", "", "Prefix prepended to every Graphite metric path, for example prometheus.")
+	graphiteTags := flag.Bool("graphite-tags", false, "Send labels to Graphite as tags instead of path components")
+	graphiteInterval := flag.Duration("graphite-interval", time.Minute, "How often to send the combined metrics to -graphite-address")
+
+	var transportOpts combiner.TransportOptions
+	flag.BoolVar(&transportOpts.HTTP2, "upstream-http2", true, "Allow HTTP/2 to be used for HTTPS upstreams")
+	flag.IntVar(&transportOpts.MaxIdleConns, "max-idle-conns", 100, "Maximum number of idle upstream connections kept open for reuse across all hosts, 0 for no limit")
+	flag.IntVar(&transportOpts.MaxIdleConnsPerHost, "max-idle-conns-per-host", 10, "Maximum number of idle connections to each upstream host kept open for reuse by later fetches")
+	flag.IntVar(&transportOpts.MaxConnsPerHost, "max-conns-per-host", 0, "Maximum number of connections to each upstream host including those in use, further fetches wait for a connection. 0 for no limit")
+	flag.DurationVar(&transportOpts.IdleConnTimeout, "idle-conn-timeout", 90*time.Second, "How long an idle upstream connection is kept open for reuse, 0 for no limit")
+	dnsRefreshInterval := flag.Duration("dns-refresh-interval", 0, "Cache the resolved addresses of upstream host names and resolve them again after this interval, instead of for every new connection. 0 to disable")
+
+	// Defaults for settings that can also be configured per target
+	var defaults combiner.Target
+	flag.StringVar(&defaults.TLSConfig.CAFile, "upstream-ca-file", "", "PEM file of CA certificates used to verify HTTPS upstreams instead of the system roots")
+	flag.StringVar(&defaults.TLSConfig.CertFile, "upstream-cert-file", "", "PEM client certificate presented to upstreams that require mutual TLS")
+	flag.StringVar(&defaults.TLSConfig.KeyFile, "upstream-key-file", "", "PEM private key for -upstream-cert-file")
+	flag.StringVar(&defaults.BearerTokenFile, "bearer-token-file", "", "File containing a bearer token sent to upstreams, re-read periodically to pick up rotated tokens")
+	flag.StringVar(&defaults.LabelConflict, "label-conflict", combiner.LabelConflictOverwrite, "How target labels that are already present on a series are resolved: overwrite, keep or rename to exported_<label>")
+
+	// Custom flags to allow multiple URLs and prefixes
+
+	var urls stringList
+	flag.Var(&urls, "url", "URL to fetch from, or a bare host:port completed with -default-scheme and -default-metrics-path (can be specified multiple times)")
+	defaultScheme := flag.String("default-scheme", "http", "Scheme of upstream URLs given as a bare host:port: http or https")
+	defaultMetricsPath := flag.String("default-metrics-path", "/metrics", "Path of upstream URLs given as a bare host:port without a path")
+
+	var urlLists stringList
+	flag.Var(&urlLists, "url-list-url", "URL serving a plain text list of upstream URLs, one per line, which is fetched again every -url-list-refresh-interval (can be specified multiple times)")
+	urlListRefreshInterval := flag.Duration("url-list-refresh-interval", time.Minute, "How often to fetch the -url-list-url lists again")
+
+	var prefixes stringList
+	flag.Var(&prefixes, "prefix", "Prefix of metric names to include in the output (can be specified multiple times). If no prefixes are given, all metrics are included.")
+
+	var matchRegexes stringList
+	flag.Var(&matchRegexes, "match-regex", "Regular expression matching the whole name of metrics to include in the output, in addition to those selected by -prefix (can be specified multiple times)")
+
+	var excludePrefixes stringList
+	flag.Var(&excludePrefixes, "exclude-prefix", "Prefix of metric names to remove from the output after -prefix and -match-regex are applied (can be specified multiple times)")
+	var includeTypes stringList
+	flag.Var(&includeTypes, "include-type", "Only include metrics of this type: counter, gauge, histogram, gaugehistogram, summary or untyped (can be specified multiple times)")
+	var excludeTypes stringList
+	flag.Var(&excludeTypes, "exclude-type", "Remove metrics of this type from the output (can be specified multiple times)")
+
+	var excludeRegexes stringList
+	flag.Var(&excludeRegexes, "exclude-regex", "Regular expression matching the whole name of metrics to remove from the output after -prefix and -match-regex are applied (can be specified multiple times)")
+
+	var keepSeries stringList
+	flag.Var(&keepSeries, "keep-series", "Series selector such as '{env=\"prod\"}', if given only series matching one of them are included in the output (can be specified multiple times)")
+
+	var dropSeries stringList
+	flag.Var(&dropSeries, "drop-series", "Series selector such as 'http_requests_total{code=~\"5..\"}', series matching one of them are removed from the output (can be specified multiple times)")
+
+	var forwardParams stringList
+	flag.Var(&forwardParams, "forward-param", "Name of a query parameter that is forwarded from requests to every upstream, for example collect[] (can be specified multiple times)")
+
+	var dropLabels stringList
+	flag.Var(&dropLabels, "drop-label", "Label to remove from every series, series that become identical are resolved with -duplicate-policy (can be specified multiple times)")
+
+	var clientAllowCIDRs stringList
+	flag.Var(&clientAllowCIDRs, "allow-cidr", "Network of clients allowed to read the metrics, such as 10.0.0.0/8, if given requests from other clients get 403 Forbidden (can be specified multiple times)")
+
+	var upstreamSchemes stringList
+	flag.Var(&upstreamSchemes, "upstream-allowed-scheme", "URL scheme that upstreams may use, if given other schemes are refused (can be specified multiple times)")
+
+	var upstreamPorts stringList
+	flag.Var(&upstreamPorts, "upstream-allowed-port", "Port that upstreams may use, if given other ports are refused (can be specified multiple times)")
+
+	var upstreamAllowCIDRs stringList
+	flag.Var(&upstreamAllowCIDRs, "upstream-allow-cidr", "Network that upstream connections may be made to, such as 10.0.0.0/8, if given connections to other addresses are refused (can be specified multiple times)")
+
+	var upstreamDenyCIDRs stringList
+	flag.Var(&upstreamDenyCIDRs, "upstream-deny-cidr", "Network that upstream connections are refused to, such as 169.254.0.0/16 to block cloud metadata endpoints (can be specified multiple times)")
+
+	upstreamIPFamily := flag.String("upstream-ip-family", combiner.IPFamilyDual, "IP family of the addresses connected to for upstreams: "+strings.Join(combiner.IPFamilies, ", "))
+
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+
 	if *verbose {
-		log.Printf("Received request for %s from %s, fetching from %v", r.URL.Path, r.RemoteAddr, urls)
+		*logLevel = "debug"
 	}
+	logger, err := newLogger(os.Stderr, *logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
 
-	if len(urls) == 0 {
-		http.Error(w, "No upstream URLs configured.", http.StatusInternalServerError)
-		return
+	if !strings.HasPrefix(*telemetryPath, "/") {
+		fatal("-telemetry-path must start with /")
 	}
 
-	var wg sync.WaitGroup
-	ch := make(chan result, len(urls))
+	filters := combiner.Filter{
+		Prefixes:        prefixes,
+		MatchRegexes:    matchRegexes,
+		ExcludePrefixes: excludePrefixes,
+		ExcludeRegexes:  excludeRegexes,
+		IncludeTypes:    includeTypes,
+		ExcludeTypes:    excludeTypes,
+		KeepSeries:      keepSeries,
+		DropSeries:      dropSeries,
+		DropLabels:      dropLabels,
+	}
 
-	wg.Add(len(urls))
-	for _, u := range urls {
-		go fetchURL(u, ch, &wg)
+	if *rateLimit < 0 || *clientRateLimit < 0 {
+		fatal("-rate-limit and -client-rate-limit must not be negative")
+	}
+	if *maxConcurrentRequests < 0 {
+		fatal("-max-concurrent-requests must not be negative")
+	}
+	if transportOpts.MaxIdleConns < 0 || transportOpts.MaxIdleConnsPerHost < 0 || transportOpts.MaxConnsPerHost < 0 || transportOpts.IdleConnTimeout < 0 {
+		fatal("-max-idle-conns, -max-idle-conns-per-host, -max-conns-per-host and -idle-conn-timeout must not be negative")
+	}
+	listenNetwork, ok := listenNetworks[*listenIPFamily]
+	if !ok {
+		fatal("-listen-ip-family must be one of " + strings.Join(slices.Sorted(maps.Keys(listenNetworks)), ", "))
 	}
 
-	// Wait for both fetch operations to complete, then close the channel.
-	go func() {
-		wg.Wait()
-		close(ch)
-	}()
+	if !slices.Contains(combiner.LabelConflictPolicies, defaults.LabelConflict) {
+		fatal("-label-conflict must be one of " + strings.Join(combiner.LabelConflictPolicies, ", "))
+	}
 
-	var concatenatedBody strings.Builder
-	var errors []error
+	if err := defaults.TLSConfig.Validate(); err != nil {
+		fatal("Invalid -upstream-cert-file and -upstream-key-file", "err", err)
+	}
+
+	allowlist, err := newClientAllowlist(clientAllowCIDRs)
+	if err != nil {
+		fatal("Invalid -allow-cidr", "err", err)
+	}
+
+	var proxy *proxyProtocol
+	if *proxyProtocolEnabled {
+		if proxy, err = newProxyProtocol(proxyProtocolTrustedCIDRs); err != nil {
+			fatal("Invalid -proxy-protocol-trusted-cidr", "err", err)
+		}
+	} else if len(proxyProtocolTrustedCIDRs) > 0 {
+		fatal("-proxy-protocol-trusted-cidr requires -proxy-protocol")
+	}
 
-	// Read results from the channel.
-	for res := range ch {
-		if res.err != nil {
-			log.Printf("Error fetching URL: %v", res.err)
-			errors = append(errors, res.err)
-			continue
+	urlPolicy := combiner.URLPolicy{Schemes: upstreamSchemes, AllowCIDRs: upstreamAllowCIDRs, DenyCIDRs: upstreamDenyCIDRs}
+	for _, p := range upstreamPorts {
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			fatal("-upstream-allowed-port must be a number", "port", p)
 		}
+		urlPolicy.Ports = append(urlPolicy.Ports, port)
+	}
 
-		if len(prefixes) == 0 {
-			// If no prefixes are specified, concatenate the entire body
-			concatenatedBody.WriteString(res.body)
-		} else {
-			// Otherwise, filter lines by prefix
-			scanner := bufio.NewScanner(strings.NewReader(res.body))
-			for scanner.Scan() {
-				line := scanner.Text()
-				for _, p := range prefixes {
-					if strings.HasPrefix(line, p) {
-						concatenatedBody.WriteString(line)
-						concatenatedBody.WriteString("\n")
-						break
-					}
-				}
+	var successThreshold combiner.SuccessThreshold
+	if *minSuccess != "" {
+		if successThreshold, err = combiner.ParseSuccessThreshold(*minSuccess); err != nil {
+			fatal("Invalid -min-success", "err", err)
+		}
+	}
+
+	if *remoteWriteInterval <= 0 {
+		fatal("-remote-write-interval must be positive")
+	}
+
+	if *pushgatewayInterval <= 0 {
+		fatal("-pushgateway-interval must be positive")
+	}
+	if *pushgatewayURL != "" && *pushgatewayJob == "" {
+		fatal("-pushgateway-job is required with -pushgateway-url")
+	}
+
+	if *graphiteInterval <= 0 {
+		fatal("-graphite-interval must be positive")
+	}
+
+	if *urlListRefreshInterval <= 0 {
+		fatal("-url-list-refresh-interval must be positive")
+	}
+
+	sourceOpts := sourceOptions{
+		urls:                   urls,
+		urlLists:               urlLists,
+		urlListRefreshInterval: *urlListRefreshInterval,
+		configFile:             *configFile,
+	}
+	sources, err := loadSources(sourceOpts, defaults)
+	if err != nil {
+		fatal("Failed to start", "err", err)
+	}
+
+	slog.Info("Configured targets", "targets", len(sources.static), "discoverers", len(sources.discoverers), "groups", len(sources.groups))
+	if len(prefixes) > 0 {
+		slog.Info("Filtering metrics by prefix", "prefixes", []string(prefixes))
+	} else {
+		slog.Info("No prefixes specified, all metrics will be included")
+	}
+
+	opts := combiner.Options{
+		Filter:               filters,
+		Timeout:              *timeout,
+		TimeoutOffset:        *timeoutOffset,
+		BreakerThreshold:     *breakerThreshold,
+		BreakerCooldown:      *breakerCooldown,
+		DuplicatePolicy:      *duplicatePolicy,
+		SortSeries:           *sortSeries,
+		InjectTimestamps:     *injectTimestamps,
+		StripTimestamps:      *stripTimestamps,
+		OutputValidation:     *outputValidation,
+		SelfMetrics:          *selfMetrics,
+		FailedTargetsHeader:  *failedTargetsHeader,
+		BuildInfo:            buildInfoMetricFamily(),
+		ScrapeInterval:       *scrapeInterval,
+		ScrapeJitter:         *scrapeJitter,
+		CacheTTL:             *cacheTTL,
+		CoalesceRequests:     *coalesceRequests,
+		CacheStaleTTL:        *cacheStaleTTL,
+		ServeStaleMaxAge:     *serveStaleMaxAge,
+		StalenessPolicy:      *stalenessPolicy,
+		MinSuccess:           successThreshold,
+		MaxBodySize:          *maxBodySize,
+		MaxConcurrentFetches: *maxConcurrentFetches,
+		Transport:            combiner.NewTransport(transportOpts),
+		DNSRefreshInterval:   *dnsRefreshInterval,
+		IPFamily:             *upstreamIPFamily,
+		DefaultScheme:        *defaultScheme,
+		DefaultMetricsPath:   *defaultMetricsPath,
+		ForwardParams:        forwardParams,
+		URLPolicy:            urlPolicy,
+		Scales:               sources.scales,
+		Aggregations:         sources.aggregations,
+	}
+	if allowlist != nil && *selfMetrics {
+		opts.Transformers = append(opts.Transformers, allowlist)
+	}
+	// The combiner options are only checked here, by the same rules as when
+	// the package is used as a library
+	agg, err := combiner.New(nil, opts)
+	if err != nil {
+		fatal("Invalid options", "err", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	discovery := newDiscoveryManager(agg)
+	if err := discovery.apply(ctx, sources); err != nil {
+		fatal("Failed to start", "err", err)
+	}
+
+	// Groups get their own filters, scales and aggregations, so the filter
+	// flags are reset
+	groupOpts := opts
+	groupOpts.Filter = combiner.Filter{}
+	groupOpts.Scales = nil
+	groupOpts.Aggregations = nil
+	groups := newGroupManager(groupOpts)
+	if err := groups.apply(ctx, sources.groups); err != nil {
+		fatal("Failed to start", "err", err)
+	}
+
+	var auth webAuth
+	if *basicAuthUsersFile != "" {
+		if auth.users, err = loadBasicAuthUsers(*basicAuthUsersFile); err != nil {
+			fatal("Failed to start", "err", err)
+		}
+	}
+	if *authTokensFile != "" {
+		if auth.tokens, err = loadAuthTokens(*authTokensFile); err != nil {
+			fatal("Failed to start", "err", err)
+		}
+	}
+
+	if *enableAdminAPI && !auth.enabled() {
+		fatal("-web-enable-admin-api requires -basic-auth-users-file or -auth-tokens-file")
+	}
+	if *adminAPIPersist && (!*enableAdminAPI || *configFile == "") {
+		fatal("-web-admin-api-persist requires -web-enable-admin-api and -config-file")
+	}
+
+	limiter := newRateLimiter(*rateLimit, *rateLimitBurst, *clientRateLimit, *clientRateLimitBurst)
+	concurrency := newConcurrencyLimiter(*maxConcurrentRequests)
+
+	// Handler groups that can be served on each listener
+	routes := map[string]func(mux *http.ServeMux){
+		handlersMetrics: func(mux *http.ServeMux) {
+			mux.Handle(*telemetryPath, allowlist.wrap(limiter.wrap(concurrency.wrap(auth.wrap(agg)))))
+			mux.Handle(path.Join(*telemetryPath, "{group}"), allowlist.wrap(limiter.wrap(concurrency.wrap(auth.wrap(groups)))))
+			mux.Handle("GET /api/v1/targets", allowlist.wrap(auth.wrap(targetsAPIHandler(func() map[string][]combiner.TargetStatus {
+				pools := groups.targets()
+				pools[""] = agg.Targets()
+				return pools
+			}))))
+			if *telemetryPath != "/" {
+				// Link to the metrics and show the targets' status from the root,
+				// all other paths return 404
+				mux.Handle("/{$}", allowlist.wrap(auth.wrap(landingPageHandler(*telemetryPath, agg.Targets))))
 			}
+		},
+		// Health endpoints don't require authentication so they can be used for probes
+		handlersHealth: func(mux *http.ServeMux) {
+			mux.HandleFunc("/healthz", healthzHandler)
+			mux.Handle("/ready", readyHandler(agg.Targets, *readyMinUpstreams, *readyMaxAge))
+		},
+	}
+
+	if *enableLifecycle {
+		routes[handlersLifecycle] = func(mux *http.ServeMux) {
+			mux.Handle("/-/reload", auth.wrap(reloadHandler(func() error {
+				sources, err := loadSources(sourceOpts, defaults)
+				if err != nil {
+					return err
+				}
+				if err := discovery.apply(ctx, sources); err != nil {
+					return err
+				}
+				if err := groups.apply(ctx, sources.groups); err != nil {
+					return err
+				}
+				if !reflect.DeepEqual(sources.scales, opts.Scales) || !reflect.DeepEqual(sources.aggregations, opts.Aggregations) {
+					slog.Warn("The scales or aggregations in the config file have changed, restart to apply them")
+				}
+				slog.Info("Reloaded configuration", "targets", len(sources.static), "discoverers", len(sources.discoverers), "groups", len(sources.groups))
+				return nil
+			})))
 		}
 	}
 
-	// Return an error if all fetches failed, otherwise return partial results
-	if len(errors) == len(urls) {
-		http.Error(w, "Failed to fetch one or more upstream services.", http.StatusInternalServerError)
-		return
+	if *enableAdminAPI {
+		admin := &targetAdmin{discovery: discovery, defaults: defaults}
+		if *adminAPIPersist {
+			admin.configFile = *configFile
+		}
+		routes[handlersAdmin] = func(mux *http.ServeMux) {
+			mux.Handle("POST /api/v1/targets", allowlist.wrap(auth.wrap(http.HandlerFunc(admin.add))))
+			mux.Handle("DELETE /api/v1/targets", allowlist.wrap(auth.wrap(http.HandlerFunc(admin.remove))))
+		}
 	}
 
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	fmt.Fprint(w, concatenatedBody.String())
-}
+	if *enablePprof {
+		routes[handlersPprof] = func(mux *http.ServeMux) {
+			registerPprof(mux, auth)
+		}
+	}
 
-func main() {
-	port := flag.Int("port", 8080, "Port for the HTTP server to listen on")
-	verbose := flag.Bool("verbose", false, "Enable verbose logging")
+	var tlsCfg *tls.Config
+	if *tlsCertFile != "" || *tlsKeyFile != "" || *tlsClientCAFile != "" {
+		if tlsCfg, err = newServerTLSConfig(*tlsCertFile, *tlsKeyFile, *tlsClientCAFile); err != nil {
+			fatal("Failed to start", "err", err)
+		}
+	}
 
-	// Custom flags to allow multiple URLs and prefixes
+	if *systemdSocket {
+		inherited, err := systemdListeners()
+		if err != nil {
+			fatal("Failed to start", "err", err)
+		}
+		for name := range inherited {
+			listens = append(listens, "systemd:"+name)
+		}
+	}
+	if len(listens) == 0 {
+		if *listenSocket != "" {
+			listens = append(listens, "unix:"+*listenSocket)
+		} else {
+			listens = append(listens, fmt.Sprintf(":%d", *port))
+		}
+	}
 
-	var urls stringList
-	flag.Var(&urls, "url", "URL to fetch from (can be specified multiple times)")
+	if *otlpEndpoint != "" {
+		shutdownTracing, err := setupTracing(ctx, *otlpEndpoint)
+		if err != nil {
+			fatal("Failed to start", "err", err)
+		}
+		defer func() {
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdownTracing(flushCtx); err != nil {
+				slog.Warn("Failed to flush traces", "err", err)
+			}
+		}()
+		slog.Info("Exporting traces", "endpoint", *otlpEndpoint)
+	}
 
-	var prefixes stringList
-	flag.Var(&prefixes, "prefix", "Prefix for lines to include in the output (can be specified multiple times). If no prefixes are given, all lines are included.")
+	if *scrapeInterval > 0 {
+		slog.Info("Scraping upstreams in the background", "interval", *scrapeInterval)
+		go agg.Run(ctx)
+	}
 
-	flag.Parse()
+	if *remoteWriteURL != "" {
+		writer, err := combiner.NewRemoteWriter(combiner.Target{URL: *remoteWriteURL, BearerTokenFile: *remoteWriteBearerTokenFile}, opts.Transport)
+		if err != nil {
+			fatal("Failed to start", "err", err)
+		}
+		slog.Info("Pushing metrics with remote write", "url", *remoteWriteURL, "interval", *remoteWriteInterval)
+		go agg.RunPusher(ctx, "remote_write", *remoteWriteInterval, writer)
+	}
 
-	if len(urls) == 0 {
-		log.Fatal("Error: At least one upstream URL must be specified with the -url flag.")
+	if *pushgatewayURL != "" {
+		pusher, err := combiner.NewPushgatewayPusher(combiner.Target{URL: *pushgatewayURL, BearerTokenFile: *pushgatewayBearerTokenFile}, *pushgatewayJob, *pushgatewayInstance, opts.Transport)
+		if err != nil {
+			fatal("Failed to start", "err", err)
+		}
+		slog.Info("Pushing metrics to Pushgateway", "url", *pushgatewayURL, "job", *pushgatewayJob, "instance", *pushgatewayInstance, "interval", *pushgatewayInterval)
+		go agg.RunPusher(ctx, "pushgateway", *pushgatewayInterval, pusher)
 	}
 
-	log.Printf("Configured to fetch from URLs: %v", urls)
-	if len(prefixes) > 0 {
-		log.Printf("Configured to filter metrics by prefixes: %v", prefixes)
-	} else {
-		log.Println("No prefixes specified, all metrics will be included.")
+	if *graphiteAddress != "" {
+		slog.Info("Sending metrics to Graphite", "address", *graphiteAddress, "interval", *graphiteInterval)
+		go agg.RunPusher(ctx, "graphite", *graphiteInterval, combiner.NewGraphitePusher(*graphiteAddress, *graphitePrefix, *graphiteTags))
 	}
 
-	// Register the handler function for root path
-	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
-		aggregatorHandler(w, r, urls, prefixes, verbose)
-	})
+	var listeners []net.Listener
+	var handlers []http.Handler
+	for _, value := range listens {
+		lc, err := parseListen(value)
+		if err != nil {
+			fatal("Failed to start", "err", err)
+		}
+		if lc.network == "tcp" {
+			lc.network = listenNetwork
+		}
+		var handler http.Handler
+		handler, err = lc.newMux(routes)
+		if err != nil {
+			fatal("Failed to start", "err", err)
+		}
+		if *enableAccessLog {
+			handler = accessLog(handler)
+		}
+		ls, err := lc.listen()
+		if err != nil {
+			fatal("Server failed to start", "err", err)
+		}
+		for _, l := range ls {
+			if proxy != nil {
+				l = proxy.wrap(l)
+			}
+			slog.Info("Listening", "address", l.Addr().String(), "handlers", lc.describe())
+			listeners = append(listeners, l)
+			handlers = append(handlers, handler)
+		}
+	}
 
-	addr := fmt.Sprintf(":%d", *port)
-	log.Printf("Starting server on %s", addr)
+	// Refreshes are shared between requests, so they're cancelled separately
+	cancelFetches := func() {
+		agg.Close()
+		groups.close()
+	}
+	errCh := make(chan error, len(listeners))
+	for i, listener := range listeners {
+		server := &http.Server{Handler: handlers[i], TLSConfig: tlsCfg}
+		serve := func() error { return server.Serve(listener) }
+		if tlsCfg != nil {
+			serve = func() error { return server.ServeTLS(listener, "", "") }
+		}
+		go func() {
+			errCh <- runServer(ctx, server, serve, *shutdownTimeout, cancelFetches)
+		}()
+	}
+	if tlsCfg != nil {
+		slog.Info("Serving HTTPS")
+	}
 
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+	for range listeners {
+		if err := <-errCh; err != nil {
+			fatal("Server failed", "err", err)
+		}
 	}
+	slog.Info("Server stopped")
 }
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout is how long a client has to send the PROXY protocol
+// header after connecting.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature starts a PROXY protocol version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocol reads the HAProxy PROXY protocol header sent by a load
+// balancer at the start of each connection, so the connection's remote address
+// is the original client rather than the load balancer.
+type proxyProtocol struct {
+	// trusted are the networks of the load balancers, connections from
+	// other addresses are used as they are. If empty every connection must
+	// start with a header.
+	trusted []netip.Prefix
+}
+
+// newProxyProtocol reads PROXY protocol headers from connections from the
+// networks in trustedCIDRs, or from all connections if there are none.
+func newProxyProtocol(trustedCIDRs []string) (*proxyProtocol, error) {
+	p := &proxyProtocol{}
+	for _, s := range trustedCIDRs {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PROXY protocol trusted network: %w", err)
+		}
+		p.trusted = append(p.trusted, prefix.Masked())
+	}
+	return p, nil
+}
+
+// wrap returns a listener that reads the headers of l's connections.
+func (p *proxyProtocol) wrap(l net.Listener) net.Listener {
+	return &proxyListener{Listener: l, protocol: p}
+}
+
+// trusts reports whether connections from addr must send a header.
+func (p *proxyProtocol) trusts(addr net.Addr) bool {
+	if len(p.trusted) == 0 {
+		return true
+	}
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := addrPort.Addr().Unmap()
+	for _, n := range p.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyListener is a listener whose connections start with a PROXY protocol
+// header.
+type proxyListener struct {
+	net.Listener
+	protocol *proxyProtocol
+}
+
+// Accept implements net.Listener. The header is read when the connection is
+// first used, so a slow client doesn't hold up accepting other connections.
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.protocol.trusts(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn is a connection starting with a PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+// readHeader reads the header once, setting the remote address to the
+// client's if the header has one. The connection is closed if the header is
+// invalid, since the rest of it can't be trusted.
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			slog.Warn("Invalid PROXY protocol header", "client", c.Conn.RemoteAddr().String(), "err", c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+// Read implements net.Conn, returning the data after the header.
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr implements net.Conn, returning the client's address from the
+// header if it has one.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a version 1 or 2 PROXY protocol header, returning the
+// source address. It returns nil if the header doesn't have an address, for
+// example for health checks from the load balancer itself.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	if bytes.Equal(start, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readProxyHeaderV1(r)
+	}
+	return nil, errors.New("connection doesn't start with a PROXY protocol header")
+}
+
+// readProxyHeaderV1 reads a version 1 header, a line such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443".
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	// The longest header is 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	text, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, errors.New("header line is too long or doesn't end with CRLF")
+	}
+
+	fields := strings.Split(text, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid version 1 header %q", text)
+	}
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil || addr.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port %q", fields[4])
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(port))), nil
+}
+
+// readProxyHeaderV2 reads a binary version 2 header.
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	versionCommand, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("failed to read header addresses: %w", err)
+	}
+
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", versionCommand>>4)
+	}
+	switch command := versionCommand & 0xf; command {
+	case 0:
+		// LOCAL connections are from the load balancer itself
+		return nil, nil
+	case 1:
+		// PROXY connections are relayed for a client
+	default:
+		return nil, fmt.Errorf("unsupported command %d", command)
+	}
+
+	var size int
+	switch family {
+	case 0x11:
+		// TCP over IPv4
+		size = 4
+	case 0x21:
+		// TCP over IPv6
+		size = 16
+	default:
+		// Other protocols don't have an IP source address
+		return nil, nil
+	}
+	if len(payload) < 2*size+4 {
+		return nil, errors.New("header addresses are too short")
+	}
+	addr, _ := netip.AddrFromSlice(payload[:size])
+	port := binary.BigEndian.Uint16(payload[2*size:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, port)), nil
+}
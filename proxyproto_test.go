@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestReadProxyHeader tests the source address is read from version 1 and 2
+// headers.
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(command, family byte, addresses ...byte) string {
+		return string(proxyV2Signature) + string([]byte{0x20 | command, family, 0, byte(len(addresses))}) + string(addresses)
+	}
+
+	testCases := []struct {
+		name          string
+		header        string
+		expected      string
+		expectedError string
+	}{
+		{name: "Version 1 IPv4", header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", expected: "192.0.2.1:56324"},
+		{name: "Version 1 IPv6", header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", expected: "[2001:db8::1]:56324"},
+		{name: "Version 1 unknown", header: "PROXY UNKNOWN\r\n"},
+		{name: "Version 1 wrong family", header: "PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n", expectedError: "invalid source address"},
+		{name: "Version 1 invalid port", header: "PROXY TCP4 192.0.2.1 198.51.100.1 70000 443\r\n", expectedError: "invalid source port"},
+		{name: "Version 1 without CRLF", header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n", expectedError: "CRLF"},
+		{name: "Version 2 IPv4", header: v2(1, 0x11, 192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb), expected: "192.0.2.1:56324"},
+		{name: "Version 2 IPv6", header: v2(1, 0x21, append(append([]byte{0x20, 0x01, 0x0d, 0xb8, 12: 0, 15: 1}, make([]byte, 16)...), 0xdc, 0x04, 0x01, 0xbb)...), expected: "[2001:db8::1]:56324"},
+		{name: "Version 2 local", header: v2(0, 0x00)},
+		{name: "Version 2 too short", header: v2(1, 0x11, 192, 0, 2, 1), expectedError: "too short"},
+		{name: "No header", header: "GET / HTTP/1.1\r\n\r\n", expectedError: "doesn't start with a PROXY protocol header"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, err := readProxyHeader(bufio.NewReader(strings.NewReader(tc.header + "GET")))
+			if tc.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+					t.Fatalf("expected error containing '%s', got: %v", tc.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readProxyHeader failed: %v", err)
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tc.expected {
+				t.Errorf("got address %q, want %q", got, tc.expected)
+			}
+		})
+	}
+}
+
+// TestProxyListener tests requests see the client address from the header,
+// and only connections from trusted networks must send one.
+func TestProxyListener(t *testing.T) {
+	testCases := []struct {
+		name     string
+		trusted  []string
+		header   string
+		expected string
+	}{
+		{name: "Header", header: "PROXY TCP4 192.0.2.1 127.0.0.1 56324 80\r\n", expected: "192.0.2.1:56324"},
+		{name: "Trusted", trusted: []string{"127.0.0.0/8"}, header: "PROXY TCP4 192.0.2.1 127.0.0.1 56324 80\r\n", expected: "192.0.2.1:56324"},
+		{name: "Untrusted", trusted: []string{"192.0.2.0/24"}, expected: "127.0.0.1:"},
+		{name: "Missing header", expected: "connection closed"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			proxy, err := newProxyProtocol(tc.trusted)
+			if err != nil {
+				t.Fatalf("newProxyProtocol failed: %v", err)
+			}
+			l, err := net.Listen("tcp4", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("listen failed: %v", err)
+			}
+			server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, r.RemoteAddr)
+			})}
+			go server.Serve(proxy.wrap(l))
+			defer server.Close()
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatalf("dial failed: %v", err)
+			}
+			defer conn.Close()
+			fmt.Fprint(conn, tc.header+"GET / HTTP/1.1\r\nHost: combiner\r\nConnection: close\r\n\r\n")
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			got := "connection closed"
+			if err == nil {
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				got = string(body)
+			}
+			if !strings.HasPrefix(got, tc.expected) {
+				t.Errorf("got %q, want %q", got, tc.expected)
+			}
+		})
+	}
+
+	if _, err := newProxyProtocol([]string{"192.0.2.0"}); err == nil {
+		t.Error("expected an error for an invalid trusted network")
+	}
+}
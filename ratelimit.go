@@ -0,0 +1,158 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitSweepInterval is how often idle per-client limiters are removed.
+const rateLimitSweepInterval = time.Minute
+
+// rateLimiter limits the rate of incoming requests with token buckets, one
+// shared by all requests and one for each client address. A nil rateLimiter
+// allows all requests.
+type rateLimiter struct {
+	// global is nil if there is no overall limit.
+	global      *rate.Limiter
+	clientRate  rate.Limit
+	clientBurst int
+	// now returns the current time, it can be overridden in tests.
+	now func() time.Time
+
+	mu        sync.Mutex
+	clients   map[string]*rate.Limiter
+	lastSweep time.Time
+}
+
+// newRateLimiter creates a rate limiter allowing globalRate requests per
+// second overall and clientRate per client, with bursts of up to the given
+// sizes. A rate of 0 disables that limit, and if both are 0 nil is returned.
+func newRateLimiter(globalRate float64, globalBurst int, clientRate float64, clientBurst int) *rateLimiter {
+	if globalRate <= 0 && clientRate <= 0 {
+		return nil
+	}
+	l := &rateLimiter{
+		clientRate:  rate.Limit(clientRate),
+		clientBurst: max(clientBurst, 1),
+		now:         time.Now,
+		clients:     make(map[string]*rate.Limiter),
+	}
+	if globalRate > 0 {
+		l.global = rate.NewLimiter(rate.Limit(globalRate), max(globalBurst, 1))
+	}
+	return l
+}
+
+// reserve checks whether a request from client is allowed. If not it returns
+// how long the client should wait before retrying.
+func (l *rateLimiter) reserve(client string) (bool, time.Duration) {
+	now := l.now()
+
+	if l.clientRate > 0 {
+		cl := l.clientLimiter(client, now)
+		if !cl.AllowN(now, 1) {
+			return false, retryAfter(cl, now)
+		}
+	}
+	if l.global != nil && !l.global.AllowN(now, 1) {
+		return false, retryAfter(l.global, now)
+	}
+	return true, 0
+}
+
+// clientLimiter returns the limiter for client, creating it if necessary.
+// Limiters whose buckets have refilled are periodically removed, since
+// they're the same as a new limiter.
+func (l *rateLimiter) clientLimiter(client string, now time.Time) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		for c, cl := range l.clients {
+			if cl.TokensAt(now) >= float64(l.clientBurst) {
+				delete(l.clients, c)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	cl, ok := l.clients[client]
+	if !ok {
+		cl = rate.NewLimiter(l.clientRate, l.clientBurst)
+		l.clients[client] = cl
+	}
+	return cl
+}
+
+// retryAfter returns how long until the limiter has a token available.
+func retryAfter(limiter *rate.Limiter, now time.Time) time.Duration {
+	missing := 1 - limiter.TokensAt(now)
+	return time.Duration(missing / float64(limiter.Limit()) * float64(time.Second))
+}
+
+// clientAddress returns the address used to identify the client of a request,
+// its IP address without the port.
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// wrap returns a handler that rejects requests over the rate limit with 429
+// Too Many Requests.
+func (l *rateLimiter) wrap(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := l.reserve(clientAddress(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+			http.Error(w, "Too many requests.", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// concurrencyLimiter limits the number of requests being served at the same
+// time. A nil concurrencyLimiter allows any number of requests.
+type concurrencyLimiter struct {
+	// slots holds a value for each request being served.
+	slots chan struct{}
+}
+
+// newConcurrencyLimiter creates a limiter allowing up to limit requests at
+// the same time, or returns nil if limit is 0.
+func newConcurrencyLimiter(limit int) *concurrencyLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &concurrencyLimiter{slots: make(chan struct{}, limit)}
+}
+
+// wrap returns a handler that rejects requests beyond the limit with 503
+// Service Unavailable, rather than queueing them while they add to the load.
+func (l *concurrencyLimiter) wrap(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case l.slots <- struct{}{}:
+			defer func() { <-l.slots }()
+		default:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many concurrent requests.", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
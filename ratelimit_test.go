@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestRateLimiter tests the global and per-client request limits.
+func TestRateLimiter(t *testing.T) {
+	testCases := []struct {
+		name        string
+		globalRate  float64
+		globalBurst int
+		clientRate  float64
+		clientBurst int
+		// requests are the clients making requests at the same time.
+		requests []string
+		expected []bool
+	}{
+		{
+			name:        "Global limit",
+			globalRate:  1,
+			globalBurst: 2,
+			requests:    []string{"a", "b", "c"},
+			expected:    []bool{true, true, false},
+		},
+		{
+			name:        "Client limit",
+			clientRate:  1,
+			clientBurst: 1,
+			requests:    []string{"a", "a", "b"},
+			expected:    []bool{true, false, true},
+		},
+		{
+			name:        "Both limits",
+			globalRate:  1,
+			globalBurst: 2,
+			clientRate:  1,
+			clientBurst: 1,
+			requests:    []string{"a", "b", "c"},
+			expected:    []bool{true, true, false},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := newRateLimiter(tc.globalRate, tc.globalBurst, tc.clientRate, tc.clientBurst)
+			now := time.Unix(1000, 0)
+			l.now = func() time.Time { return now }
+
+			for i, client := range tc.requests {
+				if ok, _ := l.reserve(client); ok != tc.expected[i] {
+					t.Errorf("request %d from %s: expected allowed %v, got %v", i, client, tc.expected[i], ok)
+				}
+			}
+
+			// The buckets refill after a few seconds
+			now = now.Add(5 * time.Second)
+			if ok, _ := l.reserve(tc.requests[0]); !ok {
+				t.Error("request was not allowed after the limit refilled")
+			}
+		})
+	}
+}
+
+// TestRateLimiterDisabled tests that no limiter is created without a rate.
+func TestRateLimiterDisabled(t *testing.T) {
+	if l := newRateLimiter(0, 10, 0, 5); l != nil {
+		t.Error("expected a nil rate limiter")
+	}
+}
+
+// TestRateLimiterSweep tests that idle client limiters are removed.
+func TestRateLimiterSweep(t *testing.T) {
+	l := newRateLimiter(0, 0, 1, 1)
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+
+	l.reserve("a")
+	now = now.Add(rateLimitSweepInterval)
+	l.reserve("b")
+
+	if _, ok := l.clients["a"]; ok {
+		t.Error("idle client limiter was not removed")
+	}
+	if _, ok := l.clients["b"]; !ok {
+		t.Error("active client limiter was removed")
+	}
+}
+
+// TestRateLimiterHandler tests rejecting requests over the limit.
+func TestRateLimiterHandler(t *testing.T) {
+	l := newRateLimiter(0, 0, 0.5, 1)
+	handler := l.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for i, expected := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != expected {
+			t.Errorf("request %d: expected status %d, got %d", i, expected, rr.Code)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.RemoteAddr = "192.0.2.1:5678"
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected a different port from the same address to be limited, got status %d", rr.Code)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("expected Retry-After 2, got %q", got)
+	}
+}
+
+// TestConcurrencyLimiter tests requests beyond the limit are rejected while
+// others are being served.
+func TestConcurrencyLimiter(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := newConcurrencyLimiter(1).wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+
+	done := make(chan int)
+	go func() {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+		done <- rr.Code
+	}()
+	<-started
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d while the limit is reached, got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("expected a Retry-After header")
+	}
+
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("expected status %d for the first request, got %d", http.StatusOK, code)
+	}
+
+	// The slot is free once the first request finishes
+	go func() { <-started }()
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status %d after the first request finished, got %d", http.StatusOK, rr.Code)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/manics/prometheus-metrics-combiner/combiner"
+)
+
+// Handler groups that can be served on a listener.
+const (
+	handlersMetrics   = "metrics"
+	handlersHealth    = "health"
+	handlersLifecycle = "lifecycle"
+	handlersPprof     = "pprof"
+	handlersAdmin     = "admin"
+)
+
+// knownHandlerGroups lists all handler groups.
+var knownHandlerGroups = []string{handlersMetrics, handlersHealth, handlersLifecycle, handlersPprof, handlersAdmin}
+
+// listenNetworks maps each -listen-ip-family to the network TCP addresses are
+// listened on. Listening on "tcp" accepts IPv4 and IPv6 connections on the
+// wildcard address, while "tcp6" only accepts IPv6 connections.
+var listenNetworks = map[string]string{
+	combiner.IPFamilyDual: "tcp",
+	combiner.IPFamilyIPv4: "tcp4",
+	combiner.IPFamilyIPv6: "tcp6",
+}
+
+// listenConfig is an address to listen on and the handler groups served on it.
+type listenConfig struct {
+	// network is "tcp", "tcp4", "tcp6", "unix", or "systemd" for sockets
+	// passed by systemd socket activation, in which case address is the
+	// FileDescriptorName.
+	network string
+	address string
+	// handlers are the handler groups to serve, empty means all enabled groups.
+	handlers []string
+}
+
+// parseListen parses a -listen value of the form [unix:|systemd:]ADDRESS[=GROUP,...].
+func parseListen(value string) (listenConfig, error) {
+	lc := listenConfig{network: "tcp"}
+
+	address, groups, hasGroups := strings.Cut(value, "=")
+	for _, network := range []string{"unix", "systemd"} {
+		if rest, ok := strings.CutPrefix(address, network+":"); ok {
+			lc.network = network
+			address = rest
+		}
+	}
+	if address == "" {
+		return lc, fmt.Errorf("invalid listen address %q: missing address", value)
+	}
+	lc.address = address
+
+	if hasGroups {
+		for _, g := range strings.Split(groups, ",") {
+			if !slices.Contains(knownHandlerGroups, g) {
+				return lc, fmt.Errorf("invalid listen address %q: unknown handler group %q, must be one of %s", value, g, strings.Join(knownHandlerGroups, ", "))
+			}
+			lc.handlers = append(lc.handlers, g)
+		}
+	}
+	return lc, nil
+}
+
+// listen opens the listeners. There may be more than one if systemd passed
+// multiple sockets with the same name.
+func (lc listenConfig) listen() ([]net.Listener, error) {
+	switch lc.network {
+	case "systemd":
+		inherited, err := systemdListeners()
+		if err != nil {
+			return nil, err
+		}
+		listeners, ok := inherited[lc.address]
+		if !ok {
+			return nil, fmt.Errorf("no socket named %s passed by systemd", lc.address)
+		}
+		return listeners, nil
+	case "unix":
+		l, err := listenUnix(lc.address)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	default:
+		l, err := net.Listen(lc.network, lc.address)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+}
+
+// newMux creates a mux serving the listener's handler groups. routes maps
+// each enabled handler group to a function that registers its handlers. A
+// dedicated mux is used since importing net/http/pprof registers its handlers
+// on http.DefaultServeMux.
+func (lc listenConfig) newMux(routes map[string]func(*http.ServeMux)) (*http.ServeMux, error) {
+	mux := http.NewServeMux()
+	if len(lc.handlers) == 0 {
+		for _, g := range knownHandlerGroups {
+			if register, ok := routes[g]; ok {
+				register(mux)
+			}
+		}
+		return mux, nil
+	}
+
+	for _, g := range lc.handlers {
+		register, ok := routes[g]
+		if !ok {
+			return nil, fmt.Errorf("handler group %s requested on %s is not enabled", g, lc.address)
+		}
+		register(mux)
+	}
+	return mux, nil
+}
+
+// describe returns the handler groups served for logging.
+func (lc listenConfig) describe() string {
+	if len(lc.handlers) == 0 {
+		return "all handlers"
+	}
+	return strings.Join(lc.handlers, ", ")
+}
+
+// certificateRefreshInterval is how often the serving certificate is re-read.
+const certificateRefreshInterval = time.Minute
+
+// certificateReloader loads a certificate and key from disk, re-reading them
+// every certificateRefreshInterval so rotated certificates are picked up without a
+// restart.
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	loadedAt time.Time
+}
+
+// get returns the current certificate. If reloading fails the previously
+// loaded certificate continues to be used.
+func (c *certificateReloader) get() (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cert != nil && time.Since(c.loadedAt) < certificateRefreshInterval {
+		return c.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			slog.Error("Failed to reload TLS certificate, continuing with the previous one", "err", err)
+			c.loadedAt = time.Now()
+			return c.cert, nil
+		}
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	c.cert = &cert
+	c.loadedAt = time.Now()
+	return c.cert, nil
+}
+
+// newServerTLSConfig creates the TLS configuration for serving the combined
+// endpoint over HTTPS. If clientCAFile is set clients must present a
+// certificate signed by one of its CAs.
+func newServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("-tls-cert-file and -tls-key-file must be set together")
+	}
+
+	reloader := &certificateReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := reloader.get(); err != nil {
+		return nil, err
+	}
+
+	tlsCfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return reloader.get()
+		},
+	}
+
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("invalid client CA: no certificates found in %s", clientCAFile)
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsCfg, nil
+}
+
+// runServer runs serve, which should start server listening, until ctx is
+// cancelled. It then stops accepting new connections and waits up to
+// drainTimeout for in-flight requests to complete. If they haven't finished
+// by then their outstanding upstream fetches, including those shared between
+// requests which are cancelled by calling cancelFetches, are cancelled and the
+// server is closed.
+func runServer(ctx context.Context, server *http.Server, serve func() error, drainTimeout time.Duration, cancelFetches func()) error {
+	// Requests inherit this context so outstanding fetches can be cancelled
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	server.BaseContext = func(net.Listener) context.Context { return baseCtx }
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- serve()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down, waiting for in-flight requests", "timeout", drainTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("In-flight requests did not complete in time, cancelling upstream fetches", "err", err)
+		cancelRequests()
+		cancelFetches()
+		server.Close()
+	}
+
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// listenUnix listens on a Unix domain socket at path. A stale socket left
+// behind by a previous process is removed first, but any other kind of file is
+// left alone. The socket is removed again when the listener is closed.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != os.ModeSocket {
+			return nil, fmt.Errorf("cannot listen on %s: file exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+		}
+	}
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and key generated for tests.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert generates a certificate signed by parent, or a self-signed CA if parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// writePEM writes the certificate and key to PEM files and returns their paths.
+func (c *testCert) writePEM(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	certFile = writeFile(t, "cert.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})))
+	keyFile = writeFile(t, "key.pem", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+	return certFile, keyFile
+}
+
+// TestNewServerTLSConfig tests serving over HTTPS with a certificate loaded from disk.
+func TestNewServerTLSConfig(t *testing.T) {
+	ca := newTestCert(t, "test-ca", nil)
+	certFile, keyFile := newTestCert(t, "combiner", ca).writePEM(t)
+
+	tlsCfg, err := newServerTLSConfig(certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("newServerTLSConfig failed: %v", err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	server.TLS = tlsCfg
+	server.StartTLS()
+	defer server.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "combiner"}}}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("HTTPS request failed: %v", err)
+	}
+	resp.Body.Close()
+	if got := resp.TLS.PeerCertificates[0].Subject.CommonName; got != "combiner" {
+		t.Errorf("server presented wrong certificate: got %s", got)
+	}
+
+	if _, err := newServerTLSConfig(certFile, "", ""); err == nil {
+		t.Error("expected an error when the key file is missing")
+	}
+}
+
+// TestNewServerTLSConfigClientCA tests that clients must present a certificate signed by the client CA.
+func TestNewServerTLSConfigClientCA(t *testing.T) {
+	ca := newTestCert(t, "test-ca", nil)
+	certFile, keyFile := newTestCert(t, "combiner", ca).writePEM(t)
+	clientCAFile, _ := ca.writePEM(t)
+
+	tlsCfg, err := newServerTLSConfig(certFile, keyFile, clientCAFile)
+	if err != nil {
+		t.Fatalf("newServerTLSConfig failed: %v", err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	server.TLS = tlsCfg
+	server.StartTLS()
+	defer server.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	clientCert := newTestCert(t, "prometheus", ca)
+	untrustedCert := newTestCert(t, "prometheus", newTestCert(t, "other-ca", nil))
+
+	testCases := []struct {
+		name        string
+		cert        *testCert
+		expectError bool
+	}{
+		{"No client certificate", nil, true},
+		{"Untrusted client certificate", untrustedCert, true},
+		{"Trusted client certificate", clientCert, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clientTLS := &tls.Config{RootCAs: pool, ServerName: "combiner"}
+			if tc.cert != nil {
+				clientTLS.Certificates = []tls.Certificate{{Certificate: [][]byte{tc.cert.der}, PrivateKey: tc.cert.key}}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+
+			resp, err := client.Get(server.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if tc.expectError && err == nil {
+				t.Error("expected the server to reject the client")
+			}
+			if !tc.expectError && err != nil {
+				t.Errorf("expected no error, but got: %v", err)
+			}
+		})
+	}
+}
+
+// TestRunServerGracefulShutdown tests that in-flight requests are drained and then cancelled on shutdown.
+func TestRunServerGracefulShutdown(t *testing.T) {
+	testCases := []struct {
+		name              string
+		handlerDuration   time.Duration
+		drainTimeout      time.Duration
+		expectedCancelled bool
+	}{
+		{"Request completes within the drain timeout", 100 * time.Millisecond, 5 * time.Second, false},
+		{"Request cancelled after the drain timeout", time.Minute, 200 * time.Millisecond, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			started := make(chan struct{})
+			cancelled := make(chan bool, 1)
+			server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				select {
+				case <-time.After(tc.handlerDuration):
+					cancelled <- false
+				case <-r.Context().Done():
+					cancelled <- true
+				}
+			})}
+
+			var fetchesCancelled atomic.Bool
+			ctx, stop := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() {
+				done <- runServer(ctx, server, func() error { return server.Serve(listener) }, tc.drainTimeout, func() { fetchesCancelled.Store(true) })
+			}()
+
+			go http.Get("http://" + listener.Addr().String())
+			<-started
+			stop()
+
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Errorf("runServer returned an error: %v", err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("runServer did not return after shutdown")
+			}
+
+			if got := <-cancelled; got != tc.expectedCancelled {
+				t.Errorf("request cancelled = %v, want %v", got, tc.expectedCancelled)
+			}
+			if got := fetchesCancelled.Load(); got != tc.expectedCancelled {
+				t.Errorf("shared fetches cancelled = %v, want %v", got, tc.expectedCancelled)
+			}
+		})
+	}
+}
+
+// TestListenUnix tests serving over a Unix domain socket, replacing a stale socket.
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "combiner.sock")
+
+	// Leave a stale socket behind as if a previous process crashed
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenUnix(path)
+	if err != nil {
+		t.Fatalf("listenUnix failed: %v", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://combiner/metrics")
+	if err != nil {
+		t.Fatalf("request over the socket failed: %v", err)
+	}
+	resp.Body.Close()
+
+	regular := filepath.Join(t.TempDir(), "regular")
+	if err := os.WriteFile(regular, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnix(regular); err == nil {
+		t.Error("expected an error when the path is a regular file")
+	}
+}
+
+// TestParseListen tests parsing of -listen values.
+func TestParseListen(t *testing.T) {
+	testCases := []struct {
+		value         string
+		expected      listenConfig
+		expectedError string
+	}{
+		{":8080", listenConfig{network: "tcp", address: ":8080"}, ""},
+		{"localhost:9090=health,pprof", listenConfig{network: "tcp", address: "localhost:9090", handlers: []string{"health", "pprof"}}, ""},
+		{"unix:/run/combiner.sock=metrics", listenConfig{network: "unix", address: "/run/combiner.sock", handlers: []string{"metrics"}}, ""},
+		{"systemd:admin=health", listenConfig{network: "systemd", address: "admin", handlers: []string{"health"}}, ""},
+		{"=metrics", listenConfig{}, "missing address"},
+		{":8080=metrics,unknown", listenConfig{}, "unknown handler group"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			lc, err := parseListen(tc.value)
+			if tc.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+					t.Fatalf("expected error containing '%s', got: %v", tc.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseListen failed: %v", err)
+			}
+			if !reflect.DeepEqual(lc, tc.expected) {
+				t.Errorf("parseListen returned %+v, want %+v", lc, tc.expected)
+			}
+		})
+	}
+}
+
+// TestListenConfigNewMux tests that only the requested handler groups are served.
+func TestListenConfigNewMux(t *testing.T) {
+	routes := map[string]func(*http.ServeMux){
+		handlersMetrics: func(mux *http.ServeMux) {
+			mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {})
+		},
+		handlersHealth: func(mux *http.ServeMux) {
+			mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {})
+		},
+	}
+
+	testCases := []struct {
+		name          string
+		handlers      []string
+		expectedPaths map[string]int
+	}{
+		{"All enabled groups", nil, map[string]int{"/metrics": http.StatusOK, "/healthz": http.StatusOK}},
+		{"Health only", []string{handlersHealth}, map[string]int{"/metrics": http.StatusNotFound, "/healthz": http.StatusOK}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mux, err := listenConfig{address: ":0", handlers: tc.handlers}.newMux(routes)
+			if err != nil {
+				t.Fatalf("newMux failed: %v", err)
+			}
+			for path, expected := range tc.expectedPaths {
+				rr := httptest.NewRecorder()
+				mux.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+				if rr.Code != expected {
+					t.Errorf("%s returned wrong status code: got %v want %v", path, rr.Code, expected)
+				}
+			}
+		})
+	}
+
+	if _, err := (listenConfig{address: ":0", handlers: []string{handlersPprof}}).newMux(routes); err == nil {
+		t.Error("expected an error for a handler group that isn't enabled")
+	}
+}
+
+// TestListenIPFamily tests TCP addresses are listened on with the network of
+// the IP family.
+func TestListenIPFamily(t *testing.T) {
+	lc, err := parseListen(":0")
+	if err != nil {
+		t.Fatalf("parseListen failed: %v", err)
+	}
+	lc.network = listenNetworks["ipv4"]
+	ls, err := lc.listen()
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer ls[0].Close()
+	addr := ls[0].Addr().(*net.TCPAddr)
+	if addr.IP.To4() == nil {
+		t.Errorf("expected an IPv4 address, got %s", addr)
+	}
+
+	lc.address = "[::1]:0"
+	if ls, err := lc.listen(); err == nil {
+		ls[0].Close()
+		t.Error("expected listening on an IPv6 address with the ipv4 family to fail")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// systemdFirstFD is the first file descriptor passed by systemd socket activation.
+const systemdFirstFD = 3
+
+// systemdListeners returns the listeners passed by systemd socket activation,
+// keyed by their FileDescriptorName. They are only read from the environment
+// once, and the environment variables are then unset so they aren't inherited
+// by child processes.
+var systemdListeners = sync.OnceValues(func() (map[string][]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	return listenersFromEnv(os.Getenv, os.Getpid(), systemdFirstFD)
+})
+
+// listenersFromEnv converts the file descriptors described by the
+// LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES environment variables into
+// listeners. Descriptors without a name are given the name "unknown", the
+// same as systemd does.
+func listenersFromEnv(getenv func(string) string, pid, firstFD int) (map[string][]net.Listener, error) {
+	if getenv("LISTEN_PID") != strconv.Itoa(pid) {
+		return nil, fmt.Errorf("no sockets passed by systemd, LISTEN_PID is not set to this process")
+	}
+	count, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("no sockets passed by systemd, invalid LISTEN_FDS %q", getenv("LISTEN_FDS"))
+	}
+
+	var names []string
+	if v := getenv("LISTEN_FDNAMES"); v != "" {
+		names = strings.Split(v, ":")
+	}
+
+	listeners := make(map[string][]net.Listener)
+	for i := range count {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(firstFD+i), name)
+		l, err := net.FileListener(f)
+		// FileListener duplicates the descriptor so the original can be closed
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d (%s) passed by systemd is not a listener: %w", firstFD+i, name, err)
+		}
+		listeners[name] = append(listeners[name], l)
+	}
+	return listeners, nil
+}
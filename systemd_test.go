@@ -0,0 +1,65 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// TestListenersFromEnv tests converting sockets passed by systemd into listeners.
+func TestListenersFromEnv(t *testing.T) {
+	original, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer original.Close()
+
+	// Duplicate the socket to get a descriptor as if it had been passed by
+	// systemd, listenersFromEnv takes ownership of it
+	f, err := original.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		"LISTEN_PID":     "1234",
+		"LISTEN_FDS":     "1",
+		"LISTEN_FDNAMES": "metrics",
+	}
+	listeners, err := listenersFromEnv(func(k string) string { return env[k] }, 1234, fd)
+	if err != nil {
+		t.Fatalf("listenersFromEnv failed: %v", err)
+	}
+	if len(listeners["metrics"]) != 1 {
+		t.Fatalf("expected one listener named metrics, got %v", listeners)
+	}
+	defer listeners["metrics"][0].Close()
+
+	if got, want := listeners["metrics"][0].Addr().String(), original.Addr().String(); got != want {
+		t.Errorf("listener has wrong address: got %s want %s", got, want)
+	}
+
+	testCases := []struct {
+		name string
+		env  map[string]string
+	}{
+		{"Not activated", map[string]string{}},
+		{"Different process", map[string]string{"LISTEN_PID": "999", "LISTEN_FDS": "1"}},
+		{"Invalid count", map[string]string{"LISTEN_PID": strconv.Itoa(1234), "LISTEN_FDS": "x"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := listenersFromEnv(func(k string) string { return tc.env[k] }, 1234, fd); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/manics/prometheus-metrics-combiner/combiner"
+	"go.yaml.in/yaml/v3"
+)
+
+// maxTargetBodySize is the maximum size of a target added with the admin API.
+const maxTargetBodySize = 1 << 20
+
+// targetAdmin adds and removes static targets while the combiner is running.
+type targetAdmin struct {
+	discovery *discoveryManager
+	// defaults are applied to added targets like those in the config file.
+	defaults combiner.Target
+	// configFile, if set, is updated with the changes so they are kept when
+	// the configuration is reloaded or the combiner restarts.
+	configFile string
+
+	// mu serialises changes so the config file matches the live targets.
+	mu sync.Mutex
+}
+
+// add adds the target in the request body, in the same YAML or JSON format as
+// the targets in the config file.
+func (a *targetAdmin) add(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxTargetBodySize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read the request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	t, node, err := parseAdminTarget(body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid target: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.discovery.addTarget(t.WithDefaults(a.defaults)); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errTargetExists) {
+			status = http.StatusConflict
+		}
+		http.Error(w, fmt.Sprintf("Failed to add target %s: %v", combiner.RedactURL(t.URL), err), status)
+		return
+	}
+	if a.configFile != "" {
+		err := updateConfigTargets(a.configFile, func(targets *yaml.Node) {
+			targets.Content = append(targets.Content, node)
+		})
+		if err != nil {
+			// Undo the change so the live targets match the config file
+			if err := a.discovery.removeTarget(t.URL); err != nil {
+				slog.Error("Failed to remove target after the config file couldn't be updated", "target", combiner.RedactURL(t.URL), "err", err)
+			}
+			slog.Error("Failed to update config file", "err", err)
+			http.Error(w, fmt.Sprintf("Failed to update config file: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	slog.Info("Added target", "target", combiner.RedactURL(t.URL))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintln(w, "OK")
+}
+
+// remove removes the static target whose URL is the url query parameter.
+func (a *targetAdmin) remove(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Query().Get("url")
+	if url == "" {
+		http.Error(w, "The url query parameter is required.", http.StatusBadRequest)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.discovery.removeTarget(url); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errTargetNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, fmt.Sprintf("Failed to remove target %s: %v", combiner.RedactURL(url), err), status)
+		return
+	}
+	if a.configFile != "" {
+		// Targets given by flags aren't in the config file, so may not be found
+		err := updateConfigTargets(a.configFile, func(targets *yaml.Node) {
+			targets.Content = slices.DeleteFunc(targets.Content, func(n *yaml.Node) bool {
+				return n.Kind == yaml.MappingNode && mappingValue(n, "url") != nil && mappingValue(n, "url").Value == url
+			})
+		})
+		if err != nil {
+			slog.Error("Failed to update config file", "err", err)
+			http.Error(w, fmt.Sprintf("Target removed but failed to update config file: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	slog.Info("Removed target", "target", combiner.RedactURL(url))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "OK")
+}
+
+// parseAdminTarget parses and validates a target, returning it and its YAML
+// node for writing to the config file.
+func parseAdminTarget(body []byte) (combiner.Target, *yaml.Node, error) {
+	var t combiner.Target
+	dec := yaml.NewDecoder(bytes.NewReader(body))
+	dec.KnownFields(true)
+	if err := dec.Decode(&t); err != nil {
+		return t, nil, err
+	}
+	if t.URL == "" {
+		return t, nil, errors.New("url is required")
+	}
+	if t.HostsFile != "" {
+		return t, nil, errors.New("hosts_file can't be used for targets added at runtime")
+	}
+	if err := t.Validate(); err != nil {
+		return t, nil, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(body, &doc); err != nil {
+		return t, nil, err
+	}
+	node := doc.Content[0]
+	// JSON is written to the config file in the block style like the rest of it
+	blockStyle(node)
+	return t, node, nil
+}
+
+// blockStyle removes the flow and quoting styles from node and its children.
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, n := range node.Content {
+		blockStyle(n)
+	}
+}
+
+// mappingValue returns the value of key in a mapping node, or nil if it isn't set.
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// updateConfigTargets calls edit with the targets sequence of the config file
+// at path and writes the result back, keeping the rest of the file including
+// its comments. The file is replaced atomically.
+func updateConfigTargets(path string, edit func(targets *yaml.Node)) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	if doc.Kind == 0 {
+		// An empty file
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("config file %s isn't a mapping", path)
+	}
+
+	targets := mappingValue(root, "targets")
+	if targets == nil {
+		targets = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "targets"}, targets)
+	}
+	if targets.Kind == yaml.ScalarNode && targets.Tag == "!!null" {
+		*targets = yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", HeadComment: targets.HeadComment, LineComment: targets.LineComment}
+	}
+	if targets.Kind != yaml.SequenceNode {
+		return fmt.Errorf("targets in config file %s isn't a list", path)
+	}
+	edit(targets)
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(info.Mode()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
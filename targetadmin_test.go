@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/manics/prometheus-metrics-combiner/combiner"
+	"go.yaml.in/yaml/v3"
+)
+
+// TestTargetAdmin tests adding and removing targets with the admin API and
+// persisting the changes to the config file.
+func TestTargetAdmin(t *testing.T) {
+	configFile := writeFile(t, "config.yml", `# Exporters
+targets:
+  # The node exporter
+  - url: http://a
+groups:
+  - name: web
+    targets:
+      - url: http://web
+`)
+	sources, err := loadSources(sourceOptions{configFile: configFile}, combiner.Target{})
+	if err != nil {
+		t.Fatalf("loadSources failed: %v", err)
+	}
+	agg, err := combiner.New(nil, combiner.Options{})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	discovery := newDiscoveryManager(agg)
+	if err := discovery.apply(context.Background(), sources); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+
+	admin := &targetAdmin{discovery: discovery, configFile: configFile}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v1/targets", admin.add)
+	mux.HandleFunc("DELETE /api/v1/targets", admin.remove)
+	request := func(method, target, body string) int {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rr.Code
+	}
+
+	testCases := []struct {
+		name            string
+		method          string
+		target          string
+		body            string
+		expectedStatus  int
+		expectedTargets []string
+	}{
+		{"Add JSON", "POST", "/api/v1/targets", `{"url": "http://b", "labels": {"env": "prod"}}`, http.StatusCreated, []string{"http://a", "http://b"}},
+		{"Add YAML", "POST", "/api/v1/targets", "url: http://c\n", http.StatusCreated, []string{"http://a", "http://b", "http://c"}},
+		{"Add existing", "POST", "/api/v1/targets", `{"url": "http://a"}`, http.StatusConflict, []string{"http://a", "http://b", "http://c"}},
+		{"Add without URL", "POST", "/api/v1/targets", `{"labels": {"env": "prod"}}`, http.StatusBadRequest, []string{"http://a", "http://b", "http://c"}},
+		{"Add unknown field", "POST", "/api/v1/targets", `{"url": "http://d", "interval": "1m"}`, http.StatusBadRequest, []string{"http://a", "http://b", "http://c"}},
+		{"Remove", "DELETE", "/api/v1/targets?url=http://a", "", http.StatusOK, []string{"http://b", "http://c"}},
+		{"Remove unknown", "DELETE", "/api/v1/targets?url=http://a", "", http.StatusNotFound, []string{"http://b", "http://c"}},
+		{"Remove without URL", "DELETE", "/api/v1/targets", "", http.StatusBadRequest, []string{"http://b", "http://c"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if code := request(tc.method, tc.target, tc.body); code != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d", tc.expectedStatus, code)
+			}
+			if urls := targetURLs(agg); !reflect.DeepEqual(urls, tc.expectedTargets) {
+				t.Errorf("got targets %v, want %v", urls, tc.expectedTargets)
+			}
+		})
+	}
+
+	// The changes are kept when the config file is reloaded
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	expected := []combiner.Target{{URL: "http://b", Labels: map[string]string{"env": "prod"}}, {URL: "http://c"}}
+	if !reflect.DeepEqual(cfg.Targets, expected) {
+		t.Errorf("got config file targets %+v, want %+v", cfg.Targets, expected)
+	}
+	if len(cfg.Groups) != 1 {
+		t.Errorf("expected the groups to be kept, got %+v", cfg.Groups)
+	}
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatalf("failed to read config file: %v", err)
+	}
+	if !strings.Contains(string(data), "# Exporters\n") {
+		t.Errorf("expected the comments to be kept:\n%s", data)
+	}
+}
+
+// TestTargetAdminRedactsURLs tests passwords in target URLs aren't echoed in
+// error responses.
+func TestTargetAdminRedactsURLs(t *testing.T) {
+	agg, err := combiner.New(nil, combiner.Options{})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	admin := &targetAdmin{discovery: newDiscoveryManager(agg)}
+
+	for _, expectedStatus := range []int{http.StatusCreated, http.StatusConflict} {
+		rr := httptest.NewRecorder()
+		admin.add(rr, httptest.NewRequest("POST", "/api/v1/targets", strings.NewReader(`{"url": "http://prometheus:secret@a"}`)))
+		if rr.Code != expectedStatus {
+			t.Fatalf("expected status %d, got %d", expectedStatus, rr.Code)
+		}
+		if body := rr.Body.String(); strings.Contains(body, "secret") {
+			t.Errorf("response contains the password: %s", body)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	admin.remove(rr, httptest.NewRequest("DELETE", "/api/v1/targets?url=http://prometheus:secret@b", nil))
+	if body := rr.Body.String(); rr.Code != http.StatusNotFound || !strings.Contains(body, "http://prometheus:xxxxx@b") {
+		t.Errorf("expected a not found error with the redacted URL, got %d: %s", rr.Code, body)
+	}
+}
+
+// TestUpdateConfigTargets tests adding targets to config files without a targets list.
+func TestUpdateConfigTargets(t *testing.T) {
+	testCases := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"Empty file", "", "targets:\n  - url: http://a\n"},
+		{"No targets", "groups: []\n", "groups: []\ntargets:\n  - url: http://a\n"},
+		{"Empty targets", "targets:\n", "targets:\n  - url: http://a\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeFile(t, "config.yml", tc.content)
+			_, node, err := parseAdminTarget([]byte(`{"url": "http://a"}`))
+			if err != nil {
+				t.Fatalf("parseAdminTarget failed: %v", err)
+			}
+			if err := updateConfigTargets(path, func(targets *yaml.Node) {
+				targets.Content = append(targets.Content, node)
+			}); err != nil {
+				t.Fatalf("updateConfigTargets failed: %v", err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("failed to read config file: %v", err)
+			}
+			if string(data) != tc.expected {
+				t.Errorf("got %q, want %q", data, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/manics/prometheus-metrics-combiner/combiner"
+)
+
+// urlListDiscoverer polls a URL serving a plain text list of upstream URLs,
+// one per line. Blank lines and lines starting with # are ignored.
+type urlListDiscoverer struct {
+	url      string
+	interval time.Duration
+	// template holds the global defaults applied to every target.
+	template combiner.Target
+}
+
+// newURLListDiscoverer creates a discoverer polling listURL every interval.
+func newURLListDiscoverer(listURL string, interval time.Duration, defaults combiner.Target) *urlListDiscoverer {
+	return &urlListDiscoverer{url: listURL, interval: interval, template: combiner.Target{}.WithDefaults(defaults)}
+}
+
+// discover fetches the list of URLs. It fails if any line isn't an HTTP or
+// HTTPS URL, so a truncated or corrupted list doesn't remove targets.
+func (d *urlListDiscoverer) discover(ctx context.Context) ([]combiner.Target, error) {
+	ctx, cancel := context.WithTimeout(ctx, httpSDTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/plain")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch URL list from %s: %w", d.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status fetching URL list from %s: %s", d.url, resp.Status)
+	}
+
+	var targets []combiner.Target
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// The combiner completes bare host:port URLs with the configured defaults
+		normalized, err := combiner.NormalizeURL(line, "", "")
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL %q in URL list from %s: %w", line, d.url, err)
+		}
+		if strings.HasPrefix(normalized, "unix:") {
+			return nil, fmt.Errorf("invalid URL %q in URL list from %s: Unix sockets can't be listed", line, d.url)
+		}
+		t := d.template
+		t.URL = line
+		targets = append(targets, t)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read URL list from %s: %w", d.url, err)
+	}
+	return targets, nil
+}
+
+// run implements discoverer.
+func (d *urlListDiscoverer) run(ctx context.Context, update func([]combiner.Target)) {
+	poll(ctx, d.interval, d.discover, update)
+}
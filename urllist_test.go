@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/manics/prometheus-metrics-combiner/combiner"
+)
+
+// TestURLListDiscoverer tests fetching a plain text list of URLs.
+func TestURLListDiscoverer(t *testing.T) {
+	testCases := []struct {
+		name          string
+		status        int
+		body          string
+		expected      []string
+		expectedError bool
+	}{
+		{
+			name:     "URLs",
+			status:   http.StatusOK,
+			body:     "# exporters\nhttp://host1:9100/metrics\n\n  https://host2:9100/metrics  \n",
+			expected: []string{"http://host1:9100/metrics", "https://host2:9100/metrics"},
+		},
+		{
+			name:   "Empty list",
+			status: http.StatusOK,
+		},
+		{
+			name:     "Bare host and port",
+			status:   http.StatusOK,
+			body:     "host2:9100\n",
+			expected: []string{"host2:9100"},
+		},
+		{
+			name:          "Invalid URL",
+			status:        http.StatusOK,
+			body:          "http://host1:9100/metrics\nftp://host2:9100\n",
+			expectedError: true,
+		},
+		{
+			name:          "Unix socket",
+			status:        http.StatusOK,
+			body:          "unix:///var/run/exporter.sock\n",
+			expectedError: true,
+		},
+		{
+			name:          "Bad status",
+			status:        http.StatusNotFound,
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				fmt.Fprint(w, tc.body)
+			}))
+			defer server.Close()
+
+			d := newURLListDiscoverer(server.URL, time.Minute, combiner.Target{LabelConflict: combiner.LabelConflictKeep})
+			targets, err := d.discover(context.Background())
+			if tc.expectedError {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("discover failed: %v", err)
+			}
+
+			var urls []string
+			for _, target := range targets {
+				urls = append(urls, target.URL)
+				if target.LabelConflict != combiner.LabelConflictKeep {
+					t.Errorf("defaults were not applied to %s", target.URL)
+				}
+			}
+			if !reflect.DeepEqual(urls, tc.expected) {
+				t.Errorf("got %v, want %v", urls, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// Build information, set at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.date=...".
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+// buildInfo returns the version, commit and build date. If they weren't set at
+// build time the module version and VCS information embedded by the Go
+// toolchain are used instead.
+func buildInfo() (string, string, string) {
+	v, c, d := version, commit, date
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return v, c, d
+	}
+	if v == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		v = info.Main.Version
+	}
+	for _, s := range info.Settings {
+		switch {
+		case s.Key == "vcs.revision" && c == "":
+			c = s.Value
+		case s.Key == "vcs.time" && d == "":
+			d = s.Value
+		}
+	}
+	return v, c, d
+}
+
+// versionString returns the build information for -version.
+func versionString() string {
+	v, c, d := buildInfo()
+	if c == "" {
+		c = "unknown"
+	}
+	if d == "" {
+		d = "unknown"
+	}
+	return fmt.Sprintf("prometheus-metrics-combiner %s (commit %s, built %s, %s)", v, c, d, runtime.Version())
+}
+
+// buildInfoMetricFamily returns a gauge with the build information as labels.
+func buildInfoMetricFamily() *dto.MetricFamily {
+	v, c, d := buildInfo()
+	label := func(name, value string) *dto.LabelPair {
+		return &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)}
+	}
+	return &dto.MetricFamily{
+		Name: proto.String("combiner_build_info"),
+		Help: proto.String("A metric with a constant '1' value labeled by version, revision, build date and goversion."),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{
+			Label: []*dto.LabelPair{
+				label("builddate", d),
+				label("goversion", runtime.Version()),
+				label("revision", c),
+				label("version", v),
+			},
+			Gauge: &dto.Gauge{Value: proto.Float64(1)},
+		}},
+	}
+}
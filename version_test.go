@@ -0,0 +1,40 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// TestBuildInfo tests that build information set at build time is reported.
+func TestBuildInfo(t *testing.T) {
+	oldVersion, oldCommit, oldDate := version, commit, date
+	defer func() { version, commit, date = oldVersion, oldCommit, oldDate }()
+	version, commit, date = "v1.2.3", "abc123", "2025-01-02T03:04:05Z"
+
+	if s := versionString(); s != "prometheus-metrics-combiner v1.2.3 (commit abc123, built 2025-01-02T03:04:05Z, "+runtime.Version()+")" {
+		t.Errorf("unexpected version string: %s", s)
+	}
+
+	labels := map[string]string{}
+	mf := buildInfoMetricFamily()
+	for _, l := range mf.Metric[0].Label {
+		labels[l.GetName()] = l.GetValue()
+	}
+	expected := map[string]string{"version": "v1.2.3", "revision": "abc123", "builddate": "2025-01-02T03:04:05Z", "goversion": runtime.Version()}
+	for name, value := range expected {
+		if labels[name] != value {
+			t.Errorf("expected label %s=%q, got %q", name, value, labels[name])
+		}
+	}
+	if mf.Metric[0].GetGauge().GetValue() != 1 {
+		t.Errorf("expected combiner_build_info to be 1")
+	}
+}
+
+// TestBuildInfoDefaults checks that a build without version information still reports something.
+func TestBuildInfoDefaults(t *testing.T) {
+	if s := versionString(); !strings.HasPrefix(s, "prometheus-metrics-combiner ") {
+		t.Errorf("unexpected version string: %s", s)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against when an unknown user is given so that
+// response times don't reveal which usernames exist.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+
+// webAuth checks the credentials of incoming requests to the combined endpoint.
+type webAuth struct {
+	// users maps usernames to bcrypt password hashes.
+	users map[string][]byte
+	// tokens are static bearer tokens accepted in the Authorization header.
+	tokens []string
+}
+
+// loadBasicAuthUsers reads a YAML file mapping usernames to bcrypt password
+// hashes, the same format as basic_auth_users in the Prometheus web config.
+func loadBasicAuthUsers(path string) (map[string][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read basic auth users file %s: %w", path, err)
+	}
+
+	var hashes map[string]string
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&hashes); err != nil {
+		return nil, fmt.Errorf("failed to parse basic auth users file %s: %w", path, err)
+	}
+
+	users := make(map[string][]byte, len(hashes))
+	for user, hash := range hashes {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("invalid bcrypt hash for user %s in %s: %w", user, path, err)
+		}
+		users[user] = []byte(hash)
+	}
+	return users, nil
+}
+
+// loadAuthTokens reads a file of bearer tokens, one per line. Blank lines and
+// lines starting with # are ignored.
+func loadAuthTokens(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read auth tokens file %s: %w", path, err)
+	}
+	defer f.Close()
+
+	var tokens []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens = append(tokens, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read auth tokens file %s: %w", path, err)
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no tokens found in auth tokens file %s", path)
+	}
+	return tokens, nil
+}
+
+// enabled reports whether any authentication is configured.
+func (a *webAuth) enabled() bool {
+	return len(a.users) > 0 || len(a.tokens) > 0
+}
+
+// authorized reports whether the request presents valid credentials, either
+// a known bearer token or a valid basic auth username and password.
+func (a *webAuth) authorized(r *http.Request) bool {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return a.validToken(token)
+	}
+
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, known := a.users[user]
+	if !known {
+		hash = dummyHash
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil && known
+}
+
+// validToken reports whether token is one of the configured bearer tokens.
+func (a *webAuth) validToken(token string) bool {
+	valid := false
+	// Check every token so the time taken doesn't reveal which one matched
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// wrap returns a handler that rejects requests without valid credentials.
+func (a *webAuth) wrap(next http.Handler) http.Handler {
+	if !a.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.authorized(r) {
+			if len(a.users) > 0 {
+				w.Header().Add("WWW-Authenticate", `Basic realm="metrics"`)
+			}
+			if len(a.tokens) > 0 {
+				w.Header().Add("WWW-Authenticate", `Bearer realm="metrics"`)
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
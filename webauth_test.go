@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestLoadBasicAuthUsers tests parsing of the basic auth users file.
+func TestLoadBasicAuthUsers(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := loadBasicAuthUsers(writeFile(t, "users.yaml", fmt.Sprintf("prometheus: %s\n", hash)))
+	if err != nil {
+		t.Fatalf("loadBasicAuthUsers failed: %v", err)
+	}
+	if string(users["prometheus"]) != string(hash) {
+		t.Errorf("loadBasicAuthUsers returned wrong hash: %s", users["prometheus"])
+	}
+
+	_, err = loadBasicAuthUsers(writeFile(t, "users.yaml", "prometheus: plaintext\n"))
+	if err == nil || !strings.Contains(err.Error(), "invalid bcrypt hash") {
+		t.Errorf("expected an invalid hash error, got: %v", err)
+	}
+}
+
+// TestWebAuthBasicAuth tests that requests without valid credentials are rejected.
+func TestWebAuthBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &webAuth{users: map[string][]byte{"prometheus": hash}}
+	handler := auth.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "metrics")
+	}))
+
+	testCases := []struct {
+		name           string
+		user           string
+		password       string
+		expectedStatus int
+	}{
+		{"No credentials", "", "", http.StatusUnauthorized},
+		{"Wrong password", "prometheus", "wrong", http.StatusUnauthorized},
+		{"Unknown user", "someone", "secret", http.StatusUnauthorized},
+		{"Valid credentials", "prometheus", "secret", http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			if tc.user != "" {
+				req.SetBasicAuth(tc.user, tc.password)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tc.expectedStatus)
+			}
+		})
+	}
+}
+
+// TestLoadAuthTokens tests parsing of the bearer tokens file.
+func TestLoadAuthTokens(t *testing.T) {
+	tokens, err := loadAuthTokens(writeFile(t, "tokens", "# Prometheus servers\ntoken-a\n\n  token-b  \n"))
+	if err != nil {
+		t.Fatalf("loadAuthTokens failed: %v", err)
+	}
+	if strings.Join(tokens, ",") != "token-a,token-b" {
+		t.Errorf("loadAuthTokens returned wrong tokens: %v", tokens)
+	}
+
+	if _, err := loadAuthTokens(writeFile(t, "tokens", "# nothing here\n")); err == nil {
+		t.Error("expected an error for a file without tokens")
+	}
+}
+
+// TestWebAuthBearerToken tests that clients can authenticate with a bearer token or basic auth.
+func TestWebAuthBearerToken(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &webAuth{users: map[string][]byte{"prometheus": hash}, tokens: []string{"token-a", "token-b"}}
+	handler := auth.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "metrics")
+	}))
+
+	testCases := []struct {
+		name           string
+		authorization  string
+		expectedStatus int
+	}{
+		{"No credentials", "", http.StatusUnauthorized},
+		{"Unknown token", "Bearer token-c", http.StatusUnauthorized},
+		{"Valid token", "Bearer token-b", http.StatusOK},
+		{"Valid basic auth", "Basic cHJvbWV0aGV1czpzZWNyZXQ=", http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tc.expectedStatus)
+			}
+			if rr.Code == http.StatusUnauthorized && len(rr.Header().Values("WWW-Authenticate")) != 2 {
+				t.Errorf("expected Basic and Bearer challenges, got %v", rr.Header().Values("WWW-Authenticate"))
+			}
+		})
+	}
+}